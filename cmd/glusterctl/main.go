@@ -0,0 +1,516 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// glusterctl lists and repairs the volumes of the glusterfs simple
+// provisioner through its admin API, and imports, exports and finds
+// orphaned volumes through the Kubernetes API.
+//
+// Commands are parsed with the standard flag package rather than cobra:
+// cobra is not a dependency of the module, and a flag set per command covers
+// the few flags of glusterctl without adding one.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gluster-simple-provisioner/pkg/volume"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var (
+	server     = flag.String("server", os.Getenv("GLUSTERCTL_SERVER"), "URL of the admin API of the provisioner, e.g. https://provisioner:8444; https is assumed without scheme. Defaults to $GLUSTERCTL_SERVER.")
+	tokenFile  = flag.String("token-file", os.Getenv("GLUSTERCTL_TOKEN_FILE"), "File holding the bearer token of the admin API. Defaults to $GLUSTERCTL_TOKEN_FILE.")
+	caFile     = flag.String("ca-file", os.Getenv("GLUSTERCTL_CA_FILE"), "File holding the CA certificates verifying the admin API, the system ones if unset. Defaults to $GLUSTERCTL_CA_FILE.")
+	kubeconfig = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file of the import, export and orphans commands. Defaults to $KUBECONFIG.")
+	timeout    = flag.Duration("timeout", 10*time.Minute, "Timeout of the command.")
+)
+
+const usage = `usage: glusterctl [flags] COMMAND [args]
+
+Commands of the admin API:
+  volumes [-usage]          list provisioned volumes
+  bricks                    show the brick placement of volumes by host
+  delete PV                 force delete a released or failed PV and its volume
+  repair-endpoints PV       recreate missing endpoints and service of a PV
+  heal [-full] PV           start a heal of the gluster volume of a PV
+  simulate [-namespace=NAMESPACE] [-name=NAME] [-access-modes=MODES] [-annotations=KEY=VALUE,...] STORAGECLASS SIZE
+                            report the bricks and checks of provisioning a claim
+
+Commands of the Kubernetes API:
+  import STORAGECLASS VOLUME SIZE NAMESPACE[/CLAIM]
+                            create a PV for an existing gluster volume
+  export PV                 print a PV for import into another cluster
+  orphans STORAGECLASS...   report gluster volumes without PVs and PVs without volumes
+
+Flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	os.Exit(run(ctx, flag.Arg(0), flag.Args()[1:]))
+}
+
+// run runs command and returns the exit code of the process
+func run(ctx context.Context, command string, args []string) int {
+	switch command {
+	case "volumes":
+		return runVolumes(ctx, args)
+	case "bricks":
+		return runBricks(ctx, args)
+	case "delete":
+		return runOperation(ctx, "delete PV", http.MethodDelete, "", args)
+	case "repair-endpoints":
+		return runOperation(ctx, "repair-endpoints PV", http.MethodPost, "/endpoints", args)
+	case "heal":
+		flags := flag.NewFlagSet("heal", flag.ContinueOnError)
+		full := flags.Bool("full", false, "Heal every file instead of the pending entries.")
+		if err := flags.Parse(args); err != nil {
+			return 2
+		}
+		suffix := "/heal"
+		if *full {
+			suffix += "?full=true"
+		}
+		return runOperation(ctx, "heal [-full] PV", http.MethodPost, suffix, flags.Args())
+	case "simulate":
+		return runSimulate(ctx, args)
+	case "import":
+		return runImport(ctx, args)
+	case "export":
+		return runExport(ctx, args)
+	case "orphans":
+		return runOrphans(ctx, args)
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n", command)
+	flag.Usage()
+	return 2
+}
+
+// adminClient returns the HTTP client of the admin API, trusting the CA
+// certificates of -ca-file if set
+func adminClient() (*http.Client, error) {
+	if *caFile == "" {
+		return http.DefaultClient, nil
+	}
+	pem, err := os.ReadFile(*caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s holds no PEM certificates", *caFile)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	return &http.Client{Transport: transport}, nil
+}
+
+// call sends a request to the admin API with in as JSON body, if not nil,
+// and decodes the JSON response into out
+func call(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	if *server == "" {
+		return fmt.Errorf("-server is not set")
+	}
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	url := strings.TrimSuffix(*server, "/")
+	if !strings.Contains(url, "://") {
+		url = "https://" + url
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url+path, body)
+	if err != nil {
+		return err
+	}
+	if *tokenFile != "" {
+		token, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	client, err := adminClient()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != "" {
+			return fmt.Errorf("%s", e.Error)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func listVolumes(ctx context.Context, usage bool) ([]volume.VolumeInfo, error) {
+	path := "/v1/volumes"
+	if usage {
+		path += "?usage=true"
+	}
+	var volumes []volume.VolumeInfo
+	err := call(ctx, http.MethodGet, path, nil, &volumes)
+	return volumes, err
+}
+
+// runVolumes lists the provisioned volumes
+func runVolumes(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("volumes", flag.ContinueOnError)
+	usage := flags.Bool("usage", false, "Collect the used bytes of every volume with du.")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "usage: volumes [-usage]\n")
+		return 2
+	}
+	volumes, err := listVolumes(ctx, *usage)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PV\tPHASE\tCLASS\tCLAIM\tVOLUME\tCAPACITY\tUSED\tHEALTHY\tBRICKS")
+	for _, v := range volumes {
+		claim, used, healthy := "-", "-", "-"
+		if v.Claim != "" {
+			claim = v.Namespace + "/" + v.Claim
+		}
+		if v.UsedBytes != nil {
+			used = resource.NewQuantity(*v.UsedBytes, resource.BinarySI).String()
+		}
+		if v.Healthy != nil {
+			healthy = fmt.Sprint(*v.Healthy)
+		}
+		if v.Error != "" {
+			healthy = "error: " + v.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\n", v.PV, v.Phase, v.StorageClass, claim, v.Volume,
+			resource.NewQuantity(v.CapacityBytes, resource.BinarySI).String(), used, healthy, len(v.Bricks))
+	}
+	w.Flush()
+	return 0
+}
+
+// runBricks shows the bricks of the provisioned volumes grouped by host
+func runBricks(ctx context.Context, args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "usage: bricks\n")
+		return 2
+	}
+	volumes, err := listVolumes(ctx, false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	type brick struct{ path, volume string }
+	hosts := make(map[string][]brick)
+	for _, v := range volumes {
+		for _, b := range v.Bricks {
+			i := strings.LastIndex(b, ":")
+			if i < 0 {
+				continue
+			}
+			hosts[b[:i]] = append(hosts[b[:i]], brick{path: b[i+1:], volume: v.Volume})
+		}
+	}
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tBRICK\tVOLUME")
+	for _, host := range names {
+		bricks := hosts[host]
+		sort.Slice(bricks, func(i, j int) bool { return bricks[i].path < bricks[j].path })
+		for _, b := range bricks {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", host, b.path, b.volume)
+		}
+	}
+	w.Flush()
+	return 0
+}
+
+// runOperation runs an admin API operation on the PV of args
+func runOperation(ctx context.Context, synopsis string, method string, suffix string, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s\n", synopsis)
+		return 2
+	}
+	if err := call(ctx, method, "/v1/volumes/"+args[0]+suffix, nil, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		return 1
+	}
+	fmt.Printf("%s\tok\n", args[0])
+	return 0
+}
+
+// runSimulate reports how a hypothetical claim would be provisioned
+func runSimulate(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	namespace := flags.String("namespace", "default", "Namespace of the claim.")
+	name := flags.String("name", "simulated", "Name of the claim.")
+	accessModes := flags.String("access-modes", string(v1.ReadWriteMany), "Comma separated access modes of the claim.")
+	annotations := flags.String("annotations", "", "Comma separated key=value annotations of the claim, e.g. parameter overrides.")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "usage: simulate [-namespace=NAMESPACE] [-name=NAME] [-access-modes=MODES] [-annotations=KEY=VALUE,...] STORAGECLASS SIZE\n")
+		return 2
+	}
+	size, err := resource.ParseQuantity(flags.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid size %q: %v\n", flags.Arg(1), err)
+		return 2
+	}
+	className := flags.Arg(0)
+	claim := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: *namespace, Name: *name, Annotations: map[string]string{}},
+		Spec: v1.PersistentVolumeClaimSpec{
+			StorageClassName: &className,
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceStorage: size},
+			},
+		},
+	}
+	for _, mode := range strings.Split(*accessModes, ",") {
+		if mode = strings.TrimSpace(mode); mode != "" {
+			claim.Spec.AccessModes = append(claim.Spec.AccessModes, v1.PersistentVolumeAccessMode(mode))
+		}
+	}
+	for _, pair := range strings.Split(*annotations, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			fmt.Fprintf(os.Stderr, "invalid annotation %q, expected KEY=VALUE\n", pair)
+			return 2
+		}
+		claim.Annotations[strings.TrimSpace(kv[0])] = kv[1]
+	}
+
+	var result volume.SimulationResult
+	if err := call(ctx, http.MethodPost, "/v1/simulate", claim, &result); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", className, err)
+		return 1
+	}
+	fmt.Printf("volume:\t%s\npv:\t%s\n", result.Volume, result.PVName)
+	if result.BlockHostVolume != "" {
+		fmt.Printf("block host volume:\t%s\n", result.BlockHostVolume)
+	} else {
+		fmt.Printf("volume type:\t%s\nforce:\t%v\n", result.VolumeType, result.Force)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	if len(result.Bricks) != 0 {
+		fmt.Fprintln(w, "\nBRICK")
+		for _, b := range result.Bricks {
+			fmt.Fprintln(w, b)
+		}
+	}
+	fmt.Fprintln(w, "\nCHECK\tRESULT\tMESSAGE")
+	for _, c := range result.Checks {
+		status := "pass"
+		if !c.Passed {
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", c.Name, status, c.Message)
+	}
+	w.Flush()
+	if !result.Provisionable {
+		return 1
+	}
+	return 0
+}
+
+// kubeClient creates a client from -kubeconfig, $KUBECONFIG or the
+// in-cluster config
+func kubeClient() (*rest.Config, kubernetes.Interface, error) {
+	path := *kubeconfig
+	if path == "" {
+		path = os.Getenv(clientcmd.RecommendedConfigPathEnvVar)
+	}
+	var config *rest.Config
+	var err error
+	if path != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", path)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	return config, clientset, err
+}
+
+// runImport creates a PV for an existing gluster volume
+func runImport(ctx context.Context, args []string) int {
+	if len(args) != 4 {
+		fmt.Fprintf(os.Stderr, "usage: import STORAGECLASS VOLUME SIZE NAMESPACE[/CLAIM]\n")
+		return 2
+	}
+	size, err := resource.ParseQuantity(args[2])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid size %q: %v\n", args[2], err)
+		return 2
+	}
+	options := volume.ImportOptions{
+		StorageClass: args[0],
+		Volume:       args[1],
+		Size:         size,
+		Namespace:    args[3],
+	}
+	if i := strings.Index(args[3], "/"); i >= 0 {
+		options.Namespace = args[3][:i]
+		options.ClaimName = args[3][i+1:]
+	}
+	config, clientset, err := kubeClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	pv, err := volume.ImportVolume(ctx, config, clientset, options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[1], err)
+		return 1
+	}
+	fmt.Printf("%s\t%s\n", args[1], pv.Name)
+	return 0
+}
+
+// runExport prints a PV as JSON without the fields bound to its cluster,
+// so that it can be created in another cluster served by the same gluster
+// hosts. The claim reference keeps namespace and name to pre-bind the PV.
+func runExport(ctx context.Context, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: export PV\n")
+		return 2
+	}
+	_, clientset, err := kubeClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	pv, err := clientset.CoreV1().PersistentVolumes().Get(ctx, args[0], metav1.GetOptions{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		return 1
+	}
+	pv.APIVersion = "v1"
+	pv.Kind = "PersistentVolume"
+	pv.ObjectMeta = metav1.ObjectMeta{
+		Name:        pv.Name,
+		Labels:      pv.Labels,
+		Annotations: pv.Annotations,
+	}
+	if claim := pv.Spec.ClaimRef; claim != nil {
+		claim.UID = ""
+		claim.ResourceVersion = ""
+	}
+	pv.Status = v1.PersistentVolumeStatus{}
+	out, err := json.MarshalIndent(pv, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	fmt.Println(string(out))
+	return 0
+}
+
+// runOrphans reports gluster volumes without PVs and PVs without gluster
+// volumes for the given StorageClasses
+func runOrphans(ctx context.Context, classes []string) int {
+	if len(classes) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: orphans STORAGECLASS...\n")
+		return 2
+	}
+	config, clientset, err := kubeClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	code := 0
+	for _, className := range classes {
+		report, err := volume.FindOrphans(ctx, config, clientset, className)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", className, err)
+			code = 1
+			continue
+		}
+		for _, name := range report.OrphanVolumes {
+			fmt.Printf("%s\torphan-volume\t%s\n", className, name)
+			code = 1
+		}
+		pvs := make([]string, 0, len(report.MissingVolumes))
+		for pv := range report.MissingVolumes {
+			pvs = append(pvs, pv)
+		}
+		sort.Strings(pvs)
+		for _, pv := range pvs {
+			fmt.Printf("%s\tmissing-volume\t%s\t%s\n", className, pv, report.MissingVolumes[pv])
+			code = 1
+		}
+		claims := make([]string, 0, len(report.Leftovers))
+		for claim := range report.Leftovers {
+			claims = append(claims, claim)
+		}
+		sort.Strings(claims)
+		for _, claim := range claims {
+			for _, leftover := range report.Leftovers[claim] {
+				fmt.Printf("%s\trollback-leftover\t%s\t%s\n", className, claim, leftover)
+			}
+			code = 1
+		}
+	}
+	return code
+}
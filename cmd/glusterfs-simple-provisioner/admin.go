@@ -0,0 +1,183 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"gluster-simple-provisioner/pkg/volume"
+	"k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// adminTimeout bounds each request of the admin API
+const adminTimeout = 10 * time.Minute
+
+// serveAdmin serves the admin API on address, with TLS when certFile is set.
+// Requests must carry the token of tokenFile as bearer token; the file is
+// read on every request so that the token can be rotated without restart.
+//
+//	GET    /v1/volumes[?usage=true]
+//	DELETE /v1/volumes/{pv}
+//	POST   /v1/volumes/{pv}/endpoints
+//	POST   /v1/volumes/{pv}/heal[?full=true]
+//	GET    /v1/storageclasses
+//	POST   /v1/simulate
+func serveAdmin(address string, certFile string, keyFile string, tokenFile string, provisioner volume.GlusterfsProvisioner) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/volumes", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.NotFound(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+		defer cancel()
+		volumes, err := provisioner.ListVolumes(ctx, r.URL.Query().Get("usage") == "true")
+		writeAdminResponse(w, volumes, err)
+	})
+	mux.HandleFunc("/v1/volumes/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/volumes/"), "/")
+		ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+		defer cancel()
+		var err error
+		switch {
+		case len(parts) == 1 && r.Method == http.MethodDelete:
+			err = provisioner.ForceDeleteVolume(ctx, parts[0])
+		case len(parts) == 2 && parts[1] == "endpoints" && r.Method == http.MethodPost:
+			err = provisioner.RepairEndpoints(ctx, parts[0])
+		case len(parts) == 2 && parts[1] == "heal" && r.Method == http.MethodPost:
+			err = provisioner.HealVolume(ctx, parts[0], r.URL.Query().Get("full") == "true")
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		writeAdminResponse(w, struct{}{}, err)
+	})
+	mux.HandleFunc("/v1/storageclasses", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.NotFound(w, r)
+			return
+		}
+		writeAdminResponse(w, provisioner.StorageClasses(), nil)
+	})
+	mux.HandleFunc("/v1/simulate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		var claim v1.PersistentVolumeClaim
+		if err := json.NewDecoder(r.Body).Decode(&claim); err != nil {
+			http.Error(w, "body is not a PersistentVolumeClaim: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+		defer cancel()
+		result, err := provisioner.SimulateProvision(ctx, &claim)
+		writeAdminResponse(w, result, err)
+	})
+	klog.Infof("Serving the admin API on %s", address)
+	err := listenAndServe(address, certFile, keyFile, authenticate("admin", tokenFile, mux))
+	klog.Fatalf("Failed to serve the admin API: %v", err)
+}
+
+// listenAndServe serves handler on address, with TLS when certFile is set
+func listenAndServe(address string, certFile string, keyFile string, handler http.Handler) error {
+	server := &http.Server{
+		Addr:      address,
+		Handler:   handler,
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+	if certFile != "" {
+		return server.ListenAndServeTLS(certFile, keyFile)
+	}
+	return server.ListenAndServe()
+}
+
+// checkAPITLS checks the TLS flags of the named API served on address.
+// Bearer tokens are only sent in plain text to loopback addresses, every
+// other address needs a certificate and key.
+func checkAPITLS(api string, address string, certFile string, keyFile string) error {
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("--%s-tls-cert and --%s-tls-key must be set together", api, api)
+	}
+	if certFile != "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("--%s-address %s is invalid: %v", api, address, err)
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		return nil
+	}
+	return fmt.Errorf("--%s-address %s is not a loopback address and needs --%s-tls-cert and --%s-tls-key", api, address, api, api)
+}
+
+// authenticate rejects requests to the named API without the bearer token
+// of tokenFile
+func authenticate(api string, tokenFile string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			klog.Errorf("glusterfs: failed to read %s token: %v", api, err)
+			http.Error(w, api+" token is not available", http.StatusServiceUnavailable)
+			return
+		}
+		expected := strings.TrimSpace(string(token))
+		given, bearer := bearerToken(r)
+		if expected == "" || !bearer || subtle.ConstantTimeCompare([]byte(given), []byte(expected)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		klog.V(2).Infof("glusterfs: %s API %s %s from %s", api, r.Method, r.URL.Path, r.RemoteAddr)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bearerToken returns the token of the Authorization header of r and whether
+// it is a bearer token
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return "", false
+	}
+	return auth[len(prefix):], true
+}
+
+// writeAdminResponse writes v as JSON, or err as {"error": ...}
+func writeAdminResponse(w http.ResponseWriter, v interface{}, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		klog.Errorf("glusterfs: admin API: %v", err)
+		status := http.StatusInternalServerError
+		if err == volume.ErrVolumeNotFound {
+			status = http.StatusNotFound
+		}
+		w.WriteHeader(status)
+		v = map[string]string{"error": err.Error()}
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		klog.Errorf("glusterfs: failed to write admin API response: %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gluster-simple-provisioner/pkg/volume"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// runCommand runs the maintenance command named by args[0] and returns the
+// exit code of the process
+func runCommand(ctx context.Context, config *rest.Config, clientset kubernetes.Interface, args []string) int {
+	switch args[0] {
+	case "orphans":
+		return runOrphans(ctx, config, clientset, args[1:])
+	case "import":
+		return runImport(ctx, config, clientset, args[1:])
+	case "adopt":
+		return runAdopt(ctx, config, clientset, args[1:])
+	case "add-bricks":
+		return runAddBricks(ctx, config, clientset, args[1:])
+	case "decommission":
+		return runDecommission(ctx, config, clientset, args[1:])
+	case "replace-brick":
+		return runReplaceBrick(ctx, config, clientset, args[1:])
+	case "transfer":
+		return runTransfer(ctx, config, clientset, args[1:])
+	case "verify":
+		return runVerify(ctx, config, clientset, args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+	return 2
+}
+
+// runOrphans reports gluster volumes without PVs and PVs without gluster
+// volumes for the given StorageClasses
+func runOrphans(ctx context.Context, config *rest.Config, clientset kubernetes.Interface, classes []string) int {
+	if len(classes) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: orphans STORAGECLASS...\n")
+		return 2
+	}
+	code := 0
+	for _, className := range classes {
+		report, err := volume.FindOrphans(ctx, config, clientset, className)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", className, err)
+			code = 1
+			continue
+		}
+		for _, name := range report.OrphanVolumes {
+			fmt.Printf("%s\torphan-volume\t%s\n", className, name)
+			code = 1
+		}
+		pvs := make([]string, 0, len(report.MissingVolumes))
+		for pv := range report.MissingVolumes {
+			pvs = append(pvs, pv)
+		}
+		sort.Strings(pvs)
+		for _, pv := range pvs {
+			fmt.Printf("%s\tmissing-volume\t%s\t%s\n", className, pv, report.MissingVolumes[pv])
+			code = 1
+		}
+		claims := make([]string, 0, len(report.Leftovers))
+		for claim := range report.Leftovers {
+			claims = append(claims, claim)
+		}
+		sort.Strings(claims)
+		for _, claim := range claims {
+			for _, leftover := range report.Leftovers[claim] {
+				fmt.Printf("%s\trollback-leftover\t%s\t%s\n", className, claim, leftover)
+			}
+			code = 1
+		}
+	}
+	return code
+}
+
+// runImport creates a PV for an existing gluster volume
+func runImport(ctx context.Context, config *rest.Config, clientset kubernetes.Interface, args []string) int {
+	if len(args) != 4 {
+		fmt.Fprintf(os.Stderr, "usage: import STORAGECLASS VOLUME SIZE NAMESPACE[/CLAIM]\n")
+		return 2
+	}
+	size, err := resource.ParseQuantity(args[2])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid size %q: %v\n", args[2], err)
+		return 2
+	}
+	options := volume.ImportOptions{
+		StorageClass: args[0],
+		Volume:       args[1],
+		Size:         size,
+		Namespace:    args[3],
+	}
+	if i := strings.Index(args[3], "/"); i >= 0 {
+		options.Namespace = args[3][:i]
+		options.ClaimName = args[3][i+1:]
+	}
+	pv, err := volume.ImportVolume(ctx, config, clientset, options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[1], err)
+		return 1
+	}
+	fmt.Printf("%s\t%s\n", args[1], pv.Name)
+	return 0
+}
+
+// runAdopt hands PVs of the heketi provisioner over to this provisioner
+func runAdopt(ctx context.Context, config *rest.Config, clientset kubernetes.Interface, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "usage: adopt STORAGECLASS [PV...]\n")
+		return 2
+	}
+	adopted, err := volume.AdoptVolumes(ctx, config, clientset, *provisioner, args[0], args[1:])
+	for _, name := range adopted {
+		fmt.Printf("adopted\t%s\n", name)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runAddBricks adds bricks to the gluster volume of a PV and rebalances it
+func runAddBricks(ctx context.Context, config *rest.Config, clientset kubernetes.Interface, args []string) int {
+	flags := flag.NewFlagSet("add-bricks", flag.ContinueOnError)
+	timeout := flags.Duration("wait", 0, "How long to wait for the rebalance to complete. 0 does not wait.")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "usage: add-bricks [-wait=DURATION] PV HOST:/ROOT[,HOST:/ROOT...]\n")
+		return 2
+	}
+	roots, err := volume.ParseBrickRootPaths(flags.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	err = volume.AddBricks(ctx, config, clientset, volume.AddBricksOptions{
+		PV:               flags.Arg(0),
+		BrickRootPaths:   roots,
+		RebalanceTimeout: *timeout,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+	return 0
+}
+
+// runDecommission moves all bricks off a host
+func runDecommission(ctx context.Context, config *rest.Config, clientset kubernetes.Interface, args []string) int {
+	flags := flag.NewFlagSet("decommission", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "Only list the bricks that would be moved.")
+	timeout := flags.Duration("migration-timeout", time.Hour, "How long to wait for the data of a distribute brick to migrate.")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "usage: decommission [-dry-run] [-migration-timeout=DURATION] HOST TARGETHOST:/ROOT\n")
+		return 2
+	}
+	roots, err := volume.ParseBrickRootPaths(flags.Arg(1))
+	if err != nil || len(roots) != 1 {
+		fmt.Fprintf(os.Stderr, "invalid target %q\n", flags.Arg(1))
+		return 2
+	}
+	moved, err := volume.Decommission(ctx, config, clientset, volume.DecommissionOptions{
+		Host:             flags.Arg(0),
+		Target:           roots[0],
+		DryRun:           *dryRun,
+		MigrationTimeout: *timeout,
+	})
+	for _, m := range moved {
+		fmt.Printf("%s\t%s\t%s\n", m.PV, m.From, m.To)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runReplaceBrick replaces a failed brick of a PV
+func runReplaceBrick(ctx context.Context, config *rest.Config, clientset kubernetes.Interface, args []string) int {
+	flags := flag.NewFlagSet("replace-brick", flag.ContinueOnError)
+	timeout := flags.Duration("wait", 0, "How long to wait for the new brick to be healed. 0 does not wait.")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 3 {
+		fmt.Fprintf(os.Stderr, "usage: replace-brick [-wait=DURATION] PV HOST:/BRICK TARGETHOST:/ROOT\n")
+		return 2
+	}
+	roots, err := volume.ParseBrickRootPaths(flags.Arg(2))
+	if err != nil || len(roots) != 1 {
+		fmt.Fprintf(os.Stderr, "invalid target %q\n", flags.Arg(2))
+		return 2
+	}
+	brick, err := volume.ReplaceBrick(ctx, config, clientset, volume.ReplaceBrickOptions{
+		PV:          flags.Arg(0),
+		Brick:       flags.Arg(1),
+		Target:      roots[0],
+		HealTimeout: *timeout,
+	})
+	if brick != "" {
+		fmt.Printf("%s\t%s\t%s\n", flags.Arg(0), flags.Arg(1), brick)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", flags.Arg(0), err)
+		return 1
+	}
+	return 0
+}
+
+// runTransfer hands PVs over to the deployment named by the provisioner and
+// identity-configmap flags
+func runTransfer(ctx context.Context, config *rest.Config, clientset kubernetes.Interface, args []string) int {
+	flags := flag.NewFlagSet("transfer", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "Only validate the transfer and list the PVs that would be transferred.")
+	from := flags.String("from", "", "Only transfer PVs stamped with this provisioner identity. Without PV names all its PVs are transferred.")
+	className := flags.String("storage-class", "", "StorageClass of the receiving provisioner whose parameters manage the PVs from now on. Empty keeps the class of each PV.")
+	if err := flags.Parse(args); err != nil || (flags.NArg() == 0 && *from == "") {
+		fmt.Fprintf(os.Stderr, "usage: transfer [-dry-run] [-from=IDENTITY] [-storage-class=CLASS] [PV...]\n")
+		return 2
+	}
+	transferred, err := volume.TransferVolumes(ctx, config, clientset, volume.TransferOptions{
+		ProvisionerName:   *provisioner,
+		IdentityConfigMap: *identityConfigMap,
+		StorageClass:      *className,
+		From:              *from,
+		PVs:               flags.Args(),
+		DryRun:            *dryRun,
+	})
+	for _, t := range transferred {
+		fmt.Printf("%s\t%s\t%s\n", t.PV, t.From, t.To)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runVerify checks the RBAC permissions, exec into the glusterfs pods, the
+// gluster peers and the brick roots of StorageClasses and prints a report
+func runVerify(ctx context.Context, config *rest.Config, clientset kubernetes.Interface, args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "Print the report as JSON.")
+	if err := flags.Parse(args); err != nil {
+		fmt.Fprintf(os.Stderr, "usage: verify [-json] [STORAGECLASS...]\n")
+		return 2
+	}
+	report, err := volume.Verify(ctx, config, clientset, *provisioner, flags.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+	} else {
+		for _, c := range report.Checks {
+			status := "ok"
+			if !c.Passed {
+				status = "FAIL"
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\n", status, c.Check, c.Target, c.Message)
+		}
+	}
+	if !report.Passed {
+		return 1
+	}
+	return 0
+}
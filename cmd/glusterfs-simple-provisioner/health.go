@@ -0,0 +1,48 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gluster-simple-provisioner/pkg/volume"
+	"k8s.io/klog"
+)
+
+// readyTimeout bounds the dependency checks of a readiness probe
+const readyTimeout = 10 * time.Second
+
+// serveHealth serves /healthz, which answers as long as the process runs,
+// and /readyz, which checks the API server and gluster hosts
+func serveHealth(port int, provisioner volume.GlusterfsProvisioner) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+		if err := provisioner.Ready(ctx); err != nil {
+			klog.V(2).Infof("glusterfs: not ready: %v", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
+	klog.Fatalf("Failed to serve health checks: %v", err)
+}
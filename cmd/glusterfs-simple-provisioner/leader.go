@@ -0,0 +1,84 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog"
+)
+
+// Timings of the leader election, those of the controller library, whose own
+// election is disabled so that background maintenance runs under the same
+// lease as the controller
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// runAsLeader runs run while holding the leader lease of provisioner, until
+// ctx is done. The lock is named like the one of the controller library and
+// held in an Endpoints and a Lease, the migration path client-go offers from
+// the Endpoints lock it no longer supports.
+func runAsLeader(ctx context.Context, client kubernetes.Interface, provisioner string, run func(ctx context.Context)) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		klog.Fatalf("Error getting hostname: %v", err)
+	}
+	lock, err := resourcelock.New(resourcelock.EndpointsLeasesResourceLock,
+		leaderElectionNamespace(),
+		strings.Replace(provisioner, "/", "-", -1),
+		client.CoreV1(),
+		client.CoordinationV1(),
+		resourcelock.ResourceLockConfig{Identity: hostname + "_" + string(uuid.NewUUID())})
+	if err != nil {
+		klog.Fatalf("Error creating lock: %v", err)
+	}
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: leaseDuration,
+		RenewDeadline: renewDeadline,
+		RetryPeriod:   retryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: run,
+			OnStoppedLeading: func() {
+				if ctx.Err() == nil {
+					klog.Fatalf("Lost the leader lease of %s", provisioner)
+				}
+			},
+		},
+	})
+}
+
+// leaderElectionNamespace returns the namespace of the leader lease, the one
+// of the pod like in the controller library
+func leaderElectionNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+	if data, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
+		if ns := strings.TrimSpace(string(data)); ns != "" {
+			return ns
+		}
+	}
+	return "default"
+}
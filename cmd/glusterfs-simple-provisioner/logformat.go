@@ -0,0 +1,93 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// klogLineRegexp splits a klog line `Lmmdd hh:mm:ss.uuuuuu pid file:line] msg`
+var klogLineRegexp = regexp.MustCompile(`^([IWEF])\d{4} [\d:.]+\s+\d+ ([^\]]+)\] (.*)$`)
+
+// operationRegexp matches the `[<id>] ` correlation ID prefix of messages
+var operationRegexp = regexp.MustCompile(`^\[([^\]\s]+)\] (.*)$`)
+
+var klogLevels = map[string]string{"I": "info", "W": "warning", "E": "error", "F": "fatal"}
+
+// jsonLogEntry is one line of the JSON log format
+type jsonLogEntry struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Caller    string `json:"caller,omitempty"`
+	Operation string `json:"operation,omitempty"`
+	Message   string `json:"msg"`
+}
+
+// jsonLogWriter rewrites klog lines as JSON objects
+type jsonLogWriter struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+func (w *jsonLogWriter) Write(data []byte) (int, error) {
+	line := strings.TrimRight(string(data), "\n")
+	entry := jsonLogEntry{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Level:   "info",
+		Message: line,
+	}
+	if m := klogLineRegexp.FindStringSubmatch(line); m != nil {
+		entry.Level = klogLevels[m[1]]
+		entry.Caller = m[2]
+		entry.Message = m[3]
+	}
+	if m := operationRegexp.FindStringSubmatch(entry.Message); m != nil {
+		entry.Operation = m[1]
+		entry.Message = m[2]
+	}
+	out, err := json.Marshal(&entry)
+	if err != nil {
+		return 0, err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, err = w.out.Write(append(out, '\n'))
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// setupJSONLogging sends every klog line as JSON to stderr. klog writes a
+// line to the output of its severity and of all lower severities, so only
+// the INFO output is kept.
+func setupJSONLogging() {
+	flag.Set("logtostderr", "false")
+	flag.Set("alsologtostderr", "false")
+	flag.Set("stderrthreshold", "FATAL")
+	klog.SetOutputBySeverity("INFO", &jsonLogWriter{out: os.Stderr})
+	klog.SetOutputBySeverity("WARNING", ioutil.Discard)
+	klog.SetOutputBySeverity("ERROR", ioutil.Discard)
+	klog.SetOutputBySeverity("FATAL", ioutil.Discard)
+}
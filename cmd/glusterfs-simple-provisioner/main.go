@@ -16,7 +16,13 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"gluster-simple-provisioner/pkg/volume"
 	"k8s.io/apimachinery/pkg/util/validation"
@@ -24,6 +30,7 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v8/controller"
 )
@@ -31,21 +38,126 @@ import (
 var (
 	provisioner = flag.String("provisioner", "gluster.org/glusterfs-simple", "Name of the provisioner. The provisioner will only provision volumes for claims that request a StorageClass with a provisioner field set equal to this name.")
 	master      = flag.String("master", "", "Master URL to build a client config from. Either this or kubeconfig needs to be set if the provisioner is being run out of cluster.")
-	kubeconfig  = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Either this or master needs to be set if the provisioner is being run out of cluster.")
+	kubeconfig  = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Either this, master or the KUBECONFIG environment variable needs to be set if the provisioner is being run out of cluster.")
+
+	brickPoolRefreshPeriod  = flag.Duration("brick-pool-refresh-period", time.Minute, "How often the capacity of BrickPools is refreshed from df. 0 disables refreshing.")
+	healthCheckPeriod       = flag.Duration("health-check-period", 5*time.Minute, "How often the bricks of provisioned volumes are checked. 0 disables monitoring.")
+	usageMetricsPeriod      = flag.Duration("usage-metrics-period", 0, "How often brick usage is collected with du for the usage metrics. 0 disables usage metrics.")
+	quotaCheckPeriod        = flag.Duration("quota-check-period", 5*time.Minute, "How often the gluster quotas of volumes of classes with quota are checked for crossed soft and hard limits. 0 disables the checks.")
+	scrubPeriod             = flag.Duration("scrub-period", time.Minute, "How often released volumes of classes with scrubOnRelease are scrubbed for reuse. 0 disables scrubbing.")
+	backupCheckPeriod       = flag.Duration("backup-check-period", 5*time.Minute, "How often volumes of classes with backupInterval are checked for due backups. 0 disables backups.")
+	volumeStatusObjects     = flag.Bool("volume-status-objects", false, "Mirror every provisioned PV in a GlusterVolume object in the namespace of its claim, updated by health checks, usage metrics and operations. Needs the GlusterVolume CRD.")
+	endpointsSyncPeriod     = flag.Duration("endpoints-sync-period", 10*time.Minute, "How often the endpoints of volumes are updated to the hosts of their bricks. 0 disables it.")
+	reconcilePeriod         = flag.Duration("reconcile-period", 0, "How often bound volumes are reconciled toward their desired state: missing gluster volumes are recreated, stopped volumes started, drifted options reset and endpoints repaired. 0 disables the reconciliation.")
+	deleteWorkers           = flag.Int("delete-workers", 0, "Number of workers cleaning up deleted volumes in the background. 0 cleans up synchronously.")
+	deleteMaxRetries        = flag.Int("delete-max-retries", 10, "How often a failed background cleanup of a deleted volume is retried.")
+	metricsPort             = flag.Int("metrics-port", 0, "Port serving Prometheus metrics on /metrics. 0 disables metrics.")
+	logFormat               = flag.String("log-format", "text", "Log format: text or json. JSON lines carry the claim UID of provisioning and deletion in the operation field.")
+	enablePprof             = flag.Bool("enable-pprof", false, "Serve pprof profiles on /debug/pprof/ at pprof-address.")
+	pprofAddress            = flag.String("pprof-address", "localhost:6060", "Address serving pprof profiles with enable-pprof.")
+	healthPort              = flag.Int("health-port", 0, "Port serving the /healthz liveness and /readyz readiness checks. 0 disables them.")
+	snapshotAddress         = flag.String("snapshot-address", "", "Address serving the snapshot API for Velero volume snapshotter plugins, e.g. :8443. Empty disables the API.")
+	snapshotTokenFile       = flag.String("snapshot-token-file", "", "File holding the bearer token of the snapshot API, read on every request. Required with snapshot-address.")
+	snapshotTLSCert         = flag.String("snapshot-tls-cert", "", "Certificate file of the snapshot API. Required unless snapshot-address is a loopback address.")
+	snapshotTLSKey          = flag.String("snapshot-tls-key", "", "Private key file of snapshot-tls-cert.")
+	adminAddress            = flag.String("admin-address", "", "Address serving the admin API listing and repairing volumes, e.g. :8444. Empty disables the API.")
+	adminTokenFile          = flag.String("admin-token-file", "/var/run/secrets/gluster-admin/token", "File holding the bearer token of the admin API, read on every request.")
+	adminTLSCert            = flag.String("admin-tls-cert", "", "Certificate file of the admin API. Required unless admin-address is a loopback address.")
+	adminTLSKey             = flag.String("admin-tls-key", "", "Private key file of admin-tls-cert.")
+	clusterFailureThreshold = flag.Int("cluster-failure-threshold", 5, "Number of consecutive command failures after which a gluster cluster is suspended. 0 disables suspension.")
+	clusterFailureBackoff   = flag.Duration("cluster-failure-backoff", time.Minute, "How long a failing gluster cluster is suspended.")
+	allowedNamespaces       = flag.String("allowed-namespaces", "", "Comma separated namespaces whose claims are provisioned. Empty allows all namespaces.")
+	deniedNamespaces        = flag.String("denied-namespaces", "", "Comma separated namespaces whose claims are never provisioned.")
+	workerThreads           = flag.Int("worker-threads", 4, "Number of claims and volumes provisioned or deleted in parallel.")
+	provisionRetryCount     = flag.Int("provision-retry-count", 15, "How often provisioning a claim is retried before giving up. 0 retries forever.")
+	deleteRetryCount        = flag.Int("delete-retry-count", 15, "How often deleting a volume is retried before giving up. 0 retries forever.")
+	retryIntervalStart      = flag.Duration("retry-interval-start", 15*time.Second, "Initial delay before a failed provisioning or deletion is retried. The delay doubles with every failure.")
+	retryIntervalMax        = flag.Duration("retry-interval-max", 1000*time.Second, "Maximum delay before a failed provisioning or deletion is retried.")
+	hostOperationLimits     = flag.String("host-operation-limits", "", "Comma separated host=limit pairs overriding --max-host-operations for single gluster hosts, e.g. 10.0.0.1=2,10.0.0.2=8.")
+	maxHostOperations       = flag.Int("max-host-operations", 4, "Number of gluster commands run at the same time on a gluster host. Further commands wait. 0 is unlimited.")
+	namespaceProvisionRate  = flag.Float64("namespace-provision-rate", 0, "Claims of a namespace provisioned per second. Claims over the rate are queued. 0 is unlimited.")
+	namespaceProvisionBurst = flag.Int("namespace-provision-burst", 10, "Claims of a namespace provisioned in a burst over namespace-provision-rate.")
+	maxNamespaceProvisions  = flag.Int("max-namespace-provisions", 0, "Number of claims of a namespace provisioned at the same time. Further claims are queued. 0 is unlimited.")
+	maxClaimPriority        = flag.Int("max-claim-priority", 0, "Highest provisioning priority a claim may request with the gluster.simple/priority annotation, as integer or PriorityClass. Higher priorities are capped.")
+	shutdownTimeout         = flag.Duration("shutdown-timeout", 2*time.Minute, "How long to wait on SIGTERM for provisioning and deletion in flight to finish.")
+	defaultsConfigMap       = flag.String("defaults-configmap", "", "namespace/name of a ConfigMap of StorageClass parameter defaults, applied without restart when it changes.")
+	stateConfigMap          = flag.String("state-configmap", "", "namespace/name of a ConfigMap holding the provisioning journal and the cleanup of deleted volumes that was still queued at shutdown.")
+	lockNamespace           = flag.String("lock-namespace", "", "Namespace of the Leases serializing BrickPool reservations and namespace quota checks of provisioners sharing them, e.g. the namespace of the provisioner. Empty serializes reservations within the process only.")
+	vaultAddress            = flag.String("vault-address", "", "URL of Vault for the vault-kv and vault-transit key providers of encrypted volumes, e.g. https://vault:8200.")
+	vaultTokenFile          = flag.String("vault-token-file", "/var/run/secrets/vault/token", "File holding the Vault token, read on every request.")
+	vaultKVMount            = flag.String("vault-kv-mount", "secret", "Mount path of the Vault KV v2 secrets engine of the vault-kv key provider.")
+	vaultKVPrefix           = flag.String("vault-kv-prefix", "gluster-simple", "Path prefix of keys in the Vault KV secrets engine.")
+	vaultTransitMount       = flag.String("vault-transit-mount", "transit", "Mount path of the Vault transit secrets engine of the vault-transit key provider.")
+	vaultTransitKey         = flag.String("vault-transit-key", "gluster-simple", "Name of the Vault transit key encrypting volume keys.")
+	notifyURL               = flag.String("notify-url", "", "URL receiving a JSON POST on every volume lifecycle event: created, deleted, create-failed and delete-failed. Empty disables notifications.")
+	notifyTimeout           = flag.Duration("notify-timeout", 10*time.Second, "Timeout of each POST to notify-url.")
+	otlpEndpoint            = flag.String("otlp-endpoint", "", "OTLP/HTTP endpoint of an OpenTelemetry collector receiving the spans of provisioning and deletion, e.g. http://otel-collector:4318. Empty disables tracing.")
+	identityConfigMap       = flag.String("identity-configmap", "", "namespace/name of a ConfigMap holding the identity of this provisioner deployment, generated on first start and stamped on every provisioned PV. Empty disables identities.")
+	takeover                = flag.Bool("takeover", false, "Delete volumes stamped with the identity of another provisioner deployment.")
+	neverForce              = flag.Bool("never-force", false, "Fail volumes that gluster only creates with force, e.g. with bricks on the root filesystem, whatever the forceCreate parameter of their class.")
+	capacityReportConfigMap = flag.String("capacity-report-configmap", "", "namespace/name of a ConfigMap the capacity, committed capacity and volume count of every brick host is written to. Empty disables the report.")
+	capacityReportPeriod    = flag.Duration("capacity-report-period", 10*time.Minute, "How often the capacity report is refreshed.")
+	csiCapacityNamespace    = flag.String("csi-capacity-namespace", "", "Namespace of the CSIStorageCapacity objects published for every served StorageClass, e.g. the namespace of the provisioner. Empty disables them.")
+	csiCapacityPeriod       = flag.Duration("csi-capacity-period", time.Minute, "How often the CSIStorageCapacity objects are refreshed from the free space of the brick roots.")
+	canaryNamespace         = flag.String("canary-namespace", "", "Namespace of the endpoints of a tiny canary volume provisioned and deleted for every served StorageClass on startup, e.g. the namespace of the provisioner. Readiness fails until all canaries passed. Empty disables them.")
+	quotaConfigMap          = flag.String("quota-configmap", "", "namespace/name of a ConfigMap mapping namespaces to the total gluster capacity they may provision.")
 )
 
+func init() {
+	// Registers -v, -logtostderr and the other klog flags
+	klog.InitFlags(nil)
+	flag.StringVar(provisioner, "provisioner-name", *provisioner, "Alias of -provisioner. Instances with different names serve different StorageClasses independently.")
+}
+
 func main() {
 	flag.Set("logtostderr", "true")
 	flag.Parse()
 
+	switch *logFormat {
+	case "text":
+	case "json":
+		setupJSONLogging()
+	default:
+		klog.Fatalf("Invalid log format %q, must be text or json", *logFormat)
+	}
+
 	if errs := validateProvisioner(*provisioner, field.NewPath("provisioner")); len(errs) != 0 {
 		klog.Fatalf("Invalid provisioner specified: %v", errs)
 	}
 	klog.Infof("Provisioner %s specified", *provisioner)
 
+	// The snapshot API deletes snapshots and clones volumes, it is never
+	// served without authentication, nor without TLS off the node
+	if *snapshotAddress != "" {
+		if err := checkAPITLS("snapshot", *snapshotAddress, *snapshotTLSCert, *snapshotTLSKey); err != nil {
+			klog.Fatalf("Invalid snapshot API flags: %v", err)
+		}
+		if *snapshotTokenFile == "" {
+			klog.Fatalf("--snapshot-address requires --snapshot-token-file")
+		}
+		if _, err := os.ReadFile(*snapshotTokenFile); err != nil {
+			klog.Fatalf("Failed to read the snapshot token: %v", err)
+		}
+	}
+
+	// The admin API deletes and repairs volumes, its token never crosses
+	// the network in plain text
+	if *adminAddress != "" {
+		if err := checkAPITLS("admin", *adminAddress, *adminTLSCert, *adminTLSKey); err != nil {
+			klog.Fatalf("Invalid admin API flags: %v", err)
+		}
+	}
+
+	hostLimits, err := parseHostLimits(*hostOperationLimits)
+	if err != nil {
+		klog.Fatalf("Invalid host operation limits: %v", err)
+	}
+
 	// Create the client according to whether we are running in or out-of-cluster
 	var config *rest.Config
-	var err error
+	if *master == "" && *kubeconfig == "" {
+		*kubeconfig = os.Getenv(clientcmd.RecommendedConfigPathEnvVar)
+	}
 	if *master != "" || *kubeconfig != "" {
 		klog.Infof("Either master or kubeconfig specified. building kube config from that..")
 		config, err = clientcmd.BuildConfigFromFlags(*master, *kubeconfig)
@@ -61,15 +173,106 @@ func main() {
 		klog.Fatalf("Failed to create client: %v", err)
 	}
 
-	glusterfsProvisioner := volume.NewGlusterfsProvisioner(config, clientset)
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(context.Background(), config, clientset, flag.Args()))
+	}
+
+	glusterfsProvisioner := volume.NewGlusterfsProvisioner(config, clientset, volume.Options{
+		ProvisionerName:         *provisioner,
+		BrickPoolRefreshPeriod:  *brickPoolRefreshPeriod,
+		HealthCheckPeriod:       *healthCheckPeriod,
+		UsageMetricsPeriod:      *usageMetricsPeriod,
+		QuotaCheckPeriod:        *quotaCheckPeriod,
+		ScrubPeriod:             *scrubPeriod,
+		BackupCheckPeriod:       *backupCheckPeriod,
+		VolumeStatusObjects:     *volumeStatusObjects,
+		ReconcilePeriod:         *reconcilePeriod,
+		EndpointsSyncPeriod:     *endpointsSyncPeriod,
+		DeleteWorkers:           *deleteWorkers,
+		DeleteMaxRetries:        *deleteMaxRetries,
+		ClusterFailureThreshold: *clusterFailureThreshold,
+		ClusterFailureBackoff:   *clusterFailureBackoff,
+		QuotaConfigMap:          *quotaConfigMap,
+		CapacityReportConfigMap: *capacityReportConfigMap,
+		CapacityReportPeriod:    *capacityReportPeriod,
+		CSICapacityNamespace:    *csiCapacityNamespace,
+		CSICapacityPeriod:       *csiCapacityPeriod,
+		CanaryNamespace:         *canaryNamespace,
+		MaxHostOperations:       *maxHostOperations,
+		HostOperationLimits:     hostLimits,
+		NamespaceProvisionRate:  float32(*namespaceProvisionRate),
+		NamespaceProvisionBurst: *namespaceProvisionBurst,
+		MaxNamespaceProvisions:  *maxNamespaceProvisions,
+		MaxClaimPriority:        int32(*maxClaimPriority),
+		StateConfigMap:          *stateConfigMap,
+		LockNamespace:           *lockNamespace,
+		DefaultsConfigMap:       *defaultsConfigMap,
+		AllowedNamespaces:       splitList(*allowedNamespaces),
+		DeniedNamespaces:        splitList(*deniedNamespaces),
+		NeverForce:              *neverForce,
+		IdentityConfigMap:       *identityConfigMap,
+		Takeover:                *takeover,
+		NotifyURL:               *notifyURL,
+		NotifyTimeout:           *notifyTimeout,
+		OTLPEndpoint:            *otlpEndpoint,
+		Vault: volume.VaultOptions{
+			Address:      *vaultAddress,
+			TokenFile:    *vaultTokenFile,
+			KVMount:      *vaultKVMount,
+			KVPrefix:     *vaultKVPrefix,
+			TransitMount: *vaultTransitMount,
+			TransitKey:   *vaultTransitKey,
+		},
+	})
+
+	options := []func(*controller.ProvisionController) error{
+		controller.Threadiness(*workerThreads),
+		controller.FailedProvisionThreshold(*provisionRetryCount),
+		controller.FailedDeleteThreshold(*deleteRetryCount),
+		controller.RateLimiter(workqueue.NewItemExponentialFailureRateLimiter(*retryIntervalStart, *retryIntervalMax)),
+		// runAsLeader elects the leader for the controller and maintenance
+		controller.LeaderElection(false),
+		controller.ClaimsInformer(glusterfsProvisioner.ClaimInformer()),
+	}
+	if *metricsPort > 0 {
+		options = append(options, controller.MetricsPort(int32(*metricsPort)))
+	}
 
 	pc := controller.NewProvisionController(
 		clientset,
 		*provisioner,
 		glusterfsProvisioner,
+		options...,
 	)
 
-	pc.Run(context.Background())
+	if *enablePprof {
+		go serveDebug(*pprofAddress)
+	}
+	if *healthPort > 0 {
+		go serveHealth(*healthPort, glusterfsProvisioner)
+	}
+	if *snapshotAddress != "" {
+		go serveSnapshots(*snapshotAddress, *snapshotTLSCert, *snapshotTLSKey, *snapshotTokenFile, glusterfsProvisioner)
+	}
+	if *adminAddress != "" {
+		go serveAdmin(*adminAddress, *adminTLSCert, *adminTLSKey, *adminTokenFile, glusterfsProvisioner)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		klog.Infof("Received %v, shutting down", sig)
+		glusterfsProvisioner.Shutdown(*shutdownTimeout)
+		cancel()
+	}()
+
+	go glusterfsProvisioner.Run(ctx)
+	runAsLeader(ctx, clientset, *provisioner, func(ctx context.Context) {
+		go glusterfsProvisioner.RunMaintenance(ctx)
+		pc.Run(ctx)
+	})
 }
 
 // validateProvisioner tests if provisioner is a valid qualified name.
@@ -86,3 +289,32 @@ func validateProvisioner(provisioner string, fldPath *field.Path) field.ErrorLis
 	}
 	return allErrs
 }
+
+// splitList splits a comma separated flag value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseHostLimits parses comma separated host=limit pairs
+func parseHostLimits(value string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, item := range splitList(value) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q is not a host=limit pair", item)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid limit of host %s: %q", parts[0], parts[1])
+		}
+		limits[strings.TrimSpace(parts[0])] = limit
+	}
+	return limits, nil
+}
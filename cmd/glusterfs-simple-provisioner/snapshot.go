@@ -0,0 +1,85 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"gluster-simple-provisioner/pkg/volume"
+	"k8s.io/klog"
+)
+
+// snapshotTimeout bounds each request of the snapshot API
+const snapshotTimeout = 5 * time.Minute
+
+// serveSnapshots serves the snapshot API called by Velero volume snapshotter
+// plugins, with TLS when certFile is set, to requests carrying the bearer
+// token of tokenFile:
+//
+//	POST   /v1/volumes/{volumeID}/snapshots   {"snapshotID": ...}
+//	DELETE /v1/snapshots/{snapshotID}
+//	POST   /v1/snapshots/{snapshotID}/clone   {"volumeID": ..., "annotations": {...}}
+func serveSnapshots(address string, certFile string, keyFile string, tokenFile string, provisioner volume.GlusterfsProvisioner) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/volumes/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/volumes/"), "/")
+		if len(parts) != 2 || parts[1] != "snapshots" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), snapshotTimeout)
+		defer cancel()
+		id, err := provisioner.CreateSnapshot(ctx, parts[0])
+		writeSnapshotResponse(w, map[string]string{"snapshotID": id}, err)
+	})
+	mux.HandleFunc("/v1/snapshots/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/snapshots/"), "/")
+		ctx, cancel := context.WithTimeout(r.Context(), snapshotTimeout)
+		defer cancel()
+		switch {
+		case len(parts) == 1 && r.Method == http.MethodDelete:
+			err := provisioner.DeleteSnapshot(ctx, parts[0])
+			writeSnapshotResponse(w, struct{}{}, err)
+		case len(parts) == 2 && parts[1] == "clone" && r.Method == http.MethodPost:
+			clone, err := provisioner.CloneSnapshot(ctx, parts[0])
+			writeSnapshotResponse(w, clone, err)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	klog.Infof("Serving the snapshot API on %s", address)
+	err := listenAndServe(address, certFile, keyFile, authenticate("snapshot", tokenFile, mux))
+	klog.Fatalf("Failed to serve the snapshot API: %v", err)
+}
+
+// writeSnapshotResponse writes v as JSON, or err as {"error": ...}
+func writeSnapshotResponse(w http.ResponseWriter, v interface{}, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		klog.Errorf("glusterfs: snapshot API: %v", err)
+		status := http.StatusInternalServerError
+		if err == volume.ErrVolumeNotFound {
+			status = http.StatusNotFound
+		}
+		w.WriteHeader(status)
+		v = map[string]string{"error": err.Error()}
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		klog.Errorf("glusterfs: failed to write snapshot API response: %v", err)
+	}
+}
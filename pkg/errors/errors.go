@@ -0,0 +1,90 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package errors classifies the failures of the provisioner, so that retry
+// logic, events and metrics treat them consistently. Classified errors keep
+// the message of the wrapped error and match their class with errors.Is.
+package errors
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrTransient marks failures expected to go away on retry, e.g. an
+	// unreachable glusterfs pod or a throttled claim
+	ErrTransient = errors.New("transient error")
+	// ErrConfig marks invalid StorageClass parameters or claims, which
+	// fail again on retry until they are fixed
+	ErrConfig = errors.New("configuration error")
+	// ErrBackend marks gluster commands that ran and failed
+	ErrBackend = errors.New("backend error")
+)
+
+type classified struct {
+	class error
+	err   error
+}
+
+func (e *classified) Error() string        { return e.err.Error() }
+func (e *classified) Unwrap() error        { return e.err }
+func (e *classified) Is(target error) bool { return target == e.class }
+
+func classify(class error, err error) error {
+	if err == nil {
+		return nil
+	}
+	var c *classified
+	if errors.As(err, &c) {
+		// The innermost classification wins
+		return err
+	}
+	return &classified{class: class, err: err}
+}
+
+// Transient classifies err as ErrTransient unless it is classified already
+func Transient(err error) error { return classify(ErrTransient, err) }
+
+// Config classifies err as ErrConfig unless it is classified already
+func Config(err error) error { return classify(ErrConfig, err) }
+
+// Backend classifies err as ErrBackend unless it is classified already
+func Backend(err error) error { return classify(ErrBackend, err) }
+
+// Configf formats an ErrConfig error
+func Configf(format string, args ...interface{}) error {
+	return Config(fmt.Errorf(format, args...))
+}
+
+// Kind returns the class of err for metrics and notifications: transient,
+// config, backend or unknown
+func Kind(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrTransient):
+		return "transient"
+	case errors.Is(err, ErrConfig):
+		return "config"
+	case errors.Is(err, ErrBackend):
+		return "backend"
+	}
+	return "unknown"
+}
+
+// IsTerminal reports whether retrying the operation failing with err is
+// pointless without a change of configuration
+func IsTerminal(err error) bool {
+	return errors.Is(err, ErrConfig)
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+)
+
+// supportedAccessModes returns the access modes the PV source of config can
+// honor. Block devices cannot be shared between nodes and only CSI volumes
+// can be limited to a single pod.
+func (config *ProvisionerConfig) supportedAccessModes() []v1.PersistentVolumeAccessMode {
+	if config.BlockHostVolume != "" {
+		return []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce}
+	}
+	modes := []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce, v1.ReadOnlyMany, v1.ReadWriteMany}
+	if config.PVSource == pvSourceCSI {
+		modes = append(modes, v1.ReadWriteOncePod)
+	}
+	return modes
+}
+
+// allowedAccessModes returns the `accessModes` of the class, or all modes
+// supported by its PV source
+func (config *ProvisionerConfig) allowedAccessModes() []v1.PersistentVolumeAccessMode {
+	if len(config.AccessModes) > 0 {
+		return config.AccessModes
+	}
+	return config.supportedAccessModes()
+}
+
+// validateAccessModes rejects claims requesting access modes the class
+// cannot honor, rather than provisioning a PV that misreports them
+func (config *ProvisionerConfig) validateAccessModes(modes []v1.PersistentVolumeAccessMode) error {
+	allowed := config.allowedAccessModes()
+	for _, mode := range modes {
+		if !containsAccessMode(allowed, mode) {
+			return fmt.Errorf("access mode %s is not supported by the storage class, supported modes are %s",
+				mode, formatAccessModes(allowed))
+		}
+	}
+	return nil
+}
+
+// checkAccessModes validates the access modes of claim against its class
+func (p *glusterfsProvisioner) checkAccessModes(ctx context.Context, class *storage.StorageClass, claim *v1.PersistentVolumeClaim) error {
+	cfg, err := p.claimConfig(ctx, class, claim, "")
+	if err != nil {
+		// Reported by preflight
+		return nil
+	}
+	return cfg.validateAccessModes(claim.Spec.AccessModes)
+}
+
+func parseAccessModes(param string) ([]v1.PersistentVolumeAccessMode, error) {
+	var modes []v1.PersistentVolumeAccessMode
+	for _, name := range strings.Split(param, ",") {
+		mode := v1.PersistentVolumeAccessMode(strings.TrimSpace(name))
+		switch mode {
+		case "":
+			continue
+		case v1.ReadWriteOnce, v1.ReadOnlyMany, v1.ReadWriteMany, v1.ReadWriteOncePod:
+			modes = append(modes, mode)
+		default:
+			return nil, fmt.Errorf("accessModes is invalid: %q is not an access mode", name)
+		}
+	}
+	return modes, nil
+}
+
+func containsAccessMode(modes []v1.PersistentVolumeAccessMode, mode v1.PersistentVolumeAccessMode) bool {
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+func formatAccessModes(modes []v1.PersistentVolumeAccessMode) string {
+	names := make([]string, len(modes))
+	for i, mode := range modes {
+		names[i] = string(mode)
+	}
+	return strings.Join(names, ",")
+}
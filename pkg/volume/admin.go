@@ -0,0 +1,172 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v8/util"
+)
+
+// VolumeInfo describes a provisioned volume in the admin inventory
+type VolumeInfo struct {
+	PV            string   `json:"persistentVolume"`
+	Phase         string   `json:"phase"`
+	StorageClass  string   `json:"storageClass"`
+	Namespace     string   `json:"namespace,omitempty"`
+	Claim         string   `json:"persistentVolumeClaim,omitempty"`
+	Volume        string   `json:"volume"`
+	Bricks        []string `json:"bricks,omitempty"`
+	CapacityBytes int64    `json:"capacityBytes"`
+	// UsedBytes is only collected on request, as it runs du on every brick
+	UsedBytes *int64 `json:"usedBytes,omitempty"`
+	// Healthy is the result of the last health check, if any
+	Healthy *bool  `json:"healthy,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ListVolumes returns the inventory of provisioned volumes. With usage the
+// used bytes of every volume are collected from its bricks.
+func (p *glusterfsProvisioner) ListVolumes(ctx context.Context, usage bool) ([]VolumeInfo, error) {
+	volumes, err := p.listProvisionedVolumes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]VolumeInfo, 0, len(volumes))
+	for i := range volumes {
+		pv := &volumes[i]
+		capacity := pv.Spec.Capacity[v1.ResourceStorage]
+		info := VolumeInfo{
+			PV:            pv.Name,
+			Phase:         string(pv.Status.Phase),
+			StorageClass:  util.GetPersistentVolumeClass(pv),
+			Volume:        glusterVolumeName(pv),
+			CapacityBytes: capacity.Value(),
+		}
+		if claim := pv.Spec.ClaimRef; claim != nil {
+			info.Namespace = claim.Namespace
+			info.Claim = claim.Name
+		}
+
+		p.volumeHealthMutex.Lock()
+		if health, ok := p.volumeHealth[pv.Name]; ok {
+			healthy := health.healthy
+			info.Healthy = &healthy
+		}
+		p.volumeHealthMutex.Unlock()
+
+		cfg, bricks, err := p.configForVolume(ctx, pv)
+		if err != nil {
+			info.Error = err.Error()
+			infos = append(infos, info)
+			continue
+		}
+		for _, b := range bricks {
+			info.Bricks = append(info.Bricks, b.Host+":"+b.Path)
+		}
+		if usage {
+			var total int64
+			for _, b := range bricks {
+				used, err := p.brickUsage(ctx, b, cfg)
+				if err != nil {
+					info.Error = err.Error()
+					break
+				}
+				total += used
+			}
+			if info.Error == "" {
+				total /= int64(replicaCount(cfg.VolumeType))
+				info.UsedBytes = &total
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// provisionedVolume returns the provisioned PV named pvName
+func (p *glusterfsProvisioner) provisionedVolume(ctx context.Context, pvName string) (*v1.PersistentVolume, error) {
+	volumes, err := p.listProvisionedVolumes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range volumes {
+		if volumes[i].Name == pvName {
+			return &volumes[i], nil
+		}
+	}
+	return nil, ErrVolumeNotFound
+}
+
+// ForceDeleteVolume deletes the gluster volume, bricks and endpoints of a
+// PV whatever its reclaim policy, then deletes the PV itself. Bound PVs
+// and deletion protection are still honored.
+func (p *glusterfsProvisioner) ForceDeleteVolume(ctx context.Context, pvName string) error {
+	pv, err := p.provisionedVolume(ctx, pvName)
+	if err != nil {
+		return err
+	}
+	if pv.Status.Phase == v1.VolumeBound {
+		return fmt.Errorf("volume %s is bound to claim %s/%s, delete the claim first", pvName, pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)
+	}
+	klog.Infof("glusterfs: force deleting volume %s", pvName)
+	p.recorder.Event(pv, v1.EventTypeWarning, "ForceDelete", "volume is force deleted by an administrator")
+	err = p.deletePV(ctx, pv)
+	if err != nil {
+		return err
+	}
+	return p.client.CoreV1().PersistentVolumes().Delete(ctx, pvName, metav1.DeleteOptions{})
+}
+
+// RepairEndpoints recreates the endpoints and service of a PV if either of
+// them is missing
+func (p *glusterfsProvisioner) RepairEndpoints(ctx context.Context, pvName string) error {
+	pv, err := p.provisionedVolume(ctx, pvName)
+	if err != nil {
+		return err
+	}
+	cfg, bricks, err := p.configForVolume(ctx, pv)
+	if err != nil {
+		return err
+	}
+	err = p.reconcileEndpoints(ctx, pv, cfg, bricks)
+	p.recordVolumeOperation(ctx, pv, cfg, bricks, "RepairEndpoints", err, "")
+	return err
+}
+
+// HealVolume starts a heal of the gluster volume of a PV, of every file
+// with full
+func (p *glusterfsProvisioner) HealVolume(ctx context.Context, pvName string, full bool) error {
+	pv, err := p.provisionedVolume(ctx, pvName)
+	if err != nil {
+		return err
+	}
+	cfg, bricks, err := p.configForVolume(ctx, pv)
+	if err != nil {
+		return err
+	}
+	cmd := fmt.Sprintf("gluster --mode=script volume heal %s", shellQuote(cfg.VolumeName))
+	if full {
+		cmd += " full"
+	}
+	klog.Infof("glusterfs: healing volume %s", cfg.VolumeName)
+	p.recorder.Event(pv, v1.EventTypeNormal, "HealStarted", "heal was started by an administrator")
+	err = p.ExecuteCommands(ctx, bricks[0].Host, []string{cmd}, cfg)
+	p.recordVolumeOperation(ctx, pv, cfg, bricks, "Heal", err, "")
+	return err
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+
+	gerrors "gluster-simple-provisioner/pkg/errors"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+)
+
+const (
+	annProvisionedBy = "pv.kubernetes.io/provisioned-by"
+	// annStorageClass names the class whose parameters manage an adopted PV,
+	// whose own class belongs to the provisioner that created it
+	annStorageClass = "gluster.simple/storage-class"
+	// heketiProvisioner is the in-tree heketi based glusterfs provisioner
+	heketiProvisioner = "kubernetes.io/glusterfs"
+)
+
+// AdoptVolumes hands the PVs named by pvNames, or all PVs of the heketi
+// provisioner if none are named, over to provisionerName. className is the
+// StorageClass of this provisioner serving the gluster cluster of the PVs.
+// The names of the adopted PVs are returned.
+func AdoptVolumes(ctx context.Context, config *rest.Config, client kubernetes.Interface, provisionerName string, className string, pvNames []string) ([]string, error) {
+	p := newGlusterfsProvisionerInternal(config, client, Options{})
+	return p.adoptVolumes(ctx, provisionerName, className, pvNames)
+}
+
+func (p *glusterfsProvisioner) adoptVolumes(ctx context.Context, provisionerName string, className string, pvNames []string) ([]string, error) {
+	class, err := p.client.StorageV1().StorageClasses().Get(ctx, className, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var pvs []v1.PersistentVolume
+	if len(pvNames) == 0 {
+		list, err := p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, pv := range list.Items {
+			if pv.Annotations[annProvisionedBy] == heketiProvisioner {
+				pvs = append(pvs, pv)
+			}
+		}
+	} else {
+		for _, name := range pvNames {
+			pv, err := p.client.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			pvs = append(pvs, *pv)
+		}
+	}
+
+	var adopted []string
+	for i := range pvs {
+		err := p.adoptVolume(ctx, &pvs[i], provisionerName, class.Name, class.Parameters)
+		if err != nil {
+			return adopted, fmt.Errorf("failed to adopt PV %s: %v", pvs[i].Name, err)
+		}
+		adopted = append(adopted, pvs[i].Name)
+	}
+	return adopted, nil
+}
+
+func (p *glusterfsProvisioner) adoptVolume(ctx context.Context, pv *v1.PersistentVolume, provisionerName string, className string, params map[string]string) error {
+	if pv.Spec.Glusterfs == nil {
+		return fmt.Errorf("PV is not a glusterfs volume")
+	}
+	if pv.Annotations[annCreatedBy] == createdBy {
+		return nil
+	}
+	cfg, err := p.newProvisionerConfig(ctx, pv.Spec.Glusterfs.Path, params)
+	if err != nil {
+		return gerrors.Configf("Parameter is invalid: %s", err)
+	}
+	bricks, err := p.volumeBricks(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	pv = pv.DeepCopy()
+	if pv.Annotations == nil {
+		pv.Annotations = make(map[string]string)
+	}
+	pv.Annotations[annCreatedBy] = createdBy
+	pv.Annotations[annProvisionedBy] = provisionerName
+	pv.Annotations[annStorageClass] = className
+	pv.Annotations[annBricks] = formatBricks(bricks)
+	_, err = p.client.CoreV1().PersistentVolumes().Update(ctx, pv, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+	klog.Infof("glusterfs: adopted PV %s with gluster volume %s", pv.Name, cfg.VolumeName)
+	return nil
+}
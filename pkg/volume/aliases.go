@@ -0,0 +1,152 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// parameterAlias is an alternate or deprecated name of a StorageClass
+// parameter
+type parameterAlias struct {
+	// canonical is the name of the parameter the alias stands for, as
+	// documented. Aliases without one are accepted and ignored.
+	canonical string
+	// deprecated aliases are reported by events and metrics, the others are
+	// accepted silently, e.g. the names used by other provisioners
+	deprecated bool
+	// value converts the value of the alias to one of canonical, nil keeps
+	// it. An empty result drops the alias.
+	value func(string) (string, error)
+}
+
+// parameterAliases maps lower case alias names to the parameter they stand for
+var parameterAliases = map[string]parameterAlias{
+	"nfsexport": {canonical: "pvSource", deprecated: true, value: func(v string) (string, error) {
+		if strings.ToLower(strings.TrimSpace(v)) == "true" {
+			return pvSourceNFS, nil
+		}
+		return "", nil
+	}},
+	// gluster-block provisioner
+	"hacount": {canonical: "blockHA"},
+
+	// kubernetes.io/glusterfs, whose volumes heketi placed. The class must
+	// get its brick roots from the GlusterCluster named after the heketi
+	// cluster or from the defaults.
+	"clusterid": {canonical: "cluster", value: func(v string) (string, error) {
+		// The first of the clusters heketi chose from
+		return strings.TrimSpace(strings.Split(v, ",")[0]), nil
+	}},
+	"volumenameprefix": {canonical: "volumeNameTemplate", value: func(v string) (string, error) {
+		prefix := strings.TrimSpace(v)
+		if err := ValidateVolumeName(prefix); err != nil {
+			return "", err
+		}
+		return prefix + "_{{.PVCNamespace}}_{{.PVCName}}_{{.PVName}}", nil
+	}},
+	"resturl":            {},
+	"restauthenabled":    {},
+	"restuser":           {},
+	"restuserkey":        {},
+	"secretname":         {},
+	"secretnamespace":    {},
+	"snapfactor":         {},
+	"customepnameprefix": {},
+}
+
+// DeprecatedParameter is a deprecated parameter set on a StorageClass
+type DeprecatedParameter struct {
+	Parameter   string `json:"parameter"`
+	Replacement string `json:"replacement"`
+}
+
+func (d DeprecatedParameter) String() string {
+	return fmt.Sprintf("parameter %s is deprecated, use %s", d.Parameter, d.Replacement)
+}
+
+// resolveParameterAliases replaces aliases in params by their canonical
+// parameters and counts the deprecated ones. A canonical parameter set as
+// well takes precedence over its alias.
+func resolveParameterAliases(params map[string]string) (map[string]string, error) {
+	var found bool
+	for k := range params {
+		if _, ok := parameterAliases[strings.ToLower(k)]; ok {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return params, nil
+	}
+
+	set := make(map[string]bool, len(params))
+	for k := range params {
+		set[strings.ToLower(k)] = true
+	}
+	resolved := make(map[string]string, len(params))
+	for k, v := range params {
+		alias, ok := parameterAliases[strings.ToLower(k)]
+		if !ok {
+			resolved[k] = v
+			continue
+		}
+		if alias.deprecated {
+			deprecatedParameters.WithLabelValues(strings.ToLower(k)).Inc()
+		}
+		if alias.canonical == "" || set[strings.ToLower(alias.canonical)] {
+			continue
+		}
+		if alias.value != nil {
+			var err error
+			v, err = alias.value(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s is invalid: %v", k, err)
+			}
+			if v == "" {
+				continue
+			}
+		}
+		resolved[alias.canonical] = v
+	}
+	return resolved, nil
+}
+
+// DeprecatedParameters returns the deprecated parameters of a StorageClass
+func DeprecatedParameters(params map[string]string) []DeprecatedParameter {
+	var deprecated []DeprecatedParameter
+	for k := range params {
+		if alias, ok := parameterAliases[strings.ToLower(k)]; ok && alias.deprecated {
+			deprecated = append(deprecated, DeprecatedParameter{Parameter: k, Replacement: alias.canonical})
+		}
+	}
+	sort.Slice(deprecated, func(i, j int) bool { return deprecated[i].Parameter < deprecated[j].Parameter })
+	return deprecated
+}
+
+// IgnoredParameters returns the parameters of a StorageClass that are
+// accepted for compatibility but have no effect, e.g. the heketi settings of
+// kubernetes.io/glusterfs classes
+func IgnoredParameters(params map[string]string) []string {
+	var ignored []string
+	for k := range params {
+		if alias, ok := parameterAliases[strings.ToLower(k)]; ok && alias.canonical == "" {
+			ignored = append(ignored, k)
+		}
+	}
+	sort.Strings(ignored)
+	return ignored
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+const (
+	// annLastBackup records the time of the last successful backup of a PV
+	annLastBackup = "gluster.simple/last-backup"
+	// annLastBackupStatus records the outcome of the last backup of a PV
+	annLastBackupStatus = "gluster.simple/last-backup-status"
+
+	backupToolRestic = "restic"
+	backupToolRclone = "rclone"
+)
+
+// backupCommand returns the command backing up the volume of cfg mounted on
+// mountpoint. The variables of the backup Secret are sourced from stdin so
+// that credentials never appear in commands or logs.
+func backupCommand(cfg *ProvisionerConfig, mountpoint string) string {
+	var tool string
+	switch cfg.BackupTool {
+	case backupToolRclone:
+		tool = fmt.Sprintf("rclone sync %s %s", shellQuote(mountpoint), shellQuote(cfg.BackupRepository+"/"+cfg.VolumeName))
+	default:
+		tool = fmt.Sprintf("restic -r %s backup --host gluster-simple --tag %s %s", shellQuote(cfg.BackupRepository), shellQuote(cfg.VolumeName), shellQuote(mountpoint))
+	}
+	return fmt.Sprintf("set -a; source /dev/stdin; set +a; "+
+		"mkdir -p %[1]s && mount -t glusterfs %[2]s %[1]s && "+
+		"{ %[3]s; rc=$?; umount %[1]s; rmdir %[1]s; exit $rc; }",
+		shellQuote(mountpoint), shellQuote("localhost:/"+cfg.VolumeName), tool)
+}
+
+// backupEnv returns the data of the backup Secret of cfg as shell variables
+func (p *glusterfsProvisioner) backupEnv(ctx context.Context, cfg *ProvisionerConfig) ([]byte, error) {
+	var env bytes.Buffer
+	if cfg.BackupSecret == "" {
+		return env.Bytes(), nil
+	}
+	namespace, name, err := splitNamespacedName(cfg.BackupSecret)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := p.client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get backup secret %s: %v", cfg.BackupSecret, err)
+	}
+	keys := make([]string, 0, len(secret.Data))
+	for k := range secret.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&env, "%s=%s\n", k, shellQuote(string(secret.Data[k])))
+	}
+	return env.Bytes(), nil
+}
+
+// runBackups backs up every provisioned volume whose class has a
+// backupInterval and whose last backup is older than it
+func (p *glusterfsProvisioner) runBackups(ctx context.Context) {
+	volumes, err := p.listProvisionedVolumes(ctx)
+	if err != nil {
+		klog.Errorf("glusterfs: failed to list volumes to back up: %v", err)
+		return
+	}
+	for i := range volumes {
+		pv := &volumes[i]
+		if pv.Status.Phase != v1.VolumeBound {
+			continue
+		}
+		cfg, bricks, err := p.configForVolume(ctx, pv)
+		if err != nil || cfg.BackupInterval == 0 || len(bricks) == 0 {
+			continue
+		}
+		if last, err := time.Parse(time.RFC3339, pv.Annotations[annLastBackup]); err == nil && time.Since(last) < cfg.BackupInterval {
+			continue
+		}
+		p.backupVolume(ctx, pv, cfg, bricks)
+	}
+}
+
+// backupVolume backs up the volume of pv from its first brick host and
+// records the outcome on pv
+func (p *glusterfsProvisioner) backupVolume(ctx context.Context, pv *v1.PersistentVolume, cfg *ProvisionerConfig, bricks []glusterBrick) {
+	klog.Infof("glusterfs: backing up volume %s with %s", cfg.VolumeName, cfg.BackupTool)
+	start := time.Now()
+	env, err := p.backupEnv(ctx, cfg)
+	if err == nil {
+		_, err = p.executeCommandWithInput(ctx, bricks[0].Host, backupCommand(cfg, "/run/gluster-simple/backup/"+cfg.VolumeName), env, cfg)
+	}
+
+	status := "succeeded"
+	if err != nil {
+		klog.Errorf("glusterfs: backup of volume %s failed: %v", cfg.VolumeName, err)
+		status = "failed: " + err.Error()
+		p.recorder.Event(pv, v1.EventTypeWarning, "BackupFailed", err.Error())
+	} else {
+		p.recorder.Event(pv, v1.EventTypeNormal, "BackedUp",
+			fmt.Sprintf("volume was backed up to %s in %v", cfg.BackupRepository, time.Since(start).Round(time.Second)))
+	}
+
+	p.recordVolumeOperation(ctx, pv, cfg, bricks, "Backup", err, cfg.BackupRepository)
+
+	rerr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := p.client.CoreV1().PersistentVolumes().Get(ctx, pv.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if latest.Annotations == nil {
+			latest.Annotations = make(map[string]string)
+		}
+		latest.Annotations[annLastBackupStatus] = status
+		if status == "succeeded" {
+			latest.Annotations[annLastBackup] = start.UTC().Format(time.RFC3339)
+		}
+		_, err = p.client.CoreV1().PersistentVolumes().Update(ctx, latest, metav1.UpdateOptions{})
+		return err
+	})
+	if rerr != nil {
+		klog.Errorf("glusterfs: failed to record backup of volume %s: %v", cfg.VolumeName, rerr)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v8/controller"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v8/gidallocator"
+)
+
+// annBlockVolume records the `hostvolume/block` of gluster-block PVs
+const annBlockVolume = "gluster.simple/block-volume"
+
+// maxBlockHA is the largest high availability count of gluster-block
+const maxBlockHA = 3
+
+// blockCreateJSON is the output of `gluster-block create ... --json`
+type blockCreateJSON struct {
+	IQN     string   `json:"IQN"`
+	Portals []string `json:"PORTAL(S)"`
+	Result  string   `json:"RESULT"`
+	ErrMsg  string   `json:"errMsg"`
+}
+
+// blockListJSON is the output of `gluster-block list <volume> --json`
+type blockListJSON struct {
+	Blocks []string `json:"blocks"`
+	Result string   `json:"RESULT"`
+	ErrMsg string   `json:"errMsg"`
+}
+
+// blockHosts returns the hosts exporting the gluster-block device of cfg
+func (config *ProvisionerConfig) blockHosts() []string {
+	ha := config.BlockHA
+	if ha == 0 {
+		ha = len(config.BrickRootPaths)
+		if ha > maxBlockHA {
+			ha = maxBlockHA
+		}
+	}
+	hosts := make([]string, 0, ha)
+	seen := make(map[string]bool)
+	for _, root := range config.BrickRootPaths {
+		if len(hosts) == ha {
+			break
+		}
+		if !seen[root.Host] {
+			seen[root.Host] = true
+			hosts = append(hosts, root.Host)
+		}
+	}
+	return hosts
+}
+
+// provisionBlock provisions a gluster-block device on the block host volume
+// of cfg and returns a PV with an iSCSI source for it
+func (p *glusterfsProvisioner) provisionBlock(
+	ctx context.Context,
+	options controller.ProvisionOptions,
+	cfg *ProvisionerConfig,
+	capacity resource.Quantity,
+	gid int,
+) (*v1.PersistentVolume, controller.ProvisioningState, error) {
+	source, err := p.createBlock(ctx, cfg, capacity.Value())
+	if err != nil {
+		if rerr := p.releaseBrickCapacity(ctx, cfg); rerr != nil {
+			klog.Errorf("glusterfs: failed to release brick capacity: %v", rerr)
+		}
+		return nil, controller.ProvisioningFinished, err
+	}
+
+	annotations := make(map[string]string)
+	annotations[annCreatedBy] = createdBy
+	annotations[gidallocator.VolumeGidAnnotationKey] = strconv.FormatInt(int64(gid), 10)
+	setPoolAnnotations(annotations, cfg)
+	annotations[annBlockVolume] = cfg.BlockHostVolume + "/" + cfg.VolumeName
+	setDeletionProtectionAnnotation(annotations, options.PVC)
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        options.PVName,
+			Annotations: annotations,
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: *options.StorageClass.ReclaimPolicy,
+			AccessModes:                   options.PVC.Spec.AccessModes,
+			VolumeMode:                    options.PVC.Spec.VolumeMode,
+			Capacity: v1.ResourceList{
+				v1.ResourceName(v1.ResourceStorage): capacity,
+			},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				ISCSI: source,
+			},
+			MountOptions: options.StorageClass.MountOptions,
+		},
+	}
+	return pv, controller.ProvisioningFinished, nil
+}
+
+// createBlock creates a gluster-block device of size bytes
+func (p *glusterfsProvisioner) createBlock(
+	ctx context.Context,
+	cfg *ProvisionerConfig,
+	size int64,
+) (*v1.ISCSIPersistentVolumeSource, error) {
+	hosts := cfg.blockHosts()
+	out, err := p.executeCommandOnHost(ctx, hosts[0], fmt.Sprintf(
+		"gluster-block create %s ha %d %s %d --json",
+		shellQuote(cfg.BlockHostVolume+"/"+cfg.VolumeName), len(hosts), shellQuote(strings.Join(hosts, ",")), size), cfg)
+	if err != nil {
+		klog.Errorf("glusterfs: failed to create block %s/%s: %v", cfg.BlockHostVolume, cfg.VolumeName, err)
+		return nil, err
+	}
+	var result blockCreateJSON
+	err = json.Unmarshal([]byte(out), &result)
+	if err == nil && result.Result != "SUCCESS" {
+		err = fmt.Errorf("%s", result.ErrMsg)
+	}
+	if err == nil && (result.IQN == "" || len(result.Portals) == 0) {
+		err = fmt.Errorf("no IQN or portal returned")
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to create block %s/%s: %v", cfg.BlockHostVolume, cfg.VolumeName, err)
+		if derr := p.deleteBlockDevice(ctx, cfg.BlockHostVolume, cfg.VolumeName, cfg); derr != nil {
+			klog.Errorf("glusterfs: failed to roll back block %s/%s: %v", cfg.BlockHostVolume, cfg.VolumeName, derr)
+		}
+		return nil, err
+	}
+
+	return &v1.ISCSIPersistentVolumeSource{
+		TargetPortal:   result.Portals[0],
+		Portals:        result.Portals[1:],
+		IQN:            result.IQN,
+		Lun:            0,
+		ISCSIInterface: "default",
+		FSType:         cfg.FSType,
+		ReadOnly:       false,
+	}, nil
+}
+
+// deleteBlock deletes the gluster-block device of a PV. Errors are returned
+// so that the deletion is retried.
+func (p *glusterfsProvisioner) deleteBlock(ctx context.Context, volume *v1.PersistentVolume, block string, cfg *ProvisionerConfig) error {
+	parts := strings.SplitN(block, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("annotation %s of volume %s is invalid: %q", annBlockVolume, volume.Name, block)
+	}
+	err := p.deleteBlockDevice(ctx, parts[0], parts[1], cfg)
+	if err != nil {
+		klog.Errorf("glusterfs: error deleting block %s of volume %s: %v", block, volume.Name, err)
+		return err
+	}
+
+	err = p.releaseBrickCapacity(ctx, cfg)
+	if err != nil {
+		klog.Errorf("glusterfs: error to release brick capacity: %v", err)
+	}
+	err = p.allocator.Release(volume)
+	if err != nil {
+		klog.Errorf("glusterfs: error to release GID: %v", err)
+	}
+	return nil
+}
+
+// deleteBlockDevice deletes block from hostVolume unless it is already gone
+func (p *glusterfsProvisioner) deleteBlockDevice(ctx context.Context, hostVolume string, block string, cfg *ProvisionerConfig) error {
+	host := cfg.BrickRootPaths[0].Host
+	out, err := p.executeCommandOnHost(ctx, host, fmt.Sprintf("gluster-block list %s --json", shellQuote(hostVolume)), cfg)
+	if err != nil {
+		return err
+	}
+	var list blockListJSON
+	err = json.Unmarshal([]byte(out), &list)
+	if err != nil {
+		return fmt.Errorf("failed to parse blocks of %s: %v", hostVolume, err)
+	}
+	if list.Result != "SUCCESS" {
+		return fmt.Errorf("failed to list blocks of %s: %s", hostVolume, list.ErrMsg)
+	}
+	found := false
+	for _, b := range list.Blocks {
+		if b == block {
+			found = true
+		}
+	}
+	if !found {
+		klog.V(2).Infof("glusterfs: block %s/%s is already deleted", hostVolume, block)
+		return nil
+	}
+
+	return p.ExecuteCommands(ctx, host, []string{
+		fmt.Sprintf("gluster-block delete %s --json", shellQuote(hostVolume+"/"+block)),
+	}, cfg)
+}
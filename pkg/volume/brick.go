@@ -0,0 +1,165 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+const (
+	// annBricks records the bricks of a provisioned volume as `host:/path,...`
+	annBricks = "gluster.simple/bricks"
+
+	// defaultBrickPathTemplate is the historical brick layout
+	defaultBrickPathTemplate = "{{.PVCNamespace}}/{{.PVCName}}-{{.VolumeName}}"
+)
+
+// BrickPathData is the data available to the brickPathTemplate parameter
+type BrickPathData struct {
+	Host         string
+	BrickRoot    string
+	Zone         string
+	Pool         string
+	PVName       string
+	PVCName      string
+	PVCNamespace string
+	VolumeName   string
+}
+
+// brickLayout returns the bricks of the volume of cfg. Brick paths are
+// rendered from brickPathTemplate relative to the brick root and may not
+// escape it.
+func brickLayout(namespace string, pvcName string, cfg *ProvisionerConfig) ([]glusterBrick, error) {
+	text := cfg.BrickPathTemplate
+	if text == "" {
+		text = defaultBrickPathTemplate
+	}
+	tmpl, err := template.New("brickPathTemplate").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("brickPathTemplate is invalid: %v", err)
+	}
+
+	bricks := make([]glusterBrick, len(cfg.BrickRootPaths))
+	seen := make(map[string]bool)
+	for i, root := range cfg.BrickRootPaths {
+		var rel strings.Builder
+		err = tmpl.Execute(&rel, BrickPathData{
+			Host:         root.Host,
+			BrickRoot:    root.Path,
+			Zone:         root.Zone,
+			Pool:         root.Pool,
+			PVName:       cfg.PVName,
+			PVCName:      pvcName,
+			PVCNamespace: namespace,
+			VolumeName:   cfg.VolumeName,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("brickPathTemplate is invalid: %v", err)
+		}
+		rootPath := filepath.Clean(root.Path)
+		prefix := rootPath
+		if rootPath != "/" {
+			prefix += "/"
+		}
+		path := filepath.Join(rootPath, rel.String())
+		if path == rootPath || !strings.HasPrefix(path, prefix) {
+			return nil, fmt.Errorf("brick path %q generated by brickPathTemplate is outside of brick root %s", path, root.Path)
+		}
+		if err := ValidateBrickPath(path); err != nil {
+			return nil, fmt.Errorf("brickPathTemplate is invalid: %v", err)
+		}
+		key := root.Host + ":" + path
+		if seen[key] {
+			return nil, fmt.Errorf("brick path %s is used twice, brickPathTemplate must give every brick a distinct path", key)
+		}
+		seen[key] = true
+		bricks[i] = glusterBrick{Host: root.Host, Path: path}
+	}
+	return bricks, nil
+}
+
+// dataAddress returns the storage network address of the brick host host,
+// which gluster and clients use, while commands run on host
+func (config *ProvisionerConfig) dataAddress(host string) string {
+	if address, ok := config.DataAddresses[host]; ok {
+		return address
+	}
+	return host
+}
+
+// managementHost returns the brick host whose storage network address is
+// address
+func (config *ProvisionerConfig) managementHost(address string) string {
+	for host, a := range config.DataAddresses {
+		if a == address {
+			return host
+		}
+	}
+	return address
+}
+
+// glusterBrickName returns the name of b in gluster, `address:/path`
+func (config *ProvisionerConfig) glusterBrickName(b glusterBrick) string {
+	return config.dataAddress(b.Host) + ":" + b.Path
+}
+
+// dataHosts returns the distinct storage network addresses of bricks
+func (config *ProvisionerConfig) dataHosts(bricks []glusterBrick) []string {
+	hosts := brickHosts(bricks)
+	for i, host := range hosts {
+		hosts[i] = config.dataAddress(host)
+	}
+	return hosts
+}
+
+// brickHosts returns the distinct hosts of bricks in order
+func brickHosts(bricks []glusterBrick) []string {
+	var hosts []string
+	seen := make(map[string]bool)
+	for _, b := range bricks {
+		if !seen[b.Host] {
+			seen[b.Host] = true
+			hosts = append(hosts, b.Host)
+		}
+	}
+	return hosts
+}
+
+// formatBricks formats bricks for the annBricks annotation
+func formatBricks(bricks []glusterBrick) string {
+	values := make([]string, len(bricks))
+	for i, b := range bricks {
+		values[i] = b.Host + ":" + b.Path
+	}
+	return strings.Join(values, ",")
+}
+
+// parseBricks parses the annBricks annotation
+func parseBricks(value string) ([]glusterBrick, error) {
+	roots, err := parseBrickRootPaths(value)
+	if err != nil {
+		return nil, err
+	}
+	bricks := make([]glusterBrick, len(roots))
+	for i, root := range roots {
+		bricks[i] = glusterBrick{Host: root.Host, Path: root.Path}
+	}
+	if err := validateBricks(bricks); err != nil {
+		return nil, err
+	}
+	return bricks, nil
+}
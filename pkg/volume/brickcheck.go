@@ -0,0 +1,94 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultBrickFilesystems are the filesystems gluster supports for bricks
+	defaultBrickFilesystems = "xfs"
+	// minXFSInodeSize is the inode size gluster needs to keep its extended
+	// attributes inline
+	minXFSInodeSize = 512
+)
+
+// checkBrickRoots verifies that every brick root of cfg is a mounted
+// filesystem of a supported type other than the root filesystem, so that
+// bricks are never silently created on `/`
+func (p *glusterfsProvisioner) checkBrickRoots(ctx context.Context, cfg *ProvisionerConfig) error {
+	if !cfg.BrickRootCheck {
+		return nil
+	}
+	checked := make(map[BrickRootPath]bool)
+	for _, root := range cfg.BrickRootPaths {
+		if checked[root] {
+			continue
+		}
+		checked[root] = true
+		err := p.checkBrickRoot(ctx, root, cfg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *glusterfsProvisioner) checkBrickRoot(ctx context.Context, root BrickRootPath, cfg *ProvisionerConfig) error {
+	out, err := p.executeCommandOnHost(ctx, root.Host,
+		fmt.Sprintf("findmnt -n -o TARGET,FSTYPE --target %s", shellQuote(root.Path)), cfg)
+	if err != nil {
+		return fmt.Errorf("brick root %s:%s is not accessible: %v", root.Host, root.Path, err)
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return fmt.Errorf("unexpected findmnt output for brick root %s:%s: %q", root.Host, root.Path, out)
+	}
+	target, fsType := fields[0], fields[1]
+
+	if target == "/" {
+		return fmt.Errorf("brick root %s:%s is on the root filesystem, mount a dedicated filesystem on it", root.Host, root.Path)
+	}
+	supported := false
+	for _, fs := range cfg.BrickFilesystems {
+		if fs == fsType {
+			supported = true
+		}
+	}
+	if !supported {
+		return fmt.Errorf("brick root %s:%s is on a %s filesystem, supported filesystems are %s",
+			root.Host, root.Path, fsType, strings.Join(cfg.BrickFilesystems, ","))
+	}
+
+	if fsType == "xfs" {
+		out, err = p.executeCommandOnHost(ctx, root.Host,
+			fmt.Sprintf("xfs_info %s | grep -o 'isize=[0-9]*' | head -n 1", shellQuote(target)), cfg)
+		if err != nil {
+			return fmt.Errorf("failed to get inode size of brick root %s:%s: %v", root.Host, root.Path, err)
+		}
+		size, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(out), "isize="))
+		if err != nil {
+			return fmt.Errorf("unexpected xfs_info output for brick root %s:%s: %q", root.Host, root.Path, out)
+		}
+		if size < minXFSInodeSize {
+			return fmt.Errorf("brick root %s:%s has an inode size of %d, gluster needs at least %d (mkfs.xfs -i size=%d)",
+				root.Host, root.Path, size, minXFSInodeSize, minXFSInodeSize)
+		}
+	}
+	return nil
+}
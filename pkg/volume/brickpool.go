@@ -0,0 +1,430 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// BrickPoolResource is the cluster-scoped BrickPool custom resource
+var BrickPoolResource = schema.GroupVersionResource{
+	Group:    "gluster.org",
+	Version:  "v1alpha1",
+	Resource: "brickpools",
+}
+
+// BrickPoolSpec describes the brick roots of a pool and how to reach their hosts
+type BrickPoolSpec struct {
+	BrickRootPaths []BrickRootPath `json:"brickRootPaths"`
+	Namespace      string          `json:"namespace,omitempty"`
+	Selector       string          `json:"selector,omitempty"`
+	// Thin marks brick roots on thin provisioned storage, e.g. LVM thin
+	// pools or shared filesystems, whose capacity may be overcommitted
+	Thin bool `json:"thin,omitempty"`
+	// OvercommitPercent limits the capacity reserved on each host of a thin
+	// pool to this percentage of its size. Defaults to 100.
+	OvercommitPercent int64 `json:"overcommitPercent,omitempty"`
+}
+
+// BrickPoolHostStatus is the capacity of one brick root as reported by `df`
+type BrickPoolHostStatus struct {
+	Host       string `json:"host"`
+	Path       string `json:"path"`
+	SizeBytes  int64  `json:"sizeBytes"`
+	UsedBytes  int64  `json:"usedBytes"`
+	FreeBytes  int64  `json:"freeBytes"`
+	LastUpdate string `json:"lastUpdate,omitempty"`
+}
+
+// BrickReservation is capacity reserved on a host for a provisioned volume
+type BrickReservation struct {
+	Volume string `json:"volume"`
+	Host   string `json:"host"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// BrickPoolStatus records capacity and reservations of a BrickPool
+type BrickPoolStatus struct {
+	Hosts        []BrickPoolHostStatus `json:"hosts,omitempty"`
+	Reservations []BrickReservation    `json:"reservations,omitempty"`
+}
+
+// BrickPool is an inventory of brick roots with capacity tracking
+type BrickPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BrickPoolSpec   `json:"spec"`
+	Status BrickPoolStatus `json:"status,omitempty"`
+}
+
+// parameters returns spec as lower case StorageClass parameters
+func (spec *BrickPoolSpec) parameters() map[string]string {
+	params := make(map[string]string)
+	if len(spec.BrickRootPaths) != 0 {
+		params["brickrootpaths"] = formatBrickRootPaths(spec.BrickRootPaths)
+	}
+	if spec.Namespace != "" {
+		params["namespace"] = spec.Namespace
+	}
+	if spec.Selector != "" {
+		params["selector"] = spec.Selector
+	}
+	return params
+}
+
+// reservedBytes returns the capacity reserved on host
+func (status *BrickPoolStatus) reservedBytes(host string) int64 {
+	var reserved int64
+	for _, r := range status.Reservations {
+		if r.Host == host {
+			reserved += r.Bytes
+		}
+	}
+	return reserved
+}
+
+// hasReservation reports whether volume already holds a reservation
+func (status *BrickPoolStatus) hasReservation(volume string) bool {
+	for _, r := range status.Reservations {
+		if r.Volume == volume {
+			return true
+		}
+	}
+	return false
+}
+
+// sizeBytes returns the size of host as last reported by `df`
+func (status *BrickPoolStatus) sizeBytes(host string) (int64, bool) {
+	var size int64
+	found := false
+	for _, h := range status.Hosts {
+		if h.Host == host {
+			size += h.SizeBytes
+			found = true
+		}
+	}
+	return size, found
+}
+
+// freeBytes returns the free capacity of host as last reported by `df`
+func (status *BrickPoolStatus) freeBytes(host string) (int64, bool) {
+	var free int64
+	found := false
+	for _, h := range status.Hosts {
+		if h.Host == host {
+			free += h.FreeBytes
+			found = true
+		}
+	}
+	return free, found
+}
+
+// overcommitError is returned for claims exceeding the overcommit ratio of
+// a thin BrickPool
+type overcommitError struct {
+	pool      string
+	host      string
+	requested int64
+	committed int64
+	limit     int64
+	percent   int64
+}
+
+func (e *overcommitError) Error() string {
+	return fmt.Sprintf("reserving %d bytes on host %s in thin brick pool %s exceeds its overcommit limit of %d%% (%d bytes), %d bytes are committed",
+		e.requested, e.host, e.pool, e.percent, e.limit, e.committed)
+}
+
+// overcommitPercent returns the overcommit ratio of a thin pool in percent
+func (spec *BrickPoolSpec) overcommitPercent() int64 {
+	if spec.OvercommitPercent > 0 {
+		return spec.OvercommitPercent
+	}
+	return 100
+}
+
+// checkCapacity returns an error unless every brick host of cfg has size
+// bytes available that are not reserved yet. Thin pools are checked against
+// their overcommit limit instead of the free capacity.
+func (pool *BrickPool) checkCapacity(cfg *ProvisionerConfig, size int64) error {
+	requested := make(map[string]int64)
+	for _, root := range cfg.BrickRootPaths {
+		requested[root.Host] += size
+	}
+	if pool.Spec.Thin {
+		return pool.checkOvercommit(cfg, requested)
+	}
+	for _, root := range cfg.BrickRootPaths {
+		free, found := pool.Status.freeBytes(root.Host)
+		if !found {
+			return fmt.Errorf("capacity of host %s in brick pool %s is unknown", root.Host, pool.Name)
+		}
+		available := free - pool.Status.reservedBytes(root.Host)
+		if available < requested[root.Host] {
+			return fmt.Errorf("insufficient capacity on host %s in brick pool %s: requested %d bytes, available %d bytes",
+				root.Host, pool.Name, requested[root.Host], available)
+		}
+	}
+	return nil
+}
+
+func (p *glusterfsProvisioner) getBrickPool(ctx context.Context, name string) (*BrickPool, error) {
+	if p.dynamicClient == nil {
+		return nil, fmt.Errorf("glusterfs: failed to get dynamic client when getting brick pool %s", name)
+	}
+	u, err := p.dynamicClient.Resource(BrickPoolResource).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return brickPoolFromUnstructured(u)
+}
+
+func brickPoolFromUnstructured(u *unstructured.Unstructured) (*BrickPool, error) {
+	var pool BrickPool
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &pool)
+	if err != nil {
+		return nil, fmt.Errorf("BrickPool %s is invalid: %v", u.GetName(), err)
+	}
+	return &pool, nil
+}
+
+func (p *glusterfsProvisioner) updateBrickPoolStatus(ctx context.Context, pool *BrickPool) error {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		return err
+	}
+	u := &unstructured.Unstructured{Object: content}
+	u.SetAPIVersion(BrickPoolResource.GroupVersion().String())
+	u.SetKind("BrickPool")
+	_, err = p.dynamicClient.Resource(BrickPoolResource).UpdateStatus(ctx, u, metav1.UpdateOptions{})
+	return err
+}
+
+// resolveBrickPoolParameters merges the BrickPool referenced by params into
+// params. Parameters set on the StorageClass take precedence.
+func (p *glusterfsProvisioner) resolveBrickPoolParameters(ctx context.Context, params map[string]string) (map[string]string, error) {
+	var poolName string
+	for k, v := range params {
+		if strings.ToLower(k) == "brickpool" {
+			poolName = strings.TrimSpace(v)
+		}
+	}
+	if poolName == "" {
+		return params, nil
+	}
+
+	pool, err := p.getBrickPool(ctx, poolName)
+	if err != nil {
+		klog.Errorf("glusterfs: failed to get brick pool %s: %v", poolName, err)
+		return nil, err
+	}
+
+	resolved := pool.Spec.parameters()
+	for k, v := range params {
+		delete(resolved, strings.ToLower(k))
+		resolved[k] = v
+	}
+	return resolved, nil
+}
+
+// checkOvercommit returns an overcommitError unless the capacity committed
+// on every brick host of cfg stays within the overcommit limit of the pool
+func (pool *BrickPool) checkOvercommit(cfg *ProvisionerConfig, requested map[string]int64) error {
+	percent := pool.Spec.overcommitPercent()
+	for _, root := range cfg.BrickRootPaths {
+		size, found := pool.Status.sizeBytes(root.Host)
+		if !found {
+			return fmt.Errorf("capacity of host %s in brick pool %s is unknown", root.Host, pool.Name)
+		}
+		limit := size / 100 * percent
+		committed := pool.Status.reservedBytes(root.Host)
+		if committed+requested[root.Host] > limit {
+			return &overcommitError{
+				pool:      pool.Name,
+				host:      root.Host,
+				requested: requested[root.Host],
+				committed: committed,
+				limit:     limit,
+				percent:   percent,
+			}
+		}
+	}
+	return nil
+}
+
+// reserveBrickCapacity reserves size bytes on every brick host of cfg in its
+// BrickPool. Reservations of a pool are serialized by lockBrickPool, and
+// the status update is retried on conflict with the capacity refresh, so
+// that concurrent provisioning never over-commits a host.
+func (p *glusterfsProvisioner) reserveBrickCapacity(ctx context.Context, cfg *ProvisionerConfig, size int64) error {
+	if cfg.BrickPool == "" {
+		return nil
+	}
+	unlock, err := p.lockBrickPool(ctx, cfg.BrickPool)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pool, err := p.getBrickPool(ctx, cfg.BrickPool)
+		if err != nil {
+			return err
+		}
+		if pool.Status.hasReservation(cfg.VolumeName) {
+			return nil
+		}
+		err = pool.checkCapacity(cfg, size)
+		if err != nil {
+			return err
+		}
+		for _, root := range cfg.BrickRootPaths {
+			pool.Status.Reservations = append(pool.Status.Reservations, BrickReservation{
+				Volume: cfg.VolumeName,
+				Host:   root.Host,
+				Bytes:  size,
+			})
+		}
+		return p.updateBrickPoolStatus(ctx, pool)
+	})
+}
+
+// releaseBrickCapacity drops the reservations held by the volume of cfg
+func (p *glusterfsProvisioner) releaseBrickCapacity(ctx context.Context, cfg *ProvisionerConfig) error {
+	if cfg.BrickPool == "" {
+		return nil
+	}
+	unlock, err := p.lockBrickPool(ctx, cfg.BrickPool)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pool, err := p.getBrickPool(ctx, cfg.BrickPool)
+		if err != nil {
+			return err
+		}
+		if !pool.Status.hasReservation(cfg.VolumeName) {
+			return nil
+		}
+		var reservations []BrickReservation
+		for _, r := range pool.Status.Reservations {
+			if r.Volume != cfg.VolumeName {
+				reservations = append(reservations, r)
+			}
+		}
+		pool.Status.Reservations = reservations
+		return p.updateBrickPoolStatus(ctx, pool)
+	})
+}
+
+// refreshBrickPools updates the host capacity of every BrickPool from `df`
+func (p *glusterfsProvisioner) refreshBrickPools(ctx context.Context) {
+	list, err := p.dynamicClient.Resource(BrickPoolResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.Errorf("glusterfs: failed to list brick pools: %v", err)
+		return
+	}
+	for i := range list.Items {
+		pool, err := brickPoolFromUnstructured(&list.Items[i])
+		if err != nil {
+			klog.Errorf("glusterfs: %v", err)
+			continue
+		}
+		err = p.refreshBrickPool(ctx, pool)
+		if err != nil {
+			klog.Errorf("glusterfs: failed to refresh brick pool %s: %v", pool.Name, err)
+		}
+	}
+}
+
+func (p *glusterfsProvisioner) refreshBrickPool(ctx context.Context, pool *BrickPool) error {
+	cfg, err := NewProvisionerConfig("", pool.Spec.parameters())
+	if err != nil {
+		return err
+	}
+
+	hosts := make([]BrickPoolHostStatus, 0, len(cfg.BrickRootPaths))
+	for _, root := range cfg.BrickRootPaths {
+		status, err := p.brickRootCapacity(ctx, root, cfg)
+		if err != nil {
+			klog.Errorf("glusterfs: failed to get capacity of %s:%s: %v", root.Host, root.Path, err)
+			continue
+		}
+		hosts = append(hosts, *status)
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := p.getBrickPool(ctx, pool.Name)
+		if err != nil {
+			return err
+		}
+		latest.Status.Hosts = hosts
+		exportBrickPoolMetrics(latest)
+		return p.updateBrickPoolStatus(ctx, latest)
+	})
+}
+
+// brickRootCapacity runs `df` for root on its host
+func (p *glusterfsProvisioner) brickRootCapacity(ctx context.Context, root BrickRootPath, cfg *ProvisionerConfig) (*BrickPoolHostStatus, error) {
+	pod, err := p.selectPod(ctx, root.Host, cfg)
+	if err != nil {
+		return nil, err
+	}
+	out, err := p.executeCommandOutput(ctx,
+		cfg.commandPreamble()+fmt.Sprintf("df -B1 --output=size,used,avail %s | tail -n 1", shellQuote(root.Path)), pod)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("unexpected df output: %q", out)
+	}
+	var values [3]int64
+	for i, f := range fields {
+		values[i], err = strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected df output: %q", out)
+		}
+	}
+	return &BrickPoolHostStatus{
+		Host:       root.Host,
+		Path:       root.Path,
+		SizeBytes:  values[0],
+		UsedBytes:  values[1],
+		FreeBytes:  values[2],
+		LastUpdate: time.Now().UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// exportBrickPoolMetrics exports the size and committed capacity of every
+// host of pool
+func exportBrickPoolMetrics(pool *BrickPool) {
+	for _, h := range pool.Status.Hosts {
+		size, _ := pool.Status.sizeBytes(h.Host)
+		brickPoolSizeBytes.WithLabelValues(pool.Name, h.Host).Set(float64(size))
+		brickPoolCommittedBytes.WithLabelValues(pool.Name, h.Host).Set(float64(pool.Status.reservedBytes(h.Host)))
+	}
+}
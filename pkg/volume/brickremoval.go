@@ -0,0 +1,205 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+)
+
+const (
+	// brickRemovalInline removes bricks within Delete
+	brickRemovalInline = "inline"
+	// brickRemovalBackground moves bricks aside within Delete and removes
+	// them in a detached process on their host
+	brickRemovalBackground = "background"
+	// brickRemovalTrash moves bricks into the trash of their brick root,
+	// which is purged after trashTTL
+	brickRemovalTrash = "trash"
+
+	// brickRemovalCheckPeriod is how often background removals are checked
+	// for completion
+	brickRemovalCheckPeriod = time.Minute
+	// deletingBrickPrefix prefixes the names of bricks being removed in the
+	// background
+	deletingBrickPrefix = ".deleting-"
+
+	// trashDir is the directory of every brick root holding trashed bricks
+	// in subdirectories per day
+	trashDir = ".trash"
+	// defaultTrashTTL is how long trashed bricks are kept by default
+	defaultTrashTTL = 24 * time.Hour
+	// trashPurgePeriod is how often expired trashed bricks are purged
+	trashPurgePeriod = time.Hour
+)
+
+// brickRemoval is a brick being removed in the background
+type brickRemoval struct {
+	brick   glusterBrick
+	cfg     *ProvisionerConfig
+	started time.Time
+}
+
+// deletingBrickPath returns the path brick is moved to for its removal in
+// the background, which is on the same filesystem so that moving is cheap
+func deletingBrickPath(brick glusterBrick, now time.Time) string {
+	dir, name := filepath.Split(brick.Path)
+	return filepath.Join(dir, fmt.Sprintf("%s%s-%d", deletingBrickPrefix, name, now.UnixNano()))
+}
+
+// removeBrickInBackground moves the brick directory aside and starts its
+// removal, prefixed with heavyCommandPrefix, detached from the command. The
+// brick path is free again as soon as this returns.
+func (p *glusterfsProvisioner) removeBrickInBackground(ctx context.Context, brick glusterBrick, cfg *ProvisionerConfig) error {
+	now := time.Now()
+	removal := glusterBrick{Host: brick.Host, Path: deletingBrickPath(brick, now)}
+	rm, err := cfg.command(commandDeleteBrick, CommandData{
+		VolumeName: cfg.VolumeName,
+		Host:       removal.Host,
+		Path:       removal.Path,
+	})
+	if err != nil {
+		return err
+	}
+	klog.Infof("mv %s:%s %s, removing it in the background", brick.Host, brick.Path, removal.Path)
+	err = p.ExecuteCommands(ctx, brick.Host, []string{fmt.Sprintf(
+		"if [ -e %s ]; then mv %s %s && (setsid nohup sh -c %s >/dev/null 2>&1 &); fi",
+		shellQuote(brick.Path), shellQuote(brick.Path), shellQuote(removal.Path), shellQuote(cfg.heavy(rm)),
+	)}, cfg)
+	if err != nil {
+		return err
+	}
+
+	p.brickRemovalsMutex.Lock()
+	p.brickRemovals[removal.Host+":"+removal.Path] = brickRemoval{brick: removal, cfg: cfg, started: now}
+	brickRemovalsPending.Set(float64(len(p.brickRemovals)))
+	p.brickRemovalsMutex.Unlock()
+	return nil
+}
+
+// checkBrickRemovals logs the background removals that completed. Removals
+// started before a restart of the provisioner complete but are not tracked.
+func (p *glusterfsProvisioner) checkBrickRemovals(ctx context.Context) {
+	p.brickRemovalsMutex.Lock()
+	removals := make(map[string]brickRemoval, len(p.brickRemovals))
+	for key, removal := range p.brickRemovals {
+		removals[key] = removal
+	}
+	p.brickRemovalsMutex.Unlock()
+
+	for key, removal := range removals {
+		out, err := p.executeCommandOnHost(ctx, removal.brick.Host, fmt.Sprintf(
+			"[ -e %s ] && echo pending || echo done", shellQuote(removal.brick.Path),
+		), removal.cfg)
+		if err != nil {
+			klog.Errorf("glusterfs: failed to check removal of brick %s: %v", key, err)
+			continue
+		}
+		if strings.TrimSpace(out) != "done" {
+			continue
+		}
+		duration := time.Since(removal.started)
+		klog.Infof("glusterfs: removed brick %s in the background in %s", key, duration.Round(time.Second))
+		brickRemovalDuration.Observe(duration.Seconds())
+		p.brickRemovalsMutex.Lock()
+		delete(p.brickRemovals, key)
+		brickRemovalsPending.Set(float64(len(p.brickRemovals)))
+		p.brickRemovalsMutex.Unlock()
+	}
+}
+
+// brickRootOf returns the brick root of cfg holding brick, or the parent
+// directory of brick if it is in none of them, e.g. because the class
+// changed
+func brickRootOf(brick glusterBrick, cfg *ProvisionerConfig) string {
+	root := ""
+	for _, r := range cfg.allBrickRoots() {
+		path := filepath.Clean(r.Path)
+		if r.Host == brick.Host && strings.HasPrefix(brick.Path, path+"/") && len(path) > len(root) {
+			root = path
+		}
+	}
+	if root == "" {
+		root = filepath.Dir(brick.Path)
+	}
+	return root
+}
+
+// trashBrick moves the brick directory into `.trash/<date>/` of its brick
+// root and touches it, so that it is purged trashTTL after it was deleted
+func (p *glusterfsProvisioner) trashBrick(ctx context.Context, brick glusterBrick, cfg *ProvisionerConfig) error {
+	now := time.Now()
+	root := brickRootOf(brick, cfg)
+	rel := strings.TrimPrefix(brick.Path, root+"/")
+	day := filepath.Join(root, trashDir, now.UTC().Format("2006-01-02"))
+	target := filepath.Join(day, fmt.Sprintf("%s-%d", strings.ReplaceAll(rel, "/", "_"), now.UnixNano()))
+	klog.Infof("mv %s:%s %s", brick.Host, brick.Path, target)
+	return p.ExecuteCommands(ctx, brick.Host, []string{fmt.Sprintf(
+		"if [ -e %s ]; then mkdir -p %s && mv %s %s && touch %s; fi",
+		shellQuote(brick.Path), shellQuote(day), shellQuote(brick.Path), shellQuote(target), shellQuote(target),
+	)}, cfg)
+}
+
+// trashRoot is a brick root with trash and the longest trashTTL of the
+// classes using it
+type trashRoot struct {
+	cfg *ProvisionerConfig
+	ttl time.Duration
+}
+
+// purgeTrash removes the trashed bricks of the brick roots of the classes
+// of this provisioner that expired, and the emptied day directories
+func (p *glusterfsProvisioner) purgeTrash(ctx context.Context) {
+	classes, err := p.classInformer.Lister().List(labels.Everything())
+	if err != nil {
+		klog.Errorf("glusterfs: failed to list storage classes: %v", err)
+		return
+	}
+	roots := make(map[glusterBrick]trashRoot)
+	for _, class := range classes {
+		if p.options.ProvisionerName != "" && class.Provisioner != p.options.ProvisionerName {
+			continue
+		}
+		cfg, err := p.classConfig(ctx, class, "")
+		if err != nil || cfg.BrickRemoval != brickRemovalTrash {
+			continue
+		}
+		for _, r := range cfg.BrickRootPaths {
+			key := glusterBrick{Host: r.Host, Path: filepath.Clean(r.Path)}
+			if root, ok := roots[key]; !ok || root.ttl < cfg.TrashTTL {
+				roots[key] = trashRoot{cfg: cfg, ttl: cfg.TrashTTL}
+			}
+		}
+	}
+
+	for key, root := range roots {
+		trash := shellQuote(filepath.Join(key.Path, trashDir))
+		minutes := int(root.ttl.Minutes())
+		err := p.ExecuteCommands(ctx, key.Host, []string{fmt.Sprintf(
+			"if [ -d %s ]; then %s && find %s -mindepth 1 -maxdepth 1 -type d -empty -delete; fi",
+			trash,
+			root.cfg.heavy(fmt.Sprintf("find %s -mindepth 2 -maxdepth 2 -mmin +%d -exec rm -rf {} +", trash, minutes)),
+			trash,
+		)}, root.cfg)
+		if err != nil {
+			klog.Errorf("glusterfs: failed to purge trash of %s:%s: %v", key.Host, key.Path, err)
+		}
+	}
+}
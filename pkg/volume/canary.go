@@ -0,0 +1,150 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+)
+
+const (
+	// canaryPrefix prefixes the names of canary volumes
+	canaryPrefix = "glusterfs-simple-canary-"
+	// canarySize is the size of canary volumes of classes without minSize
+	canarySize = 1024 * 1024
+	// canaryRetryPeriod is how often failed canaries, and canaries of
+	// changed classes, are run again
+	canaryRetryPeriod = time.Minute
+)
+
+// canaryState is the outcome of the canary of a class at a resource version
+type canaryState struct {
+	resourceVersion string
+	err             error
+}
+
+// runCanaries provisions and deletes a canary volume for every served class
+// whose canary did not pass yet at its current resource version
+func (p *glusterfsProvisioner) runCanaries(ctx context.Context) {
+	if !p.classInformer.Informer().HasSynced() {
+		return
+	}
+	classes, err := p.classInformer.Lister().List(labels.Everything())
+	if err != nil {
+		klog.Errorf("glusterfs: failed to list storage classes for canaries: %v", err)
+		return
+	}
+
+	served := make(map[string]bool)
+	for _, class := range classes {
+		if !p.servesClass(class) {
+			continue
+		}
+		served[class.Name] = true
+		p.canariesMutex.Lock()
+		state, ok := p.canaries[class.Name]
+		p.canariesMutex.Unlock()
+		if ok && state.err == nil && state.resourceVersion == class.ResourceVersion {
+			continue
+		}
+
+		err := p.runCanary(ctx, class)
+		if err != nil {
+			klog.Errorf("glusterfs: canary of storage class %s failed: %v", class.Name, err)
+			p.recorder.Eventf(class, v1.EventTypeWarning, "CanaryFailed", "canary volume failed: %v", err)
+		} else if !ok || state.err != nil {
+			klog.V(2).Infof("glusterfs: canary of storage class %s passed", class.Name)
+			p.recorder.Event(class, v1.EventTypeNormal, "CanaryPassed", "canary volume was provisioned and deleted")
+		}
+		p.canariesMutex.Lock()
+		p.canaries[class.Name] = canaryState{resourceVersion: class.ResourceVersion, err: err}
+		p.canariesMutex.Unlock()
+	}
+
+	p.canariesMutex.Lock()
+	defer p.canariesMutex.Unlock()
+	for name := range p.canaries {
+		if !served[name] {
+			delete(p.canaries, name)
+		}
+	}
+	p.canariesChecked = true
+}
+
+// runCanary creates a volume of the smallest size class allows, waits for
+// its bricks to come online and deletes it again. Classes provisioning
+// block volumes have no canary.
+func (p *glusterfsProvisioner) runCanary(ctx context.Context, class *storage.StorageClass) error {
+	name := canaryPrefix + strings.ReplaceAll(class.Name, ".", "-")
+	cfg, err := p.classConfig(ctx, class, name)
+	if err != nil {
+		return err
+	}
+	if cfg.BlockHostVolume != "" {
+		return nil
+	}
+	if err := p.excludeMaintenanceHosts(ctx, cfg); err != nil {
+		return err
+	}
+	bricks, err := brickLayout(p.options.CanaryNamespace, name, cfg)
+	if err != nil {
+		return err
+	}
+	size := int64(canarySize)
+	if cfg.MinSize != nil && cfg.MinSize.Value() > size {
+		size = cfg.MinSize.Value()
+	}
+
+	// A canary left behind by a crash would fail the brick checks
+	if err := p.deleteVolume(ctx, p.options.CanaryNamespace, name, cfg, bricks); err != nil {
+		return fmt.Errorf("failed to delete previous canary volume %s: %v", cfg.VolumeName, err)
+	}
+	// createVolume rolls back on errors
+	if _, err := p.createVolume(ctx, p.options.CanaryNamespace, name, cfg, 0, size, nil); err != nil {
+		return err
+	}
+	if err := p.deleteVolume(ctx, p.options.CanaryNamespace, name, cfg, bricks); err != nil {
+		return fmt.Errorf("failed to delete canary volume %s: %v", cfg.VolumeName, err)
+	}
+	return nil
+}
+
+// canariesReady returns an error until the canaries of all served classes
+// ran once, and while any of them fails
+func (p *glusterfsProvisioner) canariesReady() error {
+	p.canariesMutex.Lock()
+	defer p.canariesMutex.Unlock()
+	if !p.canariesChecked {
+		return fmt.Errorf("canary volumes were not checked yet")
+	}
+	var errs []string
+	for name, state := range p.canaries {
+		if state.err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, state.err))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Strings(errs)
+	return fmt.Errorf("canary volumes failed: %s", strings.Join(errs, "; "))
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// capacityReportKey is the key of the capacity report in its ConfigMap
+const capacityReportKey = "capacity.json"
+
+// CapacityReport summarizes the capacity of the brick roots of all served
+// classes and provisioned volumes
+type CapacityReport struct {
+	LastUpdate string         `json:"lastUpdate"`
+	Hosts      []HostCapacity `json:"hosts"`
+}
+
+// HostCapacity is the capacity of the brick roots of a host. Size, used
+// and free bytes sum the roots whose capacity is known.
+type HostCapacity struct {
+	Host           string         `json:"host"`
+	SizeBytes      int64          `json:"sizeBytes"`
+	UsedBytes      int64          `json:"usedBytes"`
+	FreeBytes      int64          `json:"freeBytes"`
+	CommittedBytes int64          `json:"committedBytes"`
+	Volumes        int            `json:"volumes"`
+	BrickRoots     []RootCapacity `json:"brickRoots"`
+}
+
+// RootCapacity is the capacity of a brick root as reported by `df`, and
+// the capacity of the volumes with a brick on it
+type RootCapacity struct {
+	Path      string `json:"path"`
+	SizeBytes int64  `json:"sizeBytes"`
+	UsedBytes int64  `json:"usedBytes"`
+	FreeBytes int64  `json:"freeBytes"`
+	// CommittedBytes sums the capacity of the volumes with a brick on the
+	// root, as BrickPools reserve it
+	CommittedBytes int64  `json:"committedBytes"`
+	Volumes        int    `json:"volumes"`
+	Error          string `json:"error,omitempty"`
+}
+
+// publishCapacityReport writes the capacity report to the ConfigMap named
+// by the CapacityReportConfigMap option
+func (p *glusterfsProvisioner) publishCapacityReport(ctx context.Context) {
+	report, err := p.capacityReport(ctx)
+	if err != nil {
+		klog.Errorf("glusterfs: failed to build capacity report: %v", err)
+		return
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		klog.Errorf("glusterfs: failed to encode capacity report: %v", err)
+		return
+	}
+	if err := p.writeCapacityReport(ctx, string(data)); err != nil {
+		klog.Errorf("glusterfs: failed to write capacity report to %s: %v", p.options.CapacityReportConfigMap, err)
+	}
+}
+
+// capacityReport runs `df` on the brick roots of the served classes and of
+// the provisioned volumes and counts the volumes with bricks on each
+func (p *glusterfsProvisioner) capacityReport(ctx context.Context) (*CapacityReport, error) {
+	roots := make(map[BrickRootPath]*RootCapacity)
+	// A config reaching the host of each root, to run df with
+	rootConfigs := make(map[BrickRootPath]*ProvisionerConfig)
+	addRoots := func(cfg *ProvisionerConfig) {
+		for _, root := range cfg.allBrickRoots() {
+			key := BrickRootPath{Host: root.Host, Path: root.Path}
+			if _, ok := roots[key]; !ok {
+				roots[key] = &RootCapacity{Path: root.Path}
+				rootConfigs[key] = cfg
+			}
+		}
+	}
+
+	if p.classInformer.Informer().HasSynced() {
+		classes, err := p.classInformer.Lister().List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		for _, class := range classes {
+			if !p.servesClass(class) {
+				continue
+			}
+			cfg, err := p.classConfig(ctx, class, "")
+			if err != nil {
+				// Reported by the class registry
+				continue
+			}
+			addRoots(cfg)
+		}
+	}
+
+	volumes, err := p.listProvisionedVolumes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// A volume with bricks on several roots of a host counts once for it
+	hostVolumes := make(map[string]map[string]bool)
+	for i := range volumes {
+		pv := &volumes[i]
+		cfg, bricks, err := p.configForVolume(ctx, pv)
+		if err != nil {
+			klog.Errorf("glusterfs: failed to get bricks of volume %s for the capacity report: %v", pv.Name, err)
+			continue
+		}
+		addRoots(cfg)
+		capacity := pv.Spec.Capacity[v1.ResourceStorage]
+		counted := make(map[BrickRootPath]bool)
+		for _, b := range bricks {
+			key := BrickRootPath{Host: b.Host, Path: brickRootOf(b, cfg)}
+			root, ok := roots[key]
+			if !ok {
+				root = &RootCapacity{Path: key.Path}
+				roots[key] = root
+				rootConfigs[key] = cfg
+			}
+			root.CommittedBytes += capacity.Value()
+			if !counted[key] {
+				counted[key] = true
+				root.Volumes++
+			}
+			if hostVolumes[b.Host] == nil {
+				hostVolumes[b.Host] = make(map[string]bool)
+			}
+			hostVolumes[b.Host][pv.Name] = true
+		}
+	}
+
+	hosts := make(map[string]*HostCapacity)
+	for key, root := range roots {
+		status, err := p.brickRootCapacity(ctx, key, rootConfigs[key])
+		if err != nil {
+			root.Error = err.Error()
+		} else {
+			root.SizeBytes = status.SizeBytes
+			root.UsedBytes = status.UsedBytes
+			root.FreeBytes = status.FreeBytes
+		}
+		host, ok := hosts[key.Host]
+		if !ok {
+			host = &HostCapacity{Host: key.Host, Volumes: len(hostVolumes[key.Host])}
+			hosts[key.Host] = host
+		}
+		host.SizeBytes += root.SizeBytes
+		host.UsedBytes += root.UsedBytes
+		host.FreeBytes += root.FreeBytes
+		host.CommittedBytes += root.CommittedBytes
+		host.BrickRoots = append(host.BrickRoots, *root)
+	}
+
+	report := &CapacityReport{LastUpdate: time.Now().UTC().Format(time.RFC3339)}
+	for _, host := range hosts {
+		sort.Slice(host.BrickRoots, func(i, j int) bool { return host.BrickRoots[i].Path < host.BrickRoots[j].Path })
+		report.Hosts = append(report.Hosts, *host)
+	}
+	sort.Slice(report.Hosts, func(i, j int) bool { return report.Hosts[i].Host < report.Hosts[j].Host })
+	return report, nil
+}
+
+// writeCapacityReport stores report in the CapacityReportConfigMap,
+// creating it if needed
+func (p *glusterfsProvisioner) writeCapacityReport(ctx context.Context, report string) error {
+	namespace, name, err := splitNamespacedName(p.options.CapacityReportConfigMap)
+	if err != nil {
+		return err
+	}
+	configMaps := p.client.CoreV1().ConfigMaps(namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			_, err = configMaps.Create(ctx, &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+				Data:       map[string]string{capacityReportKey: report},
+			}, metav1.CreateOptions{})
+			if errors.IsAlreadyExists(err) {
+				// Created concurrently, retry as an update
+				return errors.NewConflict(v1.Resource("configmaps"), name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[capacityReportKey] = report
+		_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"time"
+
+	storage "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// classConfigTTL bounds how long a parsed class config is reused, so that
+// changes of the BrickPool and GlusterCluster it references are picked up
+const classConfigTTL = time.Minute
+
+type classConfigEntry struct {
+	resourceVersion string
+	time            time.Time
+	cfg             *ProvisionerConfig
+}
+
+// getStorageClass returns the class named name from the StorageClass
+// informer, or from the API server until the informer has synced
+func (p *glusterfsProvisioner) getStorageClass(ctx context.Context, name string) (*storage.StorageClass, error) {
+	if p.classInformer.Informer().HasSynced() {
+		return p.classInformer.Lister().Get(name)
+	}
+	return p.client.StorageV1().StorageClasses().Get(ctx, name, metav1.GetOptions{})
+}
+
+// classConfig returns the config of class for the volume pvName. Parsed
+// configs are cached per class until the class changes or classConfigTTL
+// passes.
+func (p *glusterfsProvisioner) classConfig(ctx context.Context, class *storage.StorageClass, pvName string) (*ProvisionerConfig, error) {
+	p.classConfigsMutex.Lock()
+	entry, ok := p.classConfigs[class.Name]
+	p.classConfigsMutex.Unlock()
+
+	if !ok || entry.resourceVersion != class.ResourceVersion || time.Since(entry.time) > classConfigTTL {
+		cfg, err := p.newProvisionerConfig(ctx, "", class.Parameters)
+		if err != nil {
+			return nil, err
+		}
+		entry = classConfigEntry{resourceVersion: class.ResourceVersion, time: time.Now(), cfg: cfg}
+		if class.ResourceVersion != "" {
+			p.classConfigsMutex.Lock()
+			p.classConfigs[class.Name] = entry
+			p.classConfigsMutex.Unlock()
+		}
+	}
+
+	cfg := *entry.cfg
+	cfg.VolumeName = pvName
+	cfg.PVName = pvName
+	if pvName != "" {
+		if err := cfg.placeVolume(); err != nil {
+			return nil, err
+		}
+	}
+	return &cfg, nil
+}
+
+// invalidateClassConfigs drops all cached class configs
+func (p *glusterfsProvisioner) invalidateClassConfigs() {
+	p.classConfigsMutex.Lock()
+	p.classConfigs = make(map[string]classConfigEntry)
+	p.classConfigsMutex.Unlock()
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+)
+
+// classRevalidatePeriod is how often served classes are validated again, so
+// that changes of their BrickPool, GlusterCluster and defaults are noticed
+const classRevalidatePeriod = 5 * time.Minute
+
+// ClassInfo is the validation status of a StorageClass served by the
+// provisioner
+type ClassInfo struct {
+	Name        string    `json:"name"`
+	Valid       bool      `json:"valid"`
+	Error       string    `json:"error,omitempty"`
+	LastChecked time.Time `json:"lastChecked"`
+	// Deprecated are the deprecated parameters the class sets
+	Deprecated []DeprecatedParameter `json:"deprecated,omitempty"`
+	// Ignored are the parameters the class sets without effect
+	Ignored []string `json:"ignored,omitempty"`
+
+	resourceVersion string
+}
+
+// servesClass returns whether class belongs to this provisioner
+func (p *glusterfsProvisioner) servesClass(class *storage.StorageClass) bool {
+	return p.options.ProvisionerName == "" || class.Provisioner == p.options.ProvisionerName
+}
+
+// watchStorageClasses keeps the registry of served classes up to date: every
+// added or changed class is validated by parsing its parameters, invalid
+// classes get a warning event before any claim uses them.
+func (p *glusterfsProvisioner) watchStorageClasses(ctx context.Context) {
+	p.classQueue = workqueue.NewNamed("glusterfs-simple-storageclasses")
+	enqueue := func(obj interface{}) {
+		key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+		if err != nil {
+			klog.Errorf("glusterfs: failed to get key of storage class: %v", err)
+			return
+		}
+		p.classQueue.Add(key)
+	}
+	p.classInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    enqueue,
+		UpdateFunc: func(_, obj interface{}) { enqueue(obj) },
+		DeleteFunc: enqueue,
+	})
+	go wait.UntilWithContext(ctx, p.runClassWorker, 0)
+	go wait.UntilWithContext(ctx, p.revalidateClasses, classRevalidatePeriod)
+	go func() {
+		<-ctx.Done()
+		p.classQueue.ShutDown()
+	}()
+}
+
+// runClassWorker validates queued classes until the queue is shut down
+func (p *glusterfsProvisioner) runClassWorker(ctx context.Context) {
+	for {
+		item, shutdown := p.classQueue.Get()
+		if shutdown {
+			return
+		}
+		p.validateClass(ctx, item.(string))
+		p.classQueue.Done(item)
+	}
+}
+
+// revalidateClasses queues all served classes for validation
+func (p *glusterfsProvisioner) revalidateClasses(ctx context.Context) {
+	if !p.classInformer.Informer().HasSynced() {
+		return
+	}
+	classes, err := p.classInformer.Lister().List(labels.Everything())
+	if err != nil {
+		klog.Errorf("glusterfs: failed to list storage classes: %v", err)
+		return
+	}
+	for _, class := range classes {
+		if p.servesClass(class) {
+			p.classQueue.Add(class.Name)
+		}
+	}
+}
+
+// validateClass updates the registry entry of the class named name
+func (p *glusterfsProvisioner) validateClass(ctx context.Context, name string) {
+	class, err := p.classInformer.Lister().Get(name)
+	if errors.IsNotFound(err) || (err == nil && !p.servesClass(class)) {
+		p.unregisterClass(name)
+		return
+	}
+	if err != nil {
+		klog.Errorf("glusterfs: failed to get storage class %s: %v", name, err)
+		return
+	}
+
+	info := ClassInfo{
+		Name:            name,
+		Valid:           true,
+		LastChecked:     time.Now(),
+		Deprecated:      DeprecatedParameters(class.Parameters),
+		Ignored:         IgnoredParameters(class.Parameters),
+		resourceVersion: class.ResourceVersion,
+	}
+	if _, err := p.classConfig(ctx, class, ""); err != nil {
+		info.Valid = false
+		info.Error = err.Error()
+	}
+
+	p.classRegistryMutex.Lock()
+	previous, known := p.classRegistry[name]
+	p.classRegistry[name] = info
+	p.classRegistryMutex.Unlock()
+
+	// Deprecations are reported once per version of the class
+	if !known || previous.resourceVersion != info.resourceVersion {
+		for _, d := range info.Deprecated {
+			klog.Warningf("glusterfs: storage class %s: %s", name, d)
+			p.recorder.Event(class, v1.EventTypeWarning, "DeprecatedParameter", d.String())
+		}
+		if len(info.Ignored) != 0 {
+			p.recorder.Eventf(class, v1.EventTypeNormal, "IgnoredParameters",
+				"parameters %s have no effect with this provisioner", strings.Join(info.Ignored, ", "))
+		}
+	}
+	if info.Valid {
+		storageClassValid.WithLabelValues(name).Set(1)
+	} else {
+		storageClassValid.WithLabelValues(name).Set(0)
+	}
+	switch {
+	case !info.Valid && (!known || previous.Error != info.Error):
+		klog.Errorf("glusterfs: storage class %s is invalid: %s", name, info.Error)
+		p.recorder.Event(class, v1.EventTypeWarning, "InvalidParameters", info.Error)
+	case info.Valid && known && !previous.Valid:
+		klog.Infof("glusterfs: storage class %s is valid again", name)
+		p.recorder.Event(class, v1.EventTypeNormal, "ParametersValid", "parameters of the storage class are valid")
+	case !known:
+		klog.V(2).Infof("glusterfs: serving storage class %s", name)
+	}
+}
+
+// unregisterClass drops a deleted class, or one of another provisioner
+func (p *glusterfsProvisioner) unregisterClass(name string) {
+	p.classRegistryMutex.Lock()
+	_, known := p.classRegistry[name]
+	delete(p.classRegistry, name)
+	p.classRegistryMutex.Unlock()
+
+	p.classConfigsMutex.Lock()
+	delete(p.classConfigs, name)
+	p.classConfigsMutex.Unlock()
+
+	if known {
+		storageClassValid.DeleteLabelValues(name)
+		klog.V(2).Infof("glusterfs: no longer serving storage class %s", name)
+	}
+}
+
+// StorageClasses returns the classes served by the provisioner and their
+// validation status, sorted by name
+func (p *glusterfsProvisioner) StorageClasses() []ClassInfo {
+	p.classRegistryMutex.Lock()
+	defer p.classRegistryMutex.Unlock()
+	classes := make([]ClassInfo, 0, len(p.classRegistry))
+	for _, info := range p.classRegistry {
+		classes = append(classes, info)
+	}
+	sort.Slice(classes, func(i, j int) bool { return classes[i].Name < classes[j].Name })
+	return classes
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gerrors "gluster-simple-provisioner/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog"
+)
+
+// GlusterClusterResource is the cluster-scoped GlusterCluster custom resource
+var GlusterClusterResource = schema.GroupVersionResource{
+	Group:    "gluster.org",
+	Version:  "v1alpha1",
+	Resource: "glusterclusters",
+}
+
+// GlusterClusterSpec describes the hosts, brick roots and defaults of a gluster cluster
+type GlusterClusterSpec struct {
+	// BrickRootPaths is root path of brick for each Gluster Host
+	BrickRootPaths []BrickRootPath `json:"brickRootPaths"`
+	// Namespace and Selector locate the glusterfs pods used to run commands
+	Namespace string `json:"namespace,omitempty"`
+	Selector  string `json:"selector,omitempty"`
+	// Defaults are StorageClass parameters applied unless the class overrides them
+	VolumeType  string `json:"volumeType,omitempty"`
+	ForceCreate *bool  `json:"forceCreate,omitempty"`
+	// BrickMultiplex and MaxBricksPerProcess set cluster.brick-multiplex and
+	// cluster.max-bricks-per-process when volumes are created
+	BrickMultiplex      *bool `json:"brickMultiplex,omitempty"`
+	MaxBricksPerProcess *int  `json:"maxBricksPerProcess,omitempty"`
+	// MaintenanceHosts are cordoned hosts, which receive no new bricks
+	MaintenanceHosts []string `json:"maintenanceHosts,omitempty"`
+}
+
+// GlusterCluster is a gluster cluster referenced by StorageClasses via the `cluster` parameter
+type GlusterCluster struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec GlusterClusterSpec `json:"spec"`
+}
+
+// getGlusterCluster fetches the GlusterCluster named name
+func (p *glusterfsProvisioner) getGlusterCluster(ctx context.Context, name string) (*GlusterCluster, error) {
+	if p.dynamicClient == nil {
+		return nil, fmt.Errorf("glusterfs: failed to get dynamic client when getting cluster %s", name)
+	}
+	u, err := p.dynamicClient.Resource(GlusterClusterResource).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var cluster GlusterCluster
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &cluster)
+	if err != nil {
+		return nil, fmt.Errorf("GlusterCluster %s is invalid: %v", name, err)
+	}
+	return &cluster, nil
+}
+
+// resolveClusterParameters merges the GlusterCluster referenced by params
+// into params. Parameters set on the StorageClass take precedence.
+func (p *glusterfsProvisioner) resolveClusterParameters(ctx context.Context, params map[string]string) (map[string]string, error) {
+	var clusterName string
+	for k, v := range params {
+		if strings.ToLower(k) == "cluster" {
+			clusterName = strings.TrimSpace(v)
+		}
+	}
+	if clusterName == "" {
+		return params, nil
+	}
+
+	cluster, err := p.getGlusterCluster(ctx, clusterName)
+	if err != nil {
+		klog.Errorf("glusterfs: failed to get cluster %s: %v", clusterName, err)
+		return nil, err
+	}
+
+	resolved := cluster.Spec.parameters()
+	for k, v := range params {
+		delete(resolved, strings.ToLower(k))
+		resolved[k] = v
+	}
+	return resolved, nil
+}
+
+// parameters returns spec as StorageClass parameters. Keys are lower case
+// so that they never shadow a differently cased class parameter.
+func (spec *GlusterClusterSpec) parameters() map[string]string {
+	params := make(map[string]string)
+	if len(spec.BrickRootPaths) != 0 {
+		params["brickrootpaths"] = formatBrickRootPaths(spec.BrickRootPaths)
+	}
+	if spec.Namespace != "" {
+		params["namespace"] = spec.Namespace
+	}
+	if spec.Selector != "" {
+		params["selector"] = spec.Selector
+	}
+	if spec.VolumeType != "" {
+		params["volumetype"] = spec.VolumeType
+	}
+	if spec.ForceCreate != nil {
+		params["forcecreate"] = strconv.FormatBool(*spec.ForceCreate)
+	}
+	if spec.BrickMultiplex != nil {
+		params["brickmultiplex"] = strconv.FormatBool(*spec.BrickMultiplex)
+	}
+	if spec.MaxBricksPerProcess != nil {
+		params["maxbricksperprocess"] = strconv.Itoa(*spec.MaxBricksPerProcess)
+	}
+	if len(spec.MaintenanceHosts) != 0 {
+		params["maintenancehosts"] = strings.Join(spec.MaintenanceHosts, ",")
+	}
+	return params
+}
+
+// clusterKey identifies the gluster cluster of cfg for failure isolation
+func (config *ProvisionerConfig) clusterKey() string {
+	if config.ClusterName != "" {
+		return config.ClusterName
+	}
+	return config.Namespace + "/" + config.LabelSelector
+}
+
+type clusterState struct {
+	failures  int
+	openUntil time.Time
+}
+
+// clusterBreaker stops sending commands to a gluster cluster after repeated
+// failures, so that one broken cluster does not hold up the workers serving
+// the other clusters of the provisioner.
+type clusterBreaker struct {
+	mutex     sync.Mutex
+	threshold int
+	backoff   time.Duration
+	clusters  map[string]*clusterState
+}
+
+func newClusterBreaker(threshold int, backoff time.Duration) *clusterBreaker {
+	return &clusterBreaker{
+		threshold: threshold,
+		backoff:   backoff,
+		clusters:  make(map[string]*clusterState),
+	}
+}
+
+// allow returns an error if commands to cluster are currently suspended
+func (b *clusterBreaker) allow(cluster string) error {
+	if b == nil || b.threshold <= 0 {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	state, ok := b.clusters[cluster]
+	if !ok || state.failures < b.threshold {
+		return nil
+	}
+	if remaining := time.Until(state.openUntil); remaining > 0 {
+		return fmt.Errorf("gluster cluster %s is suspended for %v after %d consecutive failures",
+			cluster, remaining.Round(time.Second), state.failures)
+	}
+	return nil
+}
+
+// record updates the failure count of cluster with the result of a command.
+// Only transient errors count as failures: a command that ran and exited
+// non-zero proves that the cluster is reachable.
+func (b *clusterBreaker) record(cluster string, err error) {
+	if b == nil || b.threshold <= 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if gerrors.Kind(err) != "transient" {
+		delete(b.clusters, cluster)
+		return
+	}
+	state, ok := b.clusters[cluster]
+	if !ok {
+		state = &clusterState{}
+		b.clusters[cluster] = state
+	}
+	state.failures++
+	if state.failures >= b.threshold {
+		state.openUntil = time.Now().Add(b.backoff)
+		klog.Errorf("glusterfs: suspending gluster cluster %s for %v after %d consecutive failures",
+			cluster, b.backoff, state.failures)
+	}
+}
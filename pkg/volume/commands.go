@@ -0,0 +1,164 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	gerrors "gluster-simple-provisioner/pkg/errors"
+)
+
+// commandTemplatePrefix prefixes the StorageClass parameters overriding
+// command templates, e.g. `commandTemplate.createVolume`
+const commandTemplatePrefix = "commandtemplate."
+
+// Names of the command templates
+const (
+	commandCreateBrick     = "createBrick"
+	commandCreateVolume    = "createVolume"
+	commandSetVolumeOption = "setVolumeOption"
+	commandStartVolume     = "startVolume"
+	commandStopVolume      = "stopVolume"
+	commandDeleteVolume    = "deleteVolume"
+	commandDeleteBrick     = "deleteBrick"
+	commandBitrot          = "bitrot"
+	commandQuota           = "quota"
+)
+
+// defaultCommandTemplates are the commands run unless a class overrides them
+var defaultCommandTemplates = map[string]string{
+	commandCreateBrick:     "mkdir -p {{quote .Path}} && chown :{{.GID}} {{quote .Path}} && chmod 0771 {{quote .Path}}",
+	commandCreateVolume:    "gluster --mode=script volume create {{quote .VolumeName}}{{range .VolumeTypeArgs}} {{quote .}}{{end}}{{if .Transport}} transport {{quote .Transport}}{{end}}{{range .Bricks}} {{quote .}}{{end}}{{if .Force}} force{{end}}",
+	commandSetVolumeOption: "gluster --mode=script volume set {{quote .VolumeName}} {{quote .Option}} {{quote .Value}}",
+	commandStartVolume:     "gluster --mode=script volume start {{quote .VolumeName}}",
+	commandStopVolume:      "gluster --mode=script volume stop {{quote .VolumeName}} force",
+	commandDeleteVolume:    "gluster --mode=script volume delete {{quote .VolumeName}}",
+	commandDeleteBrick:     "rm -rf {{quote .Path}}",
+	commandBitrot:          "gluster --mode=script volume bitrot {{quote .VolumeName}} {{quote .Option}}{{if .Value}} {{quote .Value}}{{end}}",
+	commandQuota:           "gluster --mode=script volume quota {{quote .VolumeName}} {{quote .Option}}{{if .Path}} {{quote .Path}} {{.Value}}{{end}}",
+}
+
+// CommandData is the data available to command templates. Fields not
+// related to a command are empty.
+type CommandData struct {
+	VolumeName string
+	// VolumeType is the validated volume type, e.g. `replica 3`, and
+	// VolumeTypeArgs are its words, to be quoted one by one
+	VolumeType     string
+	VolumeTypeArgs []string
+	Transport      string
+	Force          bool
+	// Bricks are the bricks of the volume as `host:/path`
+	Bricks []string
+	// Host and Path are the brick of createBrick and deleteBrick
+	Host string
+	Path string
+	GID  int
+	// Option and Value are the option of setVolumeOption; profiles set the
+	// option `group`. For bitrot, Option is `enable`, `scrub-frequency` or
+	// `scrub-throttle`. For quota, Option is `enable` or `limit-usage` of
+	// Path, whose Value is the hard limit followed by the soft limit, e.g.
+	// `1073741824B 80%`.
+	Option string
+	Value  string
+}
+
+var commandTemplateFuncs = template.FuncMap{"quote": shellQuote}
+
+// parseCommandTemplate parses the StorageClass parameter key overriding a
+// command template and returns the name of the template
+func parseCommandTemplate(key string, value string) (string, error) {
+	suffix := strings.TrimPrefix(strings.ToLower(key), commandTemplatePrefix)
+	for name := range defaultCommandTemplates {
+		if strings.ToLower(name) != suffix {
+			continue
+		}
+		_, err := template.New(key).Funcs(commandTemplateFuncs).Option("missingkey=error").Parse(value)
+		if err != nil {
+			return "", fmt.Errorf("%s is invalid: %v", key, err)
+		}
+		return name, nil
+	}
+	return "", fmt.Errorf("%s is invalid: there is no command template %q, templates are %s",
+		key, suffix, strings.Join(sortedKeys(defaultCommandTemplates), ", "))
+}
+
+// command renders the command template name of cfg
+func (config *ProvisionerConfig) command(name string, data CommandData) (string, error) {
+	text, ok := config.CommandTemplates[name]
+	if !ok {
+		text = defaultCommandTemplates[name]
+	}
+	tmpl, err := template.New(name).Funcs(commandTemplateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", gerrors.Configf("command template %s is invalid: %v", name, err)
+	}
+	var cmd strings.Builder
+	if err := tmpl.Execute(&cmd, data); err != nil {
+		return "", gerrors.Configf("command template %s is invalid: %v", name, err)
+	}
+	return cmd.String(), nil
+}
+
+var (
+	// envNameRegexp matches the names of environment variables
+	envNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	// commandPrefixRegexp matches heavyCommandPrefix values, i.e. words of
+	// letters, digits and `._/=-`
+	commandPrefixRegexp = regexp.MustCompile(`^[a-zA-Z0-9 ._/=-]*$`)
+)
+
+// parseCommandEnv parses the commandEnv parameter of comma separated
+// NAME=value pairs
+func parseCommandEnv(param string) (map[string]string, error) {
+	env := make(map[string]string)
+	for _, pair := range strings.Split(param, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || !envNameRegexp.MatchString(kv[0]) {
+			return nil, fmt.Errorf("commandEnv is invalid (format is `NAME=value,NAME2=value2`): %s", pair)
+		}
+		env[kv[0]] = kv[1]
+	}
+	return env, nil
+}
+
+// commandPreamble returns the shell code run before every command on the
+// hosts of cfg: the commandEnv variables, and a gluster function running
+// glusterBinary instead of the gluster found in PATH
+func (config *ProvisionerConfig) commandPreamble() string {
+	var preamble strings.Builder
+	for _, name := range sortedKeys(config.CommandEnv) {
+		fmt.Fprintf(&preamble, "export %s=%s\n", name, shellQuote(config.CommandEnv[name]))
+	}
+	if config.GlusterBinary != "" {
+		fmt.Fprintf(&preamble, "gluster() { %s \"$@\"; }\n", shellQuote(config.GlusterBinary))
+	}
+	return preamble.String()
+}
+
+// heavy prefixes cmd, which loads the brick disks, with heavyCommandPrefix,
+// e.g. `nice -n 19 ionice -c 3`
+func (config *ProvisionerConfig) heavy(cmd string) string {
+	if config.HeavyCommandPrefix == "" {
+		return cmd
+	}
+	return config.HeavyCommandPrefix + " " + cmd
+}
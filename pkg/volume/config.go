@@ -14,92 +14,1071 @@ limitations under the License.
 package volume
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/yaml"
 )
 
 // BrickRootPath is root path of brick for each Gluster Host
 type BrickRootPath struct {
-	Host string
-	Path string
+	Host string `json:"host"`
+	Path string `json:"path"`
+	// Zone is the failure domain of the host, e.g. its rack
+	Zone string `json:"zone,omitempty"`
+	// Pool labels the storage of the root, e.g. `ssd`
+	Pool string `json:"pool,omitempty"`
+	// Weight is the share of bricks placed on the root relative to the
+	// others. 0 means the default of 1.
+	Weight int `json:"weight,omitempty"`
 }
 
 // ProvisionerConfig provisioner config for Provision Volume
 type ProvisionerConfig struct {
-	ForceCreate    bool
-	Namespace      string
-	LabelSelector  string
-	BrickRootPaths []BrickRootPath
-	VolumeName     string
-	VolumeType     string
+	ForceCreate               bool
+	ForceMode                 string
+	ClusterName               string
+	BrickPool                 string
+	Pool                      string
+	Namespace                 string
+	LabelSelector             string
+	BrickRootPaths            []BrickRootPath
+	VolumeName                string
+	PVName                    string
+	VolumeType                string
+	VolumeTemplate            string
+	BrickPathTemplate         string
+	VolumeOptions             map[string]string
+	SelfHeal                  string
+	ScrubOnRelease            bool
+	DeletionProtection        bool
+	Transport                 string
+	Profiles                  []string
+	BlockHostVolume           string
+	BlockHA                   int
+	FSType                    string
+	PVSource                  string
+	NFSServer                 string
+	CSIDriver                 string
+	AccessModes               []v1.PersistentVolumeAccessMode
+	BrickRootCheck            bool
+	BrickFilesystems          []string
+	BrickBackend              string
+	BrickVolumeGroup          string
+	BrickThinPool             string
+	Encryption                string
+	EncryptionSecretNamespace string
+	KeyProvider               string
+	SELinuxType               string
+	SELinuxFcontext           bool
+	PostCreateCommands        []string
+	PreDeleteCommands         []string
+	// CommandTemplates overrides defaultCommandTemplates by name
+	CommandTemplates map[string]string
+	// GlusterBinary, CommandEnv and HeavyCommandPrefix adapt the commands to
+	// the hosts, see commandPreamble and heavy
+	GlusterBinary      string
+	CommandEnv         map[string]string
+	HeavyCommandPrefix string
+	BrickRemoval       string
+	// EndpointPort and EndpointProtocol are the port of the endpoints and
+	// service of volumes, ServiceType the type of the service, if any
+	EndpointPort     int32
+	EndpointProtocol v1.Protocol
+	ServiceType      v1.ServiceType
+	CreateService    bool
+	SharedEndpoints  bool
+	// BackupVolfileServers adds the backup-volfile-servers mount option
+	BackupVolfileServers bool
+	// DataAddresses maps brick hosts, on whose glusterfs pods commands run,
+	// to their storage network addresses used by gluster and clients
+	DataAddresses    map[string]string
+	TrashTTL         time.Duration
+	BackupInterval   time.Duration
+	ProvisionTimeout time.Duration
+	BackupTool       string
+	BackupRepository string
+	BackupSecret     string
+	MinSize          *resource.Quantity
+	MaxSize          *resource.Quantity
+	// BrickCount, if set, is the number of BrickRootPaths a volume gets
+	// bricks on, see selectBrickRoots
+	BrickCount int
+	// Bitrot enables bitrot detection, with scrubs every
+	// BitrotScrubFrequency at BitrotScrubThrottle if set
+	Bitrot               bool
+	BitrotScrubFrequency string
+	BitrotScrubThrottle  string
+	// Quota limits volumes to their capacity with a gluster quota, whose
+	// soft limit is QuotaSoftLimit percent of it
+	Quota          bool
+	QuotaSoftLimit int
+	// ClusterOptions are set on all volumes of the gluster cluster, e.g.
+	// cluster.brick-multiplex
+	ClusterOptions map[string]string
+	// MaintenanceHosts receive no new bricks, see excludeMaintenanceHosts
+	MaintenanceHosts []string
+	// VolumeTypeDefaulted is set if the class sets no volumeType and
+	// VolumeType was chosen for the brick hosts of the volume
+	VolumeTypeDefaulted bool
+	// classBrickRoots are all brick roots of the class, BrickRootPaths only
+	// those chosen for the volume
+	classBrickRoots []BrickRootPath
+	volumeTypeSet   bool
+	// forceNeeded is set if ForceMode auto found force necessary
+	forceNeeded bool
 }
 
 // NewProvisionerConfig create ProvisionerConfig from parameters of StorageClass
 func NewProvisionerConfig(pvName string, params map[string]string) (*ProvisionerConfig, error) {
 	var config ProvisionerConfig
-	var err error
+	params, err := resolveParameterAliases(params)
+	if err != nil {
+		return nil, err
+	}
+	params, err = resolvePoolParameters(params)
+	if err != nil {
+		return nil, err
+	}
 
 	// Set default volume type
 	forceCreate := false
+	forceMode := ""
+	clusterName := ""
+	brickPool := ""
+	pool := ""
 	volumeType := ""
+	volumeTypeSet := false
+	volumeTemplate := ""
+	brickPathTemplate := ""
+	selfHeal := "auto"
+	scrubOnRelease := false
+	deletionProtection := false
+	brickRootCheck := true
+	var brickFilesystems []string
+	brickBackend := brickBackendDirectory
+	brickVolumeGroup := ""
+	brickThinPool := ""
+	encryption := ""
+	encryptionSecretNamespace := ""
+	keyProvider := keyProviderSecret
+	transport := ""
+	selinuxType := ""
+	selinuxFcontext := false
+	var postCreateCommands, preDeleteCommands []string
+	commandTemplates := make(map[string]string)
+	glusterBinary := ""
+	heavyCommandPrefix := ""
+	brickRemoval := brickRemovalInline
+	endpointPort := int32(1)
+	endpointProtocol := v1.ProtocolTCP
+	serviceType := v1.ServiceTypeClusterIP
+	createService := true
+	sharedEndpoints := false
+	backupVolfileServers := true
+	var dataAddresses map[string]string
+	trashTTL := defaultTrashTTL
+	var commandEnv map[string]string
+	var backupInterval, provisionTimeout time.Duration
+	var backupTool, backupRepository, backupSecret string
+	var profiles []string
+	blockHostVolume := ""
+	blockHA := 0
+	fsType := "ext4"
+	pvSource := ""
+	nfsServer := ""
+	csiDriver := defaultCSIDriver
 	namespace := "default"
 	selector := "glusterfs-node==pod"
 	var brickRootPaths []BrickRootPath
+	brickCount := 0
+	var maintenanceHosts []string
+	var minSize, maxSize *resource.Quantity
+	var volumeOptions map[string]string
+	// Options set by first-class parameters, e.g. rootSquash
+	squashOptions := make(map[string]string)
+	var clusterOptions map[string]string
+	bitrot := false
+	var bitrotScrubFrequency, bitrotScrubThrottle string
+	quota := false
+	quotaSoftLimit := 0
+	// Options set unless volumeOptions or a first-class parameter sets them
+	defaultOptions := map[string]string{
+		"nfs.disable": "on",
+		"user.cifs":   "disable",
+	}
+	var accessModes []v1.PersistentVolumeAccessMode
 
 	for k, v := range params {
+		if strings.HasPrefix(strings.ToLower(k), commandTemplatePrefix) {
+			name, err := parseCommandTemplate(k, v)
+			if err != nil {
+				return nil, err
+			}
+			commandTemplates[name] = v
+			continue
+		}
 		switch strings.ToLower(k) {
 		case "brickrootpaths":
 			brickRootPaths, err = parseBrickRootPaths(v)
 			if err != nil {
 				return nil, err
 			}
+		case "brickcount":
+			brickCount, err = strconv.Atoi(strings.TrimSpace(v))
+			if err != nil || brickCount < 0 {
+				return nil, fmt.Errorf("brickCount %q is invalid, it must be a non-negative number", v)
+			}
+		case "maintenancehosts":
+			maintenanceHosts, err = parseMaintenanceHosts(v)
+			if err != nil {
+				return nil, err
+			}
 		case "volumetype":
-			volumeType = strings.TrimSpace(v)
+			volumeType, err = parseVolumeType(v)
+			if err != nil {
+				return nil, err
+			}
+			volumeTypeSet = true
+		case "volumenametemplate":
+			volumeTemplate = strings.TrimSpace(v)
+			if _, err = template.New(k).Parse(volumeTemplate); err != nil {
+				return nil, fmt.Errorf("volumeNameTemplate is invalid: %v", err)
+			}
 		case "namespace":
 			namespace = strings.TrimSpace(v)
 		case "selector":
 			selector = strings.TrimSpace(v)
 		case "forcecreate":
-			v = strings.TrimSpace(v)
-			forceCreate = strings.ToLower(v) == "true"
+			forceMode, err = parseForceCreate(v)
+			if err != nil {
+				return nil, err
+			}
+			forceCreate = forceMode == forceAlways
+		case "cluster":
+			clusterName = strings.TrimSpace(v)
+		case "brickpool":
+			brickPool = strings.TrimSpace(v)
+		case "pool":
+			pool = strings.ToLower(strings.TrimSpace(v))
+		case "brickpathtemplate":
+			brickPathTemplate = strings.TrimSpace(v)
+			if _, err = template.New(k).Parse(brickPathTemplate); err != nil {
+				return nil, fmt.Errorf("brickPathTemplate is invalid: %v", err)
+			}
+		case "selfheal":
+			selfHeal = strings.ToLower(strings.TrimSpace(v))
+			if selfHeal != "auto" && selfHeal != "true" && selfHeal != "false" {
+				return nil, fmt.Errorf("selfHeal is invalid (one of `auto`, `true`, `false`): %s", v)
+			}
+		case "scrubonrelease":
+			scrubOnRelease = strings.ToLower(strings.TrimSpace(v)) == "true"
+		case "brickrootcheck":
+			brickRootCheck = strings.ToLower(strings.TrimSpace(v)) != "false"
+		case "brickfilesystems":
+			brickFilesystems = nil
+			for _, fs := range strings.Split(v, ",") {
+				fs = strings.ToLower(strings.TrimSpace(fs))
+				if fs != "" {
+					brickFilesystems = append(brickFilesystems, fs)
+				}
+			}
+			if len(brickFilesystems) == 0 {
+				return nil, fmt.Errorf("brickFilesystems is invalid: %s", v)
+			}
+		case "brickbackend":
+			brickBackend = strings.ToLower(strings.TrimSpace(v))
+			if brickBackend != brickBackendDirectory && brickBackend != brickBackendZFS && brickBackend != brickBackendLVM && brickBackend != brickBackendLoopback {
+				return nil, fmt.Errorf("brickBackend is invalid (one of `directory`, `zfs`, `lvm`, `loopback`): %s", v)
+			}
+		case "brickvolumegroup":
+			brickVolumeGroup = strings.TrimSpace(v)
+			if err = validateLVMName("brickVolumeGroup", brickVolumeGroup); err != nil {
+				return nil, err
+			}
+		case "brickthinpool":
+			brickThinPool = strings.TrimSpace(v)
+			if err = validateLVMName("brickThinPool", brickThinPool); err != nil {
+				return nil, err
+			}
+		case "encryption":
+			encryption = strings.ToLower(strings.TrimSpace(v))
+			if encryption != "" && encryption != encryptionLUKS {
+				return nil, fmt.Errorf("encryption is invalid (`luks`): %s", v)
+			}
+		case "encryptionsecretnamespace":
+			encryptionSecretNamespace = strings.TrimSpace(v)
+		case "keyprovider":
+			keyProvider = strings.ToLower(strings.TrimSpace(v))
+			if keyProvider != keyProviderSecret && keyProvider != keyProviderVaultKV && keyProvider != keyProviderVaultTransit {
+				return nil, fmt.Errorf("keyProvider is invalid (one of `secret`, `vault-kv`, `vault-transit`): %s", v)
+			}
+		case "deletionprotection":
+			deletionProtection = strings.ToLower(strings.TrimSpace(v)) == "true"
+		case "transport":
+			transport = strings.ToLower(strings.Replace(v, " ", "", -1))
+			if transport != "tcp" && transport != "rdma" && transport != "tcp,rdma" {
+				return nil, fmt.Errorf("transport is invalid (one of `tcp`, `rdma`, `tcp,rdma`): %s", v)
+			}
+		case "brickselinuxtype":
+			selinuxType = strings.TrimSpace(v)
+			if !selinuxTypeRegexp.MatchString(selinuxType) {
+				return nil, fmt.Errorf("brickSELinuxType is invalid: %s", v)
+			}
+		case "brickselinuxfcontext":
+			selinuxFcontext = strings.ToLower(strings.TrimSpace(v)) == "true"
+		case "rootsquash":
+			rootSquash, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("rootSquash is invalid: %s", v)
+			}
+			squashOptions["server.root-squash"] = "off"
+			if rootSquash {
+				squashOptions["server.root-squash"] = "on"
+			}
+		case "anonuid", "anongid":
+			id, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil || id < 0 {
+				return nil, fmt.Errorf("%s is invalid: %s", k, v)
+			}
+			squashOptions["server."+strings.ToLower(k)] = strconv.Itoa(id)
+		case "glusternfs":
+			enable, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("glusterNFS is invalid: %s", v)
+			}
+			delete(defaultOptions, "nfs.disable")
+			squashOptions["nfs.disable"] = "on"
+			if enable {
+				squashOptions["nfs.disable"] = "off"
+			}
+		case "cifs":
+			enable, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("cifs is invalid: %s", v)
+			}
+			delete(defaultOptions, "user.cifs")
+			squashOptions["user.cifs"] = "disable"
+			if enable {
+				squashOptions["user.cifs"] = "enable"
+			}
+		case "bitrot":
+			bitrot, err = strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("bitrot is invalid: %s", v)
+			}
+		case "bitrotscrubfrequency":
+			bitrotScrubFrequency = strings.ToLower(strings.TrimSpace(v))
+			if !containsString(bitrotScrubFrequencies, bitrotScrubFrequency) {
+				return nil, fmt.Errorf("bitrotScrubFrequency is invalid (one of `%s`): %s", strings.Join(bitrotScrubFrequencies, "`, `"), v)
+			}
+		case "bitrotscrubthrottle":
+			bitrotScrubThrottle = strings.ToLower(strings.TrimSpace(v))
+			if !containsString(bitrotScrubThrottles, bitrotScrubThrottle) {
+				return nil, fmt.Errorf("bitrotScrubThrottle is invalid (one of `%s`): %s", strings.Join(bitrotScrubThrottles, "`, `"), v)
+			}
+		case "quota":
+			quota, err = strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("quota is invalid: %s", v)
+			}
+		case "quotasoftlimit":
+			quotaSoftLimit, err = parseQuotaSoftLimit(v)
+			if err != nil {
+				return nil, err
+			}
+		case "brickmultiplex":
+			multiplex, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("brickMultiplex is invalid: %s", v)
+			}
+			if clusterOptions == nil {
+				clusterOptions = make(map[string]string)
+			}
+			clusterOptions["cluster.brick-multiplex"] = "off"
+			if multiplex {
+				clusterOptions["cluster.brick-multiplex"] = "on"
+			}
+		case "maxbricksperprocess":
+			n, err := parseTunable(k, v, 0, maxBricksPerProcess)
+			if err != nil {
+				return nil, err
+			}
+			if clusterOptions == nil {
+				clusterOptions = make(map[string]string)
+			}
+			clusterOptions["cluster.max-bricks-per-process"] = n
+		case "clienteventthreads", "servereventthreads", "iothreadcount":
+			name, limit := tunableOptions[strings.ToLower(k)], maxEventThreads
+			if name == "performance.io-thread-count" {
+				limit = maxIOThreads
+			}
+			n, err := parseTunable(k, v, 1, limit)
+			if err != nil {
+				return nil, err
+			}
+			squashOptions[name] = n
+		case "glusterbinary":
+			glusterBinary = strings.TrimSpace(v)
+			if err = ValidateBrickPath(glusterBinary); err != nil {
+				return nil, fmt.Errorf("glusterBinary is invalid: %q is not a clean absolute path", glusterBinary)
+			}
+		case "commandenv":
+			commandEnv, err = parseCommandEnv(v)
+			if err != nil {
+				return nil, err
+			}
+		case "heavycommandprefix":
+			heavyCommandPrefix = strings.TrimSpace(v)
+			if !commandPrefixRegexp.MatchString(heavyCommandPrefix) {
+				return nil, fmt.Errorf("heavyCommandPrefix is invalid: only words of letters, digits and `._/=-` are allowed")
+			}
+		case "brickremoval":
+			brickRemoval = strings.ToLower(strings.TrimSpace(v))
+			if brickRemoval != brickRemovalInline && brickRemoval != brickRemovalBackground && brickRemoval != brickRemovalTrash {
+				return nil, fmt.Errorf("brickRemoval is invalid (one of `inline`, `background`, `trash`): %s", v)
+			}
+		case "endpointport":
+			port, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil || port < 1 || port > 65535 {
+				return nil, fmt.Errorf("endpointPort is invalid (1-65535): %s", v)
+			}
+			endpointPort = int32(port)
+		case "endpointprotocol":
+			endpointProtocol = v1.Protocol(strings.ToUpper(strings.TrimSpace(v)))
+			if endpointProtocol != v1.ProtocolTCP && endpointProtocol != v1.ProtocolUDP && endpointProtocol != v1.ProtocolSCTP {
+				return nil, fmt.Errorf("endpointProtocol is invalid (one of `TCP`, `UDP`, `SCTP`): %s", v)
+			}
+		case "servicetype":
+			serviceType = v1.ServiceType(strings.TrimSpace(v))
+			if serviceType != v1.ServiceTypeClusterIP && serviceType != v1.ServiceTypeNodePort && serviceType != v1.ServiceTypeLoadBalancer {
+				return nil, fmt.Errorf("serviceType is invalid (one of `ClusterIP`, `NodePort`, `LoadBalancer`): %s", v)
+			}
+		case "createservice":
+			createService = strings.ToLower(strings.TrimSpace(v)) != "false"
+		case "dataaddresses":
+			dataAddresses, err = parseDataAddresses(v)
+			if err != nil {
+				return nil, err
+			}
+		case "backupvolfileservers":
+			backupVolfileServers = strings.ToLower(strings.TrimSpace(v)) != "false"
+		case "sharedendpoints":
+			sharedEndpoints = strings.ToLower(strings.TrimSpace(v)) == "true"
+		case "trashttl":
+			trashTTL, err = time.ParseDuration(strings.TrimSpace(v))
+			if err != nil || trashTTL < time.Minute {
+				return nil, fmt.Errorf("trashTTL is invalid (a duration of at least 1m, e.g. `72h`): %s", v)
+			}
+		case "postcreatecommands":
+			postCreateCommands, err = parseHookCommands("postCreateCommands", v)
+			if err != nil {
+				return nil, err
+			}
+		case "predeletecommands":
+			preDeleteCommands, err = parseHookCommands("preDeleteCommands", v)
+			if err != nil {
+				return nil, err
+			}
+		case "provisiontimeoutseconds":
+			seconds, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil || seconds < 0 {
+				return nil, fmt.Errorf("provisionTimeoutSeconds is invalid: %s", v)
+			}
+			provisionTimeout = time.Duration(seconds) * time.Second
+		case "backupinterval":
+			backupInterval, err = time.ParseDuration(strings.TrimSpace(v))
+			if err != nil || backupInterval < 0 {
+				return nil, fmt.Errorf("backupInterval is invalid: %s", v)
+			}
+		case "backuptool":
+			backupTool = strings.ToLower(strings.TrimSpace(v))
+			if backupTool != backupToolRestic && backupTool != backupToolRclone {
+				return nil, fmt.Errorf("backupTool is invalid: %s, must be %s or %s", v, backupToolRestic, backupToolRclone)
+			}
+		case "backuprepository":
+			backupRepository = strings.TrimSpace(v)
+		case "backupsecret":
+			backupSecret = strings.TrimSpace(v)
+		case "profiles":
+			for _, profile := range strings.Split(v, ",") {
+				profile = strings.TrimSpace(profile)
+				if profile == "" {
+					continue
+				}
+				if !volumeNameRegexp.MatchString(profile) {
+					return nil, fmt.Errorf("profiles is invalid: %q is not a gluster option group", profile)
+				}
+				profiles = append(profiles, profile)
+			}
+		case "blockhostvolume":
+			blockHostVolume = strings.TrimSpace(v)
+			if !volumeNameRegexp.MatchString(blockHostVolume) {
+				return nil, fmt.Errorf("blockHostVolume is invalid: %s", v)
+			}
+		case "blockha":
+			blockHA, err = strconv.Atoi(strings.TrimSpace(v))
+			if err != nil || blockHA < 1 {
+				return nil, fmt.Errorf("blockHA is invalid (a positive number): %s", v)
+			}
+		case "fstype":
+			fsType = strings.TrimSpace(v)
+		case "pvsource":
+			pvSource = strings.ToLower(strings.TrimSpace(v))
+			if pvSource != pvSourceGlusterfs && pvSource != pvSourceCSI && pvSource != pvSourceNFS {
+				return nil, fmt.Errorf("pvSource is invalid (one of `glusterfs`, `csi`, `nfs`): %s", v)
+			}
+		case "nfsserver":
+			nfsServer = strings.TrimSpace(v)
+		case "csidriver":
+			csiDriver = strings.TrimSpace(v)
+		case "accessmodes":
+			accessModes, err = parseAccessModes(v)
+			if err != nil {
+				return nil, err
+			}
+		case "volumeoptions":
+			volumeOptions, err = parseVolumeOptions(v)
+			if err != nil {
+				return nil, err
+			}
+		case "minsize":
+			minSize, err = parseSize(k, v)
+			if err != nil {
+				return nil, err
+			}
+		case "maxsize":
+			maxSize, err = parseSize(k, v)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
 	config.BrickRootPaths = brickRootPaths
+	config.BrickCount = brickCount
+	config.MaintenanceHosts = maintenanceHosts
+	config.ClusterOptions = clusterOptions
+	config.Bitrot = bitrot
+	config.BitrotScrubFrequency = bitrotScrubFrequency
+	config.BitrotScrubThrottle = bitrotScrubThrottle
+	config.Quota = quota
+	config.QuotaSoftLimit = quotaSoftLimit
+	if quota && quotaSoftLimit == 0 {
+		config.QuotaSoftLimit = defaultQuotaSoftLimit
+	}
+	config.classBrickRoots = brickRootPaths
 	config.VolumeName = pvName
+	config.PVName = pvName
+	config.BrickPathTemplate = brickPathTemplate
 	config.VolumeType = volumeType
+	config.volumeTypeSet = volumeTypeSet
+	config.VolumeTemplate = volumeTemplate
 	config.Namespace = namespace
 	config.LabelSelector = selector
 	config.ForceCreate = forceCreate
+	config.ForceMode = forceMode
+	config.ClusterName = clusterName
+	config.BrickPool = brickPool
+	config.Pool = pool
+	for name, value := range squashOptions {
+		if set, ok := volumeOptions[name]; ok && set != value {
+			return nil, fmt.Errorf("volumeOptions sets %s to %s, which conflicts with %s", name, set, value)
+		}
+		if volumeOptions == nil {
+			volumeOptions = make(map[string]string)
+		}
+		volumeOptions[name] = value
+	}
+	for name, value := range defaultOptions {
+		if _, ok := volumeOptions[name]; ok {
+			continue
+		}
+		if volumeOptions == nil {
+			volumeOptions = make(map[string]string)
+		}
+		volumeOptions[name] = value
+	}
+	config.VolumeOptions = volumeOptions
+	config.SelfHeal = selfHeal
+	config.ScrubOnRelease = scrubOnRelease
+	config.DeletionProtection = deletionProtection
+	config.Transport = transport
+	config.SELinuxType = selinuxType
+	config.SELinuxFcontext = selinuxFcontext
+	config.PostCreateCommands = postCreateCommands
+	config.CommandTemplates = commandTemplates
+	config.GlusterBinary = glusterBinary
+	config.CommandEnv = commandEnv
+	config.HeavyCommandPrefix = heavyCommandPrefix
+	config.BrickRemoval = brickRemoval
+	config.TrashTTL = trashTTL
+	config.EndpointPort = endpointPort
+	config.EndpointProtocol = endpointProtocol
+	config.ServiceType = serviceType
+	config.CreateService = createService
+	config.SharedEndpoints = sharedEndpoints
+	config.BackupVolfileServers = backupVolfileServers
+	config.DataAddresses = dataAddresses
+	config.PreDeleteCommands = preDeleteCommands
+	if backupTool == "" {
+		backupTool = backupToolRestic
+	}
+	config.BackupInterval = backupInterval
+	config.ProvisionTimeout = provisionTimeout
+	config.BackupTool = backupTool
+	config.BackupRepository = backupRepository
+	config.BackupSecret = backupSecret
+	config.Profiles = profiles
+	config.BlockHostVolume = blockHostVolume
+	config.BlockHA = blockHA
+	config.FSType = fsType
+	if pvSource == "" {
+		pvSource = pvSourceGlusterfs
+	}
+	config.PVSource = pvSource
+	config.NFSServer = nfsServer
+	config.CSIDriver = csiDriver
+	config.AccessModes = accessModes
+	config.BrickRootCheck = brickRootCheck
+	if brickFilesystems == nil {
+		brickFilesystems = strings.Split(defaultBrickFilesystems, ",")
+		if brickBackend == brickBackendZFS {
+			brickFilesystems = []string{"zfs"}
+		}
+	}
+	config.BrickFilesystems = brickFilesystems
+	config.BrickBackend = brickBackend
+	config.BrickVolumeGroup = brickVolumeGroup
+	config.BrickThinPool = brickThinPool
+	config.Encryption = encryption
+	config.EncryptionSecretNamespace = encryptionSecretNamespace
+	config.KeyProvider = keyProvider
+	if encryptionSecretNamespace == "" {
+		config.EncryptionSecretNamespace = namespace
+	}
+	if brickBackend == brickBackendLoopback || brickBackend == brickBackendLVM {
+		// Images and logical volumes may live on any filesystem and bricks
+		// are their mountpoints, which gluster only accepts with force
+		if forceMode == forceNever {
+			return nil, fmt.Errorf("brickBackend %s needs force, which forceCreate never prohibits", brickBackend)
+		}
+		config.BrickRootCheck = false
+		config.ForceCreate = true
+	}
+	config.MinSize = minSize
+	config.MaxSize = maxSize
 
 	err = config.validate()
 	if err != nil {
 		return nil, err
 	}
+	// Class configs keep all roots, volumes get the subset chosen for them
+	if pvName != "" {
+		if err := config.placeVolume(); err != nil {
+			return nil, err
+		}
+	}
 
 	return &config, nil
 }
 
+// newProvisionerConfig create ProvisionerConfig from parameters of StorageClass,
+// resolving the named pool, the BrickPool and GlusterCluster referenced by the `brickPool`
+// and `cluster` parameters and the defaults of the defaults ConfigMap
+func (p *glusterfsProvisioner) newProvisionerConfig(ctx context.Context, pvName string, params map[string]string) (*ProvisionerConfig, error) {
+	// Aliases are resolved first so that the class overrides the
+	// canonical parameters of pools, clusters and defaults
+	params, err := resolveParameterAliases(params)
+	if err != nil {
+		return nil, err
+	}
+	// A named pool may select the BrickPool
+	params, err = resolvePoolParameters(params)
+	if err != nil {
+		return nil, err
+	}
+	params, err = p.resolveBrickPoolParameters(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	params, err = p.resolveClusterParameters(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	return NewProvisionerConfig(pvName, p.resolveDefaultParameters(params))
+}
+
+// ParseBrickRootPaths parses brick roots in the `host:/path,host2:/path2`
+// format of the brickrootPaths parameter, or as a YAML or JSON list of
+// BrickRootPath
+func ParseBrickRootPaths(param string) ([]BrickRootPath, error) {
+	return parseBrickRootPaths(param)
+}
+
 func parseBrickRootPaths(param string) ([]BrickRootPath, error) {
-	pairs := strings.Split(param, ",")
-	brickRootPaths := make([]BrickRootPath, len(pairs))
-	for i, path := range pairs {
-		path = strings.TrimSpace(path)
-		rawBrickPath := strings.Split(path, ":")
-		if len(rawBrickPath) < 2 {
-			return nil, fmt.Errorf("BrickRootPath is invalid (format is `host:/path/to/root,host2:/path/to/root2`): %s", param)
+	var brickRootPaths []BrickRootPath
+	trimmed := strings.TrimSpace(param)
+	if strings.HasPrefix(trimmed, "[") || strings.HasPrefix(trimmed, "-") {
+		err := yaml.UnmarshalStrict([]byte(trimmed), &brickRootPaths)
+		if err != nil {
+			return nil, fmt.Errorf("brickRootPaths is invalid YAML or JSON: %v", err)
+		}
+	} else {
+		for i, pair := range strings.Split(param, ",") {
+			pair = strings.TrimSpace(pair)
+			// IPv6 hosts contain colons, paths do not
+			sep := strings.Index(pair, ":/")
+			if sep <= 0 {
+				return nil, fmt.Errorf("brickRootPaths[%d] %q is invalid (format is `host:/path/to/root,host2:/path/to/root2`)", i, pair)
+			}
+			brickRootPaths = append(brickRootPaths, BrickRootPath{Host: pair[:sep], Path: pair[sep+1:]})
 		}
-		brickRootPaths[i].Host = rawBrickPath[0]
-		brickRootPaths[i].Path = rawBrickPath[1]
+	}
+	if len(brickRootPaths) == 0 {
+		return nil, fmt.Errorf("brickRootPaths is empty")
 	}
 
+	seen := make(map[string]bool)
+	for i := range brickRootPaths {
+		root := &brickRootPaths[i]
+		root.Host = strings.TrimSpace(root.Host)
+		root.Path = strings.TrimSpace(root.Path)
+		if root.Host == "" || root.Path == "" {
+			return nil, fmt.Errorf("brickRootPaths[%d] is invalid: host and path are required", i)
+		}
+		if root.Weight < 0 {
+			return nil, fmt.Errorf("brickRootPaths[%d] is invalid: weight %d is negative", i, root.Weight)
+		}
+		key := root.Host + ":" + root.Path
+		if seen[key] {
+			return nil, fmt.Errorf("brickRootPaths[%d] is invalid: %s is listed twice", i, key)
+		}
+		seen[key] = true
+	}
 	return brickRootPaths, nil
 }
 
+// formatBrickRootPaths formats roots for the brickrootPaths parameter, in
+// the legacy format unless they have attributes
+func formatBrickRootPaths(roots []BrickRootPath) string {
+	paths := make([]string, len(roots))
+	for i, root := range roots {
+		if root.Zone != "" || root.Pool != "" || root.Weight != 0 {
+			data, _ := json.Marshal(roots)
+			return string(data)
+		}
+		paths[i] = root.Host + ":" + root.Path
+	}
+	return strings.Join(paths, ",")
+}
+
+// parseDataAddresses parses the dataAddresses parameter of comma separated
+// host=address pairs
+func parseDataAddresses(param string) (map[string]string, error) {
+	addresses := make(map[string]string)
+	for _, pair := range strings.Split(param, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("dataAddresses is invalid (format is `host=address,host2=address2`): %s", pair)
+		}
+		host, address := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		for _, h := range []string{host, address} {
+			if err := ValidateHost(h); err != nil {
+				return nil, fmt.Errorf("dataAddresses is invalid: %v", err)
+			}
+		}
+		addresses[host] = address
+	}
+	return addresses, nil
+}
+
+const (
+	// maxEventThreads and maxIOThreads are the largest thread counts gluster accepts
+	maxEventThreads = 32
+	maxIOThreads    = 64
+	// maxBricksPerProcess bounds cluster.max-bricks-per-process, 0 is unlimited
+	maxBricksPerProcess = 1024
+)
+
+var (
+	// bitrotScrubFrequencies and bitrotScrubThrottles are the values gluster
+	// accepts for the bitrot scrubber
+	bitrotScrubFrequencies = []string{"hourly", "daily", "weekly", "biweekly", "monthly"}
+	bitrotScrubThrottles   = []string{"lazy", "normal", "aggressive"}
+)
+
+// tunableOptions maps thread count parameters to their volume options
+var tunableOptions = map[string]string{
+	"clienteventthreads": "client.event-threads",
+	"servereventthreads": "server.event-threads",
+	"iothreadcount":      "performance.io-thread-count",
+}
+
+// parseTunable parses the number of the tunable parameter name, which must
+// be between min and max
+func parseTunable(name string, param string, min int, max int) (string, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(param))
+	if err != nil || n < min || n > max {
+		return "", fmt.Errorf("%s is invalid, it must be a number from %d to %d: %s", name, min, max, param)
+	}
+	return strconv.Itoa(n), nil
+}
+
+// parseMaintenanceHosts parses the `host,host2` list of the maintenanceHosts
+// parameter
+func parseMaintenanceHosts(param string) ([]string, error) {
+	var hosts []string
+	for _, host := range strings.Split(param, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if err := ValidateHost(host); err != nil {
+			return nil, fmt.Errorf("maintenanceHosts is invalid: %v", err)
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// allBrickRoots returns all brick roots of the class of config, also those
+// not chosen for its volume
+func (config *ProvisionerConfig) allBrickRoots() []BrickRootPath {
+	if config.classBrickRoots != nil {
+		return config.classBrickRoots
+	}
+	return config.BrickRootPaths
+}
+
+// volumeNameRegexp matches the names gluster accepts for volumes
+var volumeNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// VolumeNameData is the data available to the volumeNameTemplate parameter
+type VolumeNameData struct {
+	PVName       string
+	PVCName      string
+	PVCNamespace string
+	StorageClass string
+}
+
+// renderVolumeName sets VolumeName from the volumeNameTemplate parameter
+func (config *ProvisionerConfig) renderVolumeName(data VolumeNameData) error {
+	if config.VolumeTemplate == "" {
+		return nil
+	}
+	tmpl, err := template.New("volumeNameTemplate").Option("missingkey=error").Parse(config.VolumeTemplate)
+	if err != nil {
+		return fmt.Errorf("volumeNameTemplate is invalid: %v", err)
+	}
+	var name strings.Builder
+	err = tmpl.Execute(&name, data)
+	if err != nil {
+		return fmt.Errorf("volumeNameTemplate is invalid: %v", err)
+	}
+	if err := ValidateVolumeName(name.String()); err != nil {
+		return fmt.Errorf("volumeNameTemplate is invalid: %v", err)
+	}
+	config.VolumeName = name.String()
+	return nil
+}
+
+// parseVolumeType parses the volumeType parameter, which is in the gluster
+// argument format of parseVolumeTypeArgs, or in the `replicate:3`,
+// `disperse:4:2` or `none` format of kubernetes.io/glusterfs classes
+func parseVolumeType(param string) (string, error) {
+	volumeType := strings.TrimSpace(param)
+	fields := strings.Split(volumeType, ":")
+	switch {
+	case strings.ToLower(volumeType) == "none":
+		return "", nil
+	case len(fields) == 1:
+		t, err := parseVolumeTypeArgs(volumeType)
+		if err != nil {
+			return "", fmt.Errorf("volumeType %q is invalid: %v", param, err)
+		}
+		return t.String(), nil
+	case len(fields) == 2 && strings.ToLower(fields[0]) == "replicate":
+		if n, err := strconv.Atoi(fields[1]); err != nil || n < 1 {
+			return "", fmt.Errorf("volumeType %q is invalid, the replica count must be a positive number", param)
+		}
+		if fields[1] == "1" {
+			return "", nil
+		}
+		return "replica " + fields[1], nil
+	case len(fields) == 3 && strings.ToLower(fields[0]) == "disperse":
+		data, err1 := strconv.Atoi(fields[1])
+		redundancy, err2 := strconv.Atoi(fields[2])
+		if err1 != nil || err2 != nil || data < 1 || redundancy < 1 {
+			return "", fmt.Errorf("volumeType %q is invalid, the data and redundancy counts must be positive numbers", param)
+		}
+		return fmt.Sprintf("disperse-data %d redundancy %d", data, redundancy), nil
+	}
+	return "", fmt.Errorf("volumeType %q is invalid (formats are `replica N [arbiter 1]`, `disperse N [redundancy M]`, `distribute`, or `replicate:3`, `disperse:4:2` and `none`)", param)
+}
+
+// parseVolumeOptions parses the `key=value,key2=value2` list of the
+// volumeOptions parameter, or the `key value, key2 value2` list of
+// kubernetes.io/glusterfs classes
+func parseVolumeOptions(param string) (map[string]string, error) {
+	options := make(map[string]string)
+	for _, option := range strings.Split(param, ",") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) == 1 {
+			kv = strings.Fields(option)
+		}
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("volumeOptions is invalid (format is `key=value,key2=value2`): %s", param)
+		}
+		name := strings.TrimSpace(kv[0])
+		if err := ValidateVolumeOption(name); err != nil {
+			return nil, fmt.Errorf("volumeOptions is invalid: %v", err)
+		}
+		options[name] = strings.TrimSpace(kv[1])
+	}
+	return options, nil
+}
+
+func parseSize(name string, param string) (*resource.Quantity, error) {
+	size, err := resource.ParseQuantity(strings.TrimSpace(param))
+	if err != nil {
+		return nil, fmt.Errorf("%s is invalid: %s: %v", name, param, err)
+	}
+	return &size, nil
+}
+
 func (config *ProvisionerConfig) validate() error {
 	if len(config.BrickRootPaths) == 0 {
 		return fmt.Errorf("brickRootPaths are not specified")
 	}
+	for _, root := range config.BrickRootPaths {
+		if err := validateBricks([]glusterBrick{{Host: root.Host, Path: root.Path}}); err != nil {
+			return fmt.Errorf("brickRootPaths is invalid: %v", err)
+		}
+	}
+	if config.BrickCount > len(config.BrickRootPaths) {
+		return fmt.Errorf("brickCount %d is larger than the number of brick roots %d", config.BrickCount, len(config.BrickRootPaths))
+	}
+	if _, err := parseVolumeTypeArgs(config.VolumeType); err != nil {
+		return fmt.Errorf("volumeType is invalid: %v", err)
+	}
+	if replicas := replicaCount(config.VolumeType); config.BrickCount%replicas != 0 {
+		return fmt.Errorf("brickCount %d is not a multiple of the replica count %d", config.BrickCount, replicas)
+	}
+	if config.BrickCount == 0 {
+		if err := validateReplicaSets(config.BrickRootPaths, config.VolumeType, config.mayForce()); err != nil {
+			return err
+		}
+	} else if hosts := brickRootHosts(config.BrickRootPaths); replicaCount(config.VolumeType) > len(hosts) && !config.mayForce() {
+		return fmt.Errorf("volumeType %s needs %d brick hosts, got %d", config.VolumeType, replicaCount(config.VolumeType), len(hosts))
+	}
+	// Class configs are parsed without a volume name
+	if config.VolumeName != "" {
+		if err := ValidateVolumeName(config.VolumeName); err != nil {
+			return err
+		}
+	}
+	if config.MinSize != nil && config.MaxSize != nil && config.MinSize.Cmp(*config.MaxSize) > 0 {
+		return fmt.Errorf("minSize %s is larger than maxSize %s", config.MinSize.String(), config.MaxSize.String())
+	}
+	if config.BlockHostVolume != "" && config.PVSource != pvSourceGlusterfs {
+		return fmt.Errorf("pvSource %s cannot be used with blockHostVolume, which provisions iSCSI volumes", config.PVSource)
+	}
+	if config.BlockHA > len(config.BrickRootPaths) {
+		return fmt.Errorf("blockHA %d is larger than the number of brick hosts %d", config.BlockHA, len(config.BrickRootPaths))
+	}
+	if !config.Bitrot && (config.BitrotScrubFrequency != "" || config.BitrotScrubThrottle != "") {
+		return fmt.Errorf("bitrotScrubFrequency and bitrotScrubThrottle need bitrot")
+	}
+	if !config.Quota && config.QuotaSoftLimit != 0 {
+		return fmt.Errorf("quotaSoftLimit needs quota")
+	}
+	if config.Quota && config.BlockHostVolume != "" {
+		return fmt.Errorf("quota cannot be used with blockHostVolume, whose block volumes are files of a shared gluster volume")
+	}
+	if config.SELinuxFcontext && config.SELinuxType == "" {
+		return fmt.Errorf("brickSELinuxFcontext needs brickSELinuxType")
+	}
+	if config.BrickBackend == brickBackendLVM && config.BrickVolumeGroup == "" {
+		return fmt.Errorf("brickBackend lvm needs brickVolumeGroup")
+	}
+	if config.BrickBackend != brickBackendLVM && (config.BrickVolumeGroup != "" || config.BrickThinPool != "") {
+		return fmt.Errorf("brickVolumeGroup and brickThinPool need brickBackend lvm")
+	}
+	if config.Encryption != "" && config.BrickBackend != brickBackendLVM && config.BrickBackend != brickBackendLoopback {
+		return fmt.Errorf("encryption needs bricks on block devices, which the lvm and loopback brick backends provide")
+	}
+	if config.BackupInterval > 0 && config.BackupRepository == "" {
+		return fmt.Errorf("backupInterval needs backupRepository")
+	}
+	if config.BackupInterval > 0 && config.BlockHostVolume != "" {
+		return fmt.Errorf("backupInterval cannot be used with blockHostVolume")
+	}
+	supported := config.supportedAccessModes()
+	for _, mode := range config.AccessModes {
+		if !containsAccessMode(supported, mode) {
+			return fmt.Errorf("accessModes is invalid: %s is not supported by the PV source, supported modes are %s",
+				mode, formatAccessModes(supported))
+		}
+	}
 
 	return nil
 }
+
+// validateSize rejects sizes outside of the minSize/maxSize of the class
+func (config *ProvisionerConfig) validateSize(size resource.Quantity) error {
+	if config.MinSize != nil && size.Cmp(*config.MinSize) < 0 {
+		return fmt.Errorf("requested size %s is smaller than minSize %s of the storage class", size.String(), config.MinSize.String())
+	}
+	if config.MaxSize != nil && size.Cmp(*config.MaxSize) > 0 {
+		return fmt.Errorf("requested size %s is larger than maxSize %s of the storage class", size.String(), config.MaxSize.String())
+	}
+	return nil
+}
+
+// mountOptions returns the mount options of PVs: those of the class, plus
+// the transport of rdma only volumes, which FUSE clients cannot reach over tcp,
+// and the brick hosts as backup volfile servers
+func (config *ProvisionerConfig) mountOptions(classOptions []string, bricks []glusterBrick) []string {
+	options := append([]string(nil), classOptions...)
+	if config.PVSource == pvSourceNFS {
+		return options
+	}
+	if config.Transport == "rdma" {
+		options = append(options, "transport=rdma")
+	}
+	if hosts := config.dataHosts(bricks); config.BackupVolfileServers && len(hosts) > 1 && !hasMountOption(options, "backup-volfile-servers") {
+		// The client fetches the volfile from any of them if the host it
+		// mounts from is down
+		options = append(options, "backup-volfile-servers="+strings.Join(hosts, ":"))
+	}
+	return options
+}
+
+// hasMountOption reports whether options set the option name
+func hasMountOption(options []string, name string) bool {
+	for _, option := range options {
+		for _, o := range strings.Split(option, ",") {
+			if strings.TrimSpace(strings.SplitN(o, "=", 2)[0]) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
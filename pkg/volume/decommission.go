@@ -0,0 +1,308 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v8/gidallocator"
+)
+
+// removeBrickStatusXML is the output of `gluster volume remove-brick <volume> <brick> status --xml`
+type removeBrickStatusXML struct {
+	XMLName   xml.Name `xml:"cliOutput"`
+	OpRet     int      `xml:"opRet"`
+	OpErrstr  string   `xml:"opErrstr"`
+	StatusStr string   `xml:"volRemoveBrick>aggregate>statusStr"`
+}
+
+// DecommissionOptions describe a brick host to drain
+type DecommissionOptions struct {
+	// Host whose bricks are moved away
+	Host string
+	// Target receives the moved bricks
+	Target BrickRootPath
+	// DryRun only reports the bricks that would be moved
+	DryRun bool
+	// MigrationTimeout bounds the data migration of distribute volumes
+	MigrationTimeout time.Duration
+}
+
+// MovedBrick is a brick moved by Decommission
+type MovedBrick struct {
+	PV   string
+	From string
+	To   string
+}
+
+// Decommission moves every brick of the provisioned volumes on a host to
+// another brick root
+func Decommission(ctx context.Context, config *rest.Config, client kubernetes.Interface, options DecommissionOptions) ([]MovedBrick, error) {
+	p := newGlusterfsProvisionerInternal(config, client, Options{})
+	return p.decommission(ctx, options)
+}
+
+func (p *glusterfsProvisioner) decommission(ctx context.Context, options DecommissionOptions) ([]MovedBrick, error) {
+	if options.Host == options.Target.Host {
+		return nil, fmt.Errorf("target host must differ from the decommissioned host %s", options.Host)
+	}
+	volumes, err := p.listProvisionedVolumes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var moved []MovedBrick
+	for i := range volumes {
+		pv := &volumes[i]
+		_, bricks, err := p.configForVolume(ctx, pv)
+		if err != nil {
+			return moved, fmt.Errorf("PV %s: %v", pv.Name, err)
+		}
+		for _, b := range bricks {
+			if b.Host != options.Host {
+				continue
+			}
+			if options.DryRun {
+				moved = append(moved, MovedBrick{PV: pv.Name, From: b.Host + ":" + b.Path, To: options.Target.Host + ":" + options.Target.Path})
+				continue
+			}
+			to, err := p.moveBrick(ctx, pv.Name, b, options.Target, options.MigrationTimeout)
+			if to != nil {
+				moved = append(moved, MovedBrick{PV: pv.Name, From: b.Host + ":" + b.Path, To: to.Host + ":" + to.Path})
+			}
+			if err != nil {
+				return moved, fmt.Errorf("PV %s: failed to move brick %s:%s: %v", pv.Name, b.Host, b.Path, err)
+			}
+		}
+	}
+	return moved, nil
+}
+
+// moveBrick replaces brick of the gluster volume of the PV named pvName with
+// a new brick under target. Replicated volumes use replace-brick and heal
+// the new brick from its replicas; distribute volumes migrate the data of
+// the brick with remove-brick. Once gluster accepted the new brick it is
+// recorded on the PV and never deleted, even if healing or migrating to it
+// fails; the new brick is returned with that error.
+func (p *glusterfsProvisioner) moveBrick(ctx context.Context, pvName string, brick glusterBrick, target BrickRootPath, timeout time.Duration) (*glusterBrick, error) {
+	pv, err := p.client.CoreV1().PersistentVolumes().Get(ctx, pvName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	cfg, bricks, err := p.configForVolume(ctx, pv)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.Atoi(pv.Annotations[gidallocator.VolumeGidAnnotationKey])
+	if err != nil {
+		return nil, fmt.Errorf("volume %s has no valid GID annotation: %v", pv.Name, err)
+	}
+
+	// Run gluster commands on a host that stays in the volume
+	host := target.Host
+	newCfg := *cfg
+	newCfg.BrickRootPaths = []BrickRootPath{target}
+	capacity := pv.Spec.Capacity[v1.ResourceStorage]
+	claim := pv.Spec.ClaimRef
+	created, err := p.createBricks(ctx, claim.Namespace, claim.Name, &newCfg, gid, capacity.Value())
+	if err != nil {
+		p.deleteBricks(ctx, created, cfg)
+		return nil, err
+	}
+	newBrick := created[0]
+	oldName := cfg.glusterBrickName(brick)
+	newName := cfg.glusterBrickName(newBrick)
+
+	replicated := replicaCount(cfg.VolumeType) > 1 || cfg.needsSelfHeal()
+	var accepted, removed bool
+	if replicated {
+		err = p.ExecuteCommands(ctx, host, []string{
+			fmt.Sprintf("gluster --mode=script volume replace-brick %s %s %s commit force", shellQuote(cfg.VolumeName), shellQuote(oldName), shellQuote(newName)),
+		}, cfg)
+		accepted, removed = err == nil, err == nil
+	} else {
+		accepted, err = p.migrateBrick(ctx, host, oldName, newName, cfg, timeout)
+		removed = err == nil
+	}
+	if !accepted {
+		p.deleteBricks(ctx, created, cfg)
+		return nil, err
+	}
+	moveErr := err
+
+	// Until remove-brick is committed the volume has both bricks
+	var updated []glusterBrick
+	for _, b := range bricks {
+		if b == brick && removed {
+			b = newBrick
+		}
+		updated = append(updated, b)
+	}
+	if !removed {
+		updated = append(updated, newBrick)
+	}
+	err = p.recordBricks(ctx, pv.Name, updated)
+	if err != nil {
+		klog.Errorf("glusterfs: brick %s was added to volume %s but not recorded on PV %s: %v",
+			newName, cfg.VolumeName, pv.Name, err)
+		return &newBrick, err
+	}
+	if moveErr != nil {
+		p.recorder.Event(pv, v1.EventTypeWarning, "BrickMoveFailed",
+			fmt.Sprintf("brick %s was added but the data of %s was not migrated to it: %v", newName, oldName, moveErr))
+		return &newBrick, moveErr
+	}
+	p.recorder.Event(pv, v1.EventTypeNormal, "BrickMoved", fmt.Sprintf("brick %s was replaced by %s", oldName, newName))
+
+	// The old host may be gone, its brick is removed on a best effort basis
+	if err := p.deleteBricks(ctx, []glusterBrick{brick}, cfg); err != nil {
+		klog.Errorf("glusterfs: failed to remove old brick %s: %v", oldName, err)
+	}
+	if replicated {
+		err = p.ExecuteCommands(ctx, host, []string{
+			fmt.Sprintf("gluster --mode=script volume heal %s full", shellQuote(cfg.VolumeName)),
+		}, cfg)
+		if err != nil {
+			return &newBrick, fmt.Errorf("brick %s was replaced by %s but healing it failed: %v", oldName, newName, err)
+		}
+	}
+	return &newBrick, nil
+}
+
+// migrateBrick moves the data of brick oldName of a distribute volume to
+// the new brick newName with add-brick and remove-brick. added reports
+// whether newName became part of the volume, even if the migration failed.
+func (p *glusterfsProvisioner) migrateBrick(ctx context.Context, host string, oldName string, newName string, cfg *ProvisionerConfig, timeout time.Duration) (added bool, err error) {
+	add := fmt.Sprintf("gluster --mode=script volume add-brick %s %s", shellQuote(cfg.VolumeName), shellQuote(newName))
+	if cfg.ForceCreate {
+		add += " force"
+	}
+	err = p.ExecuteCommands(ctx, host, []string{add}, cfg)
+	if err != nil {
+		return false, err
+	}
+	err = p.ExecuteCommands(ctx, host, []string{
+		fmt.Sprintf("gluster --mode=script volume remove-brick %s %s start", shellQuote(cfg.VolumeName), shellQuote(oldName)),
+	}, cfg)
+	if err != nil {
+		return true, err
+	}
+
+	err = wait.PollImmediate(rebalancePollInterval, timeout, func() (bool, error) {
+		out, err := p.executeCommandOnHost(ctx, host,
+			fmt.Sprintf("gluster --mode=script volume remove-brick %s %s status --xml", shellQuote(cfg.VolumeName), shellQuote(oldName)), cfg)
+		if err != nil {
+			return false, nil
+		}
+		var status removeBrickStatusXML
+		if err := xml.Unmarshal([]byte(out), &status); err != nil {
+			return false, nil
+		}
+		switch status.StatusStr {
+		case "completed":
+			return true, nil
+		case "failed", "stopped":
+			return false, fmt.Errorf("migration of brick %s %s", oldName, status.StatusStr)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return true, fmt.Errorf("migration of brick %s did not complete: %v", oldName, err)
+	}
+	return true, p.ExecuteCommands(ctx, host, []string{
+		fmt.Sprintf("gluster --mode=script volume remove-brick %s %s commit", shellQuote(cfg.VolumeName), shellQuote(oldName)),
+	}, cfg)
+}
+
+// recordBricks stores bricks in the annBricks annotation of the PV named pvName
+func (p *glusterfsProvisioner) recordBricks(ctx context.Context, pvName string, bricks []glusterBrick) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pv, err := p.client.CoreV1().PersistentVolumes().Get(ctx, pvName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if pv.Annotations == nil {
+			pv.Annotations = make(map[string]string)
+		}
+		pv.Annotations[annBricks] = formatBricks(bricks)
+		_, err = p.client.CoreV1().PersistentVolumes().Update(ctx, pv, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// ReplaceBrickOptions describe a failed brick to replace
+type ReplaceBrickOptions struct {
+	// PV whose gluster volume holds the failed brick
+	PV string
+	// Brick is the failed brick in `host:/path` format
+	Brick string
+	// Target receives the new brick, on the same or another host
+	Target BrickRootPath
+	// HealTimeout is how long to wait for the new brick to be healed.
+	// 0 does not wait.
+	HealTimeout time.Duration
+}
+
+// ReplaceBrick replaces a failed brick of the gluster volume of a PV with a
+// new brick and heals it from the remaining replicas
+func ReplaceBrick(ctx context.Context, config *rest.Config, client kubernetes.Interface, options ReplaceBrickOptions) (string, error) {
+	p := newGlusterfsProvisionerInternal(config, client, Options{})
+	return p.replaceBrick(ctx, options)
+}
+
+func (p *glusterfsProvisioner) replaceBrick(ctx context.Context, options ReplaceBrickOptions) (string, error) {
+	pv, err := p.client.CoreV1().PersistentVolumes().Get(ctx, options.PV, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	cfg, bricks, err := p.configForVolume(ctx, pv)
+	if err != nil {
+		return "", err
+	}
+	if replicaCount(cfg.VolumeType) < 2 && !cfg.needsSelfHeal() {
+		return "", fmt.Errorf("volume %s has no replicas to heal a replaced brick from", cfg.VolumeName)
+	}
+	var failed *glusterBrick
+	for i, b := range bricks {
+		if b.Host+":"+b.Path == options.Brick {
+			failed = &bricks[i]
+		}
+	}
+	if failed == nil {
+		return "", fmt.Errorf("brick %s is not a brick of volume %s", options.Brick, cfg.VolumeName)
+	}
+
+	newBrick, err := p.moveBrick(ctx, pv.Name, *failed, options.Target, 0)
+	if newBrick == nil {
+		return "", err
+	}
+	name := newBrick.Host + ":" + newBrick.Path
+	if err != nil {
+		return name, err
+	}
+	if options.HealTimeout > 0 {
+		err = p.waitForHeal(ctx, newBrick.Host, cfg, options.HealTimeout)
+	}
+	return name, err
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// defaultsResync is the resync period of the defaults ConfigMap informer
+const defaultsResync = 10 * time.Minute
+
+// watchDefaults keeps the parameter defaults in sync with the defaults
+// ConfigMap until ctx is done
+func (p *glusterfsProvisioner) watchDefaults(ctx context.Context) {
+	namespace, name, err := splitNamespacedName(p.options.DefaultsConfigMap)
+	if err != nil {
+		klog.Errorf("glusterfs: %v", err)
+		return
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(p.client, defaultsResync,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}))
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    p.setDefaults,
+		UpdateFunc: func(_, obj interface{}) { p.setDefaults(obj) },
+		DeleteFunc: func(interface{}) { p.setDefaults(nil) },
+	})
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		klog.Errorf("glusterfs: failed to sync defaults configmap %s", p.options.DefaultsConfigMap)
+	}
+}
+
+// setDefaults replaces the parameter defaults with the data of a ConfigMap
+func (p *glusterfsProvisioner) setDefaults(obj interface{}) {
+	defaults := make(map[string]string)
+	if cm, ok := obj.(*v1.ConfigMap); ok {
+		for k, v := range cm.Data {
+			defaults[strings.ToLower(k)] = v
+		}
+	}
+	p.defaultsMutex.Lock()
+	p.defaults = defaults
+	p.defaultsMutex.Unlock()
+	p.invalidateClassConfigs()
+	klog.Infof("glusterfs: loaded %d parameter defaults from %s", len(defaults), p.options.DefaultsConfigMap)
+}
+
+// resolveDefaultParameters merges the parameter defaults into params.
+// Parameters of the StorageClass, BrickPool and GlusterCluster take precedence.
+func (p *glusterfsProvisioner) resolveDefaultParameters(params map[string]string) map[string]string {
+	p.defaultsMutex.RLock()
+	defer p.defaultsMutex.RUnlock()
+	if len(p.defaults) == 0 {
+		return params
+	}
+	resolved := make(map[string]string, len(p.defaults)+len(params))
+	for k, v := range p.defaults {
+		resolved[k] = v
+	}
+	for k, v := range params {
+		delete(resolved, strings.ToLower(k))
+		resolved[k] = v
+	}
+	return resolved
+}
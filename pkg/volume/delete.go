@@ -16,36 +16,84 @@ package volume
 import (
 	"context"
 	"fmt"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"path/filepath"
 	"strings"
+	"time"
 
+	gerrors "gluster-simple-provisioner/pkg/errors"
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/klog"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v8/util"
 )
 
 func (p *glusterfsProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume) error {
-	var err error
-	class, err := GetClassForVolume(ctx, p.client, volume)
+	if !p.beginOperation() {
+		return errShuttingDown
+	}
+	defer p.endOperation()
+	ctx = detachedContext{ctx}
+	if claim := volume.Spec.ClaimRef; claim != nil {
+		ctx = withOperation(ctx, string(claim.UID))
+	}
+	ctx, span := p.tracer.start(ctx, "delete", map[string]string{"k8s.pv.name": volume.Name})
+	err := p.deletePV(ctx, volume)
+	span.finish(err)
+	observeError("delete", err)
+	p.notifyDelete(ctx, volume, err)
+	return err
+}
+
+func (p *glusterfsProvisioner) deletePV(ctx context.Context, volume *v1.PersistentVolume) error {
+	klog.Infof("%sglusterfs: deleting volume %s", logPrefix(ctx), volume.Name)
+	cfg, bricks, err := p.configForVolume(ctx, volume)
 	if err != nil {
-		klog.Errorf("Fail to get class for volume: %v", volume)
 		return err
 	}
-	cfg, err := NewProvisionerConfig(volume.Name, class.Parameters)
-	if err != nil {
-		return fmt.Errorf("Parameter is invalid: %s", err)
+	if isDeletionProtected(volume, p.boundClaim(volume), cfg) {
+		klog.Infof("glusterfs: volume %s is protected from deletion", volume.Name)
+		return fmt.Errorf("volume %s is protected from deletion, remove the %s annotation to delete it", volume.Name, annDeletionProtected)
+	}
+	if err := p.checkOwner(volume); err != nil {
+		return err
+	}
+
+	if block, ok := volume.Annotations[annBlockVolume]; ok {
+		return p.deleteBlock(ctx, volume, block, cfg)
 	}
 
 	pvc := volume.Spec.ClaimRef
-	if pvc == nil {
-		klog.Errorf("glusterfs: ClaimRef is nil")
-		return fmt.Errorf("glusterfs: ClaimRef is nil")
+	err = p.runHook(ctx, "preDeleteCommands", cfg.PreDeleteCommands, pvc.Namespace, pvc.Name, cfg, bricks)
+	if err != nil {
+		klog.Errorf("%sglusterfs: %v", logPrefix(ctx), err)
+		return err
 	}
-	if pvc.Namespace == "" {
-		klog.Errorf("glusterfs: namespace is nil")
-		return fmt.Errorf("glusterfs: namespace is nil")
+
+	name := pvc.Name
+	if ep := volume.Spec.Glusterfs; ep != nil && strings.HasPrefix(ep.EndpointsName, dynamicEpSvcPrefix) {
+		// Reused volumes keep the endpoints name of their first claim
+		name = strings.TrimPrefix(ep.EndpointsName, dynamicEpSvcPrefix)
+	}
+	if p.deleteQueue != nil {
+		p.enqueueDelete(&deleteTask{
+			operation: operationID(ctx),
+			namespace: pvc.Namespace,
+			name:      name,
+			cfg:       cfg,
+			bricks:    bricks,
+		})
+	} else {
+		err = p.deleteVolume(ctx, pvc.Namespace, name, cfg, bricks)
+		if err != nil {
+			klog.Errorf("%sglusterfs: error deleting volume %s: %v", logPrefix(ctx), volume.Name, err)
+		}
+	}
+
+	err = p.releaseBrickCapacity(ctx, cfg)
+	if err != nil {
+		klog.Errorf("glusterfs: error to release brick capacity: %v", err)
 	}
-	p.deleteVolume(ctx, pvc.Namespace, pvc.Name, cfg)
 
 	//TODO ignorederror
 	err = p.allocator.Release(volume)
@@ -56,73 +104,267 @@ func (p *glusterfsProvisioner) Delete(ctx context.Context, volume *v1.Persistent
 	return nil
 }
 
+// volumeClassName returns the name of the class whose parameters manage a
+// provisioned volume
+func volumeClassName(volume *v1.PersistentVolume) string {
+	if name, ok := volume.Annotations[annStorageClass]; ok {
+		// Adopted volumes are managed with the parameters of another class
+		return name
+	}
+	return util.GetPersistentVolumeClass(volume)
+}
+
+// configForVolume returns the config and bricks of a provisioned volume
+func (p *glusterfsProvisioner) configForVolume(ctx context.Context, volume *v1.PersistentVolume) (*ProvisionerConfig, []glusterBrick, error) {
+	className := volumeClassName(volume)
+	if className == "" {
+		return nil, nil, fmt.Errorf("Volume has no storage class")
+	}
+	class, err := p.getStorageClass(ctx, className)
+	if err != nil {
+		klog.Errorf("Fail to get class for volume: %v", volume)
+		return nil, nil, err
+	}
+	cfg, err := p.volumeConfig(ctx, class, volume)
+	if err != nil {
+		return nil, nil, gerrors.Configf("Parameter is invalid: %s", err)
+	}
+	cfg.restoreVolumeType(volume.Annotations)
+	cfg.restoreForce(volume.Annotations)
+	cfg.restoreQuota(volume.Annotations)
+	cfg.restoreVolumeOptions(volume.Annotations)
+	if name := glusterVolumeName(volume); name != "" {
+		// The gluster volume may be named by volumeNameTemplate
+		if err := ValidateVolumeName(name); err != nil {
+			return nil, nil, gerrors.Config(err)
+		}
+		cfg.VolumeName = name
+	}
+
+	pvc := volume.Spec.ClaimRef
+	if pvc == nil {
+		klog.Errorf("glusterfs: ClaimRef is nil")
+		return nil, nil, fmt.Errorf("glusterfs: ClaimRef is nil")
+	}
+	if pvc.Namespace == "" {
+		klog.Errorf("glusterfs: namespace is nil")
+		return nil, nil, fmt.Errorf("glusterfs: namespace is nil")
+	}
+	var bricks []glusterBrick
+	if value, ok := volume.Annotations[annBricks]; ok {
+		bricks, err = parseBricks(value)
+	} else {
+		bricks, err = brickLayout(pvc.Namespace, pvc.Name, cfg)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("glusterfs: failed to get bricks of volume %s: %v", volume.Name, err)
+	}
+	return cfg, bricks, nil
+}
+
+// deleteVolume deletes the gluster volume, bricks and endpoints of a
+// volume. Every step is attempted and the first error is returned; all
+// steps are idempotent so that a failed deletion can be retried.
 func (p *glusterfsProvisioner) deleteVolume(
 	ctx context.Context,
 	namespace string, name string,
 	cfg *ProvisionerConfig,
-) {
+	bricks []glusterBrick,
+) error {
+	return p.rollbackVolume(ctx, namespace, name, cfg, bricks, true)
+}
 
-	p.deleteGlusterVolume(ctx, namespace, name, cfg)
-	p.deleteBricks(ctx, namespace, name, cfg)
+// rollbackVolume deletes what deleteVolume does, but the gluster volume
+// only if volumeCreated is set, so that a provisioning that failed to
+// create its gluster volume never deletes a volume of the same name
+func (p *glusterfsProvisioner) rollbackVolume(
+	ctx context.Context,
+	namespace string, name string,
+	cfg *ProvisionerConfig,
+	bricks []glusterBrick,
+	volumeCreated bool,
+) error {
+	var volErr error
+	start := time.Now()
+	if volumeCreated {
+		volErr = p.deleteGlusterVolume(ctx, namespace, name, cfg)
+		observeStep(ctx, "delete", "delete-volume", start, volErr)
+	}
+	var brickErr error
+	if volErr == nil {
+		// Never remove bricks of a volume that may still exist
+		start = time.Now()
+		brickErr = p.deleteBricks(ctx, bricks, cfg)
+		observeStep(ctx, "delete", "delete-bricks", start, brickErr)
+	}
+	if volErr == nil && brickErr == nil && cfg.Encryption != "" {
+		brickErr = p.deleteLUKSKey(ctx, cfg)
+	}
 
 	epServiceName := dynamicEpSvcPrefix + name
+	start = time.Now()
 	err := p.deleteEndpointService(ctx, namespace, epServiceName)
+	observeStep(ctx, "delete", "delete-endpoints", start, err)
 	if err != nil {
 		klog.Errorf("glusterfs: error deleting endpoint %s/%s: %v", namespace, epServiceName, err)
 	}
 
-	return
+	if volErr != nil {
+		return volErr
+	}
+	return brickErr
 }
 
 func (p *glusterfsProvisioner) deleteGlusterVolume(
 	ctx context.Context,
 	namespace string, name string,
 	cfg *ProvisionerConfig,
-) {
+) error {
 	var cmds []string
 	var err error
 	host := cfg.BrickRootPaths[0].Host
 
+	out, err := p.executeCommandOnHost(ctx, host, fmt.Sprintf(
+		"volumes=$(gluster --mode=script volume list) && (echo \"$volumes\" | grep -qx %s && echo present || echo absent)",
+		shellQuote(cfg.VolumeName)), cfg)
+	if err != nil {
+		klog.Errorf("glusterfs: failed to list volumes: %v", err)
+		return err
+	}
+	if strings.TrimSpace(out) == "absent" {
+		klog.V(2).Infof("glusterfs: volume %s is already deleted", cfg.VolumeName)
+		return nil
+	}
+
+	if cfg.PVSource == pvSourceNFS {
+		p.unexportNFS(ctx, host, cfg)
+	}
+
+	data := CommandData{VolumeName: cfg.VolumeName}
+	stop, err := cfg.command(commandStopVolume, data)
+	if err != nil {
+		return err
+	}
 	cmds = []string{
-		fmt.Sprintf("gluster --mode=script volume stop %s force", cfg.VolumeName),
+		// Volumes with snapshots cannot be deleted
+		fmt.Sprintf("gluster --mode=script snapshot delete volume %s || true", shellQuote(cfg.VolumeName)),
+		stop,
 	}
 
 	err = p.ExecuteCommands(ctx, host, cmds, cfg)
 	if err != nil {
 		klog.Errorf("glusterfs: failed to stop volume: %s", cfg.VolumeName)
-	} else {
-		cmds = []string{fmt.Sprintf(
-			"gluster --mode=script volume delete %s", cfg.VolumeName,
-		)}
-		err = p.ExecuteCommands(ctx, host, cmds, cfg)
-		if err != nil {
-			klog.Errorf("glusterfs: failed to delete volume: %s", cfg.VolumeName)
-		}
+	}
+	// A volume that is already stopped fails to stop but can be deleted
+	del, err := cfg.command(commandDeleteVolume, data)
+	if err != nil {
+		return err
+	}
+	cmds = []string{del}
+	err = p.ExecuteCommands(ctx, host, cmds, cfg)
+	if err != nil {
+		klog.Errorf("glusterfs: failed to delete volume: %s", cfg.VolumeName)
+		return err
 	}
 
-	return
+	return nil
 }
 
 func (p *glusterfsProvisioner) deleteBricks(ctx context.Context,
-	namespace string, pvcName string,
+	bricks []glusterBrick,
 	cfg *ProvisionerConfig,
-) {
+) error {
 	var cmds []string
-	brickName := strings.Join([]string{pvcName, cfg.VolumeName}, "-")
+	var lastErr error
 
-	for _, root := range cfg.BrickRootPaths {
-		host := root.Host
-		path := filepath.Join(root.Path, namespace, brickName)
+	for _, brick := range bricks {
+		host := brick.Host
+		path := brick.Path
 
-		klog.Infof("rm -rf %s:%s", host, path)
-		cmds = []string{
-			fmt.Sprintf("rm -rf %s", path),
+		var err error
+		if reason := unexpectedBrickPath(brick, cfg); reason != "" {
+			err = p.removeUnexpectedBrick(ctx, brick, reason, cfg)
+			if err != nil {
+				klog.Errorf("Failed to delete brick: %s: %s, %v", host, path, err)
+				lastErr = err
+			}
+			continue
+		}
+		switch cfg.BrickBackend {
+		case brickBackendZFS:
+			err = p.deleteZFSBrick(ctx, brick, cfg)
+		case brickBackendLVM:
+			err = p.deleteLVMBrick(ctx, brick, cfg)
+		case brickBackendLoopback:
+			err = p.deleteLoopbackBrick(ctx, brick, cfg)
+		default:
+			switch cfg.BrickRemoval {
+			case brickRemovalBackground:
+				err = p.removeBrickInBackground(ctx, brick, cfg)
+			case brickRemovalTrash:
+				err = p.trashBrick(ctx, brick, cfg)
+			default:
+				klog.Infof("rm -rf %s:%s", host, path)
+				var cmd string
+				cmd, err = cfg.command(commandDeleteBrick, CommandData{
+					VolumeName: cfg.VolumeName,
+					Host:       host,
+					Path:       path,
+				})
+				if err == nil {
+					cmds = []string{cfg.heavy(cmd)}
+					err = p.ExecuteCommands(ctx, host, cmds, cfg)
+				}
+			}
+		}
+		if err == nil {
+			if unlabel := selinuxUnlabelCommands(path, cfg); len(unlabel) > 0 {
+				err = p.ExecuteCommands(ctx, host, unlabel, cfg)
+			}
 		}
-		err := p.ExecuteCommands(ctx, host, cmds, cfg)
 		if err != nil {
 			klog.Errorf("Failed to delete brick: %s: %s, %v", host, path, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// unexpectedBrickPath returns why brick does not look like a brick of cfg,
+// e.g. because the brick roots of the class changed since it was created,
+// or "" if it does
+func unexpectedBrickPath(brick glusterBrick, cfg *ProvisionerConfig) string {
+	if err := ValidateBrickPath(brick.Path); err != nil {
+		return err.Error()
+	}
+	for _, r := range cfg.allBrickRoots() {
+		root := filepath.Clean(r.Path)
+		if r.Host != brick.Host || !strings.HasPrefix(brick.Path, strings.TrimSuffix(root, "/")+"/") {
+			continue
+		}
+		rel := strings.TrimPrefix(brick.Path, strings.TrimSuffix(root, "/")+"/")
+		if rel == trashDir || strings.HasPrefix(rel, trashDir+"/") {
+			return fmt.Sprintf("it is in the trash of brick root %s", root)
 		}
+		return ""
+	}
+	return "it is in none of the brick roots of the class"
+}
+
+// removeUnexpectedBrick removes the unexpected brick only if it is an empty
+// directory, so that a drifted configuration never deletes unrelated data
+func (p *glusterfsProvisioner) removeUnexpectedBrick(ctx context.Context, brick glusterBrick, reason string, cfg *ProvisionerConfig) error {
+	klog.Warningf("glusterfs: brick %s:%s is unexpected, removing it only if it is empty: %s", brick.Host, brick.Path, reason)
+	err := p.ExecuteCommands(ctx, brick.Host, []string{fmt.Sprintf(
+		"[ ! -e %s ] || rmdir %s", shellQuote(brick.Path), shellQuote(brick.Path),
+	)}, cfg)
+	if err != nil && gerrors.Kind(err) != "backend" {
+		return err
 	}
+	if err != nil {
+		return gerrors.Configf("refusing to delete brick %s:%s, which is not empty and %s", brick.Host, brick.Path, reason)
+	}
+	return nil
 }
 
 func (p *glusterfsProvisioner) deleteEndpointService(ctx context.Context, namespace string, epServiceName string) (err error) {
@@ -130,11 +372,22 @@ func (p *glusterfsProvisioner) deleteEndpointService(ctx context.Context, namesp
 	if kubeClient == nil {
 		return fmt.Errorf("glusterfs: failed to get kube client when deleting endpoint service")
 	}
+	endpoint, err := kubeClient.CoreV1().Endpoints(namespace).Get(ctx, epServiceName, metav1.GetOptions{})
+	if err == nil && endpoint.Labels[labelSharedEndpoints] == "true" {
+		// Other PVs of the namespace use them
+		klog.V(2).Infof("glusterfs: keeping shared endpoints %s/%s", namespace, epServiceName)
+		return nil
+	}
 	err = kubeClient.CoreV1().Services(namespace).Delete(ctx, epServiceName, metav1.DeleteOptions{})
-	if err != nil {
+	if err != nil && !errors.IsNotFound(err) {
 		klog.Errorf("glusterfs: error deleting service %s/%s: %v", namespace, epServiceName, err)
 	}
-	if err == nil {
+	// Classes without createService only have the endpoints
+	eerr := kubeClient.CoreV1().Endpoints(namespace).Delete(ctx, epServiceName, metav1.DeleteOptions{})
+	if eerr != nil && !errors.IsNotFound(eerr) {
+		klog.Errorf("glusterfs: error deleting endpoint %s/%s: %v", namespace, epServiceName, eerr)
+	}
+	if err == nil || eerr == nil {
 		klog.V(1).Infof("glusterfs: service/endpoint %s/%s deleted successfully", namespace, epServiceName)
 	}
 	return nil
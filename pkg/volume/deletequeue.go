@@ -0,0 +1,122 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+
+	gerrors "gluster-simple-provisioner/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+)
+
+// deleteTask is the gluster side cleanup of a deleted PV
+type deleteTask struct {
+	// operation is the correlation ID of the Delete that queued the task
+	operation string
+	namespace string
+	name      string
+	cfg       *ProvisionerConfig
+	bricks    []glusterBrick
+}
+
+// key identifies the task in the delete queue
+func (t *deleteTask) key() string {
+	return t.cfg.clusterKey() + "/" + t.cfg.VolumeName
+}
+
+// enqueueDelete queues task for the delete workers
+func (p *glusterfsProvisioner) enqueueDelete(task *deleteTask) {
+	key := task.key()
+	p.deleteTasksMutex.Lock()
+	p.deleteTasks[key] = task
+	p.deleteTasksMutex.Unlock()
+	klog.V(2).Infof("glusterfs: queued deletion of volume %s", task.cfg.VolumeName)
+	p.deleteQueue.Add(key)
+}
+
+// runDeleteWorker processes the delete queue until it is shut down
+func (p *glusterfsProvisioner) runDeleteWorker(ctx context.Context) {
+	for p.processNextDelete(ctx) {
+	}
+}
+
+func (p *glusterfsProvisioner) processNextDelete(ctx context.Context) bool {
+	item, shutdown := p.deleteQueue.Get()
+	if shutdown {
+		return false
+	}
+	defer p.deleteQueue.Done(item)
+	key := item.(string)
+
+	p.deleteTasksMutex.Lock()
+	task, ok := p.deleteTasks[key]
+	p.deleteTasksMutex.Unlock()
+	if !ok {
+		p.deleteQueue.Forget(item)
+		return true
+	}
+	if !p.beginOperation() {
+		// The task stays in deleteTasks and is persisted by Shutdown
+		return false
+	}
+	defer p.endOperation()
+
+	ctx = withOperation(detachedContext{ctx}, task.operation)
+	ctx, span := p.tracer.start(ctx, "delete-background", map[string]string{"gluster.volume": task.cfg.VolumeName})
+	err := p.deleteVolume(ctx, task.namespace, task.name, task.cfg, task.bricks)
+	span.finish(err)
+	if err == nil {
+		klog.Infof("%sglusterfs: deleted volume %s", logPrefix(ctx), task.cfg.VolumeName)
+		p.finishDelete(item, key)
+		return true
+	}
+
+	observeError("delete", err)
+	retries := p.deleteQueue.NumRequeues(item)
+	if retries < p.options.DeleteMaxRetries && !gerrors.IsTerminal(err) {
+		klog.Errorf("%sglusterfs: failed to delete volume %s (retry %d/%d): %v",
+			logPrefix(ctx), task.cfg.VolumeName, retries+1, p.options.DeleteMaxRetries, err)
+		p.deleteQueue.AddRateLimited(item)
+		return true
+	}
+	klog.Errorf("glusterfs: giving up deleting volume %s after %d retries, bricks %s must be cleaned up manually: %v",
+		task.cfg.VolumeName, retries, formatBricks(task.bricks), err)
+	p.finishDelete(item, key)
+	return true
+}
+
+func (p *glusterfsProvisioner) finishDelete(item interface{}, key string) {
+	p.deleteQueue.Forget(item)
+	p.deleteTasksMutex.Lock()
+	delete(p.deleteTasks, key)
+	p.deleteTasksMutex.Unlock()
+}
+
+// runDeleteWorkers starts the delete workers and shuts the queue down when
+// ctx is done
+func (p *glusterfsProvisioner) runDeleteWorkers(ctx context.Context) {
+	for i := 0; i < p.options.DeleteWorkers; i++ {
+		go wait.UntilWithContext(ctx, p.runDeleteWorker, 0)
+	}
+	go func() {
+		<-ctx.Done()
+		p.deleteQueue.ShutDown()
+	}()
+}
+
+func newDeleteQueue() workqueue.RateLimitingInterface {
+	return workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "glusterfs-simple-delete")
+}
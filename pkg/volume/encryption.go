@@ -0,0 +1,80 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const (
+	// encryptionLUKS encrypts bricks with LUKS
+	encryptionLUKS = "luks"
+
+	// luksKeyPrefix prefixes the names of the per-volume LUKS keys, followed
+	// by the gluster volume name
+	luksKeyPrefix = "glusterfs-luks-"
+	// keySecretKey is the data key of a key in its Secret or Vault secret
+	keySecretKey = "key"
+	// luksKeySize is the size of generated LUKS keys in bytes
+	luksKeySize = 64
+)
+
+// luksMapperName returns the device mapper name of an encrypted brick, which
+// is unique per host since brick paths are
+func luksMapperName(brick glusterBrick) string {
+	return "gluster-" + strings.ReplaceAll(strings.Trim(brick.Path, "/"), "/", "-")
+}
+
+// luksKey returns the LUKS key of the volume of cfg from its key provider,
+// generating it on first use
+func (p *glusterfsProvisioner) luksKey(ctx context.Context, cfg *ProvisionerConfig) ([]byte, error) {
+	provider, err := p.keyProvider(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return provider.key(ctx, cfg, luksKeyPrefix+cfg.VolumeName, luksKeySize)
+}
+
+// deleteLUKSKey deletes the LUKS key of the volume of cfg, which makes any
+// data left on its bricks unreadable
+func (p *glusterfsProvisioner) deleteLUKSKey(ctx context.Context, cfg *ProvisionerConfig) error {
+	provider, err := p.keyProvider(cfg)
+	if err != nil {
+		return err
+	}
+	return provider.deleteKey(ctx, cfg, luksKeyPrefix+cfg.VolumeName)
+}
+
+// openLUKSDevice formats image with LUKS and opens it, returning the device
+// of the decrypted brick. The key is passed on stdin to stay out of logs.
+func (p *glusterfsProvisioner) openLUKSDevice(ctx context.Context, brick glusterBrick, image string, cfg *ProvisionerConfig) (string, error) {
+	key, err := p.luksKey(ctx, cfg)
+	if err != nil {
+		return "", fmt.Errorf("failed to get LUKS key of volume %s: %v", cfg.VolumeName, err)
+	}
+	mapper := luksMapperName(brick)
+	_, err = p.executeCommandWithInput(ctx, brick.Host,
+		fmt.Sprintf("cryptsetup luksFormat --batch-mode --key-file=- %s", shellQuote(image)), key, cfg)
+	if err != nil {
+		return "", err
+	}
+	_, err = p.executeCommandWithInput(ctx, brick.Host,
+		fmt.Sprintf("cryptsetup open --key-file=- %s %s", shellQuote(image), shellQuote(mapper)), key, cfg)
+	if err != nil {
+		return "", err
+	}
+	return "/dev/mapper/" + mapper, nil
+}
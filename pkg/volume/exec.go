@@ -16,11 +16,17 @@ package volume
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"strings"
+	"time"
 
+	gerrors "gluster-simple-provisioner/pkg/errors"
 	"k8s.io/api/core/v1"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
 	"k8s.io/klog"
 )
 
@@ -30,14 +36,100 @@ func (p *glusterfsProvisioner) ExecuteCommands(
 	commands []string,
 	config *ProvisionerConfig,
 ) error {
+	cluster := config.clusterKey()
+	if err := p.breaker.allow(cluster); err != nil {
+		return gerrors.Transient(err)
+	}
+	release, err := p.hostLimiter.acquire(ctx, host)
+	if err != nil {
+		return gerrors.Transient(err)
+	}
+	defer release()
+
+	start := time.Now()
+	err = p.executeCommands(ctx, host, commands, config)
+	observeCommand(ctx, host, start, err)
+	// Commands that ran are classified as backend errors already
+	err = gerrors.Transient(err)
+	p.breaker.record(cluster, err)
+	return err
+}
+
+// executeScript runs commands on host in a single shell invocation, which
+// stops at the first failing command. Unlike ExecuteCommands it costs one
+// round trip to the pod however many commands there are.
+func (p *glusterfsProvisioner) executeScript(
+	ctx context.Context,
+	host string,
+	commands []string,
+	config *ProvisionerConfig,
+) error {
+	return p.ExecuteCommands(ctx, host, []string{batchScript(commands)}, config)
+}
+
+// batchScript joins commands into a fail-fast bash script
+func batchScript(commands []string) string {
+	return "set -e -o pipefail\n" + strings.Join(commands, "\n")
+}
+
+// executeCommandOnHost runs command on host and returns its stdout
+func (p *glusterfsProvisioner) executeCommandOnHost(
+	ctx context.Context,
+	host string,
+	command string,
+	config *ProvisionerConfig,
+) (string, error) {
+	return p.executeCommandWithInput(ctx, host, command, nil, config)
+}
+
+// executeCommandWithInput runs command on host with input as its stdin, which
+// unlike the command is never logged, and returns its stdout
+func (p *glusterfsProvisioner) executeCommandWithInput(
+	ctx context.Context,
+	host string,
+	command string,
+	input []byte,
+	config *ProvisionerConfig,
+) (string, error) {
+	cluster := config.clusterKey()
+	if err := p.breaker.allow(cluster); err != nil {
+		return "", gerrors.Transient(err)
+	}
+	release, err := p.hostLimiter.acquire(ctx, host)
+	if err != nil {
+		return "", gerrors.Transient(err)
+	}
+	defer release()
 
+	var out string
+	klog.V(2).Infof("%sglusterfs: running on %s: %s", logPrefix(ctx), host, command)
+	start := time.Now()
+	pod, err := p.selectPod(ctx, host, config)
+	if err == nil {
+		out, err = p.executeCommandInput(ctx, config.commandPreamble()+command, pod, input)
+	}
+	observeCommand(ctx, host, start, err)
+	err = gerrors.Transient(err)
+	p.breaker.record(cluster, err)
+	return out, err
+}
+
+func (p *glusterfsProvisioner) executeCommands(
+	ctx context.Context,
+	host string,
+	commands []string,
+	config *ProvisionerConfig,
+) error {
 	pod, err := p.selectPod(ctx, host, config)
 	if err != nil {
 		return err
 	}
+	preamble := config.commandPreamble()
 	for _, command := range commands {
-		err := p.ExecuteCommand(command, pod)
+		klog.V(2).Infof("%sglusterfs: running on %s: %s", logPrefix(ctx), host, command)
+		err := p.ExecuteCommand(ctx, preamble+command, pod)
 		if err != nil {
+			klog.Errorf("%sglusterfs: command on %s failed: %s: %v", logPrefix(ctx), host, command, err)
 			return err
 		}
 	}
@@ -46,8 +138,28 @@ func (p *glusterfsProvisioner) ExecuteCommands(
 }
 
 func (p *glusterfsProvisioner) ExecuteCommand(
+	ctx context.Context,
 	command string,
 	pod *v1.Pod) error {
+	_, err := p.executeCommandOutput(ctx, command, pod)
+	return err
+}
+
+// executeCommandOutput runs command in pod and returns its stdout
+func (p *glusterfsProvisioner) executeCommandOutput(
+	ctx context.Context,
+	command string,
+	pod *v1.Pod) (string, error) {
+	return p.executeCommandInput(ctx, command, pod, nil)
+}
+
+// executeCommandInput runs command in pod with input as its stdin, if any,
+// and returns its stdout. Cancelling ctx aborts the command.
+func (p *glusterfsProvisioner) executeCommandInput(
+	ctx context.Context,
+	command string,
+	pod *v1.Pod,
+	input []byte) (string, error) {
 	klog.V(4).Infof("Pod: %s, ExecuteCommand: %s", pod.Name, command)
 
 	containerName := pod.Spec.Containers[0].Name
@@ -59,6 +171,9 @@ func (p *glusterfsProvisioner) ExecuteCommand(
 		Param("container", containerName).
 		Param("stdout", "true").
 		Param("stderr", "true")
+	if input != nil {
+		req.Param("stdin", "true")
+	}
 
 	for _, c := range []string{"/bin/bash", "-c", command} {
 		req.Param("command", c)
@@ -67,13 +182,18 @@ func (p *glusterfsProvisioner) ExecuteCommand(
 	exec, err := remotecommand.NewSPDYExecutor(p.config, "POST", req.URL())
 	if err != nil {
 		klog.Fatalf("Failed to create NewExecutor: %v", err)
-		return err
+		return "", err
 	}
 
 	var b bytes.Buffer
 	var berr bytes.Buffer
 
-	err = exec.Stream(remotecommand.StreamOptions{
+	var stdin io.Reader
+	if input != nil {
+		stdin = bytes.NewReader(input)
+	}
+	err = exec.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdin:  stdin,
 		Stdout: &b,
 		Stderr: &berr,
 		Tty:    false,
@@ -83,10 +203,10 @@ func (p *glusterfsProvisioner) ExecuteCommand(
 	klog.Infof("Result: %v", berr.String())
 	if err != nil {
 		klog.Errorf("Failed to create Stream: %v", err)
-		return err
+		return "", classifyStreamError(err)
 	}
 
-	return nil
+	return b.String(), nil
 }
 
 func (p *glusterfsProvisioner) selectPod(
@@ -116,3 +236,19 @@ func (p *glusterfsProvisioner) selectPod(
 
 	return nil, fmt.Errorf("No pod found to match NodeName == %s", host)
 }
+
+// hasExitStatus reports whether err is a command that exited with status
+func hasExitStatus(err error, status int) bool {
+	var exitErr utilexec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitStatus() == status
+}
+
+// classifyStreamError classifies commands that ran and exited non-zero as
+// backend errors, and failures to reach the pod as transient
+func classifyStreamError(err error) error {
+	var exitErr utilexec.ExitError
+	if errors.As(err, &exitErr) {
+		return gerrors.Backend(err)
+	}
+	return gerrors.Transient(err)
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v8/gidallocator"
+)
+
+const rebalancePollInterval = 10 * time.Second
+
+// rebalanceStatusXML is the output of `gluster volume rebalance <volume> status --xml`
+type rebalanceStatusXML struct {
+	XMLName   xml.Name `xml:"cliOutput"`
+	OpRet     int      `xml:"opRet"`
+	OpErrstr  string   `xml:"opErrstr"`
+	StatusStr string   `xml:"volRebalance>aggregate>statusStr"`
+}
+
+// AddBricksOptions describe bricks to add to the gluster volume of a PV
+type AddBricksOptions struct {
+	// PV whose gluster volume is expanded
+	PV string
+	// BrickRootPaths receive one new brick each. Their number must be a
+	// multiple of the replica count of the volume.
+	BrickRootPaths []BrickRootPath
+	// RebalanceTimeout is how long to wait for the rebalance to complete.
+	// 0 starts the rebalance without waiting for it.
+	RebalanceTimeout time.Duration
+}
+
+// AddBricks adds bricks to the gluster volume of a PV and rebalances it
+func AddBricks(ctx context.Context, config *rest.Config, client kubernetes.Interface, options AddBricksOptions) error {
+	p := newGlusterfsProvisionerInternal(config, client, Options{})
+	return p.addBricks(ctx, options)
+}
+
+// rebalanceStatus returns the aggregate rebalance status of the volume of
+// cfg, e.g. `completed` or `in progress`. Volumes that never rebalanced
+// report an empty status.
+func (p *glusterfsProvisioner) rebalanceStatus(ctx context.Context, host string, cfg *ProvisionerConfig) (string, error) {
+	out, err := p.executeCommandOnHost(ctx, host,
+		fmt.Sprintf("gluster --mode=script volume rebalance %s status --xml", shellQuote(cfg.VolumeName)), cfg)
+	if err != nil {
+		return "", err
+	}
+	var status rebalanceStatusXML
+	err = xml.Unmarshal([]byte(out), &status)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse rebalance status of %s: %v", cfg.VolumeName, err)
+	}
+	if status.OpRet != 0 {
+		return "", nil
+	}
+	return status.StatusStr, nil
+}
+
+func (p *glusterfsProvisioner) addBricks(ctx context.Context, options AddBricksOptions) error {
+	pv, err := p.client.CoreV1().PersistentVolumes().Get(ctx, options.PV, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	cfg, bricks, err := p.configForVolume(ctx, pv)
+	if err != nil {
+		return err
+	}
+	replicas := replicaCount(cfg.VolumeType)
+	if len(options.BrickRootPaths) == 0 || len(options.BrickRootPaths)%replicas != 0 {
+		return fmt.Errorf("the number of new bricks (%d) must be a positive multiple of the replica count %d",
+			len(options.BrickRootPaths), replicas)
+	}
+	host := bricks[0].Host
+
+	status, err := p.rebalanceStatus(ctx, host, cfg)
+	if err != nil {
+		return err
+	}
+	if status == "in progress" {
+		return fmt.Errorf("a rebalance of volume %s is in progress", cfg.VolumeName)
+	}
+
+	gid, err := strconv.Atoi(pv.Annotations[gidallocator.VolumeGidAnnotationKey])
+	if err != nil {
+		return fmt.Errorf("volume %s has no valid GID annotation: %v", pv.Name, err)
+	}
+	newCfg := *cfg
+	newCfg.BrickRootPaths = options.BrickRootPaths
+	capacity := pv.Spec.Capacity[v1.ResourceStorage]
+	claim := pv.Spec.ClaimRef
+	added, err := p.createBricks(ctx, claim.Namespace, claim.Name, &newCfg, gid, capacity.Value())
+	if err != nil {
+		p.deleteBricks(ctx, added, cfg)
+		return err
+	}
+
+	cmd := fmt.Sprintf("gluster --mode=script volume add-brick %s", shellQuote(cfg.VolumeName))
+	for _, b := range added {
+		cmd += " " + shellQuote(cfg.glusterBrickName(b))
+	}
+	if cfg.ForceCreate {
+		cmd += " force"
+	}
+	err = p.ExecuteCommands(ctx, host, []string{cmd}, cfg)
+	if err != nil {
+		p.deleteBricks(ctx, added, cfg)
+		return err
+	}
+
+	all := append(bricks, added...)
+	err = p.recordBricks(ctx, pv.Name, all)
+	if err != nil {
+		klog.Errorf("glusterfs: bricks %s were added to volume %s but not recorded on PV %s: %v",
+			formatBricks(added), cfg.VolumeName, pv.Name, err)
+		return err
+	}
+
+	err = p.ExecuteCommands(ctx, host, []string{
+		fmt.Sprintf("gluster --mode=script volume rebalance %s start", shellQuote(cfg.VolumeName)),
+	}, cfg)
+	if err != nil {
+		return err
+	}
+	p.recorder.Event(pv, v1.EventTypeNormal, "BricksAdded",
+		fmt.Sprintf("added bricks %s and started rebalance", formatBricks(added)))
+	if options.RebalanceTimeout == 0 {
+		return nil
+	}
+
+	err = wait.PollImmediate(rebalancePollInterval, options.RebalanceTimeout, func() (bool, error) {
+		status, err := p.rebalanceStatus(ctx, host, cfg)
+		if err != nil {
+			return false, nil
+		}
+		switch status {
+		case "completed":
+			return true, nil
+		case "failed", "stopped":
+			return false, fmt.Errorf("rebalance of volume %s %s", cfg.VolumeName, status)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("rebalance of volume %s did not complete: %v", cfg.VolumeName, err)
+	}
+	return nil
+}
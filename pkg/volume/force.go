@@ -0,0 +1,128 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	gerrors "gluster-simple-provisioner/pkg/errors"
+	"k8s.io/klog"
+)
+
+const (
+	// forceCreate modes: force always, only if needed or never. The
+	// default forces only loopback bricks, which are mountpoints.
+	forceAlways = "always"
+	forceAuto   = "auto"
+	forceNever  = "never"
+
+	// annForce records that force was found necessary for a volume, so that
+	// expanding and repairing it uses force as well
+	annForce = "gluster.simple/force"
+)
+
+// parseForceCreate parses the forceCreate parameter, `true` and `false`
+// being the historical values
+func parseForceCreate(param string) (string, error) {
+	switch mode := strings.ToLower(strings.TrimSpace(param)); mode {
+	case "true", forceAlways:
+		return forceAlways, nil
+	case "false", "":
+		return "", nil
+	case forceAuto, forceNever:
+		return mode, nil
+	}
+	return "", fmt.Errorf("forceCreate is invalid (one of `true`, `false`, `auto`, `never`): %s", param)
+}
+
+// mayForce returns whether the volume of config may be created with force
+func (config *ProvisionerConfig) mayForce() bool {
+	return config.ForceCreate || config.ForceMode == forceAuto
+}
+
+// forceReasons returns why gluster needs force to create the volume of cfg:
+// replica sets sharing a host, and brick roots on the root filesystem
+func (p *glusterfsProvisioner) forceReasons(ctx context.Context, cfg *ProvisionerConfig) ([]string, error) {
+	var reasons []string
+	if cfg.BrickBackend == brickBackendLoopback || cfg.BrickBackend == brickBackendLVM {
+		reasons = append(reasons, cfg.BrickBackend+" bricks are mountpoints")
+	}
+	if replicas := replicaCount(cfg.VolumeType); replicas > 1 && !replicaSetsSpanHosts(cfg.BrickRootPaths, replicas) {
+		reasons = append(reasons, "replica sets share a host")
+	}
+	checked := make(map[BrickRootPath]bool)
+	for _, root := range cfg.BrickRootPaths {
+		if checked[root] {
+			continue
+		}
+		checked[root] = true
+		out, err := p.executeCommandOnHost(ctx, root.Host,
+			fmt.Sprintf("findmnt -n -o TARGET --target %s", shellQuote(root.Path)), cfg)
+		if err != nil {
+			return nil, fmt.Errorf("brick root %s:%s is not accessible: %v", root.Host, root.Path, err)
+		}
+		if strings.TrimSpace(out) == "/" {
+			reasons = append(reasons, fmt.Sprintf("brick root %s:%s is on the root filesystem", root.Host, root.Path))
+		}
+	}
+	return reasons, nil
+}
+
+// decideForce sets whether the volume of cfg is created with force. In auto
+// mode force is used only if forceReasons finds it necessary, in never mode,
+// or with the NeverForce option, a volume needing it fails instead.
+func (p *glusterfsProvisioner) decideForce(ctx context.Context, cfg *ProvisionerConfig) error {
+	mode := cfg.ForceMode
+	if p.options.NeverForce {
+		if cfg.ForceCreate {
+			return gerrors.Configf("forceCreate is prohibited on this provisioner, the class uses force for volume %s", cfg.VolumeName)
+		}
+		mode = forceNever
+	}
+	switch {
+	case cfg.ForceCreate:
+		klog.V(2).Infof("glusterfs: creating volume %s with force, forceCreate is set or the brick backend needs it", cfg.VolumeName)
+		return nil
+	case mode != forceAuto && mode != forceNever:
+		return nil
+	}
+
+	reasons, err := p.forceReasons(ctx, cfg)
+	if err != nil || len(reasons) == 0 {
+		return err
+	}
+	if mode == forceNever {
+		return gerrors.Configf("volume %s needs force, which is prohibited: %s", cfg.VolumeName, strings.Join(reasons, ", "))
+	}
+	klog.Infof("glusterfs: creating volume %s with force: %s", cfg.VolumeName, strings.Join(reasons, ", "))
+	cfg.ForceCreate = true
+	cfg.forceNeeded = true
+	return nil
+}
+
+// setForceAnnotation records on a PV that its volume needed force
+func setForceAnnotation(annotations map[string]string, cfg *ProvisionerConfig) {
+	if cfg.forceNeeded {
+		annotations[annForce] = "true"
+	}
+}
+
+// restoreForce uses force for a volume that needed it when it was created
+func (config *ProvisionerConfig) restoreForce(annotations map[string]string) {
+	if annotations[annForce] == "true" {
+		config.ForceCreate = true
+	}
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// annQuotaSoftLimit records the soft limit, in percent of the capacity,
+	// of a volume provisioned with a gluster quota. Only volumes with it are
+	// checked by checkQuotas.
+	annQuotaSoftLimit = "gluster.simple/quota-soft-limit"
+
+	// defaultQuotaSoftLimit is the soft limit unless quotaSoftLimit is set,
+	// the default of gluster as well
+	defaultQuotaSoftLimit = 80
+)
+
+// quotaListXML is the output of `gluster volume quota <volume> list / --xml`
+type quotaListXML struct {
+	XMLName  xml.Name `xml:"cliOutput"`
+	OpRet    int      `xml:"opRet"`
+	OpErrstr string   `xml:"opErrstr"`
+	Limits   []struct {
+		Path           string `xml:"path"`
+		HardLimit      int64  `xml:"hard_limit"`
+		SoftLimitValue int64  `xml:"soft_limit_value"`
+		UsedSpace      int64  `xml:"used_space"`
+		SoftExceeded   string `xml:"sl_exceeded"`
+		HardExceeded   string `xml:"hl_exceeded"`
+	} `xml:"volQuota>limit"`
+}
+
+// quotaUsage is the quota of the root directory of a volume
+type quotaUsage struct {
+	limit        int64
+	softLimit    int64
+	used         int64
+	softExceeded bool
+	hardExceeded bool
+}
+
+// quotaState is the last quota usage seen of a volume, so that only
+// crossings of its limits are reported
+type quotaState struct {
+	volume       string
+	namespace    string
+	claim        string
+	softExceeded bool
+	hardExceeded bool
+}
+
+// parseQuotaSoftLimit parses the quotaSoftLimit parameter, a percentage
+func parseQuotaSoftLimit(param string) (int, error) {
+	limit, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(param), "%"))
+	if err != nil || limit < 1 || limit > 99 {
+		return 0, fmt.Errorf("quotaSoftLimit is invalid (a percentage from 1 to 99): %s", param)
+	}
+	return limit, nil
+}
+
+// configureQuota limits the volume of cfg to size bytes with a gluster quota
+// on its root directory, with a soft limit of QuotaSoftLimit percent
+func (p *glusterfsProvisioner) configureQuota(ctx context.Context, bricks []glusterBrick, cfg *ProvisionerConfig, size int64) error {
+	if !cfg.Quota {
+		return nil
+	}
+	var cmds []string
+	for _, data := range []CommandData{
+		{VolumeName: cfg.VolumeName, Option: "enable"},
+		{VolumeName: cfg.VolumeName, Option: "limit-usage", Path: "/", Value: fmt.Sprintf("%dB %d%%", size, cfg.QuotaSoftLimit)},
+	} {
+		cmd, err := cfg.command(commandQuota, data)
+		if err != nil {
+			return err
+		}
+		cmds = append(cmds, cmd)
+	}
+	if err := p.executeScript(ctx, bricks[0].Host, cmds, cfg); err != nil {
+		return fmt.Errorf("failed to set quota of volume %s: %v", cfg.VolumeName, err)
+	}
+	return nil
+}
+
+// setQuotaAnnotation records on a PV that its volume has a quota
+func setQuotaAnnotation(annotations map[string]string, cfg *ProvisionerConfig) {
+	if cfg.Quota {
+		annotations[annQuotaSoftLimit] = strconv.Itoa(cfg.QuotaSoftLimit)
+	}
+}
+
+// restoreQuota sets the quota of config to the one recorded on the PV, so
+// that a class enabling quota later does not apply to older volumes
+func (config *ProvisionerConfig) restoreQuota(annotations map[string]string) {
+	softLimit, err := strconv.Atoi(annotations[annQuotaSoftLimit])
+	config.Quota = err == nil
+	config.QuotaSoftLimit = softLimit
+}
+
+// quotaUsage returns the quota of the root directory of the volume of cfg
+func (p *glusterfsProvisioner) quotaUsage(ctx context.Context, host string, cfg *ProvisionerConfig) (*quotaUsage, error) {
+	out, err := p.executeCommandOnHost(ctx, host,
+		fmt.Sprintf("gluster --mode=script volume quota %s list / --xml", shellQuote(cfg.VolumeName)), cfg)
+	if err != nil {
+		return nil, err
+	}
+	var list quotaListXML
+	if err := xml.Unmarshal([]byte(out), &list); err != nil {
+		return nil, fmt.Errorf("failed to parse quota list of %s: %v", cfg.VolumeName, err)
+	}
+	if list.OpRet != 0 {
+		return nil, fmt.Errorf("quota list of %s failed: %s", cfg.VolumeName, list.OpErrstr)
+	}
+	for _, limit := range list.Limits {
+		if limit.Path != "/" {
+			continue
+		}
+		return &quotaUsage{
+			limit:        limit.HardLimit,
+			softLimit:    limit.SoftLimitValue,
+			used:         limit.UsedSpace,
+			softExceeded: strings.EqualFold(limit.SoftExceeded, "yes"),
+			hardExceeded: strings.EqualFold(limit.HardExceeded, "yes"),
+		}, nil
+	}
+	return nil, fmt.Errorf("volume %s has no quota on its root directory", cfg.VolumeName)
+}
+
+// checkQuotas reads the quota usage of every provisioned volume with a
+// quota, exports it as metrics and records an event on the claim of
+// volumes that crossed their soft or hard limit
+func (p *glusterfsProvisioner) checkQuotas(ctx context.Context) {
+	volumes, err := p.listProvisionedVolumes(ctx)
+	if err != nil {
+		klog.Errorf("glusterfs: failed to list volumes to check quotas: %v", err)
+		return
+	}
+
+	seen := make(map[string]bool)
+	for i := range volumes {
+		pv := &volumes[i]
+		if _, ok := pv.Annotations[annQuotaSoftLimit]; !ok || pv.Spec.ClaimRef == nil {
+			continue
+		}
+		seen[pv.Name] = true
+		if err := p.checkQuota(ctx, pv); err != nil {
+			klog.Errorf("glusterfs: failed to check quota of volume %s: %v", pv.Name, err)
+		}
+	}
+
+	p.quotaStatesMutex.Lock()
+	defer p.quotaStatesMutex.Unlock()
+	for name, state := range p.quotaStates {
+		if !seen[name] {
+			volumeQuotaUsedBytes.DeleteLabelValues(name, state.volume, state.namespace, state.claim)
+			volumeQuotaSoftLimitExceeded.DeleteLabelValues(name, state.volume, state.namespace, state.claim)
+			volumeQuotaHardLimitExceeded.DeleteLabelValues(name, state.volume, state.namespace, state.claim)
+			delete(p.quotaStates, name)
+		}
+	}
+}
+
+func (p *glusterfsProvisioner) checkQuota(ctx context.Context, pv *v1.PersistentVolume) error {
+	cfg, bricks, err := p.configForVolume(ctx, pv)
+	if err != nil {
+		return err
+	}
+	usage, err := p.quotaUsage(ctx, bricks[0].Host, cfg)
+	if err != nil {
+		return err
+	}
+	claim := pv.Spec.ClaimRef
+
+	volumeQuotaUsedBytes.WithLabelValues(pv.Name, cfg.VolumeName, claim.Namespace, claim.Name).Set(float64(usage.used))
+	if usage.softExceeded {
+		volumeQuotaSoftLimitExceeded.WithLabelValues(pv.Name, cfg.VolumeName, claim.Namespace, claim.Name).Set(1)
+	} else {
+		volumeQuotaSoftLimitExceeded.WithLabelValues(pv.Name, cfg.VolumeName, claim.Namespace, claim.Name).Set(0)
+	}
+	if usage.hardExceeded {
+		volumeQuotaHardLimitExceeded.WithLabelValues(pv.Name, cfg.VolumeName, claim.Namespace, claim.Name).Set(1)
+	} else {
+		volumeQuotaHardLimitExceeded.WithLabelValues(pv.Name, cfg.VolumeName, claim.Namespace, claim.Name).Set(0)
+	}
+
+	p.quotaStatesMutex.Lock()
+	previous := p.quotaStates[pv.Name]
+	p.quotaStates[pv.Name] = quotaState{
+		volume:       cfg.VolumeName,
+		namespace:    claim.Namespace,
+		claim:        claim.Name,
+		softExceeded: usage.softExceeded,
+		hardExceeded: usage.hardExceeded,
+	}
+	p.quotaStatesMutex.Unlock()
+
+	if usage.softExceeded == previous.softExceeded && usage.hardExceeded == previous.hardExceeded {
+		return nil
+	}
+	pvc, err := p.client.CoreV1().PersistentVolumeClaims(claim.Namespace).Get(ctx, claim.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	switch {
+	case usage.hardExceeded && !previous.hardExceeded:
+		p.recorder.Eventf(pvc, v1.EventTypeWarning, "QuotaHardLimitExceeded",
+			"volume %s uses %d of %d bytes, writes fail until space is freed", cfg.VolumeName, usage.used, usage.limit)
+	case usage.softExceeded && !previous.softExceeded:
+		p.recorder.Eventf(pvc, v1.EventTypeWarning, "QuotaSoftLimitExceeded",
+			"volume %s uses %d bytes, over its soft limit of %d of %d bytes", cfg.VolumeName, usage.used, usage.softLimit, usage.limit)
+	case !usage.softExceeded && previous.softExceeded:
+		p.recorder.Eventf(pvc, v1.EventTypeNormal, "QuotaWithinLimits",
+			"volume %s uses %d bytes, below its soft limit of %d bytes", cfg.VolumeName, usage.used, usage.softLimit)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v8/util"
+)
+
+// GlusterVolumeResource is the namespaced GlusterVolume custom resource
+// recording the state of a provisioned PV in the namespace of its claim
+var GlusterVolumeResource = schema.GroupVersionResource{
+	Group:    "gluster.org",
+	Version:  "v1alpha1",
+	Resource: "glustervolumes",
+}
+
+// maxVolumeOperations is the number of operations kept in the status
+const maxVolumeOperations = 10
+
+// GlusterVolumeSpec references the PV and gluster volume
+type GlusterVolumeSpec struct {
+	PersistentVolume      string `json:"persistentVolume"`
+	PersistentVolumeClaim string `json:"persistentVolumeClaim,omitempty"`
+	StorageClass          string `json:"storageClass,omitempty"`
+	Volume                string `json:"volume"`
+	// Options are enforced on the volume with --reconcile-period on top of
+	// the volumeOptions of the class
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// GlusterVolumeOperation is an operation run on a volume
+type GlusterVolumeOperation struct {
+	Type    string `json:"type"`
+	Time    string `json:"time"`
+	Result  string `json:"result"`
+	Message string `json:"message,omitempty"`
+}
+
+// GlusterVolumeStatus is the last known state of a volume
+type GlusterVolumeStatus struct {
+	VolumeType    string                   `json:"volumeType,omitempty"`
+	Bricks        []string                 `json:"bricks,omitempty"`
+	Options       map[string]string        `json:"options,omitempty"`
+	Healthy       *bool                    `json:"healthy,omitempty"`
+	BricksOnline  int                      `json:"bricksOnline"`
+	CapacityBytes int64                    `json:"capacityBytes"`
+	UsedBytes     *int64                   `json:"usedBytes,omitempty"`
+	Operations    []GlusterVolumeOperation `json:"operations,omitempty"`
+	LastUpdate    string                   `json:"lastUpdate,omitempty"`
+}
+
+// GlusterVolume mirrors a provisioned PV for `kubectl get glustervolumes`
+type GlusterVolume struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GlusterVolumeSpec   `json:"spec"`
+	Status GlusterVolumeStatus `json:"status,omitempty"`
+}
+
+// recordOperation appends an operation to status, keeping the last
+// maxVolumeOperations
+func (status *GlusterVolumeStatus) recordOperation(operation string, err error, message string) {
+	op := GlusterVolumeOperation{
+		Type:    operation,
+		Time:    time.Now().UTC().Format(time.RFC3339),
+		Result:  "Succeeded",
+		Message: message,
+	}
+	if err != nil {
+		op.Result = "Failed"
+		op.Message = err.Error()
+	}
+	status.Operations = append(status.Operations, op)
+	if n := len(status.Operations); n > maxVolumeOperations {
+		status.Operations = status.Operations[n-maxVolumeOperations:]
+	}
+}
+
+func glusterVolumeToUnstructured(gv *GlusterVolume) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(gv)
+	if err != nil {
+		return nil, err
+	}
+	u := &unstructured.Unstructured{Object: content}
+	u.SetAPIVersion(GlusterVolumeResource.GroupVersion().String())
+	u.SetKind("GlusterVolume")
+	return u, nil
+}
+
+// newGlusterVolume returns the GlusterVolume of pv, owned by pv so that it
+// is garbage collected with it
+func newGlusterVolume(pv *v1.PersistentVolume, cfg *ProvisionerConfig) *GlusterVolume {
+	gv := &GlusterVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      pv.Name,
+			Namespace: pv.Spec.ClaimRef.Namespace,
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: "v1",
+				Kind:       "PersistentVolume",
+				Name:       pv.Name,
+				UID:        pv.UID,
+			}},
+		},
+		Spec: GlusterVolumeSpec{
+			PersistentVolume:      pv.Name,
+			PersistentVolumeClaim: pv.Spec.ClaimRef.Name,
+			StorageClass:          util.GetPersistentVolumeClass(pv),
+			Volume:                cfg.VolumeName,
+		},
+	}
+	gv.Status.recordOperation("Provisioned", nil, "")
+	gv.Status.Operations[0].Time = pv.CreationTimestamp.UTC().Format(time.RFC3339)
+	return gv
+}
+
+// updateGlusterVolume applies update to the status of the GlusterVolume of
+// pv, creating it if needed. The bricks are left as they are if nil. Failures are logged only: GlusterVolumes are
+// informational and never block operations on volumes.
+func (p *glusterfsProvisioner) updateGlusterVolume(
+	ctx context.Context,
+	pv *v1.PersistentVolume,
+	cfg *ProvisionerConfig,
+	bricks []glusterBrick,
+	update func(status *GlusterVolumeStatus),
+) {
+	if !p.options.VolumeStatusObjects || pv.Spec.ClaimRef == nil {
+		return
+	}
+	client := p.dynamicClient.Resource(GlusterVolumeResource).Namespace(pv.Spec.ClaimRef.Namespace)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var gv GlusterVolume
+		u, err := client.Get(ctx, pv.Name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			u, err = glusterVolumeToUnstructured(newGlusterVolume(pv, cfg))
+			if err != nil {
+				return err
+			}
+			u, err = client.Create(ctx, u, metav1.CreateOptions{})
+		}
+		if err != nil {
+			return err
+		}
+		err = runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &gv)
+		if err != nil {
+			return err
+		}
+		if len(gv.Status.Operations) == 0 {
+			// Created above, the status is dropped on create
+			gv.Status = newGlusterVolume(pv, cfg).Status
+		}
+
+		capacity := pv.Spec.Capacity[v1.ResourceStorage]
+		gv.Status.VolumeType = cfg.VolumeType
+		gv.Status.Options = cfg.VolumeOptions
+		gv.Status.CapacityBytes = capacity.Value()
+		if bricks != nil {
+			gv.Status.Bricks = nil
+			for _, b := range bricks {
+				gv.Status.Bricks = append(gv.Status.Bricks, b.Host+":"+b.Path)
+			}
+		}
+		update(&gv.Status)
+		gv.Status.LastUpdate = time.Now().UTC().Format(time.RFC3339)
+
+		u, err = glusterVolumeToUnstructured(&gv)
+		if err != nil {
+			return err
+		}
+		_, err = client.UpdateStatus(ctx, u, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		klog.Errorf("glusterfs: failed to update GlusterVolume %s/%s: %v", pv.Spec.ClaimRef.Namespace, pv.Name, err)
+	}
+}
+
+// recordVolumeOperation records an operation on pv in its GlusterVolume
+func (p *glusterfsProvisioner) recordVolumeOperation(
+	ctx context.Context,
+	pv *v1.PersistentVolume,
+	cfg *ProvisionerConfig,
+	bricks []glusterBrick,
+	operation string,
+	err error,
+	message string,
+) {
+	p.updateGlusterVolume(ctx, pv, cfg, bricks, func(status *GlusterVolumeStatus) {
+		status.recordOperation(operation, err, message)
+	})
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+const (
+	healthCheckInterval = 2 * time.Second
+	healthCheckTimeout  = 30 * time.Second
+)
+
+// volumeStatusXML is the output of `gluster volume status <volume> --xml`
+type volumeStatusXML struct {
+	XMLName  xml.Name `xml:"cliOutput"`
+	OpRet    int      `xml:"opRet"`
+	OpErrstr string   `xml:"opErrstr"`
+	Nodes    []struct {
+		Hostname string `xml:"hostname"`
+		Path     string `xml:"path"`
+		Status   int    `xml:"status"`
+	} `xml:"volStatus>volumes>volume>node"`
+}
+
+// volumeStatus returns the online state of the bricks of the volume of cfg,
+// keyed by `host:path`
+func (p *glusterfsProvisioner) volumeStatus(ctx context.Context, host string, cfg *ProvisionerConfig) (map[string]bool, error) {
+	out, err := p.executeCommandOnHost(ctx, host,
+		fmt.Sprintf("gluster --mode=script volume status %s --xml", shellQuote(cfg.VolumeName)), cfg)
+	if err != nil {
+		return nil, err
+	}
+	var status volumeStatusXML
+	err = xml.Unmarshal([]byte(out), &status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse volume status of %s: %v", cfg.VolumeName, err)
+	}
+	if status.OpRet != 0 {
+		return nil, fmt.Errorf("volume status of %s failed: %s", cfg.VolumeName, status.OpErrstr)
+	}
+	online := make(map[string]bool)
+	for _, node := range status.Nodes {
+		online[node.Hostname+":"+node.Path] = node.Status == 1
+	}
+	return online, nil
+}
+
+// verifyVolumeHealth waits until every brick of the started volume is online
+func (p *glusterfsProvisioner) verifyVolumeHealth(ctx context.Context, bricks []glusterBrick, cfg *ProvisionerConfig) error {
+	host := bricks[0].Host
+	var lastErr error
+	err := wait.PollImmediate(healthCheckInterval, healthCheckTimeout, func() (bool, error) {
+		online, err := p.volumeStatus(ctx, host, cfg)
+		if err != nil {
+			lastErr = err
+			return false, nil
+		}
+		for _, b := range bricks {
+			if !online[cfg.glusterBrickName(b)] {
+				lastErr = fmt.Errorf("brick %s:%s of volume %s is not online", b.Host, b.Path, cfg.VolumeName)
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		klog.Errorf("glusterfs: volume %s is not healthy: %v", cfg.VolumeName, lastErr)
+		return fmt.Errorf("volume %s is not healthy: %v", cfg.VolumeName, lastErr)
+	}
+	klog.V(2).Infof("glusterfs: all bricks of volume %s are online", cfg.VolumeName)
+	return nil
+}
+
+// healInfoXML is the output of `gluster volume heal <volume> info --xml`
+type healInfoXML struct {
+	XMLName  xml.Name `xml:"cliOutput"`
+	OpRet    int      `xml:"opRet"`
+	OpErrstr string   `xml:"opErrstr"`
+	Bricks   []struct {
+		Name            string `xml:"name"`
+		Status          string `xml:"status"`
+		NumberOfEntries string `xml:"numberOfEntries"`
+	} `xml:"healInfo>bricks>brick"`
+}
+
+// needsSelfHeal reports whether self-heal applies to the volume of cfg
+func (config *ProvisionerConfig) needsSelfHeal() bool {
+	switch config.SelfHeal {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	volumeType := strings.ToLower(config.VolumeType)
+	return strings.Contains(volumeType, "replica") || strings.Contains(volumeType, "disperse")
+}
+
+// configureSelfHeal enables self-heal on the volume of cfg, triggers an
+// initial heal and waits until every brick reports no pending entries
+func (p *glusterfsProvisioner) configureSelfHeal(ctx context.Context, bricks []glusterBrick, cfg *ProvisionerConfig) error {
+	if !cfg.needsSelfHeal() {
+		return nil
+	}
+	host := bricks[0].Host
+	cmds := []string{
+		fmt.Sprintf("gluster --mode=script volume heal %s enable", shellQuote(cfg.VolumeName)),
+		fmt.Sprintf("gluster --mode=script volume heal %s", shellQuote(cfg.VolumeName)),
+	}
+	err := p.ExecuteCommands(ctx, host, cmds, cfg)
+	if err != nil {
+		klog.Errorf("glusterfs: failed to configure self-heal of volume %s: %v", cfg.VolumeName, err)
+		return err
+	}
+
+	return p.waitForHeal(ctx, host, cfg, healthCheckTimeout)
+}
+
+// waitForHeal waits until `gluster volume heal info` reports every brick of
+// the volume of cfg connected with no entries pending heal
+func (p *glusterfsProvisioner) waitForHeal(ctx context.Context, host string, cfg *ProvisionerConfig, timeout time.Duration) error {
+	var lastErr error
+	err := wait.PollImmediate(healthCheckInterval, timeout, func() (bool, error) {
+		out, err := p.executeCommandOnHost(ctx, host,
+			fmt.Sprintf("gluster --mode=script volume heal %s info --xml", shellQuote(cfg.VolumeName)), cfg)
+		if err != nil {
+			lastErr = err
+			return false, nil
+		}
+		var info healInfoXML
+		err = xml.Unmarshal([]byte(out), &info)
+		if err != nil {
+			lastErr = fmt.Errorf("failed to parse heal info of %s: %v", cfg.VolumeName, err)
+			return false, nil
+		}
+		if info.OpRet != 0 {
+			lastErr = fmt.Errorf("heal info of %s failed: %s", cfg.VolumeName, info.OpErrstr)
+			return false, nil
+		}
+		for _, b := range info.Bricks {
+			if b.Status != "Connected" || b.NumberOfEntries != "0" {
+				lastErr = fmt.Errorf("brick %s of volume %s is %s with %s entries pending heal",
+					b.Name, cfg.VolumeName, b.Status, b.NumberOfEntries)
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		klog.Errorf("glusterfs: self-heal of volume %s did not settle: %v", cfg.VolumeName, lastErr)
+		return fmt.Errorf("self-heal of volume %s did not settle: %v", cfg.VolumeName, lastErr)
+	}
+	return nil
+}
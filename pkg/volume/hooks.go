@@ -0,0 +1,96 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// HookData is the data available to the postCreateCommands and
+// preDeleteCommands parameters. The PVC fields come from tenants, so
+// templates must shell quote every field with the `quote` function of the
+// command templates.
+type HookData struct {
+	VolumeName   string
+	PVName       string
+	PVCName      string
+	PVCNamespace string
+	// Bricks are the bricks of the volume as `host:/path`
+	Bricks []string
+	// Hosts are the brick hosts of the volume
+	Hosts []string
+}
+
+// parseHookCommands parses the newline separated command templates of a
+// hook parameter
+func parseHookCommands(name string, param string) ([]string, error) {
+	var commands []string
+	for _, line := range strings.Split(param, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if _, err := template.New(name).Funcs(commandTemplateFuncs).Option("missingkey=error").Parse(line); err != nil {
+			return nil, fmt.Errorf("%s is invalid: %v", name, err)
+		}
+		commands = append(commands, line)
+	}
+	return commands, nil
+}
+
+// runHook renders the command templates of a hook for the volume of cfg and
+// runs them on its first brick host, stopping at the first failure
+func (p *glusterfsProvisioner) runHook(
+	ctx context.Context,
+	name string, commands []string,
+	namespace string, pvcName string,
+	cfg *ProvisionerConfig,
+	bricks []glusterBrick,
+) error {
+	if len(commands) == 0 || len(bricks) == 0 {
+		return nil
+	}
+	data := HookData{
+		VolumeName:   cfg.VolumeName,
+		PVName:       cfg.PVName,
+		PVCName:      pvcName,
+		PVCNamespace: namespace,
+	}
+	for _, b := range bricks {
+		data.Bricks = append(data.Bricks, b.Host+":"+b.Path)
+	}
+	data.Hosts = brickHosts(bricks)
+
+	rendered := make([]string, len(commands))
+	for i, text := range commands {
+		tmpl, err := template.New(name).Funcs(commandTemplateFuncs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return fmt.Errorf("%s is invalid: %v", name, err)
+		}
+		var cmd strings.Builder
+		err = tmpl.Execute(&cmd, data)
+		if err != nil {
+			return fmt.Errorf("%s is invalid: %v", name, err)
+		}
+		rendered[i] = cmd.String()
+	}
+	err := p.ExecuteCommands(ctx, bricks[0].Host, rendered, cfg)
+	if err != nil {
+		return fmt.Errorf("%s of volume %s failed: %v", name, cfg.VolumeName, err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// hostLimiter caps the number of commands running at the same time on each
+// gluster host, so that a burst of claims queues up in the provisioner
+// instead of overloading glusterd or tripping the MaxSessions of sshd.
+type hostLimiter struct {
+	mutex     sync.Mutex
+	limit     int
+	overrides map[string]int
+	hosts     map[string]chan struct{}
+	queued    map[string]int
+}
+
+// newHostLimiter limits every host to limit commands, except the hosts in
+// overrides, which have their own limit
+func newHostLimiter(limit int, overrides map[string]int) *hostLimiter {
+	return &hostLimiter{
+		limit:     limit,
+		overrides: overrides,
+		hosts:     make(map[string]chan struct{}),
+		queued:    make(map[string]int),
+	}
+}
+
+func (l *hostLimiter) hostLimit(host string) int {
+	if limit, ok := l.overrides[host]; ok {
+		return limit
+	}
+	return l.limit
+}
+
+// acquire waits for a free slot on host and returns the function releasing
+// it. A limit of 0 never waits.
+func (l *hostLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	limit := l.hostLimit(host)
+	if limit <= 0 {
+		return func() {}, nil
+	}
+	l.mutex.Lock()
+	slots, ok := l.hosts[host]
+	if !ok {
+		slots = make(chan struct{}, limit)
+		l.hosts[host] = slots
+	}
+	l.mutex.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	default:
+	}
+
+	start := time.Now()
+	l.setQueued(host, 1)
+	defer l.setQueued(host, -1)
+	select {
+	case slots <- struct{}{}:
+		hostQueueWait.WithLabelValues(host).Observe(time.Since(start).Seconds())
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *hostLimiter) setQueued(host string, delta int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.queued[host] += delta
+	hostQueueDepth.WithLabelValues(host).Set(float64(l.queued[host]))
+}
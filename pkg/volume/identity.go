@@ -0,0 +1,110 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/klog"
+)
+
+const (
+	// annProvisionerIdentity records the identity of the provisioner
+	// deployment that provisioned a PV
+	annProvisionerIdentity = "gluster.simple/provisioner-identity"
+
+	// identityKey is the key of the identity in the IdentityConfigMap
+	identityKey = "identity"
+)
+
+// loadIdentity returns the identity stored in the IdentityConfigMap,
+// generating and storing one on first use, so that all replicas and
+// restarts of a provisioner deployment share it
+func (p *glusterfsProvisioner) loadIdentity(ctx context.Context) (types.UID, error) {
+	namespace, name, err := splitNamespacedName(p.options.IdentityConfigMap)
+	if err != nil {
+		return "", err
+	}
+	configMaps := p.client.CoreV1().ConfigMaps(namespace)
+	for {
+		cm, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+		if err == nil {
+			if identity := cm.Data[identityKey]; identity != "" {
+				return types.UID(identity), nil
+			}
+			identity := uuid.NewUUID()
+			if cm.Data == nil {
+				cm.Data = make(map[string]string)
+			}
+			cm.Data[identityKey] = string(identity)
+			_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+			if errors.IsConflict(err) {
+				// Another replica may have stored an identity meanwhile
+				continue
+			}
+			if err != nil {
+				return "", err
+			}
+			klog.Infof("glusterfs: generated provisioner identity %s", identity)
+			return identity, nil
+		}
+		if !errors.IsNotFound(err) {
+			return "", err
+		}
+		identity := uuid.NewUUID()
+		_, err = configMaps.Create(ctx, &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Data:       map[string]string{identityKey: string(identity)},
+		}, metav1.CreateOptions{})
+		if errors.IsAlreadyExists(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		klog.Infof("glusterfs: generated provisioner identity %s", identity)
+		return identity, nil
+	}
+}
+
+// setIdentityAnnotation stamps the identity of the provisioner on a PV
+func (p *glusterfsProvisioner) setIdentityAnnotation(annotations map[string]string) {
+	if p.identity != "" {
+		annotations[annProvisionerIdentity] = string(p.identity)
+	}
+}
+
+// checkOwner returns an error if volume was provisioned by another
+// provisioner identity, unless the Takeover option is set. Volumes without
+// an identity, and provisioners without one, are not fenced.
+func (p *glusterfsProvisioner) checkOwner(volume *v1.PersistentVolume) error {
+	owner := volume.Annotations[annProvisionerIdentity]
+	if owner == "" || p.identity == "" || types.UID(owner) == p.identity {
+		return nil
+	}
+	if p.options.Takeover {
+		klog.Infof("glusterfs: taking over volume %s of provisioner identity %s", volume.Name, owner)
+		return nil
+	}
+	err := fmt.Errorf("volume %s belongs to provisioner identity %s, not %s; delete it from its provisioner, transfer it or set --takeover",
+		volume.Name, owner, p.identity)
+	p.recorder.Event(volume, v1.EventTypeWarning, "VolumeFenced", err.Error())
+	return err
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	gerrors "gluster-simple-provisioner/pkg/errors"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+)
+
+// annImported marks PVs created for existing gluster volumes
+const annImported = "gluster.simple/imported"
+
+// ImportOptions describe an existing gluster volume to import as a PV
+type ImportOptions struct {
+	// StorageClass serving the gluster cluster of the volume
+	StorageClass string
+	// Volume is the name of the gluster volume
+	Volume string
+	// Size is the capacity of the PV
+	Size resource.Quantity
+	// Namespace of the endpoints and service of the volume
+	Namespace string
+	// ClaimName optionally pre-binds the PV to a claim in Namespace
+	ClaimName string
+}
+
+// volumeInfoXML is the output of `gluster volume info <volume> --xml`
+type volumeInfoXML struct {
+	XMLName  xml.Name          `xml:"cliOutput"`
+	OpRet    int               `xml:"opRet"`
+	OpErrstr string            `xml:"opErrstr"`
+	Volumes  []volumeInfoEntry `xml:"volInfo>volumes>volume"`
+}
+
+// volumeInfoEntry is one volume of `gluster volume info --xml`
+type volumeInfoEntry struct {
+	Name       string   `xml:"name"`
+	StatusStr  string   `xml:"statusStr"`
+	TypeStr    string   `xml:"typeStr"`
+	BrickNames []string `xml:"bricks>brick>name"`
+	Options    []struct {
+		Name  string `xml:"name"`
+		Value string `xml:"value"`
+	} `xml:"options>option"`
+}
+
+// volumeInfo returns the info of the gluster volume of cfg
+func (p *glusterfsProvisioner) volumeInfo(ctx context.Context, cfg *ProvisionerConfig) (*volumeInfoEntry, error) {
+	out, err := p.executeCommandOnHost(ctx, cfg.BrickRootPaths[0].Host,
+		fmt.Sprintf("gluster --mode=script volume info %s --xml", shellQuote(cfg.VolumeName)), cfg)
+	if err != nil {
+		return nil, err
+	}
+	var info volumeInfoXML
+	err = xml.Unmarshal([]byte(out), &info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse volume info of %s: %v", cfg.VolumeName, err)
+	}
+	if info.OpRet != 0 || len(info.Volumes) != 1 {
+		return nil, fmt.Errorf("volume info of %s failed: %s", cfg.VolumeName, info.OpErrstr)
+	}
+	return &info.Volumes[0], nil
+}
+
+// volumeBricks returns the bricks of the gluster volume of cfg
+func (p *glusterfsProvisioner) volumeBricks(ctx context.Context, cfg *ProvisionerConfig) ([]glusterBrick, error) {
+	info, err := p.volumeInfo(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	var bricks []glusterBrick
+	for _, name := range info.BrickNames {
+		i := strings.LastIndex(name, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("brick %q of volume %s is invalid", name, cfg.VolumeName)
+		}
+		bricks = append(bricks, glusterBrick{Host: cfg.managementHost(name[:i]), Path: name[i+1:]})
+	}
+	return bricks, nil
+}
+
+// ImportVolume creates a PV, endpoints and service for an existing gluster
+// volume. The PV is retained on release so that the imported data is never
+// deleted by the provisioner.
+func ImportVolume(ctx context.Context, config *rest.Config, client kubernetes.Interface, options ImportOptions) (*v1.PersistentVolume, error) {
+	p := newGlusterfsProvisionerInternal(config, client, Options{})
+	return p.importVolume(ctx, options)
+}
+
+func (p *glusterfsProvisioner) importVolume(ctx context.Context, options ImportOptions) (*v1.PersistentVolume, error) {
+	class, err := p.client.StorageV1().StorageClasses().Get(ctx, options.StorageClass, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := p.newProvisionerConfig(ctx, options.Volume, class.Parameters)
+	if err != nil {
+		return nil, gerrors.Configf("Parameter is invalid: %s", err)
+	}
+
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, pv := range pvs.Items {
+		if pv.Spec.Glusterfs != nil && pv.Spec.Glusterfs.Path == options.Volume {
+			return nil, fmt.Errorf("gluster volume %s is already used by PV %s", options.Volume, pv.Name)
+		}
+	}
+
+	bricks, err := p.volumeBricks(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	hosts := cfg.dataHosts(bricks)
+
+	pvName := "glusterfs-" + strings.ToLower(strings.Replace(options.Volume, "_", "-", -1))
+	epServiceName := dynamicEpSvcPrefix + pvName
+	endpoint, _, err := p.createEndpointService(ctx, options.Namespace, epServiceName, hosts, options.ClaimName, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	accessModes := []v1.PersistentVolumeAccessMode{v1.ReadWriteMany, v1.ReadWriteOnce, v1.ReadOnlyMany}
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: pvName,
+			Annotations: map[string]string{
+				annImported: "true",
+				annBricks:   formatBricks(bricks),
+			},
+		},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: v1.PersistentVolumeReclaimRetain,
+			StorageClassName:              class.Name,
+			AccessModes:                   accessModes,
+			Capacity: v1.ResourceList{
+				v1.ResourceStorage: options.Size,
+			},
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				Glusterfs: &v1.GlusterfsPersistentVolumeSource{
+					EndpointsName:      endpoint.Name,
+					EndpointsNamespace: &options.Namespace,
+					Path:               options.Volume,
+				},
+			},
+		},
+	}
+	if options.ClaimName != "" {
+		pv.Spec.ClaimRef = &v1.ObjectReference{
+			Kind:      "PersistentVolumeClaim",
+			Namespace: options.Namespace,
+			Name:      options.ClaimName,
+		}
+	}
+	pv, err = p.client.CoreV1().PersistentVolumes().Create(ctx, pv, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("glusterfs: imported gluster volume %s as PV %s", options.Volume, pv.Name)
+	return pv, nil
+}
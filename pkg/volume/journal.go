@@ -0,0 +1,136 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// journalKeyPrefix prefixes the keys of journal entries in the state
+	// ConfigMap, followed by the PV name
+	journalKeyPrefix = "journal."
+	// journalStaleAfter is how long an entry must be left untouched before it
+	// is considered abandoned by a crashed provisioner
+	journalStaleAfter = 30 * time.Minute
+	// journalRecoverPeriod is how often abandoned entries are recovered
+	journalRecoverPeriod = 5 * time.Minute
+)
+
+// Steps recorded in the provisioning journal
+const (
+	journalStepStarted     = "started"
+	journalStepBricks      = "bricks-created"
+	journalStepVolume      = "volume-created"
+	journalStepEndpoints   = "endpoints-created"
+	journalStepProvisioned = "provisioned"
+)
+
+// journalEntry records the steps of a Provision completed so far, so that a
+// provisioner crashing halfway never leaves gluster volumes nobody tracks
+type journalEntry struct {
+	Operation string             `json:"operation,omitempty"`
+	PVName    string             `json:"pvName"`
+	Namespace string             `json:"namespace"`
+	Name      string             `json:"name"`
+	Config    *ProvisionerConfig `json:"config"`
+	Bricks    []glusterBrick     `json:"bricks"`
+	Steps     []string           `json:"steps"`
+	Updated   string             `json:"updated"`
+}
+
+// journalStep appends step to entry and writes it to the state ConfigMap.
+// Without a state ConfigMap there is no journal.
+func (p *glusterfsProvisioner) journalStep(ctx context.Context, entry *journalEntry, step string) error {
+	if entry == nil || p.options.StateConfigMap == "" {
+		return nil
+	}
+	entry.Steps = append(entry.Steps, step)
+	entry.Updated = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	err = p.updateStateConfigMap(ctx, journalKeyPrefix+entry.PVName, string(data))
+	if err != nil {
+		klog.Errorf("%sglusterfs: failed to journal step %s of volume %s: %v", logPrefix(ctx), step, entry.PVName, err)
+	}
+	return err
+}
+
+// recoverJournal rolls back provisioning abandoned by a crashed provisioner
+// and drops the entries of provisioning that completed
+func (p *glusterfsProvisioner) recoverJournal(ctx context.Context) {
+	state, err := p.readStateConfigMap(ctx)
+	if err != nil {
+		klog.Errorf("glusterfs: failed to read journal: %v", err)
+		return
+	}
+	for key, value := range state {
+		if !strings.HasPrefix(key, journalKeyPrefix) {
+			continue
+		}
+		var entry journalEntry
+		err := json.Unmarshal([]byte(value), &entry)
+		if err != nil {
+			klog.Errorf("glusterfs: journal entry %s is invalid, dropping it: %v", key, err)
+			p.updateStateConfigMap(ctx, key, "")
+			continue
+		}
+		err = p.recoverJournalEntry(ctx, key, &entry)
+		if err != nil {
+			klog.Errorf("glusterfs: failed to recover provisioning of volume %s: %v", entry.PVName, err)
+		}
+	}
+}
+
+func (p *glusterfsProvisioner) recoverJournalEntry(ctx context.Context, key string, entry *journalEntry) error {
+	_, err := p.client.CoreV1().PersistentVolumes().Get(ctx, entry.PVName, metav1.GetOptions{})
+	if err == nil {
+		// The PV was saved, the volume is tracked by it
+		return p.updateStateConfigMap(ctx, key, "")
+	}
+	if !errors.IsNotFound(err) {
+		return err
+	}
+	updated, err := time.Parse(time.RFC3339, entry.Updated)
+	if err == nil && time.Since(updated) < journalStaleAfter {
+		// Still in progress, or retried by the controller
+		return nil
+	}
+
+	ctx = withOperation(ctx, entry.Operation)
+	klog.Infof("%sglusterfs: rolling back abandoned provisioning of volume %s after steps %s",
+		logPrefix(ctx), entry.PVName, strings.Join(entry.Steps, ","))
+	volumeCreated := false
+	for _, step := range entry.Steps {
+		volumeCreated = volumeCreated || step == journalStepVolume
+	}
+	err = p.rollbackVolume(ctx, entry.Namespace, entry.Name, entry.Config, entry.Bricks, volumeCreated)
+	if err != nil {
+		return err
+	}
+	err = p.releaseBrickCapacity(ctx, entry.Config)
+	if err != nil {
+		klog.Errorf("glusterfs: error to release brick capacity: %v", err)
+	}
+	return p.updateStateConfigMap(ctx, key, "")
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// Key providers, selected with the keyProvider parameter
+const (
+	// keyProviderSecret keeps keys in Secrets
+	keyProviderSecret = "secret"
+	// keyProviderVaultKV keeps keys in a Vault KV v2 secrets engine
+	keyProviderVaultKV = "vault-kv"
+	// keyProviderVaultTransit keeps keys in Secrets, encrypted by a Vault
+	// transit key
+	keyProviderVaultTransit = "vault-transit"
+)
+
+// keyProvider stores the per-volume keys of encrypted volumes. It holds LUKS
+// keys only; gluster TLS material lives in files on the hosts and nodes,
+// which the provisioner does not manage.
+type keyProvider interface {
+	// key returns the key named name of the volume of cfg, generating a
+	// random key of size bytes on first use
+	key(ctx context.Context, cfg *ProvisionerConfig, name string, size int) ([]byte, error)
+	// deleteKey deletes the key named name of the volume of cfg
+	deleteKey(ctx context.Context, cfg *ProvisionerConfig, name string) error
+}
+
+// keyProvider returns the key provider of cfg
+func (p *glusterfsProvisioner) keyProvider(cfg *ProvisionerConfig) (keyProvider, error) {
+	switch cfg.KeyProvider {
+	case "", keyProviderSecret:
+		return &secretKeyProvider{client: p.client}, nil
+	case keyProviderVaultKV, keyProviderVaultTransit:
+		if p.vault == nil {
+			return nil, fmt.Errorf("key provider %s needs the provisioner to be started with --vault-address", cfg.KeyProvider)
+		}
+		if cfg.KeyProvider == keyProviderVaultKV {
+			return &vaultKVKeyProvider{vault: p.vault}, nil
+		}
+		return &vaultTransitKeyProvider{vault: p.vault, client: p.client}, nil
+	}
+	return nil, fmt.Errorf("unknown key provider %s", cfg.KeyProvider)
+}
+
+func randomKey(size int) ([]byte, error) {
+	key := make([]byte, size)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+// secretKeyProvider keeps keys as they are in Secrets of the
+// encryptionSecretNamespace
+type secretKeyProvider struct {
+	client kubernetes.Interface
+}
+
+func (s *secretKeyProvider) key(ctx context.Context, cfg *ProvisionerConfig, name string, size int) ([]byte, error) {
+	return getOrCreateSecretKey(ctx, s.client, cfg.EncryptionSecretNamespace, name, func() ([]byte, error) {
+		return randomKey(size)
+	}, func(stored []byte) ([]byte, error) {
+		return stored, nil
+	})
+}
+
+func (s *secretKeyProvider) deleteKey(ctx context.Context, cfg *ProvisionerConfig, name string) error {
+	return deleteSecretKey(ctx, s.client, cfg.EncryptionSecretNamespace, name)
+}
+
+// getOrCreateSecretKey returns the key stored in the Secret namespace/name,
+// decoded by decode, or stores a new one returned by generate
+func getOrCreateSecretKey(
+	ctx context.Context,
+	client kubernetes.Interface,
+	namespace string, name string,
+	generate func() ([]byte, error),
+	decode func([]byte) ([]byte, error),
+) ([]byte, error) {
+	secrets := client.CoreV1().Secrets(namespace)
+	secret, err := secrets.Get(ctx, name, metav1.GetOptions{})
+	if err == nil {
+		stored, ok := secret.Data[keySecretKey]
+		if !ok {
+			return nil, fmt.Errorf("secret %s/%s has no %s", namespace, name, keySecretKey)
+		}
+		return decode(stored)
+	}
+	if !errors.IsNotFound(err) {
+		return nil, err
+	}
+
+	stored, err := generate()
+	if err != nil {
+		return nil, err
+	}
+	_, err = secrets.Create(ctx, &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Annotations: map[string]string{annCreatedBy: createdBy},
+		},
+		Type: v1.SecretTypeOpaque,
+		Data: map[string][]byte{keySecretKey: stored},
+	}, metav1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		// Created concurrently by another brick of the volume
+		return getOrCreateSecretKey(ctx, client, namespace, name, generate, decode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("glusterfs: created key %s/%s", namespace, name)
+	return decode(stored)
+}
+
+func deleteSecretKey(ctx context.Context, client kubernetes.Interface, namespace string, name string) error {
+	err := client.CoreV1().Secrets(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// vaultKVKeyProvider keeps keys in Vault, nothing is stored in the cluster
+type vaultKVKeyProvider struct {
+	vault *vaultClient
+}
+
+func (v *vaultKVKeyProvider) key(ctx context.Context, cfg *ProvisionerConfig, name string, size int) ([]byte, error) {
+	key, err := v.vault.readKV(ctx, name)
+	if err != nil || key != nil {
+		return key, err
+	}
+	key, err = randomKey(size)
+	if err != nil {
+		return nil, err
+	}
+	created, err := v.vault.createKV(ctx, name, key)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		// Created concurrently by another brick of the volume
+		return v.vault.readKV(ctx, name)
+	}
+	klog.Infof("glusterfs: created key %s in vault", name)
+	return key, nil
+}
+
+func (v *vaultKVKeyProvider) deleteKey(ctx context.Context, cfg *ProvisionerConfig, name string) error {
+	return v.vault.deleteKV(ctx, name)
+}
+
+// vaultTransitKeyProvider keeps keys in Secrets, encrypted with a Vault
+// transit key, so that the cluster never stores them unencrypted
+type vaultTransitKeyProvider struct {
+	vault  *vaultClient
+	client kubernetes.Interface
+}
+
+func (v *vaultTransitKeyProvider) key(ctx context.Context, cfg *ProvisionerConfig, name string, size int) ([]byte, error) {
+	return getOrCreateSecretKey(ctx, v.client, cfg.EncryptionSecretNamespace, name, func() ([]byte, error) {
+		ciphertext, err := v.vault.dataKey(ctx, size)
+		return []byte(ciphertext), err
+	}, func(stored []byte) ([]byte, error) {
+		return v.vault.decrypt(ctx, string(stored))
+	})
+}
+
+func (v *vaultTransitKeyProvider) deleteKey(ctx context.Context, cfg *ProvisionerConfig, name string) error {
+	return deleteSecretKey(ctx, v.client, cfg.EncryptionSecretNamespace, name)
+}
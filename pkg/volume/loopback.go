@@ -0,0 +1,77 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/klog"
+)
+
+// brickBackendLoopback creates every brick as a sparse image file of the
+// claim size, formatted with XFS and loop mounted on the brick path. Meant
+// for dev and test clusters without dedicated disks.
+const brickBackendLoopback = "loopback"
+
+// loopbackImage returns the path of the image file of a loopback brick
+func loopbackImage(brick glusterBrick) string {
+	return brick.Path + ".img"
+}
+
+// createLoopbackBrick creates, formats and mounts the image of brick. With
+// LUKS encryption the image is encrypted and its decrypted device mounted.
+func (p *glusterfsProvisioner) createLoopbackBrick(ctx context.Context, brick glusterBrick, size int64, cfg *ProvisionerConfig) error {
+	image := loopbackImage(brick)
+	err := p.ExecuteCommands(ctx, brick.Host, []string{
+		fmt.Sprintf("truncate -s %d %s", size, shellQuote(image)),
+	}, cfg)
+	if err != nil {
+		return err
+	}
+
+	device := image
+	mountOptions := "-o loop "
+	if cfg.Encryption == encryptionLUKS {
+		device, err = p.openLUKSDevice(ctx, brick, image, cfg)
+		if err != nil {
+			return err
+		}
+		mountOptions = ""
+	}
+	klog.Infof("mount %s:%s %s", brick.Host, device, brick.Path)
+	return p.ExecuteCommands(ctx, brick.Host, []string{
+		fmt.Sprintf("mkfs.xfs -q -i size=%d %s", minXFSInodeSize, shellQuote(device)),
+		fmt.Sprintf("mkdir -p %s", shellQuote(brick.Path)),
+		fmt.Sprintf("mount %s%s %s", mountOptions, shellQuote(device), shellQuote(brick.Path)),
+	}, cfg)
+}
+
+// deleteLoopbackBrick unmounts brick and removes its mountpoint and image
+func (p *glusterfsProvisioner) deleteLoopbackBrick(ctx context.Context, brick glusterBrick, cfg *ProvisionerConfig) error {
+	image := loopbackImage(brick)
+	klog.Infof("umount %s:%s, rm -f %s", brick.Host, brick.Path, image)
+	cmds := []string{
+		fmt.Sprintf("if mountpoint -q %s; then umount %s; fi", shellQuote(brick.Path), shellQuote(brick.Path)),
+	}
+	if cfg.Encryption == encryptionLUKS {
+		mapper := luksMapperName(brick)
+		cmds = append(cmds, fmt.Sprintf("if [ -e %s ]; then cryptsetup close %s; fi", shellQuote("/dev/mapper/"+mapper), shellQuote(mapper)))
+	}
+	cmds = append(cmds,
+		cfg.heavy(fmt.Sprintf("rm -rf %s", shellQuote(brick.Path))),
+		fmt.Sprintf("rm -f %s", shellQuote(image)),
+	)
+	return p.ExecuteCommands(ctx, brick.Host, cmds, cfg)
+}
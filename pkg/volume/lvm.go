@@ -0,0 +1,102 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// brickBackendLVM creates every brick as a logical volume of the claim size
+// in brickVolumeGroup, optionally thin provisioned from brickThinPool,
+// formatted with XFS and mounted on the brick path
+const brickBackendLVM = "lvm"
+
+// lvmNameRegexp matches the names LVM allows for volume groups and logical
+// volumes
+var lvmNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9+_.][a-zA-Z0-9+_.-]*$`)
+
+// validateLVMName checks that name, the value of param, is an LVM name
+func validateLVMName(param string, name string) error {
+	if !lvmNameRegexp.MatchString(name) {
+		return fmt.Errorf("%s %q is invalid: only letters, digits and `+_.-` are allowed", param, name)
+	}
+	return nil
+}
+
+// lvmVolumeName returns the name of the logical volume of brick, which is
+// unique per volume group since brick paths are unique per host
+func lvmVolumeName(brick glusterBrick) string {
+	name := strings.ReplaceAll(strings.Trim(brick.Path, "/"), "/", "-")
+	return "gluster-" + strings.ReplaceAll(name, "@", "_")
+}
+
+// lvmDevice returns the device of the logical volume of brick
+func lvmDevice(brick glusterBrick, cfg *ProvisionerConfig) string {
+	return "/dev/" + cfg.BrickVolumeGroup + "/" + lvmVolumeName(brick)
+}
+
+// createLVMBrick creates, formats and mounts the logical volume of brick.
+// With LUKS encryption the logical volume is encrypted and its decrypted
+// device mounted.
+func (p *glusterfsProvisioner) createLVMBrick(ctx context.Context, brick glusterBrick, size int64, cfg *ProvisionerConfig) error {
+	lv := lvmVolumeName(brick)
+	create := fmt.Sprintf("lvcreate --yes --size %db --name %s %s", size, shellQuote(lv), shellQuote(cfg.BrickVolumeGroup))
+	if cfg.BrickThinPool != "" {
+		create = fmt.Sprintf("lvcreate --yes --virtualsize %db --thin %s --name %s",
+			size, shellQuote(cfg.BrickVolumeGroup+"/"+cfg.BrickThinPool), shellQuote(lv))
+	}
+	klog.Infof("lvcreate %s:%s/%s", brick.Host, cfg.BrickVolumeGroup, lv)
+	err := p.ExecuteCommands(ctx, brick.Host, []string{create}, cfg)
+	if err != nil {
+		return err
+	}
+
+	device := lvmDevice(brick, cfg)
+	if cfg.Encryption == encryptionLUKS {
+		device, err = p.openLUKSDevice(ctx, brick, device, cfg)
+		if err != nil {
+			return err
+		}
+	}
+	klog.Infof("mount %s:%s %s", brick.Host, device, brick.Path)
+	return p.ExecuteCommands(ctx, brick.Host, []string{
+		fmt.Sprintf("mkfs.xfs -q -i size=%d %s", minXFSInodeSize, shellQuote(device)),
+		fmt.Sprintf("mkdir -p %s", shellQuote(brick.Path)),
+		fmt.Sprintf("mount %s %s", shellQuote(device), shellQuote(brick.Path)),
+	}, cfg)
+}
+
+// deleteLVMBrick unmounts brick and removes its mountpoint and logical
+// volume
+func (p *glusterfsProvisioner) deleteLVMBrick(ctx context.Context, brick glusterBrick, cfg *ProvisionerConfig) error {
+	lv := cfg.BrickVolumeGroup + "/" + lvmVolumeName(brick)
+	klog.Infof("umount %s:%s, lvremove %s", brick.Host, brick.Path, lv)
+	cmds := []string{
+		fmt.Sprintf("if mountpoint -q %s; then umount %s; fi", shellQuote(brick.Path), shellQuote(brick.Path)),
+	}
+	if cfg.Encryption == encryptionLUKS {
+		mapper := luksMapperName(brick)
+		cmds = append(cmds, fmt.Sprintf("if [ -e %s ]; then cryptsetup close %s; fi", shellQuote("/dev/mapper/"+mapper), shellQuote(mapper)))
+	}
+	cmds = append(cmds,
+		cfg.heavy(fmt.Sprintf("rm -rf %s", shellQuote(brick.Path))),
+		fmt.Sprintf("if lvs %s >/dev/null 2>&1; then lvremove --yes %s; fi", shellQuote(lv), shellQuote(lv)),
+	)
+	return p.ExecuteCommands(ctx, brick.Host, cmds, cfg)
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	gerrors "gluster-simple-provisioner/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// annMaintenance set to "true" on a Node cordons the brick host with its
+// name or one of its addresses
+const annMaintenance = "gluster.simple/maintenance"
+
+// maintenanceHosts returns the hosts in maintenance: those of cfg and the
+// names and addresses of annotated nodes. Nodes that cannot be listed are
+// logged and ignored so that provisioning does not depend on them.
+func (p *glusterfsProvisioner) maintenanceHosts(ctx context.Context, cfg *ProvisionerConfig) map[string]bool {
+	hosts := make(map[string]bool)
+	for _, host := range cfg.MaintenanceHosts {
+		hosts[host] = true
+	}
+	if p.client == nil {
+		return hosts
+	}
+	nodes, err := p.client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("glusterfs: failed to list nodes in maintenance: %v", err)
+		return hosts
+	}
+	for _, node := range nodes.Items {
+		if strings.ToLower(node.Annotations[annMaintenance]) != "true" {
+			continue
+		}
+		hosts[node.Name] = true
+		for _, address := range node.Status.Addresses {
+			hosts[address.Address] = true
+		}
+	}
+	return hosts
+}
+
+// excludeMaintenanceHosts keeps new bricks of the volume of cfg off hosts in
+// maintenance. Classes with brickCount get other brick roots chosen, classes
+// using all brick roots cannot provision until the maintenance ends.
+func (p *glusterfsProvisioner) excludeMaintenanceHosts(ctx context.Context, cfg *ProvisionerConfig) error {
+	hosts := p.maintenanceHosts(ctx, cfg)
+	inMaintenance := func(root BrickRootPath) bool {
+		return hosts[root.Host] || hosts[cfg.dataAddress(root.Host)]
+	}
+	affected := ""
+	for _, root := range cfg.BrickRootPaths {
+		if inMaintenance(root) {
+			affected = root.Host
+			break
+		}
+	}
+	if affected == "" {
+		return nil
+	}
+	if cfg.BrickCount == 0 {
+		return gerrors.Transient(fmt.Errorf("brick host %s is in maintenance and the class places bricks on all of its brick roots", affected))
+	}
+	var candidates []BrickRootPath
+	for _, root := range cfg.allBrickRoots() {
+		if !inMaintenance(root) {
+			candidates = append(candidates, root)
+		}
+	}
+	if len(candidates) < cfg.BrickCount {
+		return gerrors.Transient(fmt.Errorf("only %d brick roots are not in maintenance, brickCount is %d", len(candidates), cfg.BrickCount))
+	}
+	if err := cfg.placeVolumeOn(candidates); err != nil {
+		return gerrors.Transient(fmt.Errorf("brick roots not in maintenance cannot hold the volume: %v", err))
+	}
+	klog.Infof("glusterfs: brick host %s is in maintenance, placing volume %s on other brick roots", affected, cfg.VolumeName)
+	return nil
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	gerrors "gluster-simple-provisioner/pkg/errors"
+	"k8s.io/klog"
+)
+
+const metricsNamespace = "glusterfs_simple"
+
+var (
+	volumeHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "volume_healthy",
+		Help:      "Whether all bricks of the gluster volume are online (1) or not (0).",
+	}, []string{"persistentvolume", "volume"})
+
+	volumeBricksOnline = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "volume_bricks_online",
+		Help:      "Number of online bricks of the gluster volume.",
+	}, []string{"persistentvolume", "volume"})
+
+	volumeBricks = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "volume_bricks",
+		Help:      "Number of bricks of the gluster volume.",
+	}, []string{"persistentvolume", "volume"})
+
+	volumeUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "volume_used_bytes",
+		Help:      "Bytes used by the gluster volume, brick usage divided by the replica count.",
+	}, []string{"persistentvolume", "volume", "namespace", "persistentvolumeclaim"})
+
+	volumeCapacityBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "volume_capacity_bytes",
+		Help:      "Capacity of the persistent volume.",
+	}, []string{"persistentvolume", "volume", "namespace", "persistentvolumeclaim"})
+
+	brickUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "brick_used_bytes",
+		Help:      "Bytes used by a brick of the gluster volume.",
+	}, []string{"persistentvolume", "volume", "brick"})
+
+	volumeQuotaUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "volume_quota_used_bytes",
+		Help:      "Bytes used by the gluster volume according to its quota.",
+	}, []string{"persistentvolume", "volume", "namespace", "persistentvolumeclaim"})
+
+	volumeQuotaSoftLimitExceeded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "volume_quota_soft_limit_exceeded",
+		Help:      "Whether the gluster volume uses more than the soft limit of its quota (1) or not (0).",
+	}, []string{"persistentvolume", "volume", "namespace", "persistentvolumeclaim"})
+
+	volumeQuotaHardLimitExceeded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "volume_quota_hard_limit_exceeded",
+		Help:      "Whether the gluster volume reached the hard limit of its quota (1) or not (0).",
+	}, []string{"persistentvolume", "volume", "namespace", "persistentvolumeclaim"})
+
+	brickPoolSizeBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "brick_pool_size_bytes",
+		Help:      "Size of the brick roots of a host in a BrickPool.",
+	}, []string{"brickpool", "host"})
+
+	brickPoolCommittedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "brick_pool_committed_bytes",
+		Help:      "Capacity reserved by provisioned volumes on a host in a BrickPool.",
+	}, []string{"brickpool", "host"})
+
+	storageClassValid = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "storage_class_valid",
+		Help:      "Whether the parameters of a StorageClass served by the provisioner are valid (1) or not (0).",
+	}, []string{"storageclass"})
+
+	deprecatedParameters = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "deprecated_parameters_total",
+		Help:      "Times a deprecated StorageClass parameter was replaced by its canonical parameter.",
+	}, []string{"parameter"})
+
+	tenantQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "tenant_queue_depth",
+		Help:      "Claims of a namespace waiting for its provisioning rate or concurrency limit.",
+	}, []string{"namespace"})
+
+	tenantQueueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "tenant_queue_wait_seconds",
+		Help:      "Time from the creation of a claim until it was admitted for provisioning.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 14),
+	}, []string{"namespace"})
+
+	hostQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "host_queue_depth",
+		Help:      "Commands waiting for a free slot on a gluster host.",
+	}, []string{"host"})
+
+	hostQueueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "host_queue_wait_seconds",
+		Help:      "Time commands waited for a free slot on a gluster host.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"host"})
+
+	brickRemovalsPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "brick_removals_pending",
+		Help:      "Bricks being removed in the background.",
+	})
+
+	brickRemovalDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "brick_removal_duration_seconds",
+		Help:      "Duration of the background removal of bricks, as observed by the periodic checks.",
+		Buckets:   prometheus.ExponentialBuckets(60, 2, 12),
+	})
+
+	operationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "operation_errors_total",
+		Help:      "Failed provisioning and deletion attempts by class of error: transient, config, backend or unknown.",
+	}, []string{"operation", "kind"})
+
+	operationStepDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "operation_step_duration_seconds",
+		Help:      "Duration of the steps of provisioning and deleting volumes.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"operation", "step", "result"})
+
+	commandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "command_duration_seconds",
+		Help:      "Duration of commands run in the glusterfs pods.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"host", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(volumeHealthy, volumeBricksOnline, volumeBricks)
+	prometheus.MustRegister(volumeUsedBytes, volumeCapacityBytes, brickUsedBytes)
+	prometheus.MustRegister(volumeQuotaUsedBytes, volumeQuotaSoftLimitExceeded, volumeQuotaHardLimitExceeded)
+	prometheus.MustRegister(brickPoolSizeBytes, brickPoolCommittedBytes)
+	prometheus.MustRegister(storageClassValid, deprecatedParameters)
+	prometheus.MustRegister(tenantQueueDepth, tenantQueueWait)
+	prometheus.MustRegister(hostQueueDepth, hostQueueWait)
+	prometheus.MustRegister(brickRemovalsPending, brickRemovalDuration)
+	prometheus.MustRegister(operationStepDuration, operationErrors, commandDuration)
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// observeStep records the duration of step of a Provision or Delete since
+// start, and logs it with the correlation ID of ctx
+func observeStep(ctx context.Context, operation string, step string, start time.Time, err error) {
+	duration := time.Since(start)
+	operationStepDuration.WithLabelValues(operation, step, resultLabel(err)).Observe(duration.Seconds())
+	recordSpan(ctx, step, spanKindInternal, start, map[string]string{"gluster.operation": operation}, err)
+	klog.V(2).Infof("%sglusterfs: %s step %s took %v: %s", logPrefix(ctx), operation, step, duration, resultLabel(err))
+}
+
+// observeError counts a failed attempt of operation by class of err
+func observeError(operation string, err error) {
+	if err != nil {
+		operationErrors.WithLabelValues(operation, gerrors.Kind(err)).Inc()
+	}
+}
+
+// observeCommand records the duration of a command on host since start
+func observeCommand(ctx context.Context, host string, start time.Time, err error) {
+	commandDuration.WithLabelValues(host, resultLabel(err)).Observe(time.Since(start).Seconds())
+	recordSpan(ctx, "exec", spanKindClient, start, map[string]string{"gluster.host": host}, err)
+}
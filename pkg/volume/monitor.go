@@ -0,0 +1,130 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// listProvisionedVolumes returns the PVs provisioned by this provisioner
+// instance. PVs of other instances sharing the cluster are left alone.
+func (p *glusterfsProvisioner) listProvisionedVolumes(ctx context.Context) ([]v1.PersistentVolume, error) {
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var volumes []v1.PersistentVolume
+	for _, pv := range pvs.Items {
+		if pv.Annotations[annCreatedBy] != createdBy || glusterVolumeName(&pv) == "" {
+			continue
+		}
+		if p.options.ProvisionerName != "" && pv.Annotations[annProvisionedBy] != p.options.ProvisionerName {
+			continue
+		}
+		volumes = append(volumes, pv)
+	}
+	return volumes, nil
+}
+
+// monitorVolumes checks the bricks of every provisioned volume, exports the
+// result as metrics and records an event on PVs whose health changed
+func (p *glusterfsProvisioner) monitorVolumes(ctx context.Context) {
+	volumes, err := p.listProvisionedVolumes(ctx)
+	if err != nil {
+		klog.Errorf("glusterfs: failed to list volumes to monitor: %v", err)
+		return
+	}
+
+	seen := make(map[string]bool)
+	for i := range volumes {
+		pv := &volumes[i]
+		seen[pv.Name] = true
+		err := p.monitorVolume(ctx, pv)
+		if err != nil {
+			klog.Errorf("glusterfs: failed to monitor volume %s: %v", pv.Name, err)
+		}
+	}
+
+	p.volumeHealthMutex.Lock()
+	defer p.volumeHealthMutex.Unlock()
+	for name, health := range p.volumeHealth {
+		if !seen[name] {
+			volumeHealthy.DeleteLabelValues(name, health.volume)
+			volumeBricksOnline.DeleteLabelValues(name, health.volume)
+			volumeBricks.DeleteLabelValues(name, health.volume)
+			delete(p.volumeHealth, name)
+		}
+	}
+}
+
+type volumeHealthState struct {
+	volume  string
+	healthy bool
+}
+
+func (p *glusterfsProvisioner) monitorVolume(ctx context.Context, pv *v1.PersistentVolume) error {
+	cfg, bricks, err := p.configForVolume(ctx, pv)
+	if err != nil {
+		return err
+	}
+
+	var online int
+	var offline []string
+	status, err := p.volumeStatus(ctx, bricks[0].Host, cfg)
+	if err != nil {
+		offline = []string{err.Error()}
+	} else {
+		for _, b := range bricks {
+			if status[cfg.glusterBrickName(b)] {
+				online++
+			} else {
+				offline = append(offline, b.Host+":"+b.Path)
+			}
+		}
+	}
+	healthy := online == len(bricks)
+
+	volumeBricks.WithLabelValues(pv.Name, cfg.VolumeName).Set(float64(len(bricks)))
+	volumeBricksOnline.WithLabelValues(pv.Name, cfg.VolumeName).Set(float64(online))
+	if healthy {
+		volumeHealthy.WithLabelValues(pv.Name, cfg.VolumeName).Set(1)
+	} else {
+		volumeHealthy.WithLabelValues(pv.Name, cfg.VolumeName).Set(0)
+	}
+
+	p.updateGlusterVolume(ctx, pv, cfg, bricks, func(status *GlusterVolumeStatus) {
+		status.Healthy = &healthy
+		status.BricksOnline = online
+	})
+
+	p.volumeHealthMutex.Lock()
+	previous, known := p.volumeHealth[pv.Name]
+	p.volumeHealth[pv.Name] = volumeHealthState{volume: cfg.VolumeName, healthy: healthy}
+	p.volumeHealthMutex.Unlock()
+
+	if !healthy && (!known || previous.healthy) {
+		p.recorder.Event(pv, v1.EventTypeWarning, "VolumeUnhealthy",
+			fmt.Sprintf("gluster volume %s has %d/%d bricks online, offline: %v", cfg.VolumeName, online, len(bricks), offline))
+	}
+	if healthy && known && !previous.healthy {
+		p.recorder.Event(pv, v1.EventTypeNormal, "VolumeHealthy",
+			fmt.Sprintf("all %d bricks of gluster volume %s are online", len(bricks), cfg.VolumeName))
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// annNFSExport marks PVs whose gluster volume is exported by NFS-Ganesha
+const annNFSExport = "gluster.simple/nfs-export"
+
+// exportNFS exports the volume of cfg with NFS-Ganesha
+func (p *glusterfsProvisioner) exportNFS(ctx context.Context, bricks []glusterBrick, cfg *ProvisionerConfig) error {
+	err := p.ExecuteCommands(ctx, bricks[0].Host, []string{
+		fmt.Sprintf("gluster --mode=script volume set %s ganesha.enable on", shellQuote(cfg.VolumeName)),
+	}, cfg)
+	if err != nil {
+		klog.Errorf("glusterfs: failed to export volume %s with NFS-Ganesha: %v", cfg.VolumeName, err)
+		return err
+	}
+	return nil
+}
+
+// unexportNFS removes the NFS-Ganesha export of the volume of cfg. Volumes
+// that are not exported fail to unexport, which is ignored.
+func (p *glusterfsProvisioner) unexportNFS(ctx context.Context, host string, cfg *ProvisionerConfig) {
+	err := p.ExecuteCommands(ctx, host, []string{
+		fmt.Sprintf("gluster --mode=script volume set %s ganesha.enable off", shellQuote(cfg.VolumeName)),
+	}, cfg)
+	if err != nil {
+		klog.Errorf("glusterfs: failed to unexport volume %s from NFS-Ganesha: %v", cfg.VolumeName, err)
+	}
+}
+
+// nfsSource returns the NFS source of the exported volume of cfg. Without
+// the nfsServer parameter the first brick host serves the export.
+func (config *ProvisionerConfig) nfsSource() *v1.NFSVolumeSource {
+	server := config.NFSServer
+	if server == "" {
+		server = config.BrickRootPaths[0].Host
+	}
+	return &v1.NFSVolumeSource{
+		Server:   server,
+		Path:     "/" + config.VolumeName,
+		ReadOnly: false,
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	gerrors "gluster-simple-provisioner/pkg/errors"
+	"k8s.io/api/core/v1"
+	"k8s.io/klog"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v8/controller"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v8/util"
+)
+
+const (
+	// notifyQueueSize is the number of notifications waiting to be sent;
+	// further notifications are dropped
+	notifyQueueSize = 1000
+	// notifyAttempts is how often sending a notification is attempted
+	notifyAttempts = 3
+)
+
+// Lifecycle events sent to the notify URL
+const (
+	notifyCreated      = "created"
+	notifyDeleted      = "deleted"
+	notifyCreateFailed = "create-failed"
+	notifyDeleteFailed = "delete-failed"
+)
+
+// Notification is the JSON body posted to the notify URL on volume lifecycle
+// events
+type Notification struct {
+	Event                 string `json:"event"`
+	Time                  string `json:"time"`
+	Provisioner           string `json:"provisioner,omitempty"`
+	Operation             string `json:"operation,omitempty"`
+	PersistentVolume      string `json:"persistentVolume"`
+	Volume                string `json:"volume,omitempty"`
+	Namespace             string `json:"namespace,omitempty"`
+	PersistentVolumeClaim string `json:"persistentVolumeClaim,omitempty"`
+	StorageClass          string `json:"storageClass,omitempty"`
+	CapacityBytes         int64  `json:"capacityBytes,omitempty"`
+	Error                 string `json:"error,omitempty"`
+	ErrorKind             string `json:"errorKind,omitempty"`
+}
+
+// notifier posts notifications to a URL in the background, so that a slow
+// or failing receiver never delays provisioning
+type notifier struct {
+	url   string
+	http  *http.Client
+	queue chan *Notification
+}
+
+func newNotifier(url string, timeout time.Duration) *notifier {
+	if url == "" {
+		return nil
+	}
+	return &notifier{
+		url:   url,
+		http:  &http.Client{Timeout: timeout},
+		queue: make(chan *Notification, notifyQueueSize),
+	}
+}
+
+// notify queues n, dropping it if the queue is full
+func (n *notifier) notify(notification *Notification) {
+	if n == nil {
+		return
+	}
+	notification.Time = time.Now().UTC().Format(time.RFC3339)
+	select {
+	case n.queue <- notification:
+	default:
+		klog.Errorf("glusterfs: notification queue is full, dropping %s notification of %s",
+			notification.Event, notification.PersistentVolume)
+	}
+}
+
+// run sends queued notifications until ctx is done
+func (n *notifier) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case notification := <-n.queue:
+			n.send(ctx, notification)
+		}
+	}
+}
+
+func (n *notifier) send(ctx context.Context, notification *Notification) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		klog.Errorf("glusterfs: failed to encode notification: %v", err)
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		err = n.post(ctx, body)
+		if err == nil {
+			return
+		}
+		if attempt == notifyAttempts {
+			klog.Errorf("glusterfs: failed to send %s notification of %s: %v", notification.Event, notification.PersistentVolume, err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+	}
+}
+
+func (n *notifier) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", n.url, resp.Status)
+	}
+	return nil
+}
+
+// notifyProvision notifies the outcome of provisioning a claim
+func (p *glusterfsProvisioner) notifyProvision(ctx context.Context, options controller.ProvisionOptions, pv *v1.PersistentVolume, err error) {
+	notification := &Notification{
+		Event:                 notifyCreated,
+		Provisioner:           p.options.ProvisionerName,
+		Operation:             operationID(ctx),
+		PersistentVolume:      options.PVName,
+		Namespace:             options.PVC.Namespace,
+		PersistentVolumeClaim: options.PVC.Name,
+		StorageClass:          options.StorageClass.Name,
+	}
+	if err != nil {
+		notification.Event = notifyCreateFailed
+		notification.Error = err.Error()
+		notification.ErrorKind = gerrors.Kind(err)
+	}
+	if pv != nil {
+		notification.Volume = glusterVolumeName(pv)
+		capacity := pv.Spec.Capacity[v1.ResourceStorage]
+		notification.CapacityBytes = capacity.Value()
+	}
+	p.notifier.notify(notification)
+}
+
+// notifyDelete notifies the outcome of deleting a volume
+func (p *glusterfsProvisioner) notifyDelete(ctx context.Context, volume *v1.PersistentVolume, err error) {
+	capacity := volume.Spec.Capacity[v1.ResourceStorage]
+	notification := &Notification{
+		Event:            notifyDeleted,
+		Provisioner:      p.options.ProvisionerName,
+		Operation:        operationID(ctx),
+		PersistentVolume: volume.Name,
+		Volume:           glusterVolumeName(volume),
+		StorageClass:     util.GetPersistentVolumeClass(volume),
+		CapacityBytes:    capacity.Value(),
+	}
+	if claim := volume.Spec.ClaimRef; claim != nil {
+		notification.Namespace = claim.Namespace
+		notification.PersistentVolumeClaim = claim.Name
+	}
+	if err != nil {
+		notification.Event = notifyDeleteFailed
+		notification.Error = err.Error()
+		notification.ErrorKind = gerrors.Kind(err)
+	}
+	p.notifier.notify(notification)
+}
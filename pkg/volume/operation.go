@@ -0,0 +1,44 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+)
+
+type operationKey struct{}
+
+// withOperation returns ctx carrying the correlation ID of a Provision or
+// Delete, which is the UID of its claim
+func withOperation(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, operationKey{}, id)
+}
+
+// operationID returns the correlation ID carried by ctx
+func operationID(ctx context.Context) string {
+	id, _ := ctx.Value(operationKey{}).(string)
+	return id
+}
+
+// logPrefix returns `[<id>] ` for log lines of the operation of ctx. The
+// JSON log format moves the ID into the `operation` field.
+func logPrefix(ctx context.Context) string {
+	if id := operationID(ctx); id != "" {
+		return "[" + id + "] "
+	}
+	return ""
+}
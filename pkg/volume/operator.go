@@ -0,0 +1,213 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog"
+)
+
+// operateVolumes reconciles every bound provisioned volume toward its
+// desired state: the gluster volume exists and is started, carries the
+// options of its class and GlusterVolume, and has endpoints and a service
+func (p *glusterfsProvisioner) operateVolumes(ctx context.Context) {
+	volumes, err := p.listProvisionedVolumes(ctx)
+	if err != nil {
+		klog.Errorf("glusterfs: failed to list volumes to reconcile: %v", err)
+		return
+	}
+	for i := range volumes {
+		pv := &volumes[i]
+		if pv.Status.Phase != v1.VolumeBound {
+			continue
+		}
+		if _, ok := pv.Annotations[annBlockVolume]; ok {
+			continue
+		}
+		err := p.operateVolume(ctx, pv)
+		if err != nil {
+			klog.Errorf("glusterfs: failed to reconcile volume %s: %v", pv.Name, err)
+		}
+	}
+}
+
+func (p *glusterfsProvisioner) operateVolume(ctx context.Context, pv *v1.PersistentVolume) error {
+	cfg, bricks, err := p.configForVolume(ctx, pv)
+	if err != nil {
+		return err
+	}
+
+	names, err := p.listGlusterVolumes(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	exists := false
+	for _, name := range names {
+		if name == cfg.VolumeName {
+			exists = true
+		}
+	}
+	if !exists {
+		return p.recreateVolume(ctx, pv, cfg, bricks)
+	}
+
+	info, err := p.volumeInfo(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if info.StatusStr != "Started" {
+		klog.Infof("glusterfs: starting %s volume %s", strings.ToLower(info.StatusStr), cfg.VolumeName)
+		err = p.ExecuteCommands(ctx, bricks[0].Host, []string{
+			fmt.Sprintf("gluster --mode=script volume start %s", shellQuote(cfg.VolumeName)),
+		}, cfg)
+		p.reportReconcile(ctx, pv, cfg, bricks, "StartVolume", err, fmt.Sprintf("volume was %s", info.StatusStr))
+		if err != nil {
+			return err
+		}
+	}
+
+	desired, err := p.desiredVolumeOptions(ctx, pv, cfg)
+	if err != nil {
+		return err
+	}
+	actual := make(map[string]string)
+	for _, option := range info.Options {
+		actual[option.Name] = option.Value
+	}
+	var cmds, changed []string
+	for _, name := range sortedKeys(desired) {
+		if actual[name] == desired[name] {
+			continue
+		}
+		cmd, err := cfg.command(commandSetVolumeOption, CommandData{
+			VolumeName: cfg.VolumeName,
+			Option:     name,
+			Value:      desired[name],
+		})
+		if err != nil {
+			return err
+		}
+		cmds = append(cmds, cmd)
+		changed = append(changed, name)
+	}
+	if len(cmds) > 0 {
+		klog.Infof("glusterfs: resetting drifted options %v of volume %s", changed, cfg.VolumeName)
+		err = p.ExecuteCommands(ctx, bricks[0].Host, cmds, cfg)
+		p.reportReconcile(ctx, pv, cfg, bricks, "SetOptions", err, strings.Join(changed, ","))
+		if err != nil {
+			return err
+		}
+	}
+
+	return p.reconcileEndpoints(ctx, pv, cfg, bricks)
+}
+
+// desiredVolumeOptions returns the options of the class of pv, overridden
+// by those in the spec of its GlusterVolume if the class allows claims to
+// override volumeOptions
+func (p *glusterfsProvisioner) desiredVolumeOptions(ctx context.Context, pv *v1.PersistentVolume, cfg *ProvisionerConfig) (map[string]string, error) {
+	desired := make(map[string]string)
+	for name, value := range cfg.VolumeOptions {
+		desired[name] = value
+	}
+	if !p.options.VolumeStatusObjects {
+		return desired, nil
+	}
+	u, err := p.dynamicClient.Resource(GlusterVolumeResource).Namespace(pv.Spec.ClaimRef.Namespace).Get(ctx, pv.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return desired, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	options, _, err := unstructured.NestedStringMap(u.Object, "spec", "options")
+	if err != nil {
+		return nil, fmt.Errorf("GlusterVolume %s/%s is invalid: %v", u.GetNamespace(), u.GetName(), err)
+	}
+	if len(options) == 0 {
+		return desired, nil
+	}
+	class, err := p.getStorageClass(ctx, volumeClassName(pv))
+	if err != nil {
+		return nil, err
+	}
+	if !allowedOverrides(class.Parameters)["volumeoptions"] {
+		klog.Warningf("glusterfs: ignoring options of GlusterVolume %s/%s, storage class %s does not allow overriding volumeOptions (allowedOverrides)",
+			u.GetNamespace(), u.GetName(), class.Name)
+		return desired, nil
+	}
+	for name, value := range options {
+		if err := ValidateVolumeOption(name); err != nil {
+			klog.Warningf("glusterfs: ignoring option of GlusterVolume %s/%s: %v", u.GetNamespace(), u.GetName(), err)
+			continue
+		}
+		desired[name] = value
+	}
+	return desired, nil
+}
+
+// recreateVolume recreates the missing gluster volume of pv on its recorded
+// bricks. Data left on the bricks is kept; bricks still marked as part of
+// the lost volume are refused by gluster unless the class sets forceCreate.
+func (p *glusterfsProvisioner) recreateVolume(ctx context.Context, pv *v1.PersistentVolume, cfg *ProvisionerConfig, bricks []glusterBrick) error {
+	klog.Warningf("glusterfs: gluster volume %s of PV %s is missing, recreating it", cfg.VolumeName, pv.Name)
+	var err error
+	for _, b := range bricks {
+		err = p.ExecuteCommands(ctx, b.Host, []string{fmt.Sprintf("mkdir -p %s", shellQuote(b.Path))}, cfg)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		_, err = p.createGlusterVolume(ctx, bricks, cfg)
+	}
+	if err == nil && cfg.Quota {
+		capacity := pv.Spec.Capacity[v1.ResourceStorage]
+		err = p.configureQuota(ctx, bricks, cfg, capacity.Value())
+	}
+	if err == nil && cfg.PVSource == pvSourceNFS {
+		err = p.exportNFS(ctx, bricks, cfg)
+	}
+	p.reportReconcile(ctx, pv, cfg, bricks, "RecreateVolume", err, "gluster volume was missing")
+	if err != nil {
+		return err
+	}
+	return p.reconcileEndpoints(ctx, pv, cfg, bricks)
+}
+
+// reportReconcile records a corrective action as event and in the
+// GlusterVolume of pv
+func (p *glusterfsProvisioner) reportReconcile(
+	ctx context.Context,
+	pv *v1.PersistentVolume,
+	cfg *ProvisionerConfig,
+	bricks []glusterBrick,
+	operation string,
+	err error,
+	message string,
+) {
+	if err != nil {
+		p.recorder.Event(pv, v1.EventTypeWarning, operation+"Failed", fmt.Sprintf("%s: %v", message, err))
+	} else {
+		p.recorder.Event(pv, v1.EventTypeNormal, operation, message)
+	}
+	p.recordVolumeOperation(ctx, pv, cfg, bricks, operation, err, message)
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	gerrors "gluster-simple-provisioner/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v8/util"
+)
+
+// OrphanReport lists the gluster volumes and PVs of a StorageClass that do
+// not match up
+type OrphanReport struct {
+	StorageClass string
+	// OrphanVolumes are gluster volumes no PV refers to
+	OrphanVolumes []string
+	// MissingVolumes maps PVs of the class to their missing gluster volume
+	MissingVolumes map[string]string
+	// Leftovers maps claims of the class to what failed provisionings
+	// could not roll back, see annRollbackLeftovers
+	Leftovers map[string][]string
+}
+
+// FindOrphans compares the gluster volumes of the cluster serving className
+// with the PVs of the Kubernetes cluster
+func FindOrphans(ctx context.Context, config *rest.Config, client kubernetes.Interface, className string) (*OrphanReport, error) {
+	p := newGlusterfsProvisionerInternal(config, client, Options{})
+	return p.findOrphans(ctx, className)
+}
+
+// listGlusterVolumes returns the names of the volumes of the cluster of cfg
+func (p *glusterfsProvisioner) listGlusterVolumes(ctx context.Context, cfg *ProvisionerConfig) ([]string, error) {
+	out, err := p.executeCommandOnHost(ctx, cfg.BrickRootPaths[0].Host, "gluster --mode=script volume list", cfg)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "No volumes present") {
+			continue
+		}
+		names = append(names, line)
+	}
+	return names, nil
+}
+
+func (p *glusterfsProvisioner) findOrphans(ctx context.Context, className string) (*OrphanReport, error) {
+	class, err := p.client.StorageV1().StorageClasses().Get(ctx, className, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := p.newProvisionerConfig(ctx, "", class.Parameters)
+	if err != nil {
+		return nil, gerrors.Configf("Parameter is invalid: %s", err)
+	}
+	names, err := p.listGlusterVolumes(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool)
+	for _, name := range names {
+		existing[name] = true
+	}
+
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	report := &OrphanReport{
+		StorageClass:   className,
+		MissingVolumes: make(map[string]string),
+	}
+	referenced := make(map[string]bool)
+	for _, pv := range pvs.Items {
+		volume := glusterVolumeName(&pv)
+		if volume == "" {
+			continue
+		}
+		// Any PV, provisioned or not, keeps its gluster volume from being an orphan
+		referenced[volume] = true
+		if util.GetPersistentVolumeClass(&pv) == className && !existing[volume] {
+			report.MissingVolumes[pv.Name] = volume
+		}
+	}
+	for _, name := range names {
+		if !referenced[name] {
+			report.OrphanVolumes = append(report.OrphanVolumes, name)
+		}
+	}
+	sort.Strings(report.OrphanVolumes)
+
+	pvcs, err := p.client.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	report.Leftovers = make(map[string][]string)
+	for _, pvc := range pvcs.Items {
+		value, ok := pvc.Annotations[annRollbackLeftovers]
+		if ok && util.GetPersistentVolumeClaimClass(&pvc) == className {
+			report.Leftovers[pvc.Namespace+"/"+pvc.Name] = strings.Split(value, ",")
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	"k8s.io/klog"
+)
+
+// annVolumeOptions records the volume options of a volume whose claim
+// overrode them
+const annVolumeOptions = "gluster.simple/volume-options"
+
+// claimOverrideAnnotations maps PVC annotations to the StorageClass
+// parameter they override
+var claimOverrideAnnotations = map[string]string{
+	annVolumeType:             "volumetype",
+	annVolumeOptions:          "volumeoptions",
+	"gluster.simple/profiles": "profiles",
+	"gluster.simple/pool":     "pool",
+}
+
+// applyClaimOverrides returns params with the override annotations of claim
+// applied. Only parameters listed in the `allowedOverrides` parameter of the
+// class may be overridden.
+func applyClaimOverrides(params map[string]string, claim *v1.PersistentVolumeClaim) (map[string]string, error) {
+	allowed := allowedOverrides(params)
+	overridden := params
+	for annotation, param := range claimOverrideAnnotations {
+		value, ok := claim.Annotations[annotation]
+		if !ok {
+			continue
+		}
+		if !allowed[param] {
+			return nil, fmt.Errorf("annotation %s is not allowed by the storage class (allowedOverrides)", annotation)
+		}
+		// Claims are written by tenants, the volume type ends up in
+		// `gluster volume create` on the brick hosts
+		if param == "volumetype" {
+			if _, err := parseVolumeType(value); err != nil {
+				return nil, fmt.Errorf("annotation %s is invalid: %v", annotation, err)
+			}
+		}
+		overridden = setParameter(overridden, param, value)
+	}
+	return overridden, nil
+}
+
+// allowedOverrides returns the lower case parameters listed in the
+// `allowedOverrides` parameter
+func allowedOverrides(params map[string]string) map[string]bool {
+	allowed := make(map[string]bool)
+	for k, v := range params {
+		if strings.ToLower(k) != "allowedoverrides" {
+			continue
+		}
+		for _, name := range strings.Split(v, ",") {
+			allowed[strings.ToLower(strings.TrimSpace(name))] = true
+		}
+	}
+	return allowed
+}
+
+// setOverrideAnnotations records on a PV the volume type and options its
+// claim overrode, so that the volume is managed with them rather than with
+// those of its class
+func setOverrideAnnotations(annotations map[string]string, claim *v1.PersistentVolumeClaim, cfg *ProvisionerConfig) {
+	if _, ok := claim.Annotations[annVolumeType]; ok {
+		annotations[annVolumeType] = cfg.VolumeType
+	}
+	if _, ok := claim.Annotations[annVolumeOptions]; ok {
+		options := make([]string, 0, len(cfg.VolumeOptions))
+		for _, name := range sortedKeys(cfg.VolumeOptions) {
+			options = append(options, name+"="+cfg.VolumeOptions[name])
+		}
+		annotations[annVolumeOptions] = strings.Join(options, ",")
+	}
+}
+
+// restoreVolumeOptions sets the volume options of config to those its
+// claim overrode, as recorded on the PV
+func (config *ProvisionerConfig) restoreVolumeOptions(annotations map[string]string) {
+	value, ok := annotations[annVolumeOptions]
+	if !ok {
+		return
+	}
+	options, err := parseVolumeOptions(value)
+	if err != nil {
+		klog.Errorf("glusterfs: ignoring volume options recorded on volume %s: %v", config.PVName, err)
+		return
+	}
+	config.VolumeOptions = options
+}
+
+// hasClaimOverrides reports whether claim carries any override annotation
+// or a selector
+func hasClaimOverrides(claim *v1.PersistentVolumeClaim) bool {
+	if claim.Spec.Selector != nil {
+		return true
+	}
+	for annotation := range claimOverrideAnnotations {
+		if _, ok := claim.Annotations[annotation]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// claimConfig returns the config of a volume for claim: the cached config of
+// class, or for claims with overrides the class parameters with the
+// overrides and selector of claim applied
+func (p *glusterfsProvisioner) claimConfig(ctx context.Context, class *storage.StorageClass, claim *v1.PersistentVolumeClaim, pvName string) (*ProvisionerConfig, error) {
+	if !hasClaimOverrides(claim) {
+		return p.classConfig(ctx, class, pvName)
+	}
+	params, err := applyClaimOverrides(class.Parameters, claim)
+	if err != nil {
+		return nil, err
+	}
+	params, err = p.applyClaimSelector(ctx, params, claim)
+	if err != nil {
+		return nil, err
+	}
+	return p.newProvisionerConfig(ctx, pvName, params)
+}
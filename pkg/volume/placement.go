@@ -0,0 +1,117 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+// rootWeight returns the placement weight of root, 0 meaning 1
+func rootWeight(root BrickRootPath) int {
+	if root.Weight == 0 {
+		return 1
+	}
+	return root.Weight
+}
+
+// placementScore is the weighted rendezvous hash of root for the volume
+// key: over many volumes each root has the highest score in proportion to
+// its weight, and the score of a volume never changes with other roots
+func placementScore(key string, root BrickRootPath) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key + "\x00" + root.Host + ":" + root.Path))
+	// Uniform in (0, 1) from the top 53 bits
+	u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+	return -float64(rootWeight(root)) / math.Log(u)
+}
+
+// placeVolume narrows the brick roots of config to those chosen for its
+// volume PVName, and chooses its volume type unless the class sets one
+func (config *ProvisionerConfig) placeVolume() error {
+	return config.placeVolumeOn(config.allBrickRoots())
+}
+
+// placeVolumeOn places the volume of config on brickCount of roots, whose
+// replica sets must be on distinct hosts
+func (config *ProvisionerConfig) placeVolumeOn(roots []BrickRootPath) error {
+	config.BrickRootPaths = selectBrickRoots(config.PVName, roots, config.BrickCount)
+	config.applyDefaultVolumeType()
+	if config.BrickCount == 0 {
+		// Validated with the class
+		return nil
+	}
+	return validateReplicaSets(config.BrickRootPaths, config.VolumeType, config.mayForce())
+}
+
+// selectBrickRoots returns count of roots for the volume key, chosen by
+// weighted rendezvous hashing so that the choice is stable for a volume and
+// roots with a larger weight receive proportionally more bricks. Roots on
+// distinct hosts are preferred and the chosen roots are ordered round-robin
+// across their hosts, so that replica sets do not share a host.
+func selectBrickRoots(key string, roots []BrickRootPath, count int) []BrickRootPath {
+	if count <= 0 || count >= len(roots) {
+		return roots
+	}
+	order := make([]int, len(roots))
+	scores := make([]float64, len(roots))
+	for i, root := range roots {
+		order[i] = i
+		scores[i] = placementScore(key, root)
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return scores[order[a]] > scores[order[b]]
+	})
+
+	chosen := make([]bool, len(roots))
+	hosts := make(map[string]bool)
+	n := 0
+	for _, distinct := range []bool{true, false} {
+		for _, i := range order {
+			if n == count {
+				break
+			}
+			if chosen[i] || (distinct && hosts[roots[i].Host]) {
+				continue
+			}
+			chosen[i] = true
+			hosts[roots[i].Host] = true
+			n++
+		}
+	}
+
+	// Round-robin across hosts, in the order of roots
+	var hostOrder []string
+	byHost := make(map[string][]BrickRootPath)
+	for i, root := range roots {
+		if !chosen[i] {
+			continue
+		}
+		if _, ok := byHost[root.Host]; !ok {
+			hostOrder = append(hostOrder, root.Host)
+		}
+		byHost[root.Host] = append(byHost[root.Host], root)
+	}
+	selected := make([]BrickRootPath, 0, count)
+	for len(selected) < count {
+		for _, host := range hostOrder {
+			if len(byHost[host]) != 0 {
+				selected = append(selected, byHost[host][0])
+				byHost[host] = byHost[host][1:]
+			}
+		}
+	}
+	return selected
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+)
+
+const (
+	// annPool records the named pool of the class a volume was provisioned in
+	annPool = "gluster.simple/pool"
+	// annBrickPool records the BrickPool a volume was provisioned in
+	annBrickPool = "gluster.simple/brick-pool"
+
+	// poolParameterPrefix prefixes the parameters of named pools, in the
+	// `pool.<name>.<parameter>` format
+	poolParameterPrefix = "pool."
+)
+
+// poolParameters returns the lower case parameters of every named pool
+// defined by params
+func poolParameters(params map[string]string) map[string]map[string]string {
+	pools := make(map[string]map[string]string)
+	for k, v := range params {
+		key := strings.ToLower(k)
+		if !strings.HasPrefix(key, poolParameterPrefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(key, poolParameterPrefix), ".", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		if pools[parts[0]] == nil {
+			pools[parts[0]] = make(map[string]string)
+		}
+		pools[parts[0]][parts[1]] = v
+	}
+	return pools
+}
+
+// resolvePoolParameters returns params with the parameters of the named
+// pool selected by the `pool` parameter applied. Pool parameters take
+// precedence over the parameters of the class.
+func resolvePoolParameters(params map[string]string) (map[string]string, error) {
+	pools := poolParameters(params)
+	var poolName string
+	for k, v := range params {
+		if strings.ToLower(k) == "pool" {
+			poolName = strings.ToLower(strings.TrimSpace(v))
+		}
+	}
+	if len(pools) == 0 {
+		if poolName != "" {
+			return nil, fmt.Errorf("pool %s is not defined, the storage class has no pools", poolName)
+		}
+		return params, nil
+	}
+
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if poolName == "" {
+		return nil, fmt.Errorf("pool is not specified, one of %s", strings.Join(names, ", "))
+	}
+	poolParams, ok := pools[poolName]
+	if !ok {
+		return nil, fmt.Errorf("pool %s is not defined, one of %s", poolName, strings.Join(names, ", "))
+	}
+
+	resolved := params
+	for k, v := range poolParams {
+		resolved = setParameter(resolved, k, v)
+	}
+	return resolved, nil
+}
+
+// setParameter returns a copy of params with the lower case parameter key
+// set to value, replacing it in any case
+func setParameter(params map[string]string, key string, value string) map[string]string {
+	result := make(map[string]string, len(params)+1)
+	for k, v := range params {
+		if strings.ToLower(k) != key {
+			result[k] = v
+		}
+	}
+	result[key] = value
+	return result
+}
+
+// setPoolAnnotations records the named pool and BrickPool of cfg on a PV
+func setPoolAnnotations(annotations map[string]string, cfg *ProvisionerConfig) {
+	if cfg.Pool != "" {
+		annotations[annPool] = cfg.Pool
+	}
+	if cfg.BrickPool != "" {
+		annotations[annBrickPool] = cfg.BrickPool
+	}
+}
+
+// volumeConfig returns the config of class for volume, in the named pool
+// and BrickPool the volume was provisioned in
+func (p *glusterfsProvisioner) volumeConfig(ctx context.Context, class *storage.StorageClass, volume *v1.PersistentVolume) (*ProvisionerConfig, error) {
+	pool, hasPool := volume.Annotations[annPool]
+	brickPool, hasBrickPool := volume.Annotations[annBrickPool]
+	if !hasPool && !hasBrickPool {
+		return p.classConfig(ctx, class, volume.Name)
+	}
+	params := class.Parameters
+	if hasPool {
+		params = setParameter(params, "pool", pool)
+	}
+	if hasBrickPool {
+		params = setParameter(params, "brickpool", brickPool)
+	}
+	return p.newProvisionerConfig(ctx, volume.Name, params)
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+)
+
+const (
+	// annPriority sets the provisioning priority of a claim, either as
+	// integer or as the name of a PriorityClass
+	annPriority = "gluster.simple/priority"
+	// pendingClaimTTL forgets pending claims not seen for this long, e.g.
+	// deleted claims or claims waiting out a long retry backoff
+	pendingClaimTTL = 10 * time.Minute
+)
+
+type pendingClaim struct {
+	priority int32
+	seen     time.Time
+}
+
+// priorityGate defers claims while claims of a higher priority are pending,
+// so that the workers of the controller, whose queue is FIFO, are spent on
+// important claims first during bursts
+type priorityGate struct {
+	mutex   sync.Mutex
+	pending map[types.UID]pendingClaim
+}
+
+func newPriorityGate() *priorityGate {
+	return &priorityGate{pending: make(map[types.UID]pendingClaim)}
+}
+
+// observe records claim as pending with priority
+func (g *priorityGate) observe(uid types.UID, priority int32) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.pending[uid] = pendingClaim{priority: priority, seen: time.Now()}
+}
+
+// done forgets a claim that is provisioned or failed for good
+func (g *priorityGate) done(uid types.UID) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	delete(g.pending, uid)
+}
+
+// higherPending returns the number of pending claims with a priority higher
+// than priority
+func (g *priorityGate) higherPending(priority int32) int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	var n int
+	for uid, claim := range g.pending {
+		if time.Since(claim.seen) > pendingClaimTTL {
+			delete(g.pending, uid)
+			continue
+		}
+		if claim.priority > priority {
+			n++
+		}
+	}
+	return n
+}
+
+// claimPriority returns the priority of claim from its annPriority
+// annotation, 0 without it. Any tenant may annotate its claims, so
+// priorities, of PriorityClasses as well, are capped at MaxClaimPriority.
+func (p *glusterfsProvisioner) claimPriority(ctx context.Context, claim *v1.PersistentVolumeClaim) (int32, error) {
+	value, ok := claim.Annotations[annPriority]
+	if !ok {
+		return 0, nil
+	}
+	value = strings.TrimSpace(value)
+	var priority int32
+	if n, err := strconv.ParseInt(value, 10, 32); err == nil {
+		priority = int32(n)
+	} else {
+		class, err := p.client.SchedulingV1().PriorityClasses().Get(ctx, value, metav1.GetOptions{})
+		if err != nil {
+			return 0, fmt.Errorf("%s annotation %q is neither an integer nor a PriorityClass: %v", annPriority, value, err)
+		}
+		priority = class.Value
+	}
+	if priority > p.options.MaxClaimPriority {
+		klog.V(2).Infof("glusterfs: capping priority %d of claim %s/%s at %d", priority, claim.Namespace, claim.Name, p.options.MaxClaimPriority)
+		priority = p.options.MaxClaimPriority
+	}
+	return priority, nil
+}
+
+// admitPriority records claim as pending and returns why it is deferred
+// while claims of a higher priority are pending, or the error resolving its
+// priority
+func (p *glusterfsProvisioner) admitPriority(ctx context.Context, claim *v1.PersistentVolumeClaim) (deferred error, err error) {
+	priority, err := p.claimPriority(ctx, claim)
+	if err != nil {
+		return nil, err
+	}
+	p.priorities.observe(claim.UID, priority)
+	if n := p.priorities.higherPending(priority); n > 0 {
+		return fmt.Errorf("%d claims of a higher priority than %d are pending, the claim is deferred", n, priority), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+const (
+	// annDeletionProtected protects a PV and its gluster volume from
+	// deletion, set on the claim or the PV
+	annDeletionProtected = "gluster.simple/deletion-protected"
+	// annDeletionProtection is the former name of annDeletionProtected,
+	// still honored
+	annDeletionProtection = "gluster.simple/deletion-protection"
+)
+
+// deletionProtectionValue returns the value of the deletion protection
+// annotation in annotations and whether it is set
+func deletionProtectionValue(annotations map[string]string) (string, bool) {
+	for _, ann := range []string{annDeletionProtected, annDeletionProtection} {
+		if value, ok := annotations[ann]; ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// setDeletionProtectionAnnotation copies the deletion protection annotation
+// of claim to the annotations of its PV
+func setDeletionProtectionAnnotation(annotations map[string]string, claim *v1.PersistentVolumeClaim) {
+	if value, ok := deletionProtectionValue(claim.Annotations); ok {
+		annotations[annDeletionProtected] = value
+	}
+}
+
+// isDeletionProtected reports whether volume must not be deleted, by the
+// annotation of claim, the claim bound to volume while it exists, else of
+// volume, or by the deletionProtection parameter of its class. The
+// annotation set to "false" lifts the protection of the class.
+func isDeletionProtected(volume *v1.PersistentVolume, claim *v1.PersistentVolumeClaim, cfg *ProvisionerConfig) bool {
+	value, ok := "", false
+	if claim != nil {
+		value, ok = deletionProtectionValue(claim.Annotations)
+	}
+	if !ok {
+		value, ok = deletionProtectionValue(volume.Annotations)
+	}
+	if ok {
+		return strings.ToLower(strings.TrimSpace(value)) == "true"
+	}
+	return cfg.DeletionProtection
+}
+
+// boundClaim returns the claim volume is bound to, nil if it no longer
+// exists
+func (p *glusterfsProvisioner) boundClaim(volume *v1.PersistentVolume) *v1.PersistentVolumeClaim {
+	ref := volume.Spec.ClaimRef
+	if ref == nil {
+		return nil
+	}
+	obj, exists, err := p.claimInformer.GetStore().GetByKey(ref.Namespace + "/" + ref.Name)
+	if err != nil || !exists {
+		return nil
+	}
+	claim, ok := obj.(*v1.PersistentVolumeClaim)
+	if !ok || claim.UID != ref.UID {
+		return nil
+	}
+	return claim
+}
+
+// watchDeletionProtection keeps the deletion protection annotation of PVs in
+// sync with their claims, so that the protection a claim carried last
+// outlives the claim, e.g. when its namespace is deleted
+func (p *glusterfsProvisioner) watchDeletionProtection(ctx context.Context) {
+	// Registered on the informer itself, so that requeued claims skip it
+	_, err := p.claimInformer.SharedIndexInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			p.syncDeletionProtection(ctx, nil, obj)
+		},
+		UpdateFunc: func(oldObj, obj interface{}) {
+			p.syncDeletionProtection(ctx, oldObj, obj)
+		},
+	})
+	if err != nil {
+		klog.Errorf("glusterfs: failed to watch the deletion protection of claims: %v", err)
+	}
+}
+
+// syncDeletionProtection sets the deletion protection annotation of the PV
+// of claim obj to the one of the claim. The annotation is only removed from
+// the PV when the claim lost it, annotations set on PVs alone stay.
+func (p *glusterfsProvisioner) syncDeletionProtection(ctx context.Context, oldObj interface{}, obj interface{}) {
+	claim, ok := obj.(*v1.PersistentVolumeClaim)
+	if !ok || claim.Spec.VolumeName == "" {
+		return
+	}
+	value, set := deletionProtectionValue(claim.Annotations)
+	if !set {
+		old, ok := oldObj.(*v1.PersistentVolumeClaim)
+		if !ok {
+			return
+		}
+		if _, had := deletionProtectionValue(old.Annotations); !had {
+			return
+		}
+	}
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pv, err := p.client.CoreV1().PersistentVolumes().Get(ctx, claim.Spec.VolumeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if pv.Annotations[annCreatedBy] != createdBy || pv.Spec.ClaimRef == nil || pv.Spec.ClaimRef.UID != claim.UID {
+			return nil
+		}
+		if p.options.ProvisionerName != "" && pv.Annotations[annProvisionedBy] != p.options.ProvisionerName {
+			return nil
+		}
+		current, has := pv.Annotations[annDeletionProtected]
+		_, legacy := pv.Annotations[annDeletionProtection]
+		if !legacy && has == set && current == value {
+			return nil
+		}
+		delete(pv.Annotations, annDeletionProtection)
+		if set {
+			pv.Annotations[annDeletionProtected] = value
+		} else {
+			delete(pv.Annotations, annDeletionProtected)
+		}
+		_, err = p.client.CoreV1().PersistentVolumes().Update(ctx, pv, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		klog.Errorf("glusterfs: failed to sync the deletion protection of claim %s/%s to volume %s: %v",
+			claim.Namespace, claim.Name, claim.Spec.VolumeName, err)
+	}
+}
@@ -16,16 +16,26 @@ package volume
 import (
 	"context"
 	"fmt"
-	"path/filepath"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
 
+	gerrors "gluster-simple-provisioner/pkg/errors"
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	storageinformers "k8s.io/client-go/informers/storage/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v8/controller"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v8/gidallocator"
@@ -38,33 +48,266 @@ const (
 	dynamicEpSvcPrefix = "glusterfs-simple-"
 )
 
+// Options are the settings of the glusterfs simple provisioner
+type Options struct {
+	// ProvisionerName is the name of this provisioner instance. Background
+	// maintenance only touches the PVs it provisioned.
+	ProvisionerName string
+	// BrickPoolRefreshPeriod is how often BrickPool capacity is refreshed
+	BrickPoolRefreshPeriod time.Duration
+	// HealthCheckPeriod is how often the bricks of provisioned volumes are checked
+	HealthCheckPeriod time.Duration
+	// UsageMetricsPeriod is how often brick usage metrics are collected
+	UsageMetricsPeriod time.Duration
+	// QuotaCheckPeriod is how often the quotas of volumes of classes with
+	// quota are checked for crossed limits. 0 disables the checks.
+	QuotaCheckPeriod time.Duration
+	// ScrubPeriod is how often released volumes are scrubbed for reuse
+	ScrubPeriod time.Duration
+	// BackupCheckPeriod is how often volumes are checked for due backups
+	BackupCheckPeriod time.Duration
+	// VolumeStatusObjects mirrors every provisioned PV in a GlusterVolume
+	VolumeStatusObjects bool
+	// ReconcilePeriod is how often volumes are reconciled toward their
+	// desired state
+	ReconcilePeriod time.Duration
+	// EndpointsSyncPeriod is how often the endpoints of volumes are updated
+	// to their brick hosts. 0 disables it.
+	EndpointsSyncPeriod time.Duration
+	// DeleteWorkers is the number of workers cleaning up deleted volumes in
+	// the background. 0 cleans up synchronously in Delete.
+	DeleteWorkers int
+	// DeleteMaxRetries is how often a failed background cleanup is retried
+	DeleteMaxRetries int
+	// ClusterFailureThreshold is the number of consecutive failures after
+	// which commands to a gluster cluster are suspended. 0 disables it.
+	ClusterFailureThreshold int
+	// ClusterFailureBackoff is how long a failing gluster cluster is suspended
+	ClusterFailureBackoff time.Duration
+	// QuotaConfigMap is the namespace/name of the ConfigMap holding
+	// per-namespace capacity quotas
+	QuotaConfigMap string
+	// CapacityReportConfigMap is the namespace/name of the ConfigMap the
+	// capacity report is written to every CapacityReportPeriod. Empty
+	// disables the report.
+	CapacityReportConfigMap string
+	CapacityReportPeriod    time.Duration
+	// CSICapacityNamespace holds the CSIStorageCapacity objects of the
+	// served classes, refreshed every CSICapacityPeriod. Empty disables
+	// them.
+	CSICapacityNamespace string
+	CSICapacityPeriod    time.Duration
+	// CanaryNamespace holds the endpoints of the canary volume provisioned
+	// and deleted for every served class on startup. Readiness fails until
+	// all canaries passed. Empty disables the canaries.
+	CanaryNamespace string
+	// DefaultsConfigMap is the namespace/name of a ConfigMap of StorageClass
+	// parameter defaults, reloaded whenever it changes
+	DefaultsConfigMap string
+	// StateConfigMap is the namespace/name of the ConfigMap holding the
+	// provisioning journal and cleanup queued when the provisioner shut down
+	StateConfigMap string
+	// LockNamespace holds the Leases serializing BrickPool reservations and
+	// namespace quota checks of provisioners sharing them. Empty locks within
+	// the process only.
+	LockNamespace string
+	// MaxHostOperations caps the commands running at the same time on a
+	// gluster host. 0 is unlimited.
+	MaxHostOperations int
+	// HostOperationLimits overrides MaxHostOperations for single hosts, by
+	// host address.
+	HostOperationLimits map[string]int
+	// NamespaceProvisionRate limits the claims of a namespace provisioned
+	// per second, with bursts of NamespaceProvisionBurst. 0 is unlimited.
+	NamespaceProvisionRate  float32
+	NamespaceProvisionBurst int
+	// MaxNamespaceProvisions caps the claims of a namespace provisioned at
+	// the same time. 0 is unlimited.
+	MaxNamespaceProvisions int
+	// MaxClaimPriority caps the priorities claims request with annPriority
+	MaxClaimPriority int32
+	// Vault configures the Vault key providers of encrypted volumes
+	Vault VaultOptions
+	// NotifyURL receives a JSON POST on every volume lifecycle event. Empty
+	// disables notifications.
+	NotifyURL string
+	// NotifyTimeout bounds each POST to NotifyURL
+	NotifyTimeout time.Duration
+	// OTLPEndpoint receives the spans of provisioning and deletion with
+	// OTLP/HTTP, e.g. http://otel-collector:4318. Empty disables tracing.
+	OTLPEndpoint string
+	// AllowedNamespaces restricts provisioning to claims of these namespaces
+	AllowedNamespaces []string
+	// DeniedNamespaces are namespaces whose claims are never provisioned
+	DeniedNamespaces []string
+	// NeverForce fails volumes that gluster only creates with force, as
+	// the forceCreate parameter `never` does for a class
+	NeverForce bool
+	// IdentityConfigMap is the namespace/name of the ConfigMap holding the
+	// identity stamped on provisioned PVs. Empty disables identities.
+	IdentityConfigMap string
+	// Takeover deletes volumes stamped with another identity
+	Takeover bool
+}
+
+// GlusterfsProvisioner is a controller.Provisioner with background maintenance
+type GlusterfsProvisioner interface {
+	controller.Provisioner
+	// Run runs the informers and watches every replica needs until ctx is
+	// done
+	Run(ctx context.Context)
+	// RunMaintenance runs the background maintenance acting on volumes until
+	// ctx is done. It must only run in the replica holding the leader lease.
+	RunMaintenance(ctx context.Context)
+	// ClaimInformer returns the claim informer of the controller, through
+	// which held back claims are handed back to it
+	ClaimInformer() cache.SharedIndexInformer
+	// Ready returns an error unless the API server and gluster are reachable
+	Ready(ctx context.Context) error
+	// Shutdown drains the operations in flight before the process exits
+	Shutdown(timeout time.Duration)
+	// CreateSnapshot takes a gluster snapshot of a volume and returns its ID
+	CreateSnapshot(ctx context.Context, volumeID string) (string, error)
+	// DeleteSnapshot deletes a snapshot taken by CreateSnapshot
+	DeleteSnapshot(ctx context.Context, snapshotID string) error
+	// CloneSnapshot creates a new gluster volume from a snapshot
+	CloneSnapshot(ctx context.Context, snapshotID string) (*SnapshotClone, error)
+	// ListVolumes returns the inventory of provisioned volumes
+	ListVolumes(ctx context.Context, usage bool) ([]VolumeInfo, error)
+	// ForceDeleteVolume deletes a released or failed PV and its gluster volume
+	ForceDeleteVolume(ctx context.Context, pvName string) error
+	// RepairEndpoints recreates missing endpoints and services of a PV
+	RepairEndpoints(ctx context.Context, pvName string) error
+	// HealVolume starts a heal of the gluster volume of a PV
+	HealVolume(ctx context.Context, pvName string, full bool) error
+	// StorageClasses returns the served StorageClasses and whether they are valid
+	StorageClasses() []ClassInfo
+	// SimulateProvision reports how a claim would be provisioned without
+	// creating anything
+	SimulateProvision(ctx context.Context, claim *v1.PersistentVolumeClaim) (*SimulationResult, error)
+}
+
 // NewGlusterfsProvisioner creates a new glusterfs simple provisioner
-func NewGlusterfsProvisioner(config *rest.Config, client kubernetes.Interface) controller.Provisioner {
+func NewGlusterfsProvisioner(config *rest.Config, client kubernetes.Interface, options Options) GlusterfsProvisioner {
 	klog.Infof("Creating NewGlusterfsProvisioner.")
-	return newGlusterfsProvisionerInternal(config, client)
+	provisioner := newGlusterfsProvisionerInternal(config, client, options)
+	if options.IdentityConfigMap != "" {
+		identity, err := provisioner.loadIdentity(context.Background())
+		if err != nil {
+			klog.Fatalf("Failed to load provisioner identity from %s: %v", options.IdentityConfigMap, err)
+		}
+		klog.Infof("glusterfs: provisioner identity is %s", identity)
+		provisioner.identity = identity
+	}
+	return provisioner
 }
 
-func newGlusterfsProvisionerInternal(config *rest.Config, client kubernetes.Interface) *glusterfsProvisioner {
-	var identity types.UID
-
+func newGlusterfsProvisionerInternal(config *rest.Config, client kubernetes.Interface, options Options) *glusterfsProvisioner {
 	restClient := client.CoreV1().RESTClient()
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&corev1.EventSinkImpl{Interface: client.CoreV1().Events(v1.NamespaceAll)})
+	component := createdBy
+	if options.ProvisionerName != "" {
+		component = createdBy + "/" + options.ProvisionerName
+	}
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: component})
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+
 	provisioner := &glusterfsProvisioner{
-		config:     config,
-		client:     client,
-		restClient: restClient,
-		identity:   identity,
-		allocator:  gidallocator.New(client),
+		config:           config,
+		client:           client,
+		dynamicClient:    dynamic.NewForConfigOrDie(config),
+		restClient:       restClient,
+		recorder:         recorder,
+		allocator:        gidallocator.New(client),
+		options:          options,
+		breaker:          newClusterBreaker(options.ClusterFailureThreshold, options.ClusterFailureBackoff),
+		hostLimiter:      newHostLimiter(options.MaxHostOperations, options.HostOperationLimits),
+		priorities:       newPriorityGate(),
+		heldClaims:       newHeldClaims(),
+		reservationLocks: newReservationLocks(),
+		inFlightQuota:    newQuotaReservations(),
+		tenantLimiter:    newTenantLimiter(options.NamespaceProvisionRate, options.NamespaceProvisionBurst, options.MaxNamespaceProvisions),
+		vault:            newVaultClient(options.Vault),
+		notifier:         newNotifier(options.NotifyURL, options.NotifyTimeout),
+		tracer:           newTracer(options.OTLPEndpoint, component),
+
+		informerFactory: informerFactory,
+		classInformer:   informerFactory.Storage().V1().StorageClasses(),
+		claimInformer:   newClaimInformer(client),
+		classConfigs:    make(map[string]classConfigEntry),
+		classRegistry:   make(map[string]ClassInfo),
+
+		glusterdChecks: make(map[string]glusterdCheck),
+		volumeHealth:   make(map[string]volumeHealthState),
+		quotaStates:    make(map[string]quotaState),
+		canaries:       make(map[string]canaryState),
+		deleteTasks:    make(map[string]*deleteTask),
+		brickRemovals:  make(map[string]brickRemoval),
+	}
+	if options.DeleteWorkers > 0 {
+		provisioner.deleteQueue = newDeleteQueue()
 	}
 
 	return provisioner
 }
 
 type glusterfsProvisioner struct {
-	client     kubernetes.Interface
-	restClient rest.Interface
-	config     *rest.Config
-	identity   types.UID
-	allocator  gidallocator.Allocator
+	client           kubernetes.Interface
+	dynamicClient    dynamic.Interface
+	restClient       rest.Interface
+	recorder         record.EventRecorder
+	config           *rest.Config
+	identity         types.UID
+	allocator        gidallocator.Allocator
+	options          Options
+	breaker          *clusterBreaker
+	hostLimiter      *hostLimiter
+	tenantLimiter    *tenantLimiter
+	priorities       *priorityGate
+	heldClaims       *heldClaims
+	reservationLocks *reservationLocks
+	inFlightQuota    *quotaReservations
+	vault            *vaultClient
+	notifier         *notifier
+	tracer           *tracer
+
+	informerFactory   informers.SharedInformerFactory
+	classInformer     storageinformers.StorageClassInformer
+	claimInformer     *claimInformer
+	classConfigsMutex sync.Mutex
+	classConfigs      map[string]classConfigEntry
+
+	classQueue         workqueue.Interface
+	classRegistryMutex sync.Mutex
+	classRegistry      map[string]ClassInfo
+
+	glusterdChecksMutex sync.Mutex
+	glusterdChecks      map[string]glusterdCheck
+
+	volumeHealthMutex sync.Mutex
+	volumeHealth      map[string]volumeHealthState
+
+	quotaStatesMutex sync.Mutex
+	quotaStates      map[string]quotaState
+
+	canariesMutex   sync.Mutex
+	canaries        map[string]canaryState
+	canariesChecked bool
+
+	deleteQueue      workqueue.RateLimitingInterface
+	deleteTasksMutex sync.Mutex
+	deleteTasks      map[string]*deleteTask
+
+	brickRemovalsMutex sync.Mutex
+	brickRemovals      map[string]brickRemoval
+
+	defaultsMutex sync.RWMutex
+	defaults      map[string]string
+
+	shutdownMutex sync.Mutex
+	shuttingDown  bool
+	operations    sync.WaitGroup
 }
 
 type glusterBrick struct {
@@ -74,36 +317,240 @@ type glusterBrick struct {
 
 var _ controller.Provisioner = &glusterfsProvisioner{}
 
+// Run runs the informers and watches every replica needs until ctx is done
+func (p *glusterfsProvisioner) Run(ctx context.Context) {
+	p.watchStorageClasses(ctx)
+	p.informerFactory.Start(ctx.Done())
+	go p.claimInformer.Run(ctx.Done())
+	if p.options.DefaultsConfigMap != "" {
+		p.watchDefaults(ctx)
+	}
+	if p.notifier != nil {
+		go p.notifier.run(ctx)
+	}
+	go p.tracer.run(ctx)
+	<-ctx.Done()
+}
+
+// RunMaintenance runs the background maintenance acting on volumes until ctx
+// is done. Only the leader runs it, like the controller, so that replicas
+// never recreate, scrub, back up or purge the same volumes concurrently.
+func (p *glusterfsProvisioner) RunMaintenance(ctx context.Context) {
+	if p.deleteQueue != nil {
+		p.runDeleteWorkers(ctx)
+	}
+	p.loadPendingDeletes(ctx)
+	go p.reconcileVolumes(ctx)
+	go wait.UntilWithContext(ctx, p.requeueHeldClaims, heldClaimRequeuePeriod)
+	p.watchDeletionProtection(ctx)
+	if p.options.StateConfigMap != "" {
+		go wait.UntilWithContext(ctx, p.recoverJournal, journalRecoverPeriod)
+	}
+	go wait.UntilWithContext(ctx, p.checkBrickRemovals, brickRemovalCheckPeriod)
+	go wait.UntilWithContext(ctx, p.purgeTrash, trashPurgePeriod)
+	if p.options.BrickPoolRefreshPeriod > 0 {
+		go wait.UntilWithContext(ctx, p.refreshBrickPools, p.options.BrickPoolRefreshPeriod)
+	}
+	if p.options.HealthCheckPeriod > 0 {
+		go wait.UntilWithContext(ctx, p.monitorVolumes, p.options.HealthCheckPeriod)
+	}
+	if p.options.UsageMetricsPeriod > 0 {
+		go wait.UntilWithContext(ctx, p.exportUsageMetrics, p.options.UsageMetricsPeriod)
+	}
+	if p.options.CapacityReportConfigMap != "" && p.options.CapacityReportPeriod > 0 {
+		go wait.UntilWithContext(ctx, p.publishCapacityReport, p.options.CapacityReportPeriod)
+	}
+	if p.options.CSICapacityNamespace != "" && p.options.CSICapacityPeriod > 0 {
+		go wait.UntilWithContext(ctx, p.publishStorageCapacity, p.options.CSICapacityPeriod)
+	}
+	if p.options.CanaryNamespace != "" {
+		go wait.UntilWithContext(ctx, p.runCanaries, canaryRetryPeriod)
+	}
+	if p.options.QuotaCheckPeriod > 0 {
+		go wait.UntilWithContext(ctx, p.checkQuotas, p.options.QuotaCheckPeriod)
+	}
+	if p.options.ScrubPeriod > 0 {
+		go wait.UntilWithContext(ctx, p.reuseReleasedVolumes, p.options.ScrubPeriod)
+	}
+	if p.options.EndpointsSyncPeriod > 0 {
+		go wait.UntilWithContext(ctx, p.syncEndpoints, p.options.EndpointsSyncPeriod)
+	}
+	if p.options.ReconcilePeriod > 0 {
+		go wait.UntilWithContext(ctx, p.operateVolumes, p.options.ReconcilePeriod)
+	}
+	if p.options.BackupCheckPeriod > 0 {
+		go wait.UntilWithContext(ctx, p.runBackups, p.options.BackupCheckPeriod)
+	}
+	<-ctx.Done()
+}
+
 func (p *glusterfsProvisioner) Provision(
 	ctx context.Context,
 	options controller.ProvisionOptions) (*v1.PersistentVolume, controller.ProvisioningState, error) {
-	if options.PVC.Spec.Selector != nil {
-		return nil, controller.ProvisioningFinished, fmt.Errorf("claim Selector is not supported")
+	if !p.beginOperation() {
+		return nil, controller.ProvisioningNoChange, errShuttingDown
 	}
+	defer p.endOperation()
+	deferred, err := p.admitPriority(ctx, options.PVC)
+	if err != nil {
+		return nil, controller.ProvisioningNoChange, err
+	}
+	if deferred != nil {
+		return p.holdBack(options.PVC, "ProvisioningDeferred", deferred)
+	}
+	release, err := p.tenantLimiter.admit(options.PVC)
+	if err != nil {
+		return p.holdBack(options.PVC, "ProvisioningQueued", err)
+	}
+	defer release()
+	p.heldClaims.release(options.PVC.UID)
+	// Finish or roll back even if the controller stops meanwhile
+	ctx = withOperation(detachedContext{ctx}, string(options.PVC.UID))
+	ctx, span := p.tracer.start(ctx, "provision", map[string]string{
+		"k8s.namespace.name":    options.PVC.Namespace,
+		"k8s.pvc.name":          options.PVC.Name,
+		"k8s.pv.name":           options.PVName,
+		"k8s.storageclass.name": options.StorageClass.Name,
+	})
+	pv, state, err := p.provision(ctx, options)
+	span.finish(err)
+	if err == nil || state == controller.ProvisioningFinished {
+		p.priorities.done(options.PVC.UID)
+	}
+	observeError("provision", err)
+	p.notifyProvision(ctx, options, pv, err)
+	return pv, state, err
+}
+
+func (p *glusterfsProvisioner) provision(
+	ctx context.Context,
+	options controller.ProvisionOptions) (pv *v1.PersistentVolume, state controller.ProvisioningState, err error) {
+	klog.Infof("%sglusterfs: provisioning volume %s for claim %s/%s", logPrefix(ctx), options.PVName, options.PVC.Namespace, options.PVC.Name)
 	klog.V(4).Infof("Start Provisioning volume: VolumeOptions %v", options)
 
+	pvcNamespace := options.PVC.Namespace
+	pvcName := options.PVC.Name
+
+	cfg, err := p.claimConfig(ctx, options.StorageClass, options.PVC, options.PVName)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, gerrors.Configf("Parameter is invalid: %s", err)
+	}
+	err = cfg.renderVolumeName(VolumeNameData{
+		PVName:       options.PVName,
+		PVCName:      pvcName,
+		PVCNamespace: pvcNamespace,
+		StorageClass: options.StorageClass.Name,
+	})
+	if err != nil {
+		return nil, controller.ProvisioningFinished, gerrors.Config(err)
+	}
+
+	capacity := options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+	err = cfg.validateSize(capacity)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, gerrors.Config(err)
+	}
+
+	err = cfg.validateAccessModes(options.PVC.Spec.AccessModes)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, gerrors.Config(err)
+	}
+
+	err = p.excludeMaintenanceHosts(ctx, cfg)
+	if err != nil {
+		p.recorder.Event(options.PVC, v1.EventTypeNormal, "HostInMaintenance", err.Error())
+		return nil, controller.ProvisioningFinished, err
+	}
+
+	releaseQuota, err := p.reserveNamespaceQuota(ctx, options.PVC, options.PVName, capacity)
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+	defer func() {
+		if err != nil {
+			releaseQuota()
+		}
+	}()
+
+	err = p.reserveBrickCapacity(ctx, cfg, capacity.Value())
+	if err != nil {
+		return nil, controller.ProvisioningFinished, err
+	}
+
+	// Allocated only once the claim passed its checks, so that rejected
+	// claims retried by the controller do not use up GIDs
+	start := time.Now()
 	gid, err := p.allocator.AllocateNext(options)
+	observeStep(ctx, "provision", "allocate-gid", start, err)
 	if err != nil {
+		if rerr := p.releaseBrickCapacity(ctx, cfg); rerr != nil {
+			klog.Errorf("glusterfs: failed to release brick capacity: %v", rerr)
+		}
 		return nil, controller.ProvisioningFinished, err
 	}
+	defer func() {
+		if err != nil {
+			p.releaseGID(options, gid)
+		}
+	}()
 
-	pvcNamespace := options.PVC.Namespace
-	pvcName := options.PVC.Name
+	if cfg.BlockHostVolume != "" {
+		return p.provisionBlock(ctx, options, cfg, capacity, gid)
+	}
 
-	cfg, err := NewProvisionerConfig(options.PVName, options.StorageClass.Parameters)
+	journal := &journalEntry{
+		Operation: operationID(ctx),
+		PVName:    options.PVName,
+		Namespace: pvcNamespace,
+		Name:      pvcName,
+		Config:    cfg,
+	}
+	journal.Bricks, _ = brickLayout(pvcNamespace, pvcName, cfg)
+	err = p.journalStep(ctx, journal, journalStepStarted)
 	if err != nil {
-		return nil, controller.ProvisioningFinished, fmt.Errorf("Parameter is invalid: %s", err)
+		if rerr := p.releaseBrickCapacity(ctx, cfg); rerr != nil {
+			klog.Errorf("glusterfs: failed to release brick capacity: %v", rerr)
+		}
+		return nil, controller.ProvisioningFinished, err
 	}
 
-	r, err := p.createVolume(ctx, pvcNamespace, pvcName, cfg, gid)
+	createCtx := ctx
+	if cfg.ProvisionTimeout > 0 {
+		var cancel context.CancelFunc
+		createCtx, cancel = context.WithTimeout(ctx, cfg.ProvisionTimeout)
+		defer cancel()
+	}
+	r, err := p.createVolume(createCtx, pvcNamespace, pvcName, cfg, gid, capacity.Value(), journal)
+	if err != nil && createCtx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("provisioning exceeded provisionTimeoutSeconds of %v and was rolled back: %v", cfg.ProvisionTimeout, err)
+		p.recorder.Event(options.PVC, v1.EventTypeWarning, "ProvisioningTimeout", err.Error())
+	}
 	if err != nil {
+		klog.Errorf("%sglusterfs: failed to create volume %s: %v", logPrefix(ctx), cfg.VolumeName, err)
+		if rerr := p.releaseBrickCapacity(ctx, cfg); rerr != nil {
+			klog.Errorf("glusterfs: failed to release brick capacity: %v", rerr)
+		}
 		return nil, controller.ProvisioningFinished, err
 	}
 
 	annotations := make(map[string]string)
 	annotations[annCreatedBy] = createdBy
 	annotations[gidallocator.VolumeGidAnnotationKey] = strconv.FormatInt(int64(gid), 10)
-	pv := &v1.PersistentVolume{
+	setPoolAnnotations(annotations, cfg)
+	setVolumeTypeAnnotation(annotations, cfg)
+	setForceAnnotation(annotations, cfg)
+	setQuotaAnnotation(annotations, cfg)
+	setOverrideAnnotations(annotations, options.PVC, cfg)
+	p.setIdentityAnnotation(annotations)
+	setDeletionProtectionAnnotation(annotations, options.PVC)
+	bricks, _ := brickLayout(pvcNamespace, pvcName, cfg)
+	if bricks != nil {
+		annotations[annBricks] = formatBricks(bricks)
+	}
+	if cfg.PVSource == pvSourceNFS {
+		annotations[annNFSExport] = "true"
+	}
+	pv = &v1.PersistentVolume{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:        options.PVName,
 			Annotations: annotations,
@@ -112,23 +559,29 @@ func (p *glusterfsProvisioner) Provision(
 			PersistentVolumeReclaimPolicy: *options.StorageClass.ReclaimPolicy,
 			AccessModes:                   options.PVC.Spec.AccessModes,
 			Capacity: v1.ResourceList{
-				v1.ResourceName(v1.ResourceStorage): options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)],
-			},
-			PersistentVolumeSource: v1.PersistentVolumeSource{
-				Glusterfs: r,
+				v1.ResourceName(v1.ResourceStorage): capacity,
 			},
+			PersistentVolumeSource: cfg.persistentVolumeSource(r, bricks),
+			MountOptions:           cfg.mountOptions(options.StorageClass.MountOptions, bricks),
 		},
 	}
+	// Dropped by recoverJournal once the controller saved the PV
+	p.journalStep(ctx, journal, journalStepProvisioned)
+	p.clearLeftovers(ctx, options.PVC)
 	return pv, controller.ProvisioningFinished, nil
 }
 
-func (p *glusterfsProvisioner) getClusterNodes(cfg *ProvisionerConfig) []string {
-	// XXX: Improve to get all cluster nodes
-	nodes := make([]string, len(cfg.BrickRootPaths))
-	for i, root := range cfg.BrickRootPaths {
-		nodes[i] = root.Host
+// releaseGID releases gid, allocated for a claim whose provisioning failed
+func (p *glusterfsProvisioner) releaseGID(options controller.ProvisionOptions, gid int) {
+	volume := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{gidallocator.VolumeGidAnnotationKey: strconv.Itoa(gid)},
+		},
+		Spec: v1.PersistentVolumeSpec{StorageClassName: options.StorageClass.Name},
+	}
+	if err := p.allocator.Release(volume); err != nil {
+		klog.Errorf("glusterfs: error to release GID %d: %v", gid, err)
 	}
-	return nodes
 }
 
 func (p *glusterfsProvisioner) createVolume(
@@ -136,31 +589,91 @@ func (p *glusterfsProvisioner) createVolume(
 	namespace string, name string,
 	cfg *ProvisionerConfig,
 	gid int,
+	size int64,
+	journal *journalEntry,
 ) (*v1.GlusterfsPersistentVolumeSource, error) {
 	var err error
 	var bricks []glusterBrick
 	var endpoint *v1.Endpoints
 	var service *v1.Service
+	// Only a gluster volume created here is rolled back, never one of
+	// another claim that volumeNameTemplate happened to name the same
+	var volumeCreated bool
 
-	bricks, err = p.createBricks(ctx, namespace, name, cfg, gid)
-	if err != nil {
-		klog.Errorf("Creating bricks is failed: %s,%s", namespace, name)
+	start := time.Now()
+	err = p.checkVolumeNameFree(ctx, cfg)
+	if err == nil {
+		err = p.checkBrickRoots(ctx, cfg)
 	}
+	if err == nil {
+		err = p.decideForce(ctx, cfg)
+	}
+	observeStep(ctx, "provision", "check-brick-roots", start, err)
 
 	if err == nil {
-		err = p.createGlusterVolume(ctx, bricks, cfg)
+		start = time.Now()
+		bricks, err = p.createBricks(ctx, namespace, name, cfg, gid, size)
+		observeStep(ctx, "provision", "create-bricks", start, err)
+		if err != nil {
+			klog.Errorf("%sCreating bricks is failed: %s,%s", logPrefix(ctx), namespace, name)
+		} else {
+			p.journalStep(ctx, journal, journalStepBricks)
+		}
 	}
 
 	if err == nil {
-		epServiceName := dynamicEpSvcPrefix + name
+		start = time.Now()
+		volumeCreated, err = p.createGlusterVolume(ctx, bricks, cfg)
+		observeStep(ctx, "provision", "create-volume", start, err)
+		if volumeCreated {
+			p.journalStep(ctx, journal, journalStepVolume)
+		}
+	}
+
+	if err == nil {
+		start = time.Now()
+		err = p.verifyVolumeHealth(ctx, bricks, cfg)
+		observeStep(ctx, "provision", "verify-health", start, err)
+	}
+
+	if err == nil {
+		start = time.Now()
+		err = p.configureSelfHeal(ctx, bricks, cfg)
+		observeStep(ctx, "provision", "configure-self-heal", start, err)
+	}
+
+	if err == nil && cfg.Quota {
+		start = time.Now()
+		err = p.configureQuota(ctx, bricks, cfg, size)
+		observeStep(ctx, "provision", "configure-quota", start, err)
+	}
+
+	if err == nil {
+		start = time.Now()
+		err = p.runHook(ctx, "postCreateCommands", cfg.PostCreateCommands, namespace, name, cfg, bricks)
+		observeStep(ctx, "provision", "post-create-commands", start, err)
+	}
+
+	if err == nil && cfg.PVSource == pvSourceNFS {
+		start = time.Now()
+		err = p.exportNFS(ctx, bricks, cfg)
+		observeStep(ctx, "provision", "export-nfs", start, err)
+	}
+
+	if err == nil {
+		epServiceName := cfg.endpointsName(name)
 		epNamespace := namespace
-		dynamicHostIps := p.getClusterNodes(cfg)
-		endpoint, service, err = p.createEndpointService(ctx, epNamespace, epServiceName, dynamicHostIps, name)
+		// Clients only need the hosts serving bricks of the volume
+		dynamicHostIps := cfg.dataHosts(bricks)
+		start = time.Now()
+		endpoint, service, err = p.createEndpointService(ctx, epNamespace, epServiceName, dynamicHostIps, name, cfg)
+		observeStep(ctx, "provision", "create-endpoints", start, err)
 
 		if err != nil {
 			klog.Errorf("glusterfs: failed to create endpoint/service: %v", err)
 		} else {
 			klog.V(3).Infof("glusterfs: dynamic ep %v and svc : %v ", endpoint, service)
+			p.journalStep(ctx, journal, journalStepEndpoints)
 			return &v1.GlusterfsPersistentVolumeSource{
 				EndpointsName: endpoint.Name,
 				Path:          cfg.VolumeName,
@@ -169,70 +682,219 @@ func (p *glusterfsProvisioner) createVolume(
 		}
 	}
 
-	p.deleteVolume(ctx, namespace, name, cfg)
+	// Roll back even if ctx ran into the provisioning deadline
+	rollbackCtx := detachedContext{ctx}
+	if derr := p.rollbackVolume(rollbackCtx, namespace, name, cfg, bricks, volumeCreated); derr != nil {
+		// The journal entry stays for recoverJournal to retry the rollback
+		klog.Errorf("%sglusterfs: failed to roll back volume %s: %v", logPrefix(ctx), cfg.VolumeName, derr)
+	} else if leftovers := p.verifyRollback(rollbackCtx, cfg, bricks, volumeCreated); len(leftovers) > 0 {
+		// The journal entry stays as well
+		p.recordLeftovers(rollbackCtx, namespace, name, leftovers)
+	} else if journal != nil && p.options.StateConfigMap != "" {
+		p.updateStateConfigMap(rollbackCtx, journalKeyPrefix+journal.PVName, "")
+	}
 	return nil, err
 }
 
+// brickNotEmptyStatus is the exit status of the brick creation script when
+// the brick path holds data already
+const brickNotEmptyStatus = 3
+
+// createBricks creates the brick directories of the volume, or with the zfs
+// and loopback backends datasets or images of size bytes. Bricks created before an
+// error are returned with it so that only they are rolled back.
 func (p *glusterfsProvisioner) createBricks(
 	ctx context.Context,
 	namespace string, pvcName string,
 	cfg *ProvisionerConfig,
 	gid int,
+	size int64,
 ) ([]glusterBrick, error) {
-	var cmds []string
-	bricks := make([]glusterBrick, len(cfg.BrickRootPaths))
-	brickName := strings.Join([]string{pvcName, cfg.VolumeName}, "-")
+	layout, err := brickLayout(namespace, pvcName, cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	for i, root := range cfg.BrickRootPaths {
-		host := root.Host
-		path := filepath.Join(root.Path, namespace, brickName)
-		bricks[i].Host = host
-		bricks[i].Path = path
+	var bricks []glusterBrick
+	for i, brick := range layout {
+		host := brick.Host
+		path := brick.Path
 
+		// Refuse to reuse a directory holding data of another volume
 		klog.Infof("mkdir -p %s:%s", host, path)
-		cmds = []string{
-			fmt.Sprintf("mkdir -p %s", path),
-			fmt.Sprintf("chown :%v %s", gid, path),
-			fmt.Sprintf("chmod 0771 %s", path),
+		check := fmt.Sprintf(
+			"if [ -e %s ] && [ -n \"$(ls -A %s)\" ]; then echo \"brick path %s is not empty\" >&2; exit %d; fi",
+			shellQuote(path), shellQuote(path), shellQuote(path), brickNotEmptyStatus,
+		)
+		create, err := cfg.command(commandCreateBrick, CommandData{
+			VolumeName: cfg.VolumeName,
+			Host:       host,
+			Path:       path,
+			GID:        gid,
+		})
+		if err != nil {
+			return bricks, err
+		}
+		prepare := append([]string{create}, selinuxLabelCommands(path, cfg)...)
+
+		// Directory bricks are checked and prepared in one script, the
+		// datasets and images of the other backends are created in between
+		script := []string{check}
+		if cfg.BrickBackend == brickBackendDirectory {
+			script = append(script, prepare...)
+			prepare = nil
 		}
-		err := p.ExecuteCommands(ctx, host, cmds, cfg)
+		err = p.executeScript(ctx, host, script, cfg)
+		if hasExitStatus(err, brickNotEmptyStatus) {
+			return bricks, fmt.Errorf("brick path %s:%s already exists and is not empty: %v", host, path, err)
+		}
+		// Unless the script ran past the check the path is not ours to roll back
+		if err != nil && (prepare != nil || gerrors.Kind(err) != "backend") {
+			return bricks, err
+		}
+		bricks = append(bricks, brick)
 		if err != nil {
-			return nil, err
+			return bricks, err
+		}
+		if prepare == nil {
+			continue
+		}
+
+		switch cfg.BrickBackend {
+		case brickBackendZFS:
+			err = p.createZFSBrick(ctx, cfg.BrickRootPaths[i], brick, size, cfg)
+		case brickBackendLVM:
+			err = p.createLVMBrick(ctx, brick, size, cfg)
+		case brickBackendLoopback:
+			err = p.createLoopbackBrick(ctx, brick, size, cfg)
+		}
+		if err == nil {
+			err = p.executeScript(ctx, host, prepare, cfg)
+		}
+		if err != nil {
+			return bricks, err
 		}
 	}
 
 	return bricks, nil
 }
 
+// checkVolumeNameFree fails if a gluster volume named like the volume of cfg
+// exists already
+func (p *glusterfsProvisioner) checkVolumeNameFree(ctx context.Context, cfg *ProvisionerConfig) error {
+	names, err := p.listGlusterVolumes(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == cfg.VolumeName {
+			return gerrors.Configf("gluster volume %s exists already, check volumeNameTemplate of the storage class", cfg.VolumeName)
+		}
+	}
+	return nil
+}
+
+// createGlusterVolume creates, configures and starts the gluster volume of
+// cfg. created reports whether `gluster volume create` succeeded, even if a
+// later step failed.
 func (p *glusterfsProvisioner) createGlusterVolume(
 	ctx context.Context,
 	bricks []glusterBrick,
 	cfg *ProvisionerConfig,
-) error {
-	cmd := fmt.Sprintf(
-		"gluster --mode=script volume create %s %s", cfg.VolumeName, cfg.VolumeType,
-	)
+) (created bool, err error) {
+	volumeType, err := parseVolumeTypeArgs(cfg.VolumeType)
+	if err != nil {
+		return false, gerrors.Configf("volume type of volume %s is invalid: %v", cfg.VolumeName, err)
+	}
+	data := CommandData{
+		VolumeName:     cfg.VolumeName,
+		VolumeType:     volumeType.String(),
+		VolumeTypeArgs: volumeType.args(),
+		Transport:      cfg.Transport,
+		Force:          cfg.ForceCreate,
+	}
 	for _, b := range bricks {
-		cmd += fmt.Sprintf(" %s:%s", b.Host, b.Path)
+		data.Bricks = append(data.Bricks, cfg.glusterBrickName(b))
 	}
-	if cfg.ForceCreate {
-		cmd += " force"
+	create, err := cfg.command(commandCreateVolume, data)
+	if err != nil {
+		return false, err
 	}
 
-	cmds := []string{
-		cmd,
-		fmt.Sprintf("gluster --mode=script volume start %s", cfg.VolumeName),
+	var cmd string
+	var cmds []string
+	// Cluster options apply to the bricks started after they are set
+	for _, name := range sortedKeys(cfg.ClusterOptions) {
+		cmd, err = cfg.command(commandSetVolumeOption, CommandData{
+			VolumeName: "all",
+			Option:     name,
+			Value:      cfg.ClusterOptions[name],
+		})
+		if err != nil {
+			return false, err
+		}
+		cmds = append(cmds, cmd)
+	}
+	options := make([][2]string, 0, len(cfg.Profiles)+len(cfg.VolumeOptions))
+	for _, profile := range cfg.Profiles {
+		options = append(options, [2]string{"group", profile})
+	}
+	for _, name := range sortedKeys(cfg.VolumeOptions) {
+		options = append(options, [2]string{name, cfg.VolumeOptions[name]})
+	}
+	for _, option := range options {
+		cmd, err = cfg.command(commandSetVolumeOption, CommandData{
+			VolumeName: cfg.VolumeName,
+			Option:     option[0],
+			Value:      option[1],
+		})
+		if err != nil {
+			return false, err
+		}
+		cmds = append(cmds, cmd)
+	}
+	cmd, err = cfg.command(commandStartVolume, CommandData{VolumeName: cfg.VolumeName})
+	if err != nil {
+		return false, err
+	}
+	cmds = append(cmds, cmd)
+	if cfg.Bitrot {
+		// The scrubber is configured on the started volume
+		bitrot := [][2]string{{"enable", ""}}
+		if cfg.BitrotScrubFrequency != "" {
+			bitrot = append(bitrot, [2]string{"scrub-frequency", cfg.BitrotScrubFrequency})
+		}
+		if cfg.BitrotScrubThrottle != "" {
+			bitrot = append(bitrot, [2]string{"scrub-throttle", cfg.BitrotScrubThrottle})
+		}
+		for _, option := range bitrot {
+			cmd, err = cfg.command(commandBitrot, CommandData{
+				VolumeName: cfg.VolumeName,
+				Option:     option[0],
+				Value:      option[1],
+			})
+			if err != nil {
+				return false, err
+			}
+			cmds = append(cmds, cmd)
+		}
 	}
 	// XXX: Fix this simple host determination
 	host := bricks[0].Host
 
-	// Create and Start gluster volume
-	err := p.ExecuteCommands(ctx, host, cmds, cfg)
+	// The volume is created on its own to know whether to roll it back
+	err = p.executeScript(ctx, host, []string{create}, cfg)
 	if err != nil {
-		klog.Errorf("Failed to create gluster volume: %v", cmds)
-		return err
+		klog.Errorf("Failed to create gluster volume: %v", create)
+		return false, err
 	}
-	return nil
+	// Configure and start the gluster volume in one round trip
+	err = p.executeScript(ctx, host, cmds, cfg)
+	if err != nil {
+		klog.Errorf("Failed to start gluster volume: %v", cmds)
+		return true, err
+	}
+	return true, nil
 }
 
 func (p *glusterfsProvisioner) createEndpointService(
@@ -240,23 +902,28 @@ func (p *glusterfsProvisioner) createEndpointService(
 	namespace string, epServiceName string,
 	hostips []string,
 	pvcname string,
+	cfg *ProvisionerConfig,
 ) (endpoint *v1.Endpoints, service *v1.Service, err error) {
 
 	addrlist := make([]v1.EndpointAddress, len(hostips))
 	for i, v := range hostips {
 		addrlist[i].IP = v
 	}
+	labels := map[string]string{
+		"gluster.kubernetes.io/provisioned-for-pvc": pvcname,
+	}
+	if cfg.SharedEndpoints {
+		labels = map[string]string{labelSharedEndpoints: "true"}
+	}
 	endpoint = &v1.Endpoints{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: namespace,
 			Name:      epServiceName,
-			Labels: map[string]string{
-				"gluster.kubernetes.io/provisioned-for-pvc": pvcname,
-			},
+			Labels:    labels,
 		},
 		Subsets: []v1.EndpointSubset{{
 			Addresses: addrlist,
-			Ports:     []v1.EndpointPort{{Port: 1, Protocol: "TCP"}},
+			Ports:     []v1.EndpointPort{{Port: cfg.EndpointPort, Protocol: cfg.EndpointProtocol}},
 		}},
 	}
 	kubeClient := p.client
@@ -264,7 +931,9 @@ func (p *glusterfsProvisioner) createEndpointService(
 		return nil, nil, fmt.Errorf("glusterfs: failed to get kube client when creating endpoint service")
 	}
 	_, err = kubeClient.CoreV1().Endpoints(namespace).Create(ctx, endpoint, metav1.CreateOptions{})
-	if err != nil && errors.IsAlreadyExists(err) {
+	if err != nil && errors.IsAlreadyExists(err) && cfg.SharedEndpoints {
+		endpoint, err = p.mergeSharedEndpoints(ctx, namespace, epServiceName, hostips)
+	} else if err != nil && errors.IsAlreadyExists(err) {
 		klog.V(1).Infof("glusterfs: endpoint [%s] already exist in namespace [%s]", endpoint, namespace)
 		err = nil
 	}
@@ -272,17 +941,19 @@ func (p *glusterfsProvisioner) createEndpointService(
 		klog.Errorf("glusterfs: failed to create endpoint: %v", err)
 		return nil, nil, fmt.Errorf("error creating endpoint: %v", err)
 	}
+	if !cfg.CreateService {
+		return endpoint, nil, nil
+	}
 	service = &v1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      epServiceName,
 			Namespace: namespace,
-			Labels: map[string]string{
-				"gluster.kubernetes.io/provisioned-for-pvc": pvcname,
-			},
+			Labels:    labels,
 		},
 		Spec: v1.ServiceSpec{
+			Type: cfg.ServiceType,
 			Ports: []v1.ServicePort{
-				{Protocol: "TCP", Port: 1}}}}
+				{Protocol: cfg.EndpointProtocol, Port: cfg.EndpointPort}}}}
 	_, err = kubeClient.CoreV1().Services(namespace).Create(ctx, service, metav1.CreateOptions{})
 	if err != nil && errors.IsAlreadyExists(err) {
 		klog.V(1).Infof("glusterfs: service [%s] already exist in namespace [%s]", service, namespace)
@@ -0,0 +1,62 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"strings"
+
+	"k8s.io/api/core/v1"
+)
+
+// Values of the pvSource parameter
+const (
+	pvSourceGlusterfs = "glusterfs"
+	pvSourceCSI       = "csi"
+	pvSourceNFS       = "nfs"
+)
+
+// defaultCSIDriver is the name of the gluster CSI driver
+const defaultCSIDriver = "org.gluster.glusterfs"
+
+// persistentVolumeSource returns the source of a PV of the volume of cfg
+// with bricks, of the type selected by the pvSource parameter
+func (config *ProvisionerConfig) persistentVolumeSource(glusterfs *v1.GlusterfsPersistentVolumeSource, bricks []glusterBrick) v1.PersistentVolumeSource {
+	switch config.PVSource {
+	case pvSourceNFS:
+		return v1.PersistentVolumeSource{NFS: config.nfsSource()}
+	case pvSourceCSI:
+		return v1.PersistentVolumeSource{CSI: config.csiSource(bricks)}
+	}
+	return v1.PersistentVolumeSource{Glusterfs: glusterfs}
+}
+
+// csiSource returns a source for the gluster CSI driver mounting the volume
+// of cfg from the host of its first brick, falling back to the hosts of the
+// others
+func (config *ProvisionerConfig) csiSource(bricks []glusterBrick) *v1.CSIPersistentVolumeSource {
+	hosts := config.dataHosts(bricks)
+	attributes := map[string]string{
+		"glusterserver": hosts[0],
+		"glustervol":    config.VolumeName,
+	}
+	if len(hosts) > 1 {
+		attributes["glusterbackupvolfileservers"] = strings.Join(hosts[1:], ":")
+	}
+	return &v1.CSIPersistentVolumeSource{
+		Driver:           config.CSIDriver,
+		VolumeHandle:     config.VolumeName,
+		ReadOnly:         false,
+		VolumeAttributes: attributes,
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	gerrors "gluster-simple-provisioner/pkg/errors"
+	"k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	"k8s.io/klog"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v8/controller"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v8/util"
+)
+
+// glusterdCheckTTL is how long the result of a glusterd check is reused
+const glusterdCheckTTL = 30 * time.Second
+
+type glusterdCheck struct {
+	time time.Time
+	err  error
+}
+
+var _ controller.Qualifier = &glusterfsProvisioner{}
+
+// ShouldProvision skips claims the provisioner must not provision before
+// any work is started for them. The controller asks before it checks the
+// provisioner of the claim's class, so claims of classes served by other
+// provisioners are left to the controller without any checks or events.
+func (p *glusterfsProvisioner) ShouldProvision(ctx context.Context, claim *v1.PersistentVolumeClaim) bool {
+	className := util.GetPersistentVolumeClaimClass(claim)
+	if className == "" {
+		return true
+	}
+	class, err := p.getStorageClass(ctx, className)
+	if err != nil || !p.servesClass(class) {
+		return true
+	}
+	if p.isShuttingDown() {
+		return false
+	}
+	if err := p.checkNamespaceAllowed(claim.Namespace); err != nil {
+		klog.V(2).Infof("glusterfs: skipping claim %s/%s: %v", claim.Namespace, claim.Name, err)
+		p.recorder.Event(claim, v1.EventTypeWarning, "NamespaceNotAllowed", err.Error())
+		return false
+	}
+	if err := p.checkAccessModes(ctx, class, claim); err != nil {
+		klog.V(2).Infof("glusterfs: skipping claim %s/%s: %v", claim.Namespace, claim.Name, err)
+		p.recorder.Event(claim, v1.EventTypeWarning, "UnsupportedAccessMode", err.Error())
+		return false
+	}
+	if err := p.preflight(ctx, class, claim); err != nil {
+		klog.V(2).Infof("glusterfs: deferring claim %s/%s: %v", claim.Namespace, claim.Name, err)
+		reason := "PreflightFailed"
+		if _, ok := err.(*overcommitError); ok {
+			reason = "OvercommitExceeded"
+		}
+		p.recorder.Event(claim, v1.EventTypeWarning, reason, err.Error())
+		return false
+	}
+	return true
+}
+
+// preflight verifies that the brick hosts of the claim's class have enough
+// free capacity in the cached BrickPool inventory and that glusterd answers
+func (p *glusterfsProvisioner) preflight(ctx context.Context, class *storage.StorageClass, claim *v1.PersistentVolumeClaim) error {
+	cfg, err := p.claimConfig(ctx, class, claim, "")
+	if err != nil {
+		return gerrors.Configf("Parameter is invalid: %s", err)
+	}
+
+	if cfg.BrickPool != "" {
+		pool, err := p.getBrickPool(ctx, cfg.BrickPool)
+		if err != nil {
+			return err
+		}
+		size := claim.Spec.Resources.Requests[v1.ResourceStorage]
+		err = pool.checkCapacity(cfg, size.Value())
+		if err != nil {
+			return err
+		}
+	}
+
+	return p.checkGlusterd(ctx, cfg)
+}
+
+// checkGlusterd runs `gluster pool list` on the first brick host. Results
+// are cached for glusterdCheckTTL to keep claim syncs cheap.
+func (p *glusterfsProvisioner) checkGlusterd(ctx context.Context, cfg *ProvisionerConfig) error {
+	host := cfg.BrickRootPaths[0].Host
+	key := cfg.clusterKey() + "/" + host
+
+	p.glusterdChecksMutex.Lock()
+	check, ok := p.glusterdChecks[key]
+	p.glusterdChecksMutex.Unlock()
+	if ok && time.Since(check.time) < glusterdCheckTTL {
+		return check.err
+	}
+
+	err := p.ExecuteCommands(ctx, host, []string{"gluster --mode=script pool list"}, cfg)
+	if err != nil {
+		err = fmt.Errorf("glusterd on host %s is not reachable: %v", host, err)
+	}
+
+	p.glusterdChecksMutex.Lock()
+	p.glusterdChecks[key] = glusterdCheck{time: time.Now(), err: err}
+	p.glusterdChecksMutex.Unlock()
+	return err
+}
+
+// checkNamespaceAllowed returns an error if namespace is denied or not allowed
+func (p *glusterfsProvisioner) checkNamespaceAllowed(namespace string) error {
+	for _, ns := range p.options.DeniedNamespaces {
+		if ns == namespace {
+			return fmt.Errorf("namespace %s is denied by the gluster provisioner", namespace)
+		}
+	}
+	if len(p.options.AllowedNamespaces) == 0 {
+		return nil
+	}
+	for _, ns := range p.options.AllowedNamespaces {
+		if ns == namespace {
+			return nil
+		}
+	}
+	return fmt.Errorf("namespace %s is not allowed by the gluster provisioner", namespace)
+}
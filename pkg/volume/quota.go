@@ -0,0 +1,199 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// quotaReservationTTL drops the reservations of volumes whose PV never
+// appeared, e.g. because their claim was deleted before the PV was saved
+const quotaReservationTTL = 10 * time.Minute
+
+type quotaReservation struct {
+	size  resource.Quantity
+	since time.Time
+}
+
+// quotaReservations are the capacities of the volumes being provisioned, by
+// namespace and PV name. They count toward the quota of their namespace
+// until the controller saved their PVs.
+type quotaReservations struct {
+	mutex    sync.Mutex
+	reserved map[string]map[string]quotaReservation
+}
+
+func newQuotaReservations() *quotaReservations {
+	return &quotaReservations{reserved: make(map[string]map[string]quotaReservation)}
+}
+
+func (r *quotaReservations) reserve(namespace string, pvName string, size resource.Quantity) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.reserved[namespace] == nil {
+		r.reserved[namespace] = make(map[string]quotaReservation)
+	}
+	r.reserved[namespace][pvName] = quotaReservation{size: size, since: time.Now()}
+}
+
+func (r *quotaReservations) release(namespace string, pvName string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.reserved[namespace], pvName)
+	if len(r.reserved[namespace]) == 0 {
+		delete(r.reserved, namespace)
+	}
+}
+
+// inFlight returns the capacity reserved in namespace for PVs not in saved.
+// Reservations of saved PVs are dropped, since the PVs count themselves.
+func (r *quotaReservations) inFlight(namespace string, saved map[string]bool) resource.Quantity {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	total := resource.NewQuantity(0, resource.BinarySI)
+	for pvName, reservation := range r.reserved[namespace] {
+		if saved[pvName] || time.Since(reservation.since) > quotaReservationTTL {
+			delete(r.reserved[namespace], pvName)
+			continue
+		}
+		total.Add(reservation.size)
+	}
+	if len(r.reserved[namespace]) == 0 {
+		delete(r.reserved, namespace)
+	}
+	return *total
+}
+
+// namespaceQuota returns the capacity quota of namespace from the quota
+// ConfigMap, whose data maps namespace names to quantities. A `*` key
+// applies to namespaces without their own entry.
+func (p *glusterfsProvisioner) namespaceQuota(ctx context.Context, namespace string) (*resource.Quantity, error) {
+	if p.options.QuotaConfigMap == "" {
+		return nil, nil
+	}
+	cmNamespace, cmName, err := splitNamespacedName(p.options.QuotaConfigMap)
+	if err != nil {
+		return nil, err
+	}
+	cm, err := p.client.CoreV1().ConfigMaps(cmNamespace).Get(ctx, cmName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		klog.V(4).Infof("glusterfs: quota configmap %s not found", p.options.QuotaConfigMap)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := cm.Data[namespace]
+	if !ok {
+		value, ok = cm.Data["*"]
+	}
+	if !ok {
+		return nil, nil
+	}
+	quota, err := resource.ParseQuantity(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("quota of namespace %s in configmap %s is invalid: %v", namespace, p.options.QuotaConfigMap, err)
+	}
+	return &quota, nil
+}
+
+// namespaceUsage returns the capacity of the volumes provisioned for claims
+// in namespace, including the volumes being provisioned
+func (p *glusterfsProvisioner) namespaceUsage(ctx context.Context, namespace string) (*resource.Quantity, error) {
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	usage := resource.NewQuantity(0, resource.BinarySI)
+	saved := make(map[string]bool)
+	for _, pv := range pvs.Items {
+		saved[pv.Name] = true
+		if pv.Annotations[annCreatedBy] != createdBy {
+			continue
+		}
+		if pv.Spec.ClaimRef == nil || pv.Spec.ClaimRef.Namespace != namespace {
+			continue
+		}
+		usage.Add(pv.Spec.Capacity[v1.ResourceStorage])
+	}
+	usage.Add(p.inFlightQuota.inFlight(namespace, saved))
+	return usage, nil
+}
+
+// reserveNamespaceQuota rejects claim if provisioning size would exceed the
+// quota of its namespace, and otherwise reserves size for its PV pvName
+// until the PV is saved. Checks and reservations of a namespace are
+// serialized. The returned function drops the reservation when
+// provisioning fails.
+func (p *glusterfsProvisioner) reserveNamespaceQuota(ctx context.Context, claim *v1.PersistentVolumeClaim, pvName string, size resource.Quantity) (func(), error) {
+	if p.options.QuotaConfigMap == "" {
+		return func() {}, nil
+	}
+	unlock, err := p.lockNamespaceQuota(ctx, claim.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	msg, err := p.namespaceQuotaExceeded(ctx, claim.Namespace, size)
+	if err != nil {
+		return nil, err
+	}
+	if msg != "" {
+		p.recorder.Event(claim, v1.EventTypeWarning, "QuotaExceeded", msg)
+		return nil, fmt.Errorf("%s", msg)
+	}
+	p.inFlightQuota.reserve(claim.Namespace, pvName, size)
+	return func() {
+		p.inFlightQuota.release(claim.Namespace, pvName)
+	}, nil
+}
+
+// namespaceQuotaExceeded returns why provisioning size in namespace would
+// exceed its quota, or "" if it fits
+func (p *glusterfsProvisioner) namespaceQuotaExceeded(ctx context.Context, namespace string, size resource.Quantity) (string, error) {
+	quota, err := p.namespaceQuota(ctx, namespace)
+	if err != nil || quota == nil {
+		return "", err
+	}
+	usage, err := p.namespaceUsage(ctx, namespace)
+	if err != nil {
+		return "", err
+	}
+	total := usage.DeepCopy()
+	total.Add(size)
+	if total.Cmp(*quota) > 0 {
+		return fmt.Sprintf("gluster capacity quota of namespace %s exceeded: requested %s, used %s, quota %s",
+			namespace, size.String(), usage.String(), quota.String()), nil
+	}
+	return "", nil
+}
+
+func splitNamespacedName(name string) (string, string, error) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("%q is not in namespace/name format", name)
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Ready returns an error unless the API server answers and glusterd answers
+// on at least one gluster host of the StorageClasses of this provisioner.
+// Without classes only the API server is checked. With a CanaryNamespace
+// the canaries of all classes must have passed as well.
+func (p *glusterfsProvisioner) Ready(ctx context.Context) error {
+	_, err := p.client.Discovery().ServerVersion()
+	if err != nil {
+		return fmt.Errorf("API server is not reachable: %v", err)
+	}
+	if p.options.CanaryNamespace != "" {
+		if err := p.canariesReady(); err != nil {
+			return err
+		}
+	}
+
+	classes, err := p.client.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list storage classes: %v", err)
+	}
+	var errs []string
+	for _, class := range classes.Items {
+		if p.options.ProvisionerName != "" && class.Provisioner != p.options.ProvisionerName {
+			continue
+		}
+		cfg, err := p.classConfig(ctx, &class, "")
+		if err != nil {
+			continue
+		}
+		err = p.checkGlusterd(ctx, cfg)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err.Error())
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("no gluster host is reachable: %s", strings.Join(errs, "; "))
+}
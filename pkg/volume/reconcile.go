@@ -0,0 +1,194 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// reconcileVolumes verifies on startup that the gluster volume, endpoints
+// and service of every provisioned PV still exist. Missing endpoints and
+// services are recreated, missing gluster volumes are reported as events.
+func (p *glusterfsProvisioner) reconcileVolumes(ctx context.Context) {
+	volumes, err := p.listProvisionedVolumes(ctx)
+	if err != nil {
+		klog.Errorf("glusterfs: failed to list volumes to reconcile: %v", err)
+		return
+	}
+
+	// Volume names of each cluster, listed once
+	clusterVolumes := make(map[string]map[string]bool)
+	for i := range volumes {
+		pv := &volumes[i]
+		cfg, bricks, err := p.configForVolume(ctx, pv)
+		if err != nil {
+			klog.Errorf("glusterfs: failed to reconcile volume %s: %v", pv.Name, err)
+			continue
+		}
+
+		key := cfg.clusterKey()
+		existing, ok := clusterVolumes[key]
+		if !ok {
+			names, err := p.listGlusterVolumes(ctx, cfg)
+			if err != nil {
+				klog.Errorf("glusterfs: failed to list gluster volumes of cluster %s: %v", key, err)
+			} else {
+				existing = make(map[string]bool)
+				for _, name := range names {
+					existing[name] = true
+				}
+			}
+			clusterVolumes[key] = existing
+		}
+		if existing != nil && !existing[cfg.VolumeName] {
+			klog.Errorf("glusterfs: gluster volume %s of PV %s does not exist", cfg.VolumeName, pv.Name)
+			p.recorder.Event(pv, v1.EventTypeWarning, "VolumeMissing",
+				fmt.Sprintf("gluster volume %s does not exist", cfg.VolumeName))
+		}
+
+		err = p.reconcileEndpoints(ctx, pv, cfg, bricks)
+		if err != nil {
+			klog.Errorf("glusterfs: failed to reconcile endpoints of volume %s: %v", pv.Name, err)
+		}
+	}
+	klog.Infof("glusterfs: reconciled %d volumes", len(volumes))
+}
+
+// reconcileEndpoints recreates the endpoints and service of a glusterfs PV
+// if either of them is missing, and updates the addresses of existing
+// endpoints to the brick hosts
+func (p *glusterfsProvisioner) reconcileEndpoints(ctx context.Context, pv *v1.PersistentVolume, cfg *ProvisionerConfig, bricks []glusterBrick) error {
+	source := pv.Spec.Glusterfs
+	claim := pv.Spec.ClaimRef
+	if source == nil || claim == nil || pv.Status.Phase == v1.VolumeReleased {
+		return nil
+	}
+	namespace := claim.Namespace
+	if source.EndpointsNamespace != nil {
+		namespace = *source.EndpointsNamespace
+	}
+
+	hosts := cfg.dataHosts(bricks)
+
+	endpoint, epErr := p.client.CoreV1().Endpoints(namespace).Get(ctx, source.EndpointsName, metav1.GetOptions{})
+	var svcErr error
+	if cfg.CreateService {
+		_, svcErr = p.client.CoreV1().Services(namespace).Get(ctx, source.EndpointsName, metav1.GetOptions{})
+	}
+	if epErr == nil && svcErr == nil {
+		return p.syncEndpointAddresses(ctx, pv, endpoint, hosts)
+	}
+	for _, err := range []error{epErr, svcErr} {
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	_, _, err := p.createEndpointService(ctx, namespace, source.EndpointsName, hosts, claim.Name, cfg)
+	if err != nil {
+		return err
+	}
+	klog.Infof("glusterfs: recreated endpoints %s/%s of volume %s", namespace, source.EndpointsName, pv.Name)
+	p.recorder.Event(pv, v1.EventTypeNormal, "EndpointsRepaired",
+		fmt.Sprintf("recreated missing endpoints and service %s/%s", namespace, source.EndpointsName))
+	return nil
+}
+
+// syncEndpointAddresses updates the addresses of the endpoints of pv to the
+// hosts of its bricks, e.g. after bricks were moved to other hosts. Shared
+// endpoints only get missing hosts added.
+func (p *glusterfsProvisioner) syncEndpointAddresses(ctx context.Context, pv *v1.PersistentVolume, endpoint *v1.Endpoints, hosts []string) error {
+	if endpoint.Labels[labelSharedEndpoints] == "true" {
+		_, err := p.mergeSharedEndpoints(ctx, endpoint.Namespace, endpoint.Name, hosts)
+		return err
+	}
+	if len(hosts) == 0 || equalEndpointAddresses(endpoint, hosts) {
+		return nil
+	}
+
+	addresses := make([]v1.EndpointAddress, len(hosts))
+	for i, host := range hosts {
+		addresses[i].IP = host
+	}
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := p.client.CoreV1().Endpoints(endpoint.Namespace).Get(ctx, endpoint.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if len(latest.Subsets) == 0 {
+			latest.Subsets = endpoint.Subsets
+		}
+		if len(latest.Subsets) == 0 {
+			latest.Subsets = []v1.EndpointSubset{{}}
+		}
+		latest.Subsets = latest.Subsets[:1]
+		latest.Subsets[0].Addresses = addresses
+		_, err = p.client.CoreV1().Endpoints(endpoint.Namespace).Update(ctx, latest, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	klog.Infof("glusterfs: updated endpoints %s/%s of volume %s to hosts %v", endpoint.Namespace, endpoint.Name, pv.Name, hosts)
+	p.recorder.Event(pv, v1.EventTypeNormal, "EndpointsUpdated",
+		fmt.Sprintf("updated endpoints %s/%s to the brick hosts %s", endpoint.Namespace, endpoint.Name, strings.Join(hosts, ", ")))
+	return nil
+}
+
+// equalEndpointAddresses reports whether endpoint lists exactly hosts
+func equalEndpointAddresses(endpoint *v1.Endpoints, hosts []string) bool {
+	current := make(map[string]bool)
+	for _, subset := range endpoint.Subsets {
+		for _, address := range subset.Addresses {
+			current[address.IP] = true
+		}
+	}
+	if len(current) != len(hosts) {
+		return false
+	}
+	for _, host := range hosts {
+		if !current[host] {
+			return false
+		}
+	}
+	return true
+}
+
+// syncEndpoints keeps the endpoints of every provisioned PV in line with the
+// hosts of its bricks
+func (p *glusterfsProvisioner) syncEndpoints(ctx context.Context) {
+	volumes, err := p.listProvisionedVolumes(ctx)
+	if err != nil {
+		klog.Errorf("glusterfs: failed to list volumes to sync endpoints: %v", err)
+		return
+	}
+	for i := range volumes {
+		pv := &volumes[i]
+		cfg, bricks, err := p.configForVolume(ctx, pv)
+		if err == nil {
+			err = p.reconcileEndpoints(ctx, pv, cfg, bricks)
+		}
+		if err != nil {
+			klog.Errorf("glusterfs: failed to sync endpoints of volume %s: %v", pv.Name, err)
+		}
+	}
+}
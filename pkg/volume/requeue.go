@@ -0,0 +1,148 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v8/controller"
+)
+
+const (
+	// claimResyncPeriod is the resync period the controller library uses
+	// for its own claim informer
+	claimResyncPeriod = 15 * time.Minute
+	// heldClaimRequeuePeriod is how often held back claims are handed back
+	// to the controller
+	heldClaimRequeuePeriod = 10 * time.Second
+)
+
+// claimInformer is the claim informer of the controller. It keeps the event
+// handlers the controller adds, so that claims the provisioner held back can
+// be handed back to the queue of the controller as if they were updated.
+// Unlike a failed Provision, this does not count toward the failed attempts
+// after which the controller gives up on a claim.
+type claimInformer struct {
+	cache.SharedIndexInformer
+	mutex    sync.Mutex
+	handlers []cache.ResourceEventHandler
+}
+
+func newClaimInformer(client kubernetes.Interface) *claimInformer {
+	return &claimInformer{
+		SharedIndexInformer: coreinformers.NewPersistentVolumeClaimInformer(client, metav1.NamespaceAll, claimResyncPeriod, cache.Indexers{}),
+	}
+}
+
+func (i *claimInformer) AddEventHandler(handler cache.ResourceEventHandler) (cache.ResourceEventHandlerRegistration, error) {
+	i.keep(handler)
+	return i.SharedIndexInformer.AddEventHandler(handler)
+}
+
+func (i *claimInformer) AddEventHandlerWithResyncPeriod(handler cache.ResourceEventHandler, resyncPeriod time.Duration) (cache.ResourceEventHandlerRegistration, error) {
+	i.keep(handler)
+	return i.SharedIndexInformer.AddEventHandlerWithResyncPeriod(handler, resyncPeriod)
+}
+
+func (i *claimInformer) keep(handler cache.ResourceEventHandler) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.handlers = append(i.handlers, handler)
+}
+
+// requeue hands claim to the event handlers as an update
+func (i *claimInformer) requeue(claim *v1.PersistentVolumeClaim) {
+	i.mutex.Lock()
+	handlers := i.handlers
+	i.mutex.Unlock()
+	for _, handler := range handlers {
+		handler.OnUpdate(claim, claim)
+	}
+}
+
+// heldClaims are the claims Provision held back, by UID
+type heldClaims struct {
+	mutex  sync.Mutex
+	claims map[types.UID]*v1.PersistentVolumeClaim
+}
+
+func newHeldClaims() *heldClaims {
+	return &heldClaims{claims: make(map[types.UID]*v1.PersistentVolumeClaim)}
+}
+
+func (h *heldClaims) hold(claim *v1.PersistentVolumeClaim) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.claims[claim.UID] = claim
+}
+
+func (h *heldClaims) release(uid types.UID) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.claims, uid)
+}
+
+func (h *heldClaims) list() []*v1.PersistentVolumeClaim {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	claims := make([]*v1.PersistentVolumeClaim, 0, len(h.claims))
+	for _, claim := range h.claims {
+		claims = append(claims, claim)
+	}
+	return claims
+}
+
+// ClaimInformer returns the claim informer to pass to the controller with
+// controller.ClaimsInformer. It is run by Run.
+func (p *glusterfsProvisioner) ClaimInformer() cache.SharedIndexInformer {
+	return p.claimInformer
+}
+
+// holdBack records claim as held back for reason and returns what Provision
+// returns for it: an IgnoredError, which the controller neither retries nor
+// counts as a failed attempt. requeueHeldClaims hands the claim back later.
+func (p *glusterfsProvisioner) holdBack(claim *v1.PersistentVolumeClaim, reason string, err error) (*v1.PersistentVolume, controller.ProvisioningState, error) {
+	klog.V(2).Infof("glusterfs: holding back claim %s/%s: %v", claim.Namespace, claim.Name, err)
+	p.recorder.Event(claim, v1.EventTypeNormal, reason, err.Error())
+	p.heldClaims.hold(claim)
+	return nil, controller.ProvisioningFinished, &controller.IgnoredError{Reason: err.Error()}
+}
+
+// requeueHeldClaims hands the held back claims that still wait for a volume
+// back to the controller
+func (p *glusterfsProvisioner) requeueHeldClaims(ctx context.Context) {
+	for _, held := range p.heldClaims.list() {
+		obj, exists, err := p.claimInformer.GetStore().Get(held)
+		if err != nil {
+			klog.Errorf("glusterfs: failed to get claim %s/%s: %v", held.Namespace, held.Name, err)
+			continue
+		}
+		claim, _ := obj.(*v1.PersistentVolumeClaim)
+		if !exists || claim.UID != held.UID || claim.Spec.VolumeName != "" {
+			p.heldClaims.release(held.UID)
+			p.priorities.done(held.UID)
+			continue
+		}
+		p.claimInformer.requeue(claim)
+	}
+}
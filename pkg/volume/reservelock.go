@@ -0,0 +1,163 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+const (
+	// reservationLeaseDuration bounds how long a crashed provisioner blocks
+	// the reservations of a BrickPool. Reservations take a few API calls.
+	reservationLeaseDuration = 15 * time.Second
+	reservationLeaseTimeout  = 2 * reservationLeaseDuration
+	reservationLeasePoll     = 200 * time.Millisecond
+	reservationLeasePrefix   = "glusterfs-simple-brickpool-"
+	quotaLeasePrefix         = "glusterfs-simple-quota-"
+)
+
+// reservationLocks serializes capacity checks and reservations per
+// BrickPool and namespace quota. Within the process a mutex is enough;
+// provisioners sharing them across processes also hold a Lease in
+// LockNamespace.
+type reservationLocks struct {
+	mutex  sync.Mutex
+	pools  map[string]*sync.Mutex
+	holder string
+}
+
+func newReservationLocks() *reservationLocks {
+	hostname, _ := os.Hostname()
+	return &reservationLocks{
+		pools:  make(map[string]*sync.Mutex),
+		holder: fmt.Sprintf("%s_%d", hostname, os.Getpid()),
+	}
+}
+
+func (l *reservationLocks) pool(name string) *sync.Mutex {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	m, ok := l.pools[name]
+	if !ok {
+		m = &sync.Mutex{}
+		l.pools[name] = m
+	}
+	return m
+}
+
+// lockBrickPool locks the reservations of pool and returns the function
+// unlocking them
+func (p *glusterfsProvisioner) lockBrickPool(ctx context.Context, pool string) (func(), error) {
+	unlock, err := p.lockReservations(ctx, reservationLeasePrefix+pool)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock brick pool %s: %v", pool, err)
+	}
+	return unlock, nil
+}
+
+// lockNamespaceQuota locks the quota of namespace and returns the function
+// unlocking it
+func (p *glusterfsProvisioner) lockNamespaceQuota(ctx context.Context, namespace string) (func(), error) {
+	unlock, err := p.lockReservations(ctx, quotaLeasePrefix+namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock the quota of namespace %s: %v", namespace, err)
+	}
+	return unlock, nil
+}
+
+// lockReservations locks the reservations guarded by the Lease name
+func (p *glusterfsProvisioner) lockReservations(ctx context.Context, name string) (func(), error) {
+	m := p.reservationLocks.pool(name)
+	m.Lock()
+	if p.options.LockNamespace == "" {
+		return m.Unlock, nil
+	}
+	err := p.acquireLease(ctx, name)
+	if err != nil {
+		m.Unlock()
+		return nil, err
+	}
+	return func() {
+		p.releaseLease(ctx, name)
+		m.Unlock()
+	}, nil
+}
+
+// acquireLease waits until the Lease name is free or expired and takes it
+func (p *glusterfsProvisioner) acquireLease(ctx context.Context, name string) error {
+	leases := p.client.CoordinationV1().Leases(p.options.LockNamespace)
+	holder := p.reservationLocks.holder
+	duration := int32(reservationLeaseDuration.Seconds())
+	return wait.PollImmediate(reservationLeasePoll, reservationLeaseTimeout, func() (bool, error) {
+		now := metav1.NowMicro()
+		lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			_, err = leases.Create(ctx, &coordinationv1.Lease{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: p.options.LockNamespace},
+				Spec: coordinationv1.LeaseSpec{
+					HolderIdentity:       &holder,
+					LeaseDurationSeconds: &duration,
+					AcquireTime:          &now,
+					RenewTime:            &now,
+				},
+			}, metav1.CreateOptions{})
+			if errors.IsAlreadyExists(err) {
+				return false, nil
+			}
+			return err == nil, err
+		}
+		if err != nil {
+			return false, err
+		}
+		spec := &lease.Spec
+		if spec.HolderIdentity != nil && *spec.HolderIdentity != "" && *spec.HolderIdentity != holder &&
+			spec.RenewTime != nil && spec.LeaseDurationSeconds != nil &&
+			time.Since(spec.RenewTime.Time) < time.Duration(*spec.LeaseDurationSeconds)*time.Second {
+			return false, nil
+		}
+		spec.HolderIdentity = &holder
+		spec.LeaseDurationSeconds = &duration
+		spec.AcquireTime = &now
+		spec.RenewTime = &now
+		_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+		if errors.IsConflict(err) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+}
+
+// releaseLease frees the Lease name if it is still held by this process
+func (p *glusterfsProvisioner) releaseLease(ctx context.Context, name string) {
+	leases := p.client.CoordinationV1().Leases(p.options.LockNamespace)
+	lease, err := leases.Get(ctx, name, metav1.GetOptions{})
+	if err == nil && lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity == p.reservationLocks.holder {
+		lease.Spec.HolderIdentity = nil
+		_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		// The lease expires after reservationLeaseDuration
+		klog.Errorf("glusterfs: failed to release lease %s/%s: %v", p.options.LockNamespace, name, err)
+	}
+}
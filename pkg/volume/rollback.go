@@ -0,0 +1,111 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// annRollbackLeftovers records on a claim the bricks and gluster volume a
+// failed provisioning could not roll back, as `volume:<name>` and
+// `brick:<host>:/path` separated by commas
+const annRollbackLeftovers = "gluster.simple/rollback-leftovers"
+
+// verifyRollback returns what is left of the gluster volume of cfg and of
+// bricks after a rollback. Anything that cannot be checked is reported.
+func (p *glusterfsProvisioner) verifyRollback(ctx context.Context, cfg *ProvisionerConfig, bricks []glusterBrick, volumeCreated bool) []string {
+	var leftovers []string
+	if volumeCreated {
+		names, err := p.listGlusterVolumes(ctx, cfg)
+		if err != nil {
+			klog.Errorf("%sglusterfs: failed to verify rollback of volume %s: %v", logPrefix(ctx), cfg.VolumeName, err)
+			leftovers = append(leftovers, "volume:"+cfg.VolumeName)
+		}
+		for _, name := range names {
+			if name == cfg.VolumeName {
+				leftovers = append(leftovers, "volume:"+cfg.VolumeName)
+			}
+		}
+	}
+	for _, b := range bricks {
+		paths := shellQuote(b.Path)
+		switch cfg.BrickBackend {
+		case brickBackendLVM:
+			paths += " " + shellQuote(lvmDevice(b, cfg))
+		case brickBackendLoopback:
+			paths += " " + shellQuote(loopbackImage(b))
+		}
+		out, err := p.executeCommandOnHost(ctx, b.Host,
+			fmt.Sprintf("for p in %s; do [ -e \"$p\" ] && echo present; done; true", paths), cfg)
+		if err != nil {
+			klog.Errorf("%sglusterfs: failed to verify rollback of brick %s:%s: %v", logPrefix(ctx), b.Host, b.Path, err)
+		}
+		if err != nil || strings.Contains(out, "present") {
+			leftovers = append(leftovers, "brick:"+b.Host+":"+b.Path)
+		}
+	}
+	return leftovers
+}
+
+// recordLeftovers records leftovers of a rollback on the claim and reports
+// them as event, for the orphans command and the administrator to clean up
+func (p *glusterfsProvisioner) recordLeftovers(ctx context.Context, namespace string, pvcName string, leftovers []string) {
+	klog.Errorf("%sglusterfs: rollback of claim %s/%s left %v", logPrefix(ctx), namespace, pvcName, leftovers)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pvc, err := p.client.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, pvcName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if pvc.Annotations == nil {
+			pvc.Annotations = make(map[string]string)
+		}
+		pvc.Annotations[annRollbackLeftovers] = strings.Join(leftovers, ",")
+		pvc, err = p.client.CoreV1().PersistentVolumeClaims(namespace).Update(ctx, pvc, metav1.UpdateOptions{})
+		if err == nil {
+			p.recorder.Event(pvc, v1.EventTypeWarning, "RollbackIncomplete",
+				fmt.Sprintf("failed provisioning left %s, see the %s annotation", strings.Join(leftovers, ", "), annRollbackLeftovers))
+		}
+		return err
+	})
+	if err != nil {
+		klog.Errorf("glusterfs: failed to record rollback leftovers on claim %s/%s: %v", namespace, pvcName, err)
+	}
+}
+
+// clearLeftovers drops the leftovers recorded on a claim once it was
+// provisioned, which reused or replaced them
+func (p *glusterfsProvisioner) clearLeftovers(ctx context.Context, claim *v1.PersistentVolumeClaim) {
+	if _, ok := claim.Annotations[annRollbackLeftovers]; !ok {
+		return
+	}
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pvc, err := p.client.CoreV1().PersistentVolumeClaims(claim.Namespace).Get(ctx, claim.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		delete(pvc.Annotations, annRollbackLeftovers)
+		_, err = p.client.CoreV1().PersistentVolumeClaims(claim.Namespace).Update(ctx, pvc, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		klog.Errorf("glusterfs: failed to clear rollback leftovers of claim %s/%s: %v", claim.Namespace, claim.Name, err)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+)
+
+// annReused marks PVs that were scrubbed and made available again
+const annReused = "gluster.simple/reused"
+
+// reuseReleasedVolumes scrubs released PVs of classes with scrubOnRelease
+// and makes them available to new claims. Reused PVs bound to a claim get
+// endpoints in the namespace of the claim.
+func (p *glusterfsProvisioner) reuseReleasedVolumes(ctx context.Context) {
+	volumes, err := p.listProvisionedVolumes(ctx)
+	if err != nil {
+		klog.Errorf("glusterfs: failed to list volumes to scrub: %v", err)
+		return
+	}
+	for i := range volumes {
+		pv := &volumes[i]
+		switch {
+		case pv.Status.Phase == v1.VolumeReleased &&
+			pv.Spec.PersistentVolumeReclaimPolicy == v1.PersistentVolumeReclaimRetain:
+			err = p.scrubVolume(ctx, pv)
+		case pv.Status.Phase == v1.VolumeBound && pv.Annotations[annReused] == "true":
+			err = p.ensureReusedEndpoints(ctx, pv)
+		default:
+			continue
+		}
+		if err != nil {
+			klog.Errorf("glusterfs: failed to reuse volume %s: %v", pv.Name, err)
+		}
+	}
+}
+
+// scrubVolume removes all data of the released pv through a gluster mount
+// and clears its claim reference
+func (p *glusterfsProvisioner) scrubVolume(ctx context.Context, pv *v1.PersistentVolume) error {
+	cfg, bricks, err := p.configForVolume(ctx, pv)
+	if err != nil {
+		return err
+	}
+	if !cfg.ScrubOnRelease {
+		return nil
+	}
+	if isDeletionProtected(pv, p.boundClaim(pv), cfg) {
+		klog.V(2).Infof("glusterfs: not scrubbing volume %s, it is protected from deletion", pv.Name)
+		p.recorder.Eventf(pv, v1.EventTypeNormal, "ScrubSkipped",
+			"volume is protected from deletion, remove the %s annotation to scrub it", annDeletionProtected)
+		return nil
+	}
+
+	klog.Infof("glusterfs: scrubbing released volume %s (%s)", pv.Name, cfg.VolumeName)
+	cmds := []string{fmt.Sprintf(
+		"dir=$(mktemp -d) && mount -t glusterfs %s \"$dir\" && "+
+			"(%s; rc=$?; umount \"$dir\"; rmdir \"$dir\"; exit $rc)",
+		shellQuote("localhost:/"+cfg.VolumeName), cfg.heavy("find \"$dir\" -mindepth 1 -delete"),
+	)}
+	err = p.ExecuteCommands(ctx, bricks[0].Host, cmds, cfg)
+	if err != nil {
+		p.recorder.Event(pv, v1.EventTypeWarning, "ScrubFailed", err.Error())
+		return err
+	}
+
+	pv = pv.DeepCopy()
+	pv.Spec.ClaimRef = nil
+	if pv.Annotations == nil {
+		pv.Annotations = make(map[string]string)
+	}
+	pv.Annotations[annReused] = "true"
+	_, err = p.client.CoreV1().PersistentVolumes().Update(ctx, pv, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+	p.recorder.Event(pv, v1.EventTypeNormal, "Scrubbed", "volume was scrubbed and is available again")
+	return nil
+}
+
+// ensureReusedEndpoints creates the endpoints of a reused pv in the
+// namespace of the claim it is now bound to
+func (p *glusterfsProvisioner) ensureReusedEndpoints(ctx context.Context, pv *v1.PersistentVolume) error {
+	if pv.Spec.Glusterfs == nil || pv.Spec.Glusterfs.EndpointsNamespace != nil {
+		return nil
+	}
+	cfg, bricks, err := p.configForVolume(ctx, pv)
+	if err != nil {
+		return err
+	}
+	hosts := cfg.dataHosts(bricks)
+	claim := pv.Spec.ClaimRef
+	_, _, err = p.createEndpointService(ctx, claim.Namespace, pv.Spec.Glusterfs.EndpointsName, hosts, claim.Name, cfg)
+	return err
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// poolLabel matches the name of a named pool or BrickPool in claim
+// selectors, in addition to the labels of the BrickPool itself
+const poolLabel = "gluster.simple/pool"
+
+// applyClaimSelector returns params with the pool matched by the selector of
+// claim, e.g. `matchLabels: {gluster.simple/pool: ssd}`. Classes with named
+// pools match the `pool` parameter, which must be listed in allowedOverrides,
+// other classes match the `brickPool` parameter, which must be listed too.
+func (p *glusterfsProvisioner) applyClaimSelector(ctx context.Context, params map[string]string, claim *v1.PersistentVolumeClaim) (map[string]string, error) {
+	if claim.Spec.Selector == nil {
+		return params, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(claim.Spec.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("claim selector is invalid: %v", err)
+	}
+
+	param := "brickpool"
+	var candidates []labels.Set
+	if pools := poolParameters(params); len(pools) > 0 {
+		param = "pool"
+		for name := range pools {
+			candidates = append(candidates, labels.Set{poolLabel: name})
+		}
+	} else {
+		candidates, err = p.brickPoolLabels(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !allowedOverrides(params)[param] {
+		return nil, fmt.Errorf("claim selector is not allowed by the storage class (allowedOverrides must include %s)", param)
+	}
+
+	var matches []string
+	for _, set := range candidates {
+		if selector.Matches(set) {
+			matches = append(matches, set[poolLabel])
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no pool matches claim selector %s", selector.String())
+	case 1:
+		return setParameter(params, param, matches[0]), nil
+	default:
+		sort.Strings(matches)
+		return nil, fmt.Errorf("claim selector %s matches several pools: %s", selector.String(), strings.Join(matches, ", "))
+	}
+}
+
+// brickPoolLabels returns the labels of every BrickPool, plus poolLabel
+// holding its name
+func (p *glusterfsProvisioner) brickPoolLabels(ctx context.Context) ([]labels.Set, error) {
+	if p.dynamicClient == nil {
+		return nil, fmt.Errorf("glusterfs: failed to get dynamic client when selecting brick pool")
+	}
+	list, err := p.dynamicClient.Resource(BrickPoolResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list brick pools: %v", err)
+	}
+	sets := make([]labels.Set, len(list.Items))
+	for i, item := range list.Items {
+		sets[i] = labels.Set{}
+		for k, v := range item.GetLabels() {
+			sets[i][k] = v
+		}
+		sets[i][poolLabel] = item.GetName()
+	}
+	return sets, nil
+}
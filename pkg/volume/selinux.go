@@ -0,0 +1,47 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// selinuxTypeRegexp matches SELinux types, e.g. glusterd_brick_t
+var selinuxTypeRegexp = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// selinuxLabelCommands returns the commands labeling a new brick with the
+// SELinux type of cfg. With brickSELinuxFcontext the label is also
+// registered with semanage, so that it survives a relabel of the host.
+func selinuxLabelCommands(path string, cfg *ProvisionerConfig) []string {
+	if cfg.SELinuxType == "" {
+		return nil
+	}
+	if cfg.SELinuxFcontext {
+		return []string{
+			fmt.Sprintf("semanage fcontext -a -t %s %s", shellQuote(cfg.SELinuxType), shellQuote(path+"(/.*)?")),
+			fmt.Sprintf("restorecon -R %s", shellQuote(path)),
+		}
+	}
+	return []string{fmt.Sprintf("chcon -R -t %s %s", shellQuote(cfg.SELinuxType), shellQuote(path))}
+}
+
+// selinuxUnlabelCommands returns the commands dropping the semanage rule of
+// a deleted brick
+func selinuxUnlabelCommands(path string, cfg *ProvisionerConfig) []string {
+	if !cfg.SELinuxFcontext {
+		return nil
+	}
+	return []string{fmt.Sprintf("semanage fcontext -d %s || true", shellQuote(path+"(/.*)?"))}
+}
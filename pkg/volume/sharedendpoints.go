@@ -0,0 +1,81 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+const (
+	// sharedEndpointsName names the endpoints and service shared by the PVs
+	// of a namespace with the sharedEndpoints parameter
+	sharedEndpointsName = dynamicEpSvcPrefix + "cluster"
+	// labelSharedEndpoints marks shared endpoints and services
+	labelSharedEndpoints = "gluster.simple/shared-endpoints"
+)
+
+// endpointsName returns the name of the endpoints and service of the volume
+// pvName
+func (config *ProvisionerConfig) endpointsName(pvName string) string {
+	if !config.SharedEndpoints {
+		return dynamicEpSvcPrefix + pvName
+	}
+	// Volumes of other clusters have other hosts
+	if config.ClusterName != "" {
+		return sharedEndpointsName + "-" + config.ClusterName
+	}
+	return sharedEndpointsName
+}
+
+// mergeSharedEndpoints adds the hosts missing from the shared endpoints
+// namespace/name. Hosts are never removed, as PVs still using them may
+// reference the endpoints.
+func (p *glusterfsProvisioner) mergeSharedEndpoints(ctx context.Context, namespace string, name string, hosts []string) (*v1.Endpoints, error) {
+	var endpoint *v1.Endpoints
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest, err := p.client.CoreV1().Endpoints(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		endpoint = latest
+		if len(latest.Subsets) == 0 {
+			latest.Subsets = []v1.EndpointSubset{{}}
+		}
+		subset := &latest.Subsets[0]
+		present := make(map[string]bool)
+		for _, address := range subset.Addresses {
+			present[address.IP] = true
+		}
+		added := false
+		for _, host := range hosts {
+			if !present[host] {
+				subset.Addresses = append(subset.Addresses, v1.EndpointAddress{IP: host})
+				present[host] = true
+				added = true
+			}
+		}
+		if !added {
+			return nil
+		}
+		klog.V(2).Infof("glusterfs: adding hosts to shared endpoints %s/%s", namespace, name)
+		endpoint, err = p.client.CoreV1().Endpoints(namespace).Update(ctx, latest, metav1.UpdateOptions{})
+		return err
+	})
+	return endpoint, err
+}
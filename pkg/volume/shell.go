@@ -0,0 +1,95 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Commands run in the glusterfs pods are bash scripts. Every volume name,
+// host and path interpolated into them is validated against a strict set of
+// characters when the configuration is parsed, and quoted with shellQuote
+// where it is interpolated, so that neither a crafted claim nor a mistyped
+// class can inject shell syntax.
+
+// brickPathRegexp matches the characters allowed in brick roots and paths
+var brickPathRegexp = regexp.MustCompile(`^/[a-zA-Z0-9_.+@/-]*$`)
+
+// volumeOptionRegexp matches gluster volume option names
+var volumeOptionRegexp = regexp.MustCompile(`^[a-z0-9.-]+$`)
+
+// ValidateVolumeOption checks that name is a gluster volume option name,
+// which only has lower case letters, digits, `.` and `-`
+func ValidateVolumeOption(name string) error {
+	if !volumeOptionRegexp.MatchString(name) {
+		return fmt.Errorf("volume option %q is invalid: only lower case letters, digits, `.` and `-` are allowed", name)
+	}
+	return nil
+}
+
+// ValidateVolumeName checks that name is a gluster volume name, which only
+// has letters, digits, `-` and `_`
+func ValidateVolumeName(name string) error {
+	if !volumeNameRegexp.MatchString(name) {
+		return fmt.Errorf("volume name %q is invalid: only letters, digits, `-` and `_` are allowed", name)
+	}
+	return nil
+}
+
+// ValidateBrickPath checks that path is a clean absolute path of letters,
+// digits and `_.+@/-`
+func ValidateBrickPath(path string) error {
+	if !brickPathRegexp.MatchString(path) {
+		return fmt.Errorf("brick path %q is invalid: only absolute paths of letters, digits and `_.+@/-` are allowed", path)
+	}
+	if filepath.Clean(path) != path {
+		return fmt.Errorf("brick path %q is invalid: it is not a clean path", path)
+	}
+	return nil
+}
+
+// ValidateHost checks that host is an IP address or a DNS name
+func ValidateHost(host string) error {
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if msgs := validation.IsDNS1123Subdomain(strings.ToLower(host)); len(msgs) > 0 {
+		return fmt.Errorf("host %q is invalid: %s", host, strings.Join(msgs, ", "))
+	}
+	return nil
+}
+
+// validateBricks checks the hosts and paths of bricks or brick roots
+func validateBricks(bricks []glusterBrick) error {
+	for _, b := range bricks {
+		if err := ValidateHost(b.Host); err != nil {
+			return err
+		}
+		if err := ValidateBrickPath(b.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shellQuote quotes s as a single word for sh
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
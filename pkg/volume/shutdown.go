@@ -0,0 +1,249 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	gerrors "gluster-simple-provisioner/pkg/errors"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// pendingDeletesKey is the key of the state ConfigMap holding the cleanup
+// that was still queued when the provisioner shut down
+const pendingDeletesKey = "pending-deletes"
+
+// errShuttingDown is returned for operations started during shutdown
+var errShuttingDown = gerrors.Transient(fmt.Errorf("the gluster provisioner is shutting down"))
+
+// pendingDelete is a deleteTask persisted in the state ConfigMap
+type pendingDelete struct {
+	Operation string             `json:"operation,omitempty"`
+	Namespace string             `json:"namespace"`
+	Name      string             `json:"name"`
+	Config    *ProvisionerConfig `json:"config"`
+	Bricks    []glusterBrick     `json:"bricks"`
+}
+
+// detachedContext keeps the values of its parent but not its cancellation,
+// so that an operation in flight is finished even when the controller stops
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.Context.Value(key) }
+
+// beginOperation registers a Provision or Delete in flight. It returns false
+// once the provisioner is shutting down.
+func (p *glusterfsProvisioner) beginOperation() bool {
+	p.shutdownMutex.Lock()
+	defer p.shutdownMutex.Unlock()
+	if p.shuttingDown {
+		return false
+	}
+	p.operations.Add(1)
+	return true
+}
+
+func (p *glusterfsProvisioner) endOperation() {
+	p.operations.Done()
+}
+
+func (p *glusterfsProvisioner) isShuttingDown() bool {
+	p.shutdownMutex.Lock()
+	defer p.shutdownMutex.Unlock()
+	return p.shuttingDown
+}
+
+// Shutdown stops accepting claims and deletions, waits up to timeout for the
+// operations in flight to finish or roll back, and persists the cleanup that
+// is still queued to the state ConfigMap
+func (p *glusterfsProvisioner) Shutdown(timeout time.Duration) {
+	p.shutdownMutex.Lock()
+	p.shuttingDown = true
+	p.shutdownMutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.operations.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		klog.Infof("glusterfs: all operations finished")
+	case <-time.After(timeout):
+		klog.Errorf("glusterfs: operations still running after %v, shutting down anyway", timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	err := p.savePendingDeletes(ctx)
+	if err != nil {
+		klog.Errorf("glusterfs: failed to persist pending deletions: %v", err)
+	}
+}
+
+// savePendingDeletes writes the queued delete tasks to the state ConfigMap
+func (p *glusterfsProvisioner) savePendingDeletes(ctx context.Context) error {
+	p.deleteTasksMutex.Lock()
+	pending := make([]pendingDelete, 0, len(p.deleteTasks))
+	for _, task := range p.deleteTasks {
+		pending = append(pending, pendingDelete{
+			Operation: task.operation,
+			Namespace: task.namespace,
+			Name:      task.name,
+			Config:    task.cfg,
+			Bricks:    task.bricks,
+		})
+	}
+	p.deleteTasksMutex.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	if p.options.StateConfigMap == "" {
+		for _, d := range pending {
+			klog.Errorf("glusterfs: deletion of volume %s was not finished, bricks %s must be cleaned up manually",
+				d.Config.VolumeName, formatBricks(d.Bricks))
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	err = p.updateStateConfigMap(ctx, pendingDeletesKey, string(data))
+	if err != nil {
+		return err
+	}
+	klog.Infof("glusterfs: persisted %d pending deletions to %s", len(pending), p.options.StateConfigMap)
+	return nil
+}
+
+// loadPendingDeletes resumes the cleanup persisted by the last shutdown
+func (p *glusterfsProvisioner) loadPendingDeletes(ctx context.Context) {
+	if p.options.StateConfigMap == "" {
+		return
+	}
+	state, err := p.readStateConfigMap(ctx)
+	if err != nil {
+		klog.Errorf("glusterfs: failed to get state configmap %s: %v", p.options.StateConfigMap, err)
+		return
+	}
+	value, ok := state[pendingDeletesKey]
+	if !ok {
+		return
+	}
+	var pending []pendingDelete
+	err = json.Unmarshal([]byte(value), &pending)
+	if err != nil {
+		klog.Errorf("glusterfs: pending deletions in %s are invalid: %v", p.options.StateConfigMap, err)
+		return
+	}
+	for _, d := range pending {
+		task := &deleteTask{
+			operation: d.Operation,
+			namespace: d.Namespace,
+			name:      d.Name,
+			cfg:       d.Config,
+			bricks:    d.Bricks,
+		}
+		klog.Infof("glusterfs: resuming deletion of volume %s", d.Config.VolumeName)
+		if p.deleteQueue != nil {
+			p.enqueueDelete(task)
+			continue
+		}
+		err := p.deleteVolume(withOperation(ctx, task.operation), task.namespace, task.name, task.cfg, task.bricks)
+		if err != nil {
+			klog.Errorf("glusterfs: failed to delete volume %s, bricks %s must be cleaned up manually: %v",
+				task.cfg.VolumeName, formatBricks(task.bricks), err)
+		}
+	}
+
+	err = p.updateStateConfigMap(ctx, pendingDeletesKey, "")
+	if err != nil {
+		klog.Errorf("glusterfs: failed to clear pending deletions in %s: %v", p.options.StateConfigMap, err)
+	}
+}
+
+// readStateConfigMap returns the data of the state ConfigMap, which is
+// empty if the ConfigMap does not exist yet
+func (p *glusterfsProvisioner) readStateConfigMap(ctx context.Context) (map[string]string, error) {
+	namespace, name, err := splitNamespacedName(p.options.StateConfigMap)
+	if err != nil {
+		return nil, err
+	}
+	cm, err := p.client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cm.Data, nil
+}
+
+// updateStateConfigMap sets key of the state ConfigMap to value, creating
+// the ConfigMap if needed. An empty value removes key. Concurrent updates
+// of other keys are retried on conflict.
+func (p *glusterfsProvisioner) updateStateConfigMap(ctx context.Context, key string, value string) error {
+	namespace, name, err := splitNamespacedName(p.options.StateConfigMap)
+	if err != nil {
+		return err
+	}
+	configMaps := p.client.CoreV1().ConfigMaps(namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			if value == "" {
+				return nil
+			}
+			_, err = configMaps.Create(ctx, &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+				Data:       map[string]string{key: value},
+			}, metav1.CreateOptions{})
+			if errors.IsAlreadyExists(err) {
+				// Created concurrently, retry as an update
+				return errors.NewConflict(v1.Resource("configmaps"), name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		if value == "" {
+			if _, ok := cm.Data[key]; !ok {
+				return nil
+			}
+			delete(cm.Data, key)
+		} else {
+			cm.Data[key] = value
+		}
+		_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
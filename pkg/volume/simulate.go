@@ -0,0 +1,143 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+)
+
+// SimulationCheck is the outcome of one check of a simulated provisioning
+type SimulationCheck struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message,omitempty"`
+}
+
+// SimulationResult describes what provisioning a claim would do
+type SimulationResult struct {
+	StorageClass string `json:"storageClass"`
+	PVName       string `json:"persistentVolume"`
+	Volume       string `json:"volume,omitempty"`
+	VolumeType   string `json:"volumeType,omitempty"`
+	// Hosts are the distinct hosts of Bricks, in brick order
+	Hosts  []string `json:"hosts,omitempty"`
+	Bricks []string `json:"bricks,omitempty"`
+	Force  bool     `json:"force,omitempty"`
+	// BlockHostVolume is set for claims provisioned as block volumes
+	BlockHostVolume string            `json:"blockHostVolume,omitempty"`
+	Checks          []SimulationCheck `json:"checks"`
+	// Provisionable is set if all checks passed
+	Provisionable bool `json:"provisionable"`
+}
+
+// SimulateProvision runs the checks of provisioning claim and reports the
+// bricks that would be created, without creating or reserving anything.
+// Bricks are placed by the PV name derived from the UID of claim; claims
+// without one get a random UID, so weighted placement varies between runs.
+func (p *glusterfsProvisioner) SimulateProvision(ctx context.Context, claim *v1.PersistentVolumeClaim) (*SimulationResult, error) {
+	className := ""
+	if claim.Spec.StorageClassName != nil {
+		className = *claim.Spec.StorageClassName
+	}
+	if className == "" {
+		return nil, fmt.Errorf("claim has no storageClassName")
+	}
+	class, err := p.getStorageClass(ctx, className)
+	if err != nil {
+		return nil, err
+	}
+	if !p.servesClass(class) {
+		return nil, fmt.Errorf("storage class %s belongs to provisioner %s", className, class.Provisioner)
+	}
+	uid := claim.UID
+	if uid == "" {
+		uid = uuid.NewUUID()
+	}
+
+	result := &SimulationResult{StorageClass: className, PVName: "pvc-" + string(uid)}
+	check := func(name string, err error) bool {
+		c := SimulationCheck{Name: name, Passed: err == nil}
+		if err != nil {
+			c.Message = err.Error()
+		}
+		result.Checks = append(result.Checks, c)
+		return err == nil
+	}
+	defer func() {
+		result.Provisionable = true
+		for _, c := range result.Checks {
+			result.Provisionable = result.Provisionable && c.Passed
+		}
+	}()
+
+	cfg, err := p.claimConfig(ctx, class, claim, result.PVName)
+	if !check("parameters", err) {
+		return result, nil
+	}
+	err = cfg.renderVolumeName(VolumeNameData{
+		PVName:       result.PVName,
+		PVCName:      claim.Name,
+		PVCNamespace: claim.Namespace,
+		StorageClass: className,
+	})
+	if !check("volumeName", err) {
+		return result, nil
+	}
+	result.Volume = cfg.VolumeName
+
+	capacity := claim.Spec.Resources.Requests[v1.ResourceStorage]
+	check("size", cfg.validateSize(capacity))
+	check("accessModes", cfg.validateAccessModes(claim.Spec.AccessModes))
+	check("maintenance", p.excludeMaintenanceHosts(ctx, cfg))
+	msg, err := p.namespaceQuotaExceeded(ctx, claim.Namespace, capacity)
+	if err == nil && msg != "" {
+		err = fmt.Errorf("%s", msg)
+	}
+	check("namespaceQuota", err)
+	if cfg.BrickPool != "" {
+		pool, err := p.getBrickPool(ctx, cfg.BrickPool)
+		if err == nil {
+			err = pool.checkCapacity(cfg, capacity.Value())
+		}
+		check("brickPool", err)
+	}
+
+	if cfg.BlockHostVolume != "" {
+		result.BlockHostVolume = cfg.BlockHostVolume
+		return result, nil
+	}
+	result.VolumeType = cfg.VolumeType
+	bricks, err := brickLayout(claim.Namespace, claim.Name, cfg)
+	if !check("bricks", err) {
+		return result, nil
+	}
+	seen := make(map[string]bool)
+	for _, b := range bricks {
+		result.Bricks = append(result.Bricks, cfg.glusterBrickName(b))
+		if !seen[b.Host] {
+			seen[b.Host] = true
+			result.Hosts = append(result.Hosts, b.Host)
+		}
+	}
+	if cfg.BrickRootCheck {
+		check("brickRoots", p.checkBrickRoots(ctx, cfg))
+	}
+	check("force", p.decideForce(ctx, cfg))
+	result.Force = cfg.ForceCreate
+	return result, nil
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// snapshotSeparator separates the gluster volume from the time in
+// snapshot IDs, so that snapshots can be deleted without any other state
+const snapshotSeparator = "-snap-"
+
+// ErrVolumeNotFound is returned for gluster volumes without a provisioned PV
+var ErrVolumeNotFound = fmt.Errorf("volume not found")
+
+// SnapshotClone is a gluster volume created from a snapshot
+type SnapshotClone struct {
+	// VolumeID is the name of the new gluster volume
+	VolumeID string `json:"volumeID"`
+	// Annotations must be set on the restored PV so that the provisioner
+	// manages the bricks of the clone instead of those of the source volume
+	Annotations map[string]string `json:"annotations"`
+}
+
+// snapshotVolume returns the gluster volume of a snapshot ID
+func snapshotVolume(snapshotID string) (string, error) {
+	i := strings.LastIndex(snapshotID, snapshotSeparator)
+	if i <= 0 || !volumeNameRegexp.MatchString(snapshotID) {
+		return "", fmt.Errorf("snapshot ID %q is invalid", snapshotID)
+	}
+	return snapshotID[:i], nil
+}
+
+// findVolume returns the config and PV of a provisioned gluster volume
+func (p *glusterfsProvisioner) findVolume(ctx context.Context, volumeID string) (*ProvisionerConfig, *v1.PersistentVolume, error) {
+	volumes, err := p.listProvisionedVolumes(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range volumes {
+		pv := &volumes[i]
+		if glusterVolumeName(pv) != volumeID {
+			continue
+		}
+		if _, ok := pv.Annotations[annBlockVolume]; ok {
+			return nil, nil, fmt.Errorf("volume %s is a block volume, which cannot be snapshotted", volumeID)
+		}
+		cfg, _, err := p.configForVolume(ctx, pv)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cfg, pv, nil
+	}
+	return nil, nil, ErrVolumeNotFound
+}
+
+// CreateSnapshot takes a gluster snapshot of volumeID and returns its ID.
+// Gluster snapshots need bricks on thinly provisioned LVM volumes.
+func (p *glusterfsProvisioner) CreateSnapshot(ctx context.Context, volumeID string) (string, error) {
+	cfg, pv, err := p.findVolume(ctx, volumeID)
+	if err != nil {
+		return "", err
+	}
+	snapshotID := volumeID + snapshotSeparator + time.Now().UTC().Format("20060102150405")
+	klog.Infof("glusterfs: creating snapshot %s of volume %s", snapshotID, volumeID)
+	err = p.ExecuteCommands(ctx, cfg.BrickRootPaths[0].Host, []string{
+		fmt.Sprintf("gluster --mode=script snapshot create %s %s no-timestamp", shellQuote(snapshotID), shellQuote(volumeID)),
+		fmt.Sprintf("gluster --mode=script snapshot activate %s", shellQuote(snapshotID)),
+	}, cfg)
+	p.recordVolumeOperation(ctx, pv, cfg, nil, "Snapshot", err, snapshotID)
+	if err != nil {
+		p.recorder.Event(pv, v1.EventTypeWarning, "SnapshotFailed", err.Error())
+		return "", err
+	}
+	p.recorder.Event(pv, v1.EventTypeNormal, "SnapshotCreated", fmt.Sprintf("snapshot %s was created", snapshotID))
+	return snapshotID, nil
+}
+
+// DeleteSnapshot deletes a snapshot. Snapshots of deleted volumes were
+// deleted with the volume and are reported as deleted.
+func (p *glusterfsProvisioner) DeleteSnapshot(ctx context.Context, snapshotID string) error {
+	volumeID, err := snapshotVolume(snapshotID)
+	if err != nil {
+		return err
+	}
+	cfg, _, err := p.findVolume(ctx, volumeID)
+	if err == ErrVolumeNotFound {
+		klog.V(2).Infof("glusterfs: volume %s of snapshot %s is deleted", volumeID, snapshotID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	klog.Infof("glusterfs: deleting snapshot %s", snapshotID)
+	return p.ExecuteCommands(ctx, cfg.BrickRootPaths[0].Host, []string{fmt.Sprintf(
+		"gluster --mode=script snapshot info %s >/dev/null 2>&1 || exit 0; gluster --mode=script snapshot delete %s",
+		shellQuote(snapshotID), shellQuote(snapshotID))}, cfg)
+}
+
+// CloneSnapshot creates and starts a new gluster volume from a snapshot.
+// The bricks of the clone are carved from the snapshot by gluster.
+func (p *glusterfsProvisioner) CloneSnapshot(ctx context.Context, snapshotID string) (*SnapshotClone, error) {
+	volumeID, err := snapshotVolume(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	cfg, _, err := p.findVolume(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	clone := *cfg
+	clone.VolumeName = volumeID + "-restore-" + time.Now().UTC().Format("20060102150405")
+	klog.Infof("glusterfs: cloning snapshot %s to volume %s", snapshotID, clone.VolumeName)
+	err = p.ExecuteCommands(ctx, cfg.BrickRootPaths[0].Host, []string{
+		fmt.Sprintf("gluster --mode=script snapshot clone %s %s", shellQuote(clone.VolumeName), shellQuote(snapshotID)),
+		fmt.Sprintf("gluster --mode=script volume start %s", shellQuote(clone.VolumeName)),
+	}, cfg)
+	if err != nil {
+		return nil, err
+	}
+	bricks, err := p.volumeBricks(ctx, &clone)
+	if err != nil {
+		return nil, err
+	}
+	return &SnapshotClone{
+		VolumeID:    clone.VolumeName,
+		Annotations: map[string]string{annBricks: formatBricks(bricks)},
+	}, nil
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	storage "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+)
+
+const (
+	// labelCapacityClass labels the CSIStorageCapacity objects of a class
+	labelCapacityClass = "gluster.simple/storageclass"
+	// capacityObjectPrefix prefixes the names of CSIStorageCapacity objects
+	capacityObjectPrefix = "glusterfs-simple-capacity-"
+)
+
+// classSegments returns the topology segments of class: one per term of its
+// allowedTopologies, or all nodes, since gluster volumes are mounted over
+// the network
+func classSegments(class *storage.StorageClass) []*metav1.LabelSelector {
+	if len(class.AllowedTopologies) == 0 {
+		return []*metav1.LabelSelector{{}}
+	}
+	segments := make([]*metav1.LabelSelector, 0, len(class.AllowedTopologies))
+	for _, term := range class.AllowedTopologies {
+		selector := &metav1.LabelSelector{}
+		for _, req := range term.MatchLabelExpressions {
+			selector.MatchExpressions = append(selector.MatchExpressions, metav1.LabelSelectorRequirement{
+				Key:      req.Key,
+				Operator: metav1.LabelSelectorOpIn,
+				Values:   req.Values,
+			})
+		}
+		segments = append(segments, selector)
+	}
+	return segments
+}
+
+// classCapacity returns the capacity left for volumes of cfg and the size
+// of the largest volume that fits, from the free bytes of its brick roots.
+// Every volume takes its size on each of its bricks, as BrickPools reserve
+// it, on all roots of the class or on brickCount of them.
+func classCapacity(cfg *ProvisionerConfig, free map[BrickRootPath]int64) (int64, int64) {
+	maintenance := make(map[string]bool)
+	for _, host := range cfg.MaintenanceHosts {
+		maintenance[host] = true
+	}
+	var frees []int64
+	roots := cfg.allBrickRoots()
+	for _, root := range roots {
+		bytes, ok := free[BrickRootPath{Host: root.Host, Path: root.Path}]
+		if ok && !maintenance[root.Host] {
+			frees = append(frees, bytes)
+		}
+	}
+	count := cfg.BrickCount
+	if count == 0 {
+		count = len(roots)
+	}
+	if count == 0 || len(frees) < count {
+		return 0, 0
+	}
+	sort.Slice(frees, func(i, j int) bool { return frees[i] > frees[j] })
+	var total int64
+	for _, bytes := range frees {
+		total += bytes
+	}
+	capacity, maxSize := total/int64(count), frees[count-1]
+	if cfg.MaxSize != nil && maxSize > cfg.MaxSize.Value() {
+		maxSize = cfg.MaxSize.Value()
+	}
+	if capacity < maxSize {
+		maxSize = capacity
+	}
+	return capacity, maxSize
+}
+
+// publishStorageCapacity maintains a CSIStorageCapacity object per served
+// class and topology segment in the CSICapacityNamespace, so that the
+// scheduler and autoscalers see the headroom left on the brick roots
+func (p *glusterfsProvisioner) publishStorageCapacity(ctx context.Context) {
+	if !p.classInformer.Informer().HasSynced() {
+		return
+	}
+	classes, err := p.classInformer.Lister().List(labels.Everything())
+	if err != nil {
+		klog.Errorf("glusterfs: failed to list storage classes: %v", err)
+		return
+	}
+
+	free := make(map[BrickRootPath]int64)
+	checked := make(map[BrickRootPath]bool)
+	desired := make(map[string]*storage.CSIStorageCapacity)
+	for _, class := range classes {
+		if !p.servesClass(class) {
+			continue
+		}
+		cfg, err := p.classConfig(ctx, class, "")
+		if err != nil {
+			// Reported by the class registry
+			continue
+		}
+		for _, root := range cfg.allBrickRoots() {
+			key := BrickRootPath{Host: root.Host, Path: root.Path}
+			if checked[key] {
+				continue
+			}
+			checked[key] = true
+			status, err := p.brickRootCapacity(ctx, key, cfg)
+			if err != nil {
+				klog.Errorf("glusterfs: failed to get capacity of %s:%s: %v", root.Host, root.Path, err)
+				continue
+			}
+			free[key] = status.FreeBytes
+		}
+		capacity, maxSize := classCapacity(cfg, free)
+		for i, segment := range classSegments(class) {
+			name := fmt.Sprintf("%s%s-%d", capacityObjectPrefix, class.Name, i)
+			desired[name] = &storage.CSIStorageCapacity{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: p.options.CSICapacityNamespace,
+					Labels:    map[string]string{labelCapacityClass: class.Name},
+				},
+				NodeTopology:      segment,
+				StorageClassName:  class.Name,
+				Capacity:          resource.NewQuantity(capacity, resource.BinarySI),
+				MaximumVolumeSize: resource.NewQuantity(maxSize, resource.BinarySI),
+			}
+		}
+	}
+
+	capacities := p.client.StorageV1().CSIStorageCapacities(p.options.CSICapacityNamespace)
+	existing, err := capacities.List(ctx, metav1.ListOptions{LabelSelector: labelCapacityClass})
+	if err != nil {
+		klog.Errorf("glusterfs: failed to list storage capacities: %v", err)
+		return
+	}
+	for i := range existing.Items {
+		current := &existing.Items[i]
+		want, ok := desired[current.Name]
+		if !ok {
+			// Objects of classes of other instances are theirs to maintain
+			class, err := p.classInformer.Lister().Get(current.StorageClassName)
+			if err == nil && !p.servesClass(class) {
+				continue
+			}
+			if err != nil && !errors.IsNotFound(err) {
+				continue
+			}
+			err = capacities.Delete(ctx, current.Name, metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				klog.Errorf("glusterfs: failed to delete storage capacity %s: %v", current.Name, err)
+			}
+			continue
+		}
+		if !equality.Semantic.DeepEqual(current.NodeTopology, want.NodeTopology) {
+			// The topology is immutable, the object is created again
+			err = capacities.Delete(ctx, current.Name, metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				klog.Errorf("glusterfs: failed to delete storage capacity %s: %v", current.Name, err)
+				delete(desired, current.Name)
+			}
+			continue
+		}
+		delete(desired, current.Name)
+		if equality.Semantic.DeepEqual(current.Capacity, want.Capacity) &&
+			equality.Semantic.DeepEqual(current.MaximumVolumeSize, want.MaximumVolumeSize) {
+			continue
+		}
+		current.Capacity = want.Capacity
+		current.MaximumVolumeSize = want.MaximumVolumeSize
+		if _, err := capacities.Update(ctx, current, metav1.UpdateOptions{}); err != nil {
+			klog.Errorf("glusterfs: failed to update storage capacity %s: %v", current.Name, err)
+		}
+	}
+	for _, want := range desired {
+		if _, err := capacities.Create(ctx, want, metav1.CreateOptions{}); err != nil {
+			klog.Errorf("glusterfs: failed to create storage capacity %s: %v", want.Name, err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// maxQueuedAge drops claims from the tenant queue that were not retried for
+// this long, e.g. because they were deleted meanwhile
+const maxQueuedAge = time.Hour
+
+// tenantLimiter rate limits provisioning per namespace and caps the claims
+// of a namespace provisioned at the same time. Claims over the limits are
+// held back and handed back to the controller every heldClaimRequeuePeriod,
+// without counting as failed attempts, so that the workers stay free for
+// claims of other namespaces.
+type tenantLimiter struct {
+	mutex    sync.Mutex
+	qps      float32
+	burst    int
+	limit    int
+	limiters map[string]flowcontrol.RateLimiter
+	active   map[string]int
+	// queued records when claims were first refused, per namespace
+	queued map[string]map[types.UID]time.Time
+}
+
+func newTenantLimiter(qps float32, burst int, limit int) *tenantLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tenantLimiter{
+		qps:      qps,
+		burst:    burst,
+		limit:    limit,
+		limiters: make(map[string]flowcontrol.RateLimiter),
+		active:   make(map[string]int),
+		queued:   make(map[string]map[types.UID]time.Time),
+	}
+}
+
+// admit admits claim for provisioning and returns the function releasing
+// its slot, or an error if its namespace is over its limits
+func (l *tenantLimiter) admit(claim *v1.PersistentVolumeClaim) (func(), error) {
+	if l == nil || (l.qps <= 0 && l.limit <= 0) {
+		return func() {}, nil
+	}
+	namespace := claim.Namespace
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.pruneQueued()
+
+	var err error
+	if l.limit > 0 && l.active[namespace] >= l.limit {
+		err = fmt.Errorf("namespace %s already provisions %d claims, the claim is queued", namespace, l.limit)
+	} else if l.qps > 0 && !l.rateLimiter(namespace).TryAccept() {
+		err = fmt.Errorf("namespace %s exceeds its provisioning rate of %v claims per second, the claim is queued", namespace, l.qps)
+	}
+	if err != nil {
+		if l.queued[namespace] == nil {
+			l.queued[namespace] = make(map[types.UID]time.Time)
+		}
+		if _, ok := l.queued[namespace][claim.UID]; !ok {
+			l.queued[namespace][claim.UID] = time.Now()
+		}
+		tenantQueueDepth.WithLabelValues(namespace).Set(float64(len(l.queued[namespace])))
+		return nil, err
+	}
+
+	// Wait time counts from the creation of the claim, which includes the
+	// time the claim was held back
+	tenantQueueWait.WithLabelValues(namespace).Observe(time.Since(claim.CreationTimestamp.Time).Seconds())
+	delete(l.queued[namespace], claim.UID)
+	tenantQueueDepth.WithLabelValues(namespace).Set(float64(len(l.queued[namespace])))
+	l.active[namespace]++
+	return func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.active[namespace]--
+		if l.active[namespace] == 0 {
+			delete(l.active, namespace)
+		}
+	}, nil
+}
+
+func (l *tenantLimiter) rateLimiter(namespace string) flowcontrol.RateLimiter {
+	limiter, ok := l.limiters[namespace]
+	if !ok {
+		limiter = flowcontrol.NewTokenBucketRateLimiter(l.qps, l.burst)
+		l.limiters[namespace] = limiter
+	}
+	return limiter
+}
+
+func (l *tenantLimiter) pruneQueued() {
+	for namespace, claims := range l.queued {
+		for uid, since := range claims {
+			if time.Since(since) > maxQueuedAge {
+				delete(claims, uid)
+			}
+		}
+		tenantQueueDepth.WithLabelValues(namespace).Set(float64(len(claims)))
+		if len(claims) == 0 {
+			delete(l.queued, namespace)
+		}
+	}
+}
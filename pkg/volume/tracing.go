@@ -0,0 +1,299 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	// spanQueueSize bounds the spans waiting for export; further spans are
+	// dropped rather than slowing down provisioning
+	spanQueueSize = 4096
+	// spanBatchSize is the most spans exported in one request
+	spanBatchSize = 512
+	// spanExportPeriod is how often queued spans are exported
+	spanExportPeriod = 5 * time.Second
+	// spanExportTimeout bounds each export request
+	spanExportTimeout = 10 * time.Second
+)
+
+// OTLP span kinds and status codes
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+	spanStatusOK     = 1
+	spanStatusError  = 2
+)
+
+// tracer records spans of provisioning and deletion and exports them to an
+// OpenTelemetry collector with OTLP over HTTP in its JSON encoding. A nil
+// tracer records nothing.
+type tracer struct {
+	url     string
+	service string
+	client  *http.Client
+	spans   chan *span
+}
+
+// span is a finished or running operation of a trace
+type span struct {
+	tracer     *tracer
+	traceID    string
+	spanID     string
+	parentID   string
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        error
+}
+
+type spanKey struct{}
+
+// newTracer returns a tracer exporting to the OTLP/HTTP endpoint, e.g.
+// http://otel-collector:4318, or nil if endpoint is empty
+func newTracer(endpoint string, service string) *tracer {
+	if endpoint == "" {
+		return nil
+	}
+	return &tracer{
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service: service,
+		client:  &http.Client{Timeout: spanExportTimeout},
+		spans:   make(chan *span, spanQueueSize),
+	}
+}
+
+// start starts the root span of an operation and returns ctx carrying it
+func (t *tracer) start(ctx context.Context, name string, attributes map[string]string) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &span{
+		tracer:     t,
+		traceID:    randomHex(16),
+		spanID:     randomHex(8),
+		name:       name,
+		kind:       spanKindServer,
+		start:      time.Now(),
+		attributes: attributes,
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// finish ends s with the result err and queues it for export
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	s.tracer.queue(s)
+}
+
+// recordSpan records a child of the span of ctx that ran from start until
+// now, e.g. a step of provisioning. Without a span in ctx it does nothing.
+func recordSpan(ctx context.Context, name string, kind int, start time.Time, attributes map[string]string, err error) {
+	parent, _ := ctx.Value(spanKey{}).(*span)
+	if parent == nil {
+		return
+	}
+	parent.tracer.queue(&span{
+		tracer:     parent.tracer,
+		traceID:    parent.traceID,
+		spanID:     randomHex(8),
+		parentID:   parent.spanID,
+		name:       name,
+		kind:       kind,
+		start:      start,
+		end:        time.Now(),
+		attributes: attributes,
+		err:        err,
+	})
+}
+
+func (t *tracer) queue(s *span) {
+	select {
+	case t.spans <- s:
+	default:
+		klog.V(2).Infof("glusterfs: dropping span %s, the export queue is full", s.name)
+	}
+}
+
+// run exports the queued spans in batches until ctx is done, then exports
+// the spans left
+func (t *tracer) run(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	ticker := time.NewTicker(spanExportPeriod)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < spanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-ctx.Done():
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+			}
+			t.export(batch)
+			return
+		}
+		t.export(batch)
+		batch = nil
+	}
+}
+
+// export posts spans to the collector. Failures are logged, spans are not
+// retried.
+func (t *tracer) export(spans []*span) {
+	if len(spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(t.request(spans))
+	if err != nil {
+		klog.Errorf("glusterfs: failed to encode spans: %v", err)
+		return
+	}
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		klog.Errorf("glusterfs: failed to export %d spans to %s: %v", len(spans), t.url, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		klog.Errorf("glusterfs: failed to export %d spans to %s: %s", len(spans), t.url, resp.Status)
+	}
+}
+
+// OTLP/HTTP JSON encoding of ExportTraceServiceRequest
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func (t *tracer) request(spans []*span) otlpRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		status := otlpStatus{Code: spanStatusOK}
+		if s.err != nil {
+			status = otlpStatus{Code: spanStatusError, Message: s.err.Error()}
+		}
+		encoded = append(encoded, otlpSpan{
+			TraceID:           s.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attributes),
+			Status:            status,
+		})
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttributes(map[string]string{"service.name": t.service})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "gluster-simple-provisioner"},
+			Spans: encoded,
+		}},
+	}}}
+}
+
+func otlpAttributes(attributes map[string]string) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	encoded := make([]otlpAttribute, 0, len(keys))
+	for _, key := range keys {
+		encoded = append(encoded, otlpAttribute{Key: key, Value: otlpValue{StringValue: attributes[key]}})
+	}
+	return encoded
+}
+
+// randomHex returns n random bytes in hex, the encoding of trace and span
+// IDs in OTLP/JSON
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// IDs only need to be unique, not secret
+		return fmt.Sprintf("%0*x", 2*n, time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
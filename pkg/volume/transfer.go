@@ -0,0 +1,184 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+)
+
+// TransferOptions selects the PVs handed over to another provisioner
+// deployment by TransferVolumes
+type TransferOptions struct {
+	// ProvisionerName is the name of the receiving deployment
+	ProvisionerName string
+	// IdentityConfigMap holds the identity of the receiving deployment.
+	// Empty drops the identity of the PVs, so that they are not fenced.
+	IdentityConfigMap string
+	// StorageClass is a class of the receiving deployment whose parameters
+	// manage the PVs from now on. Empty keeps the class of each PV.
+	StorageClass string
+	// From restricts the transfer to PVs stamped with this identity
+	From string
+	// PVs names the PVs to transfer. All PVs of From are transferred if
+	// empty.
+	PVs []string
+	// DryRun only validates the transfer
+	DryRun bool
+}
+
+// VolumeTransfer is a PV handed over by TransferVolumes
+type VolumeTransfer struct {
+	PV string
+	// From and To are the provisioner names and identities before and
+	// after the transfer
+	From string
+	To   string
+}
+
+// TransferVolumes hands PVs of this provisioner over to another deployment
+// by rewriting their provisioner name and identity annotations, after
+// checking that the receiving deployment serves their class and that their
+// gluster volume exists. The transferred PVs are returned, or with DryRun
+// those that would be.
+func TransferVolumes(ctx context.Context, config *rest.Config, client kubernetes.Interface, options TransferOptions) ([]VolumeTransfer, error) {
+	p := newGlusterfsProvisionerInternal(config, client, Options{
+		ProvisionerName:   options.ProvisionerName,
+		IdentityConfigMap: options.IdentityConfigMap,
+	})
+	return p.transferVolumes(ctx, options)
+}
+
+func (p *glusterfsProvisioner) transferVolumes(ctx context.Context, options TransferOptions) ([]VolumeTransfer, error) {
+	if len(options.PVs) == 0 && options.From == "" {
+		return nil, fmt.Errorf("name the PVs to transfer or the identity to transfer them from")
+	}
+	if p.options.IdentityConfigMap != "" {
+		identity, err := p.loadIdentity(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load identity from %s: %v", p.options.IdentityConfigMap, err)
+		}
+		p.identity = identity
+	}
+
+	var pvs []v1.PersistentVolume
+	if len(options.PVs) == 0 {
+		list, err := p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, pv := range list.Items {
+			if pv.Annotations[annCreatedBy] == createdBy && pv.Annotations[annProvisionerIdentity] == options.From {
+				pvs = append(pvs, pv)
+			}
+		}
+	} else {
+		for _, name := range options.PVs {
+			pv, err := p.client.CoreV1().PersistentVolumes().Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			pvs = append(pvs, *pv)
+		}
+	}
+
+	var transferred []VolumeTransfer
+	for i := range pvs {
+		transfer, err := p.transferVolume(ctx, &pvs[i], options)
+		if err != nil {
+			return transferred, fmt.Errorf("failed to transfer PV %s: %v", pvs[i].Name, err)
+		}
+		if transfer != nil {
+			transferred = append(transferred, *transfer)
+		}
+	}
+	return transferred, nil
+}
+
+// transferVolume validates and rewrites the ownership annotations of pv.
+// PVs owned by the receiving deployment already are skipped.
+func (p *glusterfsProvisioner) transferVolume(ctx context.Context, pv *v1.PersistentVolume, options TransferOptions) (*VolumeTransfer, error) {
+	if pv.Annotations[annCreatedBy] != createdBy {
+		return nil, fmt.Errorf("PV was not provisioned by %s", createdBy)
+	}
+	if pv.DeletionTimestamp != nil {
+		return nil, fmt.Errorf("PV is being deleted")
+	}
+	owner := pv.Annotations[annProvisionerIdentity]
+	if options.From != "" && owner != options.From {
+		return nil, fmt.Errorf("PV belongs to provisioner identity %q, not %s", owner, options.From)
+	}
+
+	pv = pv.DeepCopy()
+	from := pv.Annotations[annProvisionedBy] + "/" + owner
+	pv.Annotations[annProvisionedBy] = p.options.ProvisionerName
+	if p.identity != "" {
+		pv.Annotations[annProvisionerIdentity] = string(p.identity)
+	} else {
+		delete(pv.Annotations, annProvisionerIdentity)
+	}
+	if options.StorageClass != "" {
+		pv.Annotations[annStorageClass] = options.StorageClass
+	}
+	to := pv.Annotations[annProvisionedBy] + "/" + pv.Annotations[annProvisionerIdentity]
+	if from == to && options.StorageClass == "" {
+		return nil, nil
+	}
+
+	// The receiving deployment must be able to delete the volume
+	className := pv.Annotations[annStorageClass]
+	if className == "" {
+		className = pv.Spec.StorageClassName
+	}
+	class, err := p.getStorageClass(ctx, className)
+	if err != nil {
+		return nil, err
+	}
+	if !p.servesClass(class) {
+		return nil, fmt.Errorf("storage class %s belongs to provisioner %s, not %s", className, class.Provisioner, p.options.ProvisionerName)
+	}
+	cfg, _, err := p.configForVolume(ctx, pv)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := pv.Annotations[annBlockVolume]; !ok {
+		volumes, err := p.listGlusterVolumes(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, name := range volumes {
+			found = found || name == cfg.VolumeName
+		}
+		if !found {
+			return nil, fmt.Errorf("gluster volume %s does not exist in the cluster of storage class %s", cfg.VolumeName, className)
+		}
+	}
+
+	transfer := &VolumeTransfer{PV: pv.Name, From: from, To: to}
+	if options.DryRun {
+		return transfer, nil
+	}
+	if _, err := p.client.CoreV1().PersistentVolumes().Update(ctx, pv, metav1.UpdateOptions{}); err != nil {
+		return nil, err
+	}
+	klog.Infof("glusterfs: transferred PV %s from %s to %s", pv.Name, from, to)
+	return transfer, nil
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// replicaCount returns the replica count of volumeType, 1 if not replicated
+func replicaCount(volumeType string) int {
+	fields := strings.Fields(strings.ToLower(volumeType))
+	for i, f := range fields {
+		if f == "replica" && i+1 < len(fields) {
+			if n, err := strconv.Atoi(fields[i+1]); err == nil && n > 0 {
+				return n
+			}
+		}
+	}
+	return 1
+}
+
+// brickUsage returns the bytes used by brick according to `du`
+func (p *glusterfsProvisioner) brickUsage(ctx context.Context, brick glusterBrick, cfg *ProvisionerConfig) (int64, error) {
+	out, err := p.executeCommandOnHost(ctx, brick.Host,
+		fmt.Sprintf("du -sb %s | cut -f1", shellQuote(brick.Path)), cfg)
+	if err != nil {
+		return 0, err
+	}
+	used, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected du output: %q", out)
+	}
+	return used, nil
+}
+
+// exportUsageMetrics exports the used bytes of the bricks and volumes of
+// every provisioned PV
+func (p *glusterfsProvisioner) exportUsageMetrics(ctx context.Context) {
+	volumes, err := p.listProvisionedVolumes(ctx)
+	if err != nil {
+		klog.Errorf("glusterfs: failed to list volumes for usage metrics: %v", err)
+		return
+	}
+
+	volumeUsedBytes.Reset()
+	volumeCapacityBytes.Reset()
+	brickUsedBytes.Reset()
+	for i := range volumes {
+		pv := &volumes[i]
+		err := p.exportVolumeUsage(ctx, pv)
+		if err != nil {
+			klog.Errorf("glusterfs: failed to get usage of volume %s: %v", pv.Name, err)
+		}
+	}
+}
+
+func (p *glusterfsProvisioner) exportVolumeUsage(ctx context.Context, pv *v1.PersistentVolume) error {
+	cfg, bricks, err := p.configForVolume(ctx, pv)
+	if err != nil {
+		return err
+	}
+	claim := pv.Spec.ClaimRef
+
+	var total int64
+	for _, b := range bricks {
+		used, err := p.brickUsage(ctx, b, cfg)
+		if err != nil {
+			return err
+		}
+		brickUsedBytes.WithLabelValues(pv.Name, cfg.VolumeName, b.Host+":"+b.Path).Set(float64(used))
+		total += used
+	}
+
+	capacity := pv.Spec.Capacity[v1.ResourceStorage]
+	volumeCapacityBytes.WithLabelValues(pv.Name, cfg.VolumeName, claim.Namespace, claim.Name).Set(float64(capacity.Value()))
+	used := total / int64(replicaCount(cfg.VolumeType))
+	volumeUsedBytes.WithLabelValues(pv.Name, cfg.VolumeName, claim.Namespace, claim.Name).Set(float64(used))
+	p.updateGlusterVolume(ctx, pv, cfg, bricks, func(status *GlusterVolumeStatus) {
+		status.UsedBytes = &used
+	})
+	return nil
+}
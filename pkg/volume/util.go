@@ -16,6 +16,8 @@ package volume
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 
 	"k8s.io/api/core/v1"
 	storage "k8s.io/api/storage/v1"
@@ -40,3 +42,38 @@ func GetClassForVolume(ctx context.Context, kubeClient kubernetes.Interface, pv
 	}
 	return class, nil
 }
+
+// sortedKeys returns the keys of m in sorted order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// containsString returns whether s is one of values
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// glusterVolumeName returns the gluster volume of pv, whichever source it is
+// mounted with. It is empty for PVs of other volumes.
+func glusterVolumeName(pv *v1.PersistentVolume) string {
+	if pv.Spec.Glusterfs != nil {
+		return pv.Spec.Glusterfs.Path
+	}
+	if pv.Spec.NFS != nil && pv.Annotations[annNFSExport] == "true" {
+		return strings.TrimPrefix(pv.Spec.NFS.Path, "/")
+	}
+	if pv.Spec.CSI != nil && pv.Annotations[annCreatedBy] == createdBy {
+		return pv.Spec.CSI.VolumeHandle
+	}
+	return ""
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// VaultOptions configures the Vault key providers
+type VaultOptions struct {
+	// Address is the URL of Vault, e.g. https://vault:8200. Empty disables
+	// the Vault key providers.
+	Address string
+	// TokenFile is a file holding the Vault token, read on every request
+	// so that it can be rotated
+	TokenFile string
+	// KVMount is the mount path of the KV v2 secrets engine
+	KVMount string
+	// KVPrefix prefixes the paths of keys in the KV secrets engine
+	KVPrefix string
+	// TransitMount is the mount path of the transit secrets engine
+	TransitMount string
+	// TransitKey is the name of the transit key encrypting volume keys
+	TransitKey string
+}
+
+// vaultClient talks to the Vault HTTP API
+type vaultClient struct {
+	options VaultOptions
+	http    *http.Client
+}
+
+func newVaultClient(options VaultOptions) *vaultClient {
+	if options.Address == "" {
+		return nil
+	}
+	return &vaultClient{
+		options: options,
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// vaultError is returned for Vault responses with an error status
+type vaultError struct {
+	status int
+	errors []string
+}
+
+func (e *vaultError) Error() string {
+	return fmt.Sprintf("vault returned %d: %s", e.status, strings.Join(e.errors, "; "))
+}
+
+// request sends body as JSON to path of the Vault API and decodes the
+// response into out
+func (v *vaultClient) request(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	token, err := ioutil.ReadFile(v.options.TokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to read vault token: %v", err)
+	}
+	var data []byte
+	if body != nil {
+		data, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(v.options.Address, "/")+"/v1/"+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var result struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return &vaultError{status: resp.StatusCode, errors: result.Errors}
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (v *vaultClient) kvPath(kind string, name string) string {
+	path := v.options.KVMount + "/" + kind + "/"
+	if v.options.KVPrefix != "" {
+		path += strings.Trim(v.options.KVPrefix, "/") + "/"
+	}
+	return path + name
+}
+
+// readKV returns the key stored at name in the KV secrets engine, or nil if
+// there is none
+func (v *vaultClient) readKV(ctx context.Context, name string) ([]byte, error) {
+	var result struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+	err := v.request(ctx, http.MethodGet, v.kvPath("data", name), nil, &result)
+	if e, ok := err.(*vaultError); ok && e.status == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	encoded, ok := result.Data.Data[keySecretKey]
+	if !ok {
+		return nil, fmt.Errorf("vault secret %s has no %s", name, keySecretKey)
+	}
+	return base64.StdEncoding.DecodeString(encoded)
+}
+
+// createKV stores key at name in the KV secrets engine unless a key exists
+// already, in which case it returns false
+func (v *vaultClient) createKV(ctx context.Context, name string, key []byte) (bool, error) {
+	body := map[string]interface{}{
+		"data":    map[string]string{keySecretKey: base64.StdEncoding.EncodeToString(key)},
+		"options": map[string]int{"cas": 0},
+	}
+	err := v.request(ctx, http.MethodPost, v.kvPath("data", name), body, nil)
+	if e, ok := err.(*vaultError); ok && e.status == http.StatusBadRequest {
+		// The check-and-set of version 0 fails if the secret exists
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// deleteKV deletes all versions of the key at name in the KV secrets engine
+func (v *vaultClient) deleteKV(ctx context.Context, name string) error {
+	err := v.request(ctx, http.MethodDelete, v.kvPath("metadata", name), nil, nil)
+	if e, ok := err.(*vaultError); ok && e.status == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// dataKey generates a key of size bytes in Vault and returns it encrypted
+// with the transit key
+func (v *vaultClient) dataKey(ctx context.Context, size int) (string, error) {
+	var result struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	path := v.options.TransitMount + "/datakey/wrapped/" + v.options.TransitKey
+	err := v.request(ctx, http.MethodPost, path, map[string]int{"bits": size * 8}, &result)
+	if err != nil {
+		return "", err
+	}
+	return result.Data.Ciphertext, nil
+}
+
+// decrypt decrypts ciphertext with the transit key
+func (v *vaultClient) decrypt(ctx context.Context, ciphertext string) ([]byte, error) {
+	var result struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	path := v.options.TransitMount + "/decrypt/" + v.options.TransitKey
+	err := v.request(ctx, http.MethodPost, path, map[string]string{"ciphertext": ciphertext}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(result.Data.Plaintext)
+}
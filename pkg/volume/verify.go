@@ -0,0 +1,234 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	authorization "k8s.io/api/authorization/v1"
+	storage "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// Checks of a VerifyReport
+const (
+	VerifyCheckRBAC       = "rbac"
+	VerifyCheckParameters = "parameters"
+	VerifyCheckExec       = "exec"
+	VerifyCheckPeers      = "peers"
+	VerifyCheckBrickRoot  = "brickRoot"
+)
+
+// requiredPermissions are the permissions provisioning and deleting volumes
+// needs at least, as granted by deploy/rbac.yaml
+var requiredPermissions = []authorization.ResourceAttributes{
+	{Verb: "list", Resource: "persistentvolumes"},
+	{Verb: "create", Resource: "persistentvolumes"},
+	{Verb: "delete", Resource: "persistentvolumes"},
+	{Verb: "update", Resource: "persistentvolumeclaims"},
+	{Verb: "list", Group: "storage.k8s.io", Resource: "storageclasses"},
+	{Verb: "watch", Group: "storage.k8s.io", Resource: "storageclasses"},
+	{Verb: "create", Resource: "events"},
+	{Verb: "list", Resource: "pods"},
+	{Verb: "create", Resource: "pods", Subresource: "exec"},
+	{Verb: "create", Resource: "endpoints"},
+	{Verb: "delete", Resource: "endpoints"},
+	{Verb: "create", Resource: "services"},
+	{Verb: "delete", Resource: "services"},
+	{Verb: "get", Resource: "secrets"},
+}
+
+// VerifyCheck is the outcome of one check of Verify
+type VerifyCheck struct {
+	Check string `json:"check"`
+	// Target is what was checked: a permission, class, host or brick root
+	Target  string `json:"target"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message,omitempty"`
+}
+
+// VerifyReport lists the checks of Verify
+type VerifyReport struct {
+	Checks []VerifyCheck `json:"checks"`
+	// Passed is set if all checks passed
+	Passed bool `json:"passed"`
+}
+
+func (r *VerifyReport) add(check string, target string, err error) bool {
+	c := VerifyCheck{Check: check, Target: target, Passed: err == nil}
+	if err != nil {
+		c.Message = err.Error()
+	}
+	r.Checks = append(r.Checks, c)
+	return err == nil
+}
+
+// Verify checks what provisioning depends on outside of StorageClass
+// parameters: the RBAC permissions of the client, exec into the glusterfs
+// pod of every brick host, the gluster peer status of every cluster and the
+// mounts of all brick roots. classNames restricts the checks to these
+// classes, otherwise all classes of provisionerName are checked.
+func Verify(ctx context.Context, config *rest.Config, client kubernetes.Interface, provisionerName string, classNames []string) (*VerifyReport, error) {
+	p := newGlusterfsProvisionerInternal(config, client, Options{ProvisionerName: provisionerName})
+	return p.verify(ctx, classNames)
+}
+
+func (p *glusterfsProvisioner) verify(ctx context.Context, classNames []string) (*VerifyReport, error) {
+	report := &VerifyReport{}
+	for _, attrs := range requiredPermissions {
+		attrs := attrs
+		report.add(VerifyCheckRBAC, permissionName(attrs), p.checkPermission(ctx, &attrs))
+	}
+
+	var classes []storage.StorageClass
+	if len(classNames) == 0 {
+		list, err := p.client.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for _, class := range list.Items {
+			if p.servesClass(&class) {
+				classes = append(classes, class)
+			}
+		}
+	} else {
+		for _, name := range classNames {
+			class, err := p.client.StorageV1().StorageClasses().Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			classes = append(classes, *class)
+		}
+	}
+
+	// Hosts and clusters shared by classes are checked once
+	execChecked := make(map[string]bool)
+	execFailed := make(map[string]bool)
+	peersChecked := make(map[string]bool)
+	rootsChecked := make(map[string]bool)
+	for i := range classes {
+		class := &classes[i]
+		cfg, err := p.classConfig(ctx, class, "")
+		if !report.add(VerifyCheckParameters, class.Name, err) {
+			continue
+		}
+		roots := cfg.allBrickRoots()
+		for _, root := range roots {
+			key := cfg.clusterKey() + "/" + root.Host
+			if execChecked[key] {
+				continue
+			}
+			execChecked[key] = true
+			_, err := p.executeCommandOnHost(ctx, root.Host, "true", cfg)
+			execFailed[key] = !report.add(VerifyCheckExec, root.Host, err)
+		}
+
+		host := cfg.BrickRootPaths[0].Host
+		if !peersChecked[cfg.clusterKey()] && !execFailed[cfg.clusterKey()+"/"+host] {
+			peersChecked[cfg.clusterKey()] = true
+			p.verifyPeers(ctx, report, host, roots, cfg)
+		}
+
+		for _, root := range roots {
+			key := cfg.clusterKey() + "/" + root.Host + ":" + root.Path
+			if rootsChecked[key] || execFailed[cfg.clusterKey()+"/"+root.Host] {
+				continue
+			}
+			rootsChecked[key] = true
+			if cfg.BrickRootCheck {
+				err = p.checkBrickRoot(ctx, root, cfg)
+			} else {
+				_, err = p.executeCommandOnHost(ctx, root.Host, fmt.Sprintf("test -d %s", shellQuote(root.Path)), cfg)
+				if err != nil {
+					err = fmt.Errorf("brick root %s:%s is not a directory: %v", root.Host, root.Path, err)
+				}
+			}
+			report.add(VerifyCheckBrickRoot, root.Host+":"+root.Path, err)
+		}
+	}
+
+	report.Passed = true
+	for _, c := range report.Checks {
+		report.Passed = report.Passed && c.Passed
+	}
+	return report, nil
+}
+
+// checkPermission asks the API server whether the client may do attrs
+func (p *glusterfsProvisioner) checkPermission(ctx context.Context, attrs *authorization.ResourceAttributes) error {
+	review, err := p.client.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorization.SelfSubjectAccessReview{
+		Spec: authorization.SelfSubjectAccessReviewSpec{ResourceAttributes: attrs},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	if !review.Status.Allowed {
+		if review.Status.Reason != "" {
+			return fmt.Errorf("not allowed: %s", review.Status.Reason)
+		}
+		return fmt.Errorf("not allowed")
+	}
+	return nil
+}
+
+// permissionName formats attrs as in `kubectl auth can-i`
+func permissionName(attrs authorization.ResourceAttributes) string {
+	resource := attrs.Resource
+	if attrs.Group != "" {
+		resource += "." + attrs.Group
+	}
+	if attrs.Subresource != "" {
+		resource += "/" + attrs.Subresource
+	}
+	return attrs.Verb + " " + resource
+}
+
+// verifyPeers runs `gluster pool list` on host and checks that every peer
+// is connected and every host of roots is a peer
+func (p *glusterfsProvisioner) verifyPeers(ctx context.Context, report *VerifyReport, host string, roots []BrickRootPath, cfg *ProvisionerConfig) {
+	out, err := p.executeCommandOnHost(ctx, host, "gluster --mode=script pool list", cfg)
+	if !report.add(VerifyCheckPeers, host, err) {
+		return
+	}
+	peers := make(map[string]bool)
+	for _, line := range strings.Split(out, "\n") {
+		// UUID, Hostname, State
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] == "UUID" {
+			continue
+		}
+		name, state := fields[1], strings.Join(fields[2:], " ")
+		if name == "localhost" {
+			name = host
+		}
+		peers[name] = true
+		if state != "Connected" {
+			report.add(VerifyCheckPeers, name, fmt.Errorf("peer is %s", state))
+		}
+	}
+	checked := make(map[string]bool)
+	for _, root := range roots {
+		if checked[root.Host] || root.Host == host {
+			continue
+		}
+		checked[root.Host] = true
+		if !peers[root.Host] {
+			report.add(VerifyCheckPeers, root.Host, fmt.Errorf("host is not a peer of the gluster pool of %s", host))
+		}
+	}
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// annVolumeType records the volume type chosen for a volume whose class
+// sets no volumeType
+const annVolumeType = "gluster.simple/volume-type"
+
+// maxDefaultReplicas is the largest replica count chosen by default
+const maxDefaultReplicas = 3
+
+// volumeTypeArgs is a volume type parsed into the arguments of `gluster
+// volume create` selecting it. Zero counts are omitted; a zero value is a
+// distributed volume.
+type volumeTypeArgs struct {
+	Replica      int
+	Arbiter      int
+	Disperse     int
+	DisperseData int
+	Redundancy   int
+}
+
+// parseVolumeTypeArgs parses the gluster arguments of a volume type:
+// `replica N [arbiter 1]`, `disperse N [redundancy M]`,
+// `disperse-data N redundancy M` or `distribute`. Anything else is
+// rejected, as volume types are passed to `gluster volume create`.
+func parseVolumeTypeArgs(volumeType string) (volumeTypeArgs, error) {
+	var t volumeTypeArgs
+	fields := strings.Fields(strings.ToLower(volumeType))
+	count := func(i int) (int, error) {
+		if i >= len(fields) {
+			return 0, fmt.Errorf("%s needs a count", fields[i-1])
+		}
+		n, err := strconv.Atoi(fields[i])
+		if err != nil || n < 1 || strconv.Itoa(n) != fields[i] {
+			return 0, fmt.Errorf("the %s count %q must be a positive number", fields[i-1], fields[i])
+		}
+		return n, nil
+	}
+	var err error
+	switch {
+	case len(fields) == 0 || len(fields) == 1 && fields[0] == "distribute":
+		return t, nil
+	case fields[0] == "replica":
+		if t.Replica, err = count(1); err != nil {
+			return t, err
+		}
+		if t.Replica < 2 {
+			return t, fmt.Errorf("the replica count must be at least 2")
+		}
+		if len(fields) == 2 {
+			return t, nil
+		}
+		if len(fields) == 4 && fields[2] == "arbiter" && fields[3] == "1" {
+			t.Arbiter = 1
+			return t, nil
+		}
+	case fields[0] == "disperse":
+		if t.Disperse, err = count(1); err != nil {
+			return t, err
+		}
+		if len(fields) == 2 {
+			return t, nil
+		}
+		if len(fields) == 4 && fields[2] == "redundancy" {
+			if t.Redundancy, err = count(3); err != nil {
+				return t, err
+			}
+			if t.Redundancy >= t.Disperse {
+				return t, fmt.Errorf("the redundancy count must be smaller than the disperse count")
+			}
+			return t, nil
+		}
+	case fields[0] == "disperse-data":
+		if t.DisperseData, err = count(1); err != nil {
+			return t, err
+		}
+		if len(fields) == 4 && fields[2] == "redundancy" {
+			t.Redundancy, err = count(3)
+			return t, err
+		}
+	}
+	return t, fmt.Errorf("%q is not one of `replica N [arbiter 1]`, `disperse N [redundancy M]`, `disperse-data N redundancy M` and `distribute`", volumeType)
+}
+
+// args returns the arguments of `gluster volume create` selecting t
+func (t volumeTypeArgs) args() []string {
+	var args []string
+	add := func(name string, n int) {
+		if n > 0 {
+			args = append(args, name, strconv.Itoa(n))
+		}
+	}
+	add("replica", t.Replica)
+	add("arbiter", t.Arbiter)
+	add("disperse", t.Disperse)
+	add("disperse-data", t.DisperseData)
+	add("redundancy", t.Redundancy)
+	return args
+}
+
+// String returns t in the canonical format of the volumeType parameter
+func (t volumeTypeArgs) String() string {
+	return strings.Join(t.args(), " ")
+}
+
+// defaultVolumeType returns the volume type of a volume with bricks on
+// roots whose class sets no volumeType: a replica on every host for up to
+// maxDefaultReplicas hosts, distributed replica sets beyond, and a
+// distributed volume on a single host or if no replica count fits.
+func defaultVolumeType(roots []BrickRootPath) string {
+	hosts := len(brickRootHosts(roots))
+	if hosts <= 1 {
+		return ""
+	}
+	for replicas := maxDefaultReplicas; replicas >= 2; replicas-- {
+		if replicas <= hosts && len(roots)%replicas == 0 && replicaSetsSpanHosts(roots, replicas) {
+			return "replica " + strconv.Itoa(replicas)
+		}
+	}
+	return ""
+}
+
+// brickRootHosts returns the distinct hosts of roots
+func brickRootHosts(roots []BrickRootPath) map[string]bool {
+	hosts := make(map[string]bool)
+	for _, root := range roots {
+		hosts[root.Host] = true
+	}
+	return hosts
+}
+
+// replicaSetsSpanHosts returns whether every replica set, i.e. every
+// replicas consecutive roots, has its bricks on distinct hosts
+func replicaSetsSpanHosts(roots []BrickRootPath, replicas int) bool {
+	for i := 0; i+replicas <= len(roots); i += replicas {
+		if len(brickRootHosts(roots[i:i+replicas])) != replicas {
+			return false
+		}
+	}
+	return true
+}
+
+// validateReplicaSets returns an error unless roots hold whole replica sets
+// of volumeType, each on distinct hosts. gluster creates replicas sharing a
+// host only with force, so forceCreate skips the host checks.
+func validateReplicaSets(roots []BrickRootPath, volumeType string, force bool) error {
+	replicas := replicaCount(volumeType)
+	if replicas < 2 {
+		return nil
+	}
+	if len(roots)%replicas != 0 {
+		return fmt.Errorf("volumeType %s needs a multiple of %d bricks, got %d brick roots", volumeType, replicas, len(roots))
+	}
+	if force {
+		return nil
+	}
+	if hosts := brickRootHosts(roots); len(hosts) < replicas {
+		return fmt.Errorf("volumeType %s needs %d brick hosts, got %d", volumeType, replicas, len(hosts))
+	}
+	for i := 0; i < len(roots); i += replicas {
+		set := roots[i : i+replicas]
+		if len(brickRootHosts(set)) == replicas {
+			continue
+		}
+		var bricks []string
+		for _, root := range set {
+			bricks = append(bricks, root.Host+":"+root.Path)
+		}
+		return fmt.Errorf("replica set %d (%s) has two bricks on one host, every %d consecutive brick roots must be on distinct hosts unless forceCreate is set",
+			i/replicas+1, strings.Join(bricks, ", "), replicas)
+	}
+	return nil
+}
+
+// applyDefaultVolumeType sets the volume type of the volume of config
+// unless the class sets one
+func (config *ProvisionerConfig) applyDefaultVolumeType() {
+	if config.volumeTypeSet {
+		return
+	}
+	config.VolumeType = defaultVolumeType(config.BrickRootPaths)
+	config.VolumeTypeDefaulted = true
+}
+
+// setVolumeTypeAnnotation records a defaulted volume type of cfg on a PV
+func setVolumeTypeAnnotation(annotations map[string]string, cfg *ProvisionerConfig) {
+	if cfg.VolumeTypeDefaulted {
+		annotations[annVolumeType] = cfg.VolumeType
+	}
+}
+
+// restoreVolumeType sets the volume type of config to the one recorded on
+// the PV. Volumes provisioned before volume types were defaulted have none
+// recorded and were created as distributed volumes.
+func (config *ProvisionerConfig) restoreVolumeType(annotations map[string]string) {
+	if volumeType, ok := annotations[annVolumeType]; ok {
+		t, err := parseVolumeTypeArgs(volumeType)
+		if err != nil {
+			klog.Errorf("glusterfs: ignoring volume type recorded on volume %s: %v", config.PVName, err)
+			return
+		}
+		config.VolumeType = t.String()
+		return
+	}
+	if config.VolumeTypeDefaulted {
+		config.VolumeType = ""
+		config.VolumeTypeDefaulted = false
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// Brick backends, selected with the brickBackend parameter
+const (
+	// brickBackendDirectory creates bricks as directories of the brick root
+	brickBackendDirectory = "directory"
+	// brickBackendZFS creates a ZFS dataset per brick below the dataset
+	// mounted on the brick root, with a quota of the claim size
+	brickBackendZFS = "zfs"
+)
+
+// zfsDataset returns the name and mountpoint of the ZFS dataset holding path
+func (p *glusterfsProvisioner) zfsDataset(ctx context.Context, host string, path string, cfg *ProvisionerConfig) (string, string, error) {
+	out, err := p.executeCommandOnHost(ctx, host, fmt.Sprintf("zfs list -H -o name,mountpoint %s", shellQuote(path)), cfg)
+	if err != nil {
+		return "", "", err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("unexpected zfs list output for %s:%s: %q", host, path, out)
+	}
+	return fields[0], fields[1], nil
+}
+
+// createZFSBrick creates brick as a dataset below the dataset mounted on
+// root, so that the inherited mountpoint of the dataset is the brick path
+func (p *glusterfsProvisioner) createZFSBrick(ctx context.Context, root BrickRootPath, brick glusterBrick, size int64, cfg *ProvisionerConfig) error {
+	rootPath := filepath.Clean(root.Path)
+	parent, mountpoint, err := p.zfsDataset(ctx, root.Host, rootPath, cfg)
+	if err != nil {
+		return fmt.Errorf("brick root %s:%s is not a ZFS dataset: %v", root.Host, root.Path, err)
+	}
+	if mountpoint != rootPath {
+		return fmt.Errorf("brick root %s:%s is not the mountpoint of a ZFS dataset, %s is mounted on %s",
+			root.Host, root.Path, parent, mountpoint)
+	}
+	dataset := parent + "/" + strings.TrimPrefix(brick.Path, rootPath+"/")
+	klog.Infof("zfs create %s:%s quota=%d", root.Host, dataset, size)
+	return p.ExecuteCommands(ctx, root.Host, []string{
+		fmt.Sprintf("zfs create -p -o quota=%d %s", size, shellQuote(dataset)),
+	}, cfg)
+}
+
+// deleteZFSBrick destroys the dataset of brick. Bricks that are not the
+// mountpoint of their own dataset, e.g. left by a failed creation, are
+// removed as directories.
+func (p *glusterfsProvisioner) deleteZFSBrick(ctx context.Context, brick glusterBrick, cfg *ProvisionerConfig) error {
+	dataset, mountpoint, err := p.zfsDataset(ctx, brick.Host, brick.Path, cfg)
+	if err != nil || mountpoint != filepath.Clean(brick.Path) {
+		klog.Infof("rm -rf %s:%s", brick.Host, brick.Path)
+		return p.ExecuteCommands(ctx, brick.Host, []string{cfg.heavy(fmt.Sprintf("rm -rf %s", shellQuote(brick.Path)))}, cfg)
+	}
+	klog.Infof("zfs destroy %s:%s", brick.Host, dataset)
+	return p.ExecuteCommands(ctx, brick.Host, []string{fmt.Sprintf("zfs destroy -r %s", shellQuote(dataset))}, cfg)
+}